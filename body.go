@@ -0,0 +1,39 @@
+package unixsock
+
+import "io"
+
+// bodyKey is the key under which a streamed request body is passed to
+// handlers along with the arguments of the command
+const bodyKey = "_body"
+
+// Body returns the request body streamed by the client along with args (see
+// client.SendFrom), or nil if there is none. The body has to be consumed
+// before the handler returns.
+func Body(args Args) io.Reader {
+	body, _ := args[bodyKey].(io.Reader)
+	return body
+}
+
+// WithBody returns a copy of args carrying body
+func WithBody(args Args, body io.Reader) Args {
+	withBody := make(Args, len(args)+1)
+	for k, v := range args {
+		withBody[k] = v
+	}
+	withBody[bodyKey] = body
+	return withBody
+}
+
+// WithoutBody returns args without the request body (if any)
+func WithoutBody(args Args) Args {
+	if _, ok := args[bodyKey]; !ok {
+		return args
+	}
+	withoutBody := make(Args, len(args))
+	for k, v := range args {
+		if k != bodyKey {
+			withoutBody[k] = v
+		}
+	}
+	return withoutBody
+}
@@ -0,0 +1,245 @@
+// Package chaos provides a fault-injecting transport (see unixsock.Transport)
+// for soak-testing clients and servers: it wraps another transport and
+// injects latency, short reads, split writes, dropped bytes and abrupt closes
+// with configurable probabilities. Faults are drawn from a seeded source, so
+// that a failing run can be reproduced with the same seed.
+package chaos
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// splitPause separates the parts of a split write, so that the peer reads
+// them separately
+const splitPause = time.Millisecond
+
+// Faults are the probabilities (between 0 and 1) of the faults injected
+// into every read or write of a connection
+type Faults struct {
+	Latency    float64       // Delay the operation by up to MaxLatency
+	MaxLatency time.Duration // Upper bound of injected delays
+	ShortRead  float64       // Return only a part of the requested bytes
+	SplitWrite float64       // Write the data in several parts
+	DropByte   float64       // Silently drop a byte of the written data (corrupts the stream)
+	Close      float64       // Close the connection abruptly instead
+}
+
+// Counts are the numbers of faults injected so far
+type Counts struct {
+	Delays       uint64 `json:"delays"`
+	ShortReads   uint64 `json:"short_reads"`
+	SplitWrites  uint64 `json:"split_writes"`
+	DroppedBytes uint64 `json:"dropped_bytes"`
+	Closes       uint64 `json:"closes"`
+}
+
+// Transport wraps another transport and injects faults into the
+// connections it dials and accepts. Every connection draws its faults from
+// its own source, seeded in the order the connections are established.
+type Transport struct {
+	base unixsock.Transport
+
+	mu     sync.Mutex
+	faults Faults
+	seeds  *rand.Rand
+	counts Counts
+}
+
+// New creates a transport injecting faults into the connections of base
+// (the unix socket if nil). Runs using the same seed inject the same faults,
+// as long as the connections are established in the same order.
+func New(base unixsock.Transport, faults Faults, seed int64) *Transport {
+	if base == nil {
+		base = unixsock.NetTransport{Network: "unix"}
+	}
+	return &Transport{
+		base:   base,
+		faults: faults,
+		seeds:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+// SetFaults changes the faults injected from now on, e.g. in order to let
+// the connections recover at the end of a soak test
+func (t *Transport) SetFaults(faults Faults) {
+	t.mu.Lock()
+	t.faults = faults
+	t.mu.Unlock()
+}
+
+// Counts returns the numbers of faults injected so far
+func (t *Transport) Counts() Counts {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.counts
+}
+
+// Dial connects to address via the wrapped transport
+func (t *Transport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := t.base.Dial(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	return t.Wrap(conn), nil
+}
+
+// Listen listens on address via the wrapped transport
+func (t *Transport) Listen(address string) (net.Listener, error) {
+	l, err := t.base.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{Listener: l, t: t}, nil
+}
+
+// Wrap injects faults into conn, e.g. a connection established by other
+// means than the transport
+func (t *Transport) Wrap(conn net.Conn) net.Conn {
+	t.mu.Lock()
+	seed := t.seeds.Int63()
+	t.mu.Unlock()
+
+	return &faultyConn{
+		Conn: conn,
+		t:    t,
+		rand: rand.New(rand.NewSource(seed)),
+	}
+}
+
+// listener injects faults into the accepted connections
+type listener struct {
+	net.Listener
+	t *Transport
+}
+
+// Accept accepts a connection and injects faults into it
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.t.Wrap(conn), nil
+}
+
+// faultyConn is a connection injecting faults into its reads and writes
+type faultyConn struct {
+	net.Conn
+	t *Transport
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// plan draws the faults of a single operation
+type plan struct {
+	delay time.Duration
+	close bool
+	split bool
+	drop  bool
+	short bool
+	cut   float64 // Fraction of the data at which to cut (short reads, split writes, dropped bytes)
+}
+
+// draw draws the faults of a single read (or write)
+func (c *faultyConn) draw(read bool) plan {
+	c.t.mu.Lock()
+	faults := c.t.faults
+	c.t.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var p plan
+	if c.rand.Float64() < faults.Latency && faults.MaxLatency > 0 {
+		p.delay = time.Duration(c.rand.Int63n(int64(faults.MaxLatency)))
+	}
+	p.close = c.rand.Float64() < faults.Close
+	if read {
+		p.short = c.rand.Float64() < faults.ShortRead
+	} else {
+		p.split = c.rand.Float64() < faults.SplitWrite
+		p.drop = c.rand.Float64() < faults.DropByte
+	}
+	p.cut = c.rand.Float64()
+
+	return p
+}
+
+// count records the injected faults
+func (c *faultyConn) count(fn func(counts *Counts)) {
+	c.t.mu.Lock()
+	fn(&c.t.counts)
+	c.t.mu.Unlock()
+}
+
+// delay sleeps for the injected latency (if any) and closes the connection
+// if planned
+func (c *faultyConn) delay(p plan) {
+	if p.delay > 0 {
+		c.count(func(counts *Counts) { counts.Delays++ })
+		time.Sleep(p.delay)
+	}
+	if p.close {
+		c.count(func(counts *Counts) { counts.Closes++ })
+		c.Conn.Close()
+	}
+}
+
+// Read reads from the connection, possibly fewer bytes than available
+func (c *faultyConn) Read(b []byte) (int, error) {
+	p := c.draw(true)
+	c.delay(p)
+
+	if p.short && len(b) > 1 {
+		c.count(func(counts *Counts) { counts.ShortReads++ })
+		b = b[:1+int(p.cut*float64(len(b)-1))]
+	}
+
+	return c.Conn.Read(b)
+}
+
+// Write writes to the connection, possibly in parts or dropping a byte. A
+// dropped byte is reported as written.
+func (c *faultyConn) Write(b []byte) (int, error) {
+	p := c.draw(false)
+	c.delay(p)
+
+	data := b
+	if p.drop && len(b) > 0 {
+		c.count(func(counts *Counts) { counts.DroppedBytes++ })
+		i := int(p.cut * float64(len(b)-1))
+		data = append(append(make([]byte, 0, len(b)-1), b[:i]...), b[i+1:]...)
+	}
+
+	if !p.split || len(data) < 2 {
+		if _, err := c.Conn.Write(data); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	c.count(func(counts *Counts) { counts.SplitWrites++ })
+	cut := 1 + int(p.cut*float64(len(data)-2))
+	n, err := c.Conn.Write(data[:cut])
+	if err != nil {
+		return n, err
+	}
+	time.Sleep(splitPause)
+	if _, err := c.Conn.Write(data[cut:]); err != nil {
+		return n, err
+	}
+
+	return len(b), nil
+}
+
+// PeerCreds returns the credentials of the wrapped connection's peer (see
+// unixsock.PeerCreds)
+func (c *faultyConn) PeerCreds() (*unixsock.PeerCred, error) {
+	return unixsock.PeerCreds(c.Conn)
+}
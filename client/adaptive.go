@@ -0,0 +1,122 @@
+package client
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Adaptive timeout defaults
+const (
+	adaptiveWindow     = 128 // Latencies kept per command
+	adaptiveMinSamples = 10  // Latencies observed before the timeout of a command adapts
+	adaptiveAlpha      = 0.2 // Weight of a new latency in the moving average
+)
+
+// AdaptiveTimeout derives the timeout of every command from its observed
+// latencies, instead of applying one static timeout to trivial pings and
+// heavy dumps alike. The timeout of a command is a multiple of the 99th
+// percentile of its recent latencies, bounded by min and max. Commands
+// observed fewer than 10 times keep the client's static timeout (see
+// WithTimeout). Calls timing out count as latencies of the timeout, so that
+// the timeout of a command that became slower grows back. It is safe for
+// concurrent use and can be shared by several clients.
+type AdaptiveTimeout struct {
+	mu         sync.Mutex
+	multiplier float64
+	min, max   time.Duration
+	commands   map[string]*latencies
+}
+
+// latencies are the recent latencies of a single command
+type latencies struct {
+	window []time.Duration // Ring buffer of the last adaptiveWindow latencies
+	next   int
+	ewma   float64 // Exponentially weighted moving average (nanoseconds)
+}
+
+// NewAdaptiveTimeout creates an adaptive timeout of multiplier times the 99th
+// percentile of the observed latencies, bounded by min and max (unbounded if
+// zero)
+func NewAdaptiveTimeout(multiplier float64, min, max time.Duration) *AdaptiveTimeout {
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	return &AdaptiveTimeout{
+		multiplier: multiplier,
+		min:        min,
+		max:        max,
+		commands:   make(map[string]*latencies),
+	}
+}
+
+// Timeout returns the timeout of cmd, or false if too few of its latencies
+// have been observed yet
+func (a *AdaptiveTimeout) Timeout(cmd string) (time.Duration, bool) {
+	a.mu.Lock()
+	l, ok := a.commands[cmd]
+	if !ok || len(l.window) < adaptiveMinSamples {
+		a.mu.Unlock()
+		return 0, false
+	}
+	p99 := l.percentile(0.99)
+	a.mu.Unlock()
+
+	timeout := time.Duration(float64(p99) * a.multiplier)
+	if timeout < a.min {
+		timeout = a.min
+	}
+	if a.max > 0 && timeout > a.max {
+		timeout = a.max
+	}
+
+	return timeout, true
+}
+
+// Latency returns the moving average and the 99th percentile of the recent
+// latencies of cmd (zero if none have been observed)
+func (a *AdaptiveTimeout) Latency(cmd string) (ewma, p99 time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	l, ok := a.commands[cmd]
+	if !ok {
+		return 0, 0
+	}
+
+	return time.Duration(l.ewma), l.percentile(0.99)
+}
+
+// observe records a single latency of cmd
+func (a *AdaptiveTimeout) observe(cmd string, latency time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	l, ok := a.commands[cmd]
+	if !ok {
+		l = &latencies{window: make([]time.Duration, 0, adaptiveWindow), ewma: float64(latency)}
+		a.commands[cmd] = l
+	}
+
+	if len(l.window) < adaptiveWindow {
+		l.window = append(l.window, latency)
+	} else {
+		l.window[l.next] = latency
+		l.next = (l.next + 1) % adaptiveWindow
+	}
+	l.ewma += adaptiveAlpha * (float64(latency) - l.ewma)
+}
+
+// percentile returns the q-th quantile of the recent latencies
+func (l *latencies) percentile(q float64) time.Duration {
+	if len(l.window) == 0 {
+		return 0
+	}
+
+	sorted := append([]time.Duration(nil), l.window...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return sorted[int(math.Ceil(q*float64(len(sorted))))-1]
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Errors reported by IsServerAlive
+var (
+	// ErrNoSocket means that the socket file does not exist, i.e. no server
+	// has been started (or it has been stopped cleanly)
+	ErrNoSocket = errors.New("no socket file")
+
+	// ErrStaleSocket means that the socket file exists, but nobody accepts
+	// connections on it, e.g. because the server has crashed
+	ErrStaleSocket = errors.New("stale socket: connection refused")
+)
+
+// aliveTimeout is the time limit of connecting to the socket in IsServerAlive
+const aliveTimeout = time.Second
+
+// IsServerAlive informs whether a server is listening on the socket at path,
+// so that supervisors and CLIs can report an accurate status before sending
+// commands. If not, the error tells why: ErrNoSocket if the socket file does
+// not exist, ErrStaleSocket if it is left over from a server that is gone,
+// and any other error if the status could not be determined (e.g. the
+// permissions of the socket do not allow connecting).
+func IsServerAlive(path string) (bool, error) {
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, ErrNoSocket
+	}
+	if err != nil {
+		return false, fmt.Errorf("IsServerAlive: %s", err.Error())
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return false, fmt.Errorf("IsServerAlive: %s is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, aliveTimeout)
+	if err != nil {
+		switch dialErrno(err) {
+		case syscall.ECONNREFUSED:
+			return false, ErrStaleSocket
+		case syscall.ENOENT: // Removed in the meantime
+			return false, ErrNoSocket
+		}
+		return false, fmt.Errorf("IsServerAlive: %s", err.Error())
+	}
+	conn.Close()
+
+	return true, nil
+}
+
+// dialErrno returns the system error underlying a failed dial (if any)
+func dialErrno(err error) error {
+	if op, ok := err.(*net.OpError); ok {
+		err = op.Err
+	}
+	if sys, ok := err.(*os.SyscallError); ok {
+		err = sys.Err
+	}
+	return err
+}
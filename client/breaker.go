@@ -0,0 +1,185 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned when the circuit breaker rejects a call
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+// Circuit breaker states
+const (
+	BreakerClosed   BreakerState = iota // Calls pass through
+	BreakerOpen                         // Calls fail fast
+	BreakerHalfOpen                     // A single probe call is let through
+)
+
+// String returns the name of the state
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerHooks are optional callbacks invoked by the circuit breaker, e.g.
+// for exporting metrics. Hooks are called synchronously and must not block.
+type BreakerHooks struct {
+	OnStateChange func(from, to BreakerState) // Breaker changed state
+	OnSuccess     func()                      // A call succeeded
+	OnFailure     func(err error)             // A call failed
+	OnReject      func()                      // A call was rejected without being attempted
+}
+
+// CircuitBreaker stops calling a failing UnixSockSrv. After threshold
+// consecutive failures the breaker opens and rejects all calls with
+// ErrCircuitOpen. Once cooldown has elapsed a single probe call is let
+// through (half-open): its success closes the breaker, its failure opens it
+// again for another cooldown period. Calls given up by the caller (its
+// context being done) count neither as successes nor as failures.
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	hooks     BreakerHooks
+
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewCircuitBreaker creates a new circuit breaker. hooks can be nil.
+func NewCircuitBreaker(threshold int, cooldown time.Duration, hooks *BreakerHooks) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	b := &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+	if hooks != nil {
+		b.hooks = *hooks
+	}
+
+	return b
+}
+
+// State returns the current state of the breaker
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// allow checks whether a call may be attempted. probe is the token of the
+// call: true for the single probe of a half-open breaker, which is the only
+// call whose outcome closes or reopens it (see record).
+func (b *CircuitBreaker) allow() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			b.reject()
+			return false, ErrCircuitOpen
+		}
+		b.setState(BreakerHalfOpen)
+		b.probing = true
+		return true, nil
+	case BreakerHalfOpen:
+		if b.probing {
+			b.reject()
+			return false, ErrCircuitOpen
+		}
+		b.probing = true
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// record records the outcome of an allowed call. Calls admitted before the
+// breaker opened (i.e. other than the probe) finishing late only count while
+// the breaker is closed, so that they can neither close a half-open breaker
+// nor reopen it.
+func (b *CircuitBreaker) record(probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if b.hooks.OnSuccess != nil {
+			b.hooks.OnSuccess()
+		}
+	} else if b.hooks.OnFailure != nil {
+		b.hooks.OnFailure(err)
+	}
+
+	switch {
+	case probe:
+		b.probing = false
+		if err == nil {
+			b.failures = 0
+			b.setState(BreakerClosed)
+		} else {
+			b.openedAt = time.Now()
+			b.setState(BreakerOpen)
+		}
+	case b.state != BreakerClosed:
+	case err == nil:
+		b.failures = 0
+	default:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.openedAt = time.Now()
+			b.setState(BreakerOpen)
+		}
+	}
+}
+
+// release ends an allowed call whose outcome says nothing about the server
+// (e.g. cancelled by the caller), letting another call probe in its place
+func (b *CircuitBreaker) release(probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+}
+
+// reject notifies the hooks about a rejected call
+func (b *CircuitBreaker) reject() {
+	if b.hooks.OnReject != nil {
+		b.hooks.OnReject()
+	}
+}
+
+// setState changes the state and notifies the hooks
+func (b *CircuitBreaker) setState(state BreakerState) {
+	if b.state == state {
+		return
+	}
+	from := b.state
+	b.state = state
+	if b.hooks.OnStateChange != nil {
+		b.hooks.OnStateChange(from, state)
+	}
+}
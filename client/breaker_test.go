@@ -0,0 +1,131 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+
+	var transitions []string
+	var successes, failures, rejects int
+	breaker := NewCircuitBreaker(3, 50*time.Millisecond, &BreakerHooks{
+		OnStateChange: func(from, to BreakerState) { transitions = append(transitions, fmt.Sprintf("%s->%s", from, to)) },
+		OnSuccess:     func() { successes++ },
+		OnFailure:     func(err error) { failures++ },
+		OnReject:      func() { rejects++ },
+	})
+	failure := errors.New("connection refused")
+
+	call := func(err error) error {
+		probe, allowErr := breaker.allow()
+		if allowErr != nil {
+			return allowErr
+		}
+		breaker.record(probe, err)
+		return nil
+	}
+
+	// Closed: failures below the threshold (and reset by a success)
+	call(failure)
+	call(failure)
+	call(nil)
+	call(failure)
+	call(failure)
+	if state := breaker.State(); state != BreakerClosed {
+		t.Fatalf("TestCircuitBreaker: expected a closed breaker, got %s", state)
+	}
+
+	// closed -> open after threshold consecutive failures
+	call(failure)
+	if state := breaker.State(); state != BreakerOpen {
+		t.Fatalf("TestCircuitBreaker: expected an open breaker, got %s", state)
+	}
+	if err := call(nil); err != ErrCircuitOpen {
+		t.Errorf("TestCircuitBreaker: expected an open breaker to reject calls, got %v", err)
+	}
+
+	// open -> half-open after the cooldown, letting a single probe through
+	time.Sleep(60 * time.Millisecond)
+	if state := breaker.State(); state != BreakerHalfOpen {
+		t.Fatalf("TestCircuitBreaker: expected a half-open breaker, got %s", state)
+	}
+	probe, err := breaker.allow()
+	if err != nil || !probe {
+		t.Fatalf("TestCircuitBreaker: expected the probe to be allowed, got %t (%v)", probe, err)
+	}
+	if _, err := breaker.allow(); err != ErrCircuitOpen {
+		t.Errorf("TestCircuitBreaker: expected a second probe to be rejected, got %v", err)
+	}
+
+	// Probe failure -> open again
+	breaker.record(probe, failure)
+	if state := breaker.State(); state != BreakerOpen {
+		t.Fatalf("TestCircuitBreaker: expected the failed probe to reopen the breaker, got %s", state)
+	}
+
+	// Probe success -> closed
+	time.Sleep(60 * time.Millisecond)
+	if err := call(nil); err != nil {
+		t.Fatalf("TestCircuitBreaker: expected the probe to be allowed, got %v", err)
+	}
+	if state := breaker.State(); state != BreakerClosed {
+		t.Fatalf("TestCircuitBreaker: expected the successful probe to close the breaker, got %s", state)
+	}
+
+	expected := []string{"closed->open", "open->half-open", "half-open->open", "open->half-open", "half-open->closed"}
+	if !reflect.DeepEqual(transitions, expected) {
+		t.Errorf("TestCircuitBreaker: expected transitions %v, got %v", expected, transitions)
+	}
+	if successes != 2 || failures != 6 || rejects != 2 {
+		t.Errorf("TestCircuitBreaker: unexpected hook calls: %d successes, %d failures, %d rejects", successes, failures, rejects)
+	}
+
+}
+
+func TestCircuitBreakerLateCalls(t *testing.T) {
+
+	breaker := NewCircuitBreaker(1, 10*time.Millisecond, nil)
+	failure := errors.New("connection refused")
+
+	// A call admitted while closed is still running when the breaker opens
+	late, _ := breaker.allow()
+	probe, _ := breaker.allow()
+	breaker.record(probe, failure)
+	if state := breaker.State(); state != BreakerOpen {
+		t.Fatalf("TestCircuitBreakerLateCalls: expected an open breaker, got %s", state)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	probe, err := breaker.allow()
+	if err != nil || !probe {
+		t.Fatalf("TestCircuitBreakerLateCalls: expected the probe to be allowed, got %t (%v)", probe, err)
+	}
+
+	// The late call does not resolve the half-open breaker
+	breaker.record(late, nil)
+	if state := breaker.State(); state != BreakerHalfOpen {
+		t.Errorf("TestCircuitBreakerLateCalls: late success changed the breaker to %s", state)
+	}
+	if _, err := breaker.allow(); err != ErrCircuitOpen {
+		t.Errorf("TestCircuitBreakerLateCalls: expected the probe to be still in flight, got %v", err)
+	}
+
+	// A released probe (e.g. cancelled by the caller) lets another call probe
+	breaker.release(probe)
+	if state := breaker.State(); state != BreakerHalfOpen {
+		t.Errorf("TestCircuitBreakerLateCalls: release changed the breaker to %s", state)
+	}
+	probe, err = breaker.allow()
+	if err != nil || !probe {
+		t.Fatalf("TestCircuitBreakerLateCalls: expected a new probe to be allowed, got %t (%v)", probe, err)
+	}
+	breaker.record(probe, nil)
+	if state := breaker.State(); state != BreakerClosed {
+		t.Errorf("TestCircuitBreakerLateCalls: expected the probe to close the breaker, got %s", state)
+	}
+
+}
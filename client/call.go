@@ -0,0 +1,83 @@
+package client
+
+import (
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// CallOption overrides the client's settings for a single call (see Call)
+type CallOption func(*Request)
+
+// WithCallTimeout sets the time limit of the call, overriding WithTimeout
+func WithCallTimeout(timeout time.Duration) CallOption {
+	return func(r *Request) {
+		r.timeout = timeout
+	}
+}
+
+// WithNoResponse sends the command without waiting for a response. Call
+// returns a nil response once the command has been written.
+func WithNoResponse() CallOption {
+	return func(r *Request) {
+		r.Respond = false
+	}
+}
+
+// WithAck sends the command without waiting for it to be executed, but waits
+// for the server to acknowledge its receipt, so that high-rate senders
+// detect a lost connection or a server that falls behind without paying for
+// the latency of the handler. Call returns a nil response once the receipt
+// has been acknowledged. Servers that do not support acknowledgements
+// respond after executing the command instead.
+func WithAck() CallOption {
+	return func(r *Request) {
+		r.Respond = true
+		r.ack = true
+	}
+}
+
+// WithCallPriority sets the priority of the call, overriding WithPriority
+func WithCallPriority(priority unixsock.Priority) CallOption {
+	return func(r *Request) {
+		r.priority = &priority
+	}
+}
+
+// WithCallTTL stamps the call with an expiry of ttl after sending, overriding
+// WithTTL
+func WithCallTTL(ttl time.Duration) CallOption {
+	return func(r *Request) {
+		r.ttl = ttl
+	}
+}
+
+// WithCallMeta attaches a metadata entry to the call (see Request.Meta)
+func WithCallMeta(key, value string) CallOption {
+	return func(r *Request) {
+		r.SetMeta(key, value)
+	}
+}
+
+// Call sends a command and waits for its response, applying the per-call
+// options on top of the client's settings
+func (u *unixSockClient) Call(ctx context.Context, cmd string, args unixsock.Args, opts ...CallOption) (*unixsock.Response, error) {
+	return u.call(ctx, newRequest(cmd, args, opts))
+}
+
+// Notify sends a command without waiting for a response, applying the
+// per-call options on top of the client's settings
+func (u *unixSockClient) Notify(ctx context.Context, cmd string, args unixsock.Args, opts ...CallOption) error {
+	_, err := u.call(ctx, newRequest(cmd, args, append([]CallOption{WithNoResponse()}, opts...)))
+	return err
+}
+
+// newRequest creates a request expecting a response, with opts applied
+func newRequest(cmd string, args unixsock.Args, opts []CallOption) *Request {
+	req := &Request{Cmd: cmd, Args: args, Respond: true}
+	for _, opt := range opts {
+		opt(req)
+	}
+	return req
+}
@@ -1,12 +1,51 @@
 package client
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+	"hash/crc32"
+	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Reserved commands handled by every UnixSockSrv
+const (
+	sysHealth    = unixsock.SysHealth
+	sysHello     = unixsock.SysHello
+	sysSubscribe = unixsock.SysSubscribe
+	sysCancel    = unixsock.SysCancel
+	sysGoAway    = unixsock.SysGoAway // Event sent by servers shutting down
+)
+
+// health returns the server's health check command (see WithSystemPrefix)
+func (u *unixSockClient) health() string {
+	if u.systemPrefix == "" {
+		return sysHealth
+	}
+	return u.systemPrefix + strings.TrimPrefix(sysHealth, unixsock.SysPrefix)
+}
+
+// cancelMeta is the key of the handshake response metadata with which
+// servers acknowledge cancellations
+const cancelMeta = "cancel"
+
+// Keys of the handshake response metadata of servers resuming sessions (see
+// WithSessionResumption)
+const (
+	resumeTokenMeta = "resume_token"
+	resumedMeta     = "resumed"
+)
+
+// cancelTimeout is the time limit of sending a cancellation
+const cancelTimeout = time.Second
+
 // UnixSockClient represents a client meant to communicate with a UnixSockSrv
 type UnixSockClient interface {
 
@@ -14,97 +53,884 @@ type UnixSockClient interface {
 	Send(cmd string, args unixsock.Args, respond, close bool) (*unixsock.Response, error)
 
 	// Options sets the options of the underlying communications
+	//
+	// Deprecated: pass WithMaxLength and WithTimeout to New instead. respond
+	// and close are ignored, since Send takes them for every message.
 	Options(maxLength int, timeout time.Duration, respond, close bool)
 
+	// Call sends a command and waits for its response. Unlike changing the
+	// client's settings, per-call options (e.g. WithCallTimeout,
+	// WithNoResponse) apply to this call only and are safe to use
+	// concurrently.
+	Call(ctx context.Context, cmd string, args unixsock.Args, opts ...CallOption) (*unixsock.Response, error)
+
+	// Notify sends a command without waiting for a response (see
+	// WithNoResponse). It returns once the command has been written,
+	// reporting a failure to write it instead of ignoring it. The server
+	// executes notifications before reading the next message of the
+	// connection, so that they take effect before the calls made after Notify
+	// returns (as long as the connection is not replaced in the meantime).
+	Notify(ctx context.Context, cmd string, args unixsock.Args, opts ...CallOption) error
+
+	// SendFrom sends a command along with a request body streamed from r in
+	// chunks (see unixsock.Body). size is the length of the body, or -1 if
+	// unknown; a reader delivering a different number of bytes aborts the
+	// request.
+	SendFrom(ctx context.Context, cmd string, args unixsock.Args, r io.Reader, size int64) (*unixsock.Response, error)
+
+	// SendRaw writes a complete, already encoded frame (e.g. one received by
+	// a bridge process, see unixsock.ReadFrame) to the server and returns the
+	// frames of the response without decoding them
+	SendRaw(ctx context.Context, frame []byte) ([]byte, error)
+
+	// SendTo sends a command and streams the (possibly chunked) payload of
+	// the response into w without buffering it in memory. The returned
+	// response carries the final status of the command.
+	SendTo(ctx context.Context, cmd string, args unixsock.Args, w io.Writer) (*unixsock.Response, error)
+
+	// Warmup establishes up to n connections (completing their handshakes)
+	// ahead of the first calls, so that a burst of requests at startup does
+	// not pay for dialing. A multi-client (see NewMulti) connects to its
+	// first n servers. It returns the number of connections established.
+	Warmup(ctx context.Context, n int) (int, error)
+
+	// Ping checks the health of the UnixSockSrv. It returns an error if the
+	// server cannot be reached or reports a degraded state.
+	Ping(ctx context.Context) error
+
+	// OnEvent registers a handler for events broadcast by the UnixSockSrv.
+	// Registering a handler keeps the connection to the server open, so that
+	// events are received even while the client is idle. Events are handled
+	// one at a time on the connection's reader, so the handler must not
+	// block.
+	OnEvent(handler func(cmd string, args unixsock.Args))
+
+	// OnDisconnect registers a handler invoked whenever a connection to the
+	// server ends, telling why (e.g. the reason sent by the server in its
+	// close frame). Handlers must not block.
+	OnDisconnect(handler func(d *Disconnect))
+
+	// Subscribe returns a channel delivering the events whose command
+	// matches topic (a path.Match pattern). The channel is closed once ctx is
+	// done or the connection is lost. Like OnEvent, subscribing keeps the
+	// connection to the server open.
+	Subscribe(ctx context.Context, topic string) (<-chan Event, error)
+
+	// Detach stops using the connection to the server without closing it
+	// and returns it along with its state, so that another client can take
+	// it over (see Attach), e.g. across an exec boundary together with its
+	// file descriptor. It returns a nil connection if not connected.
+	Detach() (net.Conn, SessionState)
+
+	// Attach takes over a connection detached by another client instead of
+	// dialing one, replacing the client's own connection (if any)
+	Attach(conn net.Conn, state SessionState) error
+
+	// Stats returns the client-side metrics of the calls made so far
+	// (responses by status, failures, retries, dials, calls in flight and a
+	// latency histogram). A multi-client sums up the metrics of all servers.
+	Stats() Stats
+
+	// Use appends middleware wrapping every outgoing call (Send, SendFrom,
+	// SendTo and Ping). Middleware registered first sees the call first.
+	Use(middleware ...Middleware)
+
 	// Quit closes the client
 	Quit()
 }
 
 // unixSockClient implements the UnixSockClient interface
 type unixSockClient struct {
-	maxLength      int
-	timeout        time.Duration
-	respond, close bool
-	unixSockPath   string
-	conn           net.Conn
-	conntime       time.Time
+	mu                 sync.Mutex
+	maxLength          int
+	timeout            time.Duration
+	unixSockPath       string
+	sess               *session
+	breaker            *CircuitBreaker
+	adaptive           *AdaptiveTimeout
+	priority           unixsock.Priority
+	ttl                time.Duration
+	writeBuffer        int
+	compression        string
+	frameHeader        bool
+	acceptEncoding     string
+	frameCRC           bool
+	cancellation       bool // Cancel abandoned calls (see WithCancellation)
+	tags               map[string]string
+	filePassing        bool // Accept payloads passed as files (see WithFilePassing)
+	lastID             uint64
+	onEvent            func(cmd string, args unixsock.Args)
+	eventFilter        string
+	listening          bool // Connection kept open for events
+	subscriptionBuffer int
+	overflow           OverflowPolicy
+	lastEvent          uint64 // Sequence number of the last event received (atomic)
+	middleware         []Middleware
+	onState            func(state ConnState, err error)
+	onDisconnect       func(d *Disconnect)
+	liveness           time.Duration
+	dialTimeout        time.Duration
+	transport          unixsock.Transport // Dials the server (see WithTransport)
+	eager              bool
+	dumper             *unixsock.Dumper // Frames are dumped (see WithDebugDump)
+	systemPrefix       string           // Namespace of the server's system commands (see WithSystemPrefix)
+	resumption         bool             // Resume the session on redial (see WithSessionResumption)
+	resumeToken        string           // Token issued by the server for the next connection
+	metrics            metrics          // Client-side statistics (see Stats)
+	quit               chan struct{}
+
+	rawMu sync.Mutex
+	raw   net.Conn // Connection carrying raw frames (see SendRaw)
+}
+
+// ConnState is the state of the client's connection to the server
+type ConnState int
+
+// Connection states
+const (
+	StateDisconnected ConnState = iota // Connection lost or closed
+	StateConnected                     // Connection (re)established
+	StateGoingAway                     // Server shutting down (see GoAwayError)
+)
+
+// String returns the name of the state
+func (s ConnState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnected:
+		return "connected"
+	case StateGoingAway:
+		return "going away"
+	default:
+		return "unknown"
+	}
 }
 
 // New creates a new UnixSockClient connecting to the UnixSockPath
-func New(UnixSockPath string) (UnixSockClient, error) {
+func New(UnixSockPath string, opts ...Option) (UnixSockClient, error) {
+	u, err := newClient(UnixSockPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// newClient creates a new unixSockClient
+func newClient(UnixSockPath string, opts []Option) (*unixSockClient, error) {
 
-	return &unixSockClient{
-		maxLength:    1 << 20,
-		timeout:      5 * time.Second,
-		respond:      true,
-		close:        true,
-		unixSockPath: UnixSockPath,
-	}, nil
+	u := &unixSockClient{
+		maxLength:          1 << 20,
+		timeout:            5 * time.Second,
+		unixSockPath:       UnixSockPath,
+		dialTimeout:        5 * time.Second,
+		quit:               make(chan struct{}),
+		subscriptionBuffer: defaultSubscriptionBuffer,
+	}
+
+	for _, opt := range opts {
+		opt(u)
+	}
+	if err := u.validate(); err != nil {
+		return nil, fmt.Errorf("New: %s", err.Error())
+	}
+
+	// Verify connectivity
+	if u.eager {
+		if _, err := u.reconnect(context.Background()); err != nil {
+			return nil, fmt.Errorf("New: %s", err.Error())
+		}
+	}
+
+	return u, nil
 
 }
 
 // Options sets communicator options
 func (u *unixSockClient) Options(maxLength int, timeout time.Duration, respond, close bool) {
-	u.respond = respond
-	u.close = close
-	u.maxLength = maxLength
-	u.timeout = timeout
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	WithMaxLength(maxLength)(u)
+	WithTimeout(timeout)(u)
 }
 
 // Send sends a single message to a UnixSockSrv
 func (u *unixSockClient) Send(cmd string, args unixsock.Args, respond, close bool) (*unixsock.Response, error) {
 
-	// Connect to the socket
-	if err := u.reconnect(); err != nil {
-		return nil, fmt.Errorf("Send: could not connect to the unix socket: %s", err.Error())
+	return u.call(context.Background(), &Request{Cmd: cmd, Args: args, Respond: respond, Close: close})
+}
+
+// SendTo sends a command and streams the response payload into w
+func (u *unixSockClient) SendTo(ctx context.Context, cmd string, args unixsock.Args, w io.Writer) (*unixsock.Response, error) {
+
+	resp, err := u.call(ctx, &Request{Cmd: cmd, Args: args, Respond: true, sink: w})
+	if err != nil {
+		return nil, err
+	}
+
+	// Unchunked payloads are written as well
+	if resp != nil && resp.Payload != "" {
+		if _, err := io.WriteString(w, resp.Payload); err != nil {
+			return nil, fmt.Errorf("SendTo: could not write payload: %s", err.Error())
+		}
+		resp.Payload = ""
+	}
+
+	return resp, nil
+}
+
+// SendFrom sends a command along with a request body streamed from r
+func (u *unixSockClient) SendFrom(ctx context.Context, cmd string, args unixsock.Args, r io.Reader, size int64) (*unixsock.Response, error) {
+
+	if size >= 0 {
+		r = &exactReader{r: r, left: size}
+	}
+
+	return u.call(ctx, &Request{Cmd: cmd, Args: args, Respond: true, source: r})
+}
+
+// Ping checks the health of the UnixSockSrv
+func (u *unixSockClient) Ping(ctx context.Context) error {
+
+	resp, err := u.call(ctx, &Request{Cmd: u.health(), Args: unixsock.Args{}, Respond: true})
+	if err != nil {
+		return fmt.Errorf("Ping: %s", err.Error())
+	}
+
+	if resp == nil || resp.Status != unixsock.STATUS_OK {
+		if resp == nil {
+			return fmt.Errorf("Ping: got nil response")
+		}
+		return fmt.Errorf("Ping: server is unhealthy: %s", resp.Error)
+	}
+
+	return nil
+}
+
+// Request is a single command sent to the server, as seen by middleware (see
+// Use)
+type Request struct {
+	Cmd     string
+	Args    unixsock.Args
+	Respond bool
+	Close   bool
+
+	// Meta is sent along with the command, apart from its arguments, e.g.
+	// trace IDs or auth tokens attached by middleware (see SetMeta)
+	Meta map[string]string
+
+	// sink receives streamed response data (collected in the payload if nil)
+	sink io.Writer
+
+	// source streams the request body (if any)
+	source io.Reader
+
+	// ack asks the server to acknowledge the receipt of the command instead
+	// of responding (see WithAck)
+	ack bool
+
+	// Per-call overrides of the client's settings (see CallOption)
+	timeout  time.Duration
+	priority *unixsock.Priority
+	ttl      time.Duration
+}
+
+// SetMeta attaches a single metadata entry to the request
+func (r *Request) SetMeta(key, value string) {
+	if r.Meta == nil {
+		r.Meta = make(map[string]string)
+	}
+	r.Meta[key] = value
+}
+
+// call sends req through the client's middleware chain
+func (u *unixSockClient) call(ctx context.Context, req *Request) (*unixsock.Response, error) {
+
+	u.mu.Lock()
+	middleware := u.middleware
+	u.mu.Unlock()
+
+	send := Sender(u.guarded)
+	for i := len(middleware) - 1; i >= 0; i-- {
+		send = middleware[i](send)
+	}
+
+	return send(ctx, req)
+}
+
+// guarded performs a single exchange, guarded by the circuit breaker (if any)
+func (u *unixSockClient) guarded(ctx context.Context, req *Request) (*unixsock.Response, error) {
+
+	if u.breaker == nil {
+		return u.send(ctx, req)
+	}
+
+	probe, err := u.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := u.send(ctx, req)
+	_, maintenance := err.(*MaintenanceError)
+	switch {
+	case err != nil && givenUp(ctx):
+		// Given up by the caller, which says nothing about the server
+		u.breaker.release(probe)
+	case maintenance:
+		// Servers in maintenance are responsive
+		u.breaker.record(probe, nil)
+	default:
+		u.breaker.record(probe, err)
+	}
+
+	return resp, err
+}
+
+// givenUp informs whether the caller has given up on a call, i.e. ctx is
+// done or its deadline has passed (which the read deadline derived from it
+// may notice first)
+func givenUp(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	deadline, ok := ctx.Deadline()
+	return ok && !time.Now().Before(deadline)
+}
+
+// send performs a single request/response exchange. The exchange is aborted
+// when ctx is done and times out after the client's timeout or ctx's
+// deadline, whichever comes first. If the connection turns out to be broken
+// before the message could be written, it is redialed transparently once.
+func (u *unixSockClient) send(ctx context.Context, req *Request) (*unixsock.Response, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("Send: %s", err.Error())
+	}
+
+	started := time.Now()
+	u.metrics.begin()
+
+	for attempt := 1; ; attempt++ {
+
+		// Connect to the socket
+		sess, err := u.session(ctx)
+		if err != nil {
+			u.metrics.end(time.Since(started), nil, err)
+			if u.shutDown() {
+				return nil, ErrServerShuttingDown
+			}
+			return nil, &connectError{fmt.Errorf("Send: could not connect to the unix socket: %s", err.Error())}
+		}
+
+		resp, sent, err := u.exchange(ctx, sess, req)
+		if err != nil && !sent && attempt == 1 {
+			sess.close()
+			u.metrics.retry()
+			continue
+		}
+		u.metrics.end(time.Since(started), resp, err)
+		if err == nil {
+			if m := maintenanceError(resp); m != nil {
+				return resp, m
+			}
+			if refusedOnShutdown(resp) {
+				return resp, ErrServerShuttingDown
+			}
+		}
+
+		return resp, err
+	}
+
+}
+
+// connectError is returned when a command could not be sent, because the
+// server could not be reached
+type connectError struct {
+	error
+}
+
+// exchange sends a single request over sess and waits for the response. It
+// also reports whether the message has been written (partially written
+// request bodies can not be retried).
+func (u *unixSockClient) exchange(ctx context.Context, sess *session, req *Request) (*unixsock.Response, bool, error) {
+
+	u.mu.Lock()
+	u.lastID++
+	id := u.lastID
+	maxLength, timeout := u.maxLength, u.timeout
+	u.mu.Unlock()
+
+	priority, ttl := u.priority, u.ttl
+	if u.adaptive != nil {
+		if adapted, ok := u.adaptive.Timeout(req.Cmd); ok {
+			timeout = adapted
+		}
+	}
+	if req.timeout > 0 {
+		timeout = req.timeout
+	}
+	if req.priority != nil {
+		priority = *req.priority
+	}
+	if req.ttl > 0 {
+		ttl = req.ttl
+	}
+
+	// Transaction time limit
+	shortened := false
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout, shortened = time.Until(deadline), true
+	}
+
+	respond, sink := req.Respond, req.sink
+
+	// Register for the response
+	var wait *call
+	if respond {
+		var ok bool
+		if wait, ok = sess.expect(id); !ok {
+			return nil, false, fmt.Errorf("Send: connection to the unix socket lost")
+		}
+		defer sess.forget(id)
 	}
+	sess.touch()
 
 	// Construct new message
-	msg := unixsock.NewSender(u.conn, cmd, args, respond, close)
+	closeConn := req.Close && req.source == nil
+	msg := unixsock.NewSender(sess.conn, req.Cmd, req.Args, respond, closeConn, unixsock.WithMaxLength(maxLength), unixsock.WithTimeout(timeout))
 
 	// Set options
-	msg.Options(u.maxLength, u.timeout, respond, close)
+	msg.SetID(id)
+	msg.SetMeta(req.Meta)
+	msg.SetAck(req.ack)
+	msg.SetPriority(priority)
+	msg.SetWriteBuffer(u.writeBuffer)
+	if ttl > 0 {
+		expiry := time.Now().Add(ttl)
+		if deadline, ok := ctx.Deadline(); ok && deadline.Before(expiry) {
+			expiry = deadline
+		}
+		msg.SetExpiry(expiry)
+	}
+	if req.source != nil {
+		msg.SetChunk(nil, true)
+	}
 
 	// Send
+	started := time.Now()
 	if err := msg.Send(); err != nil {
-		return nil, fmt.Errorf("Send: could not send a command: %s", err.Error())
+		return nil, false, fmt.Errorf("Send: could not send a command: %s", err.Error())
 	}
 
-	// Wait for response
-	if respond {
+	// Stream the request body
+	if req.source != nil {
+		if err := u.upload(sess, id, req, maxLength, timeout); err != nil {
+			sess.close()
+			return nil, true, fmt.Errorf("Send: could not stream the request body: %s", err.Error())
+		}
+	}
+
+	if !respond {
+		return nil, true, nil
+	}
+
+	// Wait for response (the timeout applies to each chunk of a stream)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var collected *bytes.Buffer
+	streamed := &streamSummary{sum: crc32.NewIEEE()}
+	observed := u.adaptive == nil
+	for {
+		select {
+		case reply, ok := <-wait.replies:
+			if !ok {
+				d := sess.lost()
+				if d != nil && d.Reason == unixsock.CloseShutdown {
+					return nil, true, ErrServerShuttingDown
+				}
+				if d != nil && d.Reason != "" {
+					return nil, true, fmt.Errorf("Send: failed receiving a response: %s", d.Error())
+				}
+				return nil, true, fmt.Errorf("Send: failed receiving a response: connection lost")
+			}
+
+			// Latency until the first reply (the timeout applies to each
+			// chunk of a stream)
+			if !observed {
+				u.adaptive.observe(req.Cmd, time.Since(started))
+				observed = true
+			}
+
+			// Receipt acknowledged
+			if reply.IsAck() {
+				return nil, true, nil
+			}
+
+			// Chunk of a streamed response
+			if chunk := reply.GetChunk(); len(chunk) > 0 {
+				streamed.add(chunk)
+				if sink == nil {
+					if collected == nil {
+						collected = &bytes.Buffer{}
+					}
+					sink = collected
+				}
+				if _, err := sink.Write(chunk); err != nil {
+					return nil, true, fmt.Errorf("Send: could not write streamed data: %s", err.Error())
+				}
+			}
+			if reply.HasMore() {
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(timeout)
+				continue
+			}
+
+			resp := reply.GetResponse()
+			if f := reply.GetFile(); f != nil {
+				if err := passedFile(f, req.sink, resp); err != nil {
+					return nil, true, fmt.Errorf("Send: %s", err.Error())
+				}
+			}
+			if resp != nil {
+				if err := resp.DecodePayload(); err != nil {
+					return nil, true, fmt.Errorf("Send: %s", err.Error())
+				}
+				if err := streamed.verify(resp.Trailer); err != nil {
+					return nil, true, fmt.Errorf("Send: %s", err.Error())
+				}
+				if collected != nil {
+					resp.Payload = collected.String() + resp.Payload
+				}
+			}
+			return resp, true, nil
+
+		case <-timer.C:
+			// Timeouts shortened by the context say nothing about the latency
+			if !observed && !shortened {
+				u.adaptive.observe(req.Cmd, timeout)
+			}
+			sess.cancel(id)
+			return nil, true, fmt.Errorf("Send: failed receiving a response: timed out after %s", timeout)
+		case <-ctx.Done():
+			sess.cancel(id)
+			return nil, true, fmt.Errorf("Send: failed receiving a response: %s", ctx.Err().Error())
+		}
+	}
+
+}
+
+// session returns a live session, dialing a new connection if the previous
+// one has been lost. Sessions idle for longer than the liveness threshold
+// (if any) are verified with a ping before being reused.
+func (u *unixSockClient) session(ctx context.Context) (*session, error) {
+
+	u.mu.Lock()
+	sess := u.sess
+	u.mu.Unlock()
+
+	if sess != nil && sess.alive() {
+		if u.liveness <= 0 || sess.idle() < u.liveness {
+			return sess, nil
+		}
+		if _, _, err := u.exchange(ctx, sess, &Request{Cmd: u.health(), Args: unixsock.Args{}, Respond: true}); err == nil {
+			return sess, nil
+		}
+		sess.close()
+	}
+
+	return u.reconnect(ctx)
+}
+
+// reconnect establishes a new connection to the unix socket. Dialing is
+// aborted when ctx is done or after the dial timeout.
+func (u *unixSockClient) reconnect(ctx context.Context) (*session, error) {
+
+	u.mu.Lock()
+
+	// Another caller may have reconnected in the meantime
+	if u.sess != nil && u.sess.alive() {
+		defer u.mu.Unlock()
+		return u.sess, nil
+	}
+
+	fd, err := u.dial(ctx)
+	u.metrics.dialed(err)
+	if err != nil {
+		u.mu.Unlock()
+		return nil, fmt.Errorf("reconnect: could not connect to socket: %s", err.Error())
+	}
+
+	c := unixsock.NewConn(fd)
+	if u.dumper != nil {
+		c.SetDump(u.dumper, "client "+u.unixSockPath)
+	}
+	cancellable, resumed, err := u.handshake(c)
+	if err != nil {
+		u.mu.Unlock()
+		c.Close()
+		return nil, fmt.Errorf("reconnect: %s", err.Error())
+	}
+	if !resumed {
+		if err := u.subscribe(c); err != nil {
+			u.mu.Unlock()
+			c.Close()
+			return nil, fmt.Errorf("reconnect: %s", err.Error())
+		}
+	}
+
+	u.sess = newSession(c, u.maxLength, u.deliver(u.onEvent), u.stateChanged, u.disconnected)
+	u.sess.cancellable = cancellable
+	sess := u.sess
+	u.mu.Unlock()
+
+	u.stateChanged(StateConnected, nil)
+
+	return sess, nil
+
+}
+
+// dial connects to the server via the client's transport (the unix socket by
+// default), giving up when ctx is done or after the dial timeout
+func (u *unixSockClient) dial(ctx context.Context) (net.Conn, error) {
+
+	if u.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, u.dialTimeout)
+		defer cancel()
+	}
+
+	transport := u.transport
+	if transport == nil {
+		transport = unixsock.NetTransport{Network: "unix"}
+	}
+
+	return transport.Dial(ctx, u.unixSockPath)
+}
+
+// stateChanged notifies the state callback (if any)
+func (u *unixSockClient) stateChanged(state ConnState, err error) {
+	if u.onState != nil {
+		u.onState(state, err)
+	}
+}
+
+// handshake negotiates connection features with the server. It is skipped
+// if no feature has been requested. It reports whether the server accepts
+// cancellations and whether it has resumed the session of the previous
+// connection (see WithSessionResumption). The caller must hold the lock.
+func (u *unixSockClient) handshake(c *unixsock.Conn) (bool, bool, error) {
+
+	if u.compression == "" && !u.frameHeader && u.acceptEncoding == "" && !u.cancellation && len(u.tags) == 0 && !u.filePassing && !u.resumption {
+		return false, false, nil
+	}
+
+	args := unixsock.Args{}
+	if u.compression != "" {
+		args["compression"] = []interface{}{u.compression}
+	}
+	if u.frameHeader {
+		args["frame_header"] = true
+		args["frame_crc"] = u.frameCRC
+	}
+	if u.acceptEncoding != "" {
+		args["accept_encoding"] = []interface{}{u.acceptEncoding}
+	}
+	if u.cancellation {
+		args["cancel"] = true
+	}
+	if u.filePassing && u.compression == "" && c.AcceptFiles() == nil {
+		args["file_passing"] = true
+	}
+	if len(u.tags) > 0 {
+		tags := make(map[string]interface{}, len(u.tags))
+		for key, value := range u.tags {
+			tags[key] = value
+		}
+		args["tags"] = tags
+	}
+	if u.resumption {
+		args["resume"] = u.resumeToken
+		if u.listening {
+			args["since"] = atomic.LoadUint64(&u.lastEvent)
+		}
+	}
+
+	msg := unixsock.NewSender(c, sysHello, args, true, false, unixsock.WithMaxLength(u.maxLength), unixsock.WithTimeout(u.timeout))
+	if err := msg.Send(); err != nil {
+		return false, false, fmt.Errorf("handshake: could not send hello: %s", err.Error())
+	}
+
+	// Skip live events sent before the handshake completed, which the
+	// server replays after the response when resuming (if it keeps them)
+	for {
 		if err := msg.Receive(); err != nil {
-			return nil, fmt.Errorf("Send: failed receiving a response: %s", err.Error())
+			return false, false, fmt.Errorf("handshake: failed receiving a response: %s", err.Error())
+		}
+		if !msg.IsEvent() {
+			break
 		}
+	}
 
-		return msg.GetResponse(), nil
+	// Servers supporting the frame header respond with it, which switches
+	// the connection over (see unixsock.Conn.EnableFrameHeader)
+	resp := msg.GetResponse()
+	if resp != nil && resp.Payload != "" {
+		if err := c.EnableCompression(resp.Payload); err != nil {
+			return false, false, fmt.Errorf("handshake: %s", err.Error())
+		}
 	}
 
-	return nil, nil
+	// Servers not supporting resumption issue no token
+	resumed := false
+	if u.resumption && resp != nil {
+		resumed = resp.Meta[resumedMeta] == "true"
+		u.resumeToken = resp.Meta[resumeTokenMeta]
+	}
 
+	return u.cancellation && resp != nil && resp.Meta[cancelMeta] == "true", resumed, nil
 }
 
-// reconnect reestablishes the connection to the unix socket
-func (u *unixSockClient) reconnect() error {
+// subscribe sends the event filter (if any) to the server. Clients that
+// have received events before also ask the server for the events they missed
+// while reconnecting.
+func (u *unixSockClient) subscribe(c *unixsock.Conn) error {
 
-	if u.conn != nil && time.Now().Unix()-u.conntime.Unix() < 5 {
+	since := atomic.LoadUint64(&u.lastEvent)
+	if u.eventFilter == "" && (!u.listening || since == 0) {
 		return nil
 	}
 
-	c, err := net.Dial("unix", u.unixSockPath)
-	if err != nil {
-		return fmt.Errorf("reconnect: could not connect to socket: %s", err.Error())
+	args := unixsock.Args{"filter": u.eventFilter}
+	if u.listening {
+		args["since"] = since
+	}
+
+	msg := unixsock.NewSender(c, sysSubscribe, args, true, false, unixsock.WithMaxLength(u.maxLength), unixsock.WithTimeout(u.timeout))
+	if err := msg.Send(); err != nil {
+		return fmt.Errorf("subscribe: could not send the event filter: %s", err.Error())
+	}
+
+	// Skip live events sent before the subscription took effect, which the
+	// server replays after the response (if it keeps them)
+	for {
+		if err := msg.Receive(); err != nil {
+			return fmt.Errorf("subscribe: failed receiving a response: %s", err.Error())
+		}
+		if !msg.IsEvent() {
+			break
+		}
+	}
+
+	resp := msg.GetResponse()
+	if err := resp.Err(); err != nil {
+		// Servers that do not support subscriptions simply do not replay
+		// missed events
+		if u.eventFilter == "" {
+			return nil
+		}
+		return fmt.Errorf("subscribe: event filter rejected: %s", err.Error())
 	}
 
-	u.conn = c
-	u.conntime = time.Now()
+	// Sequence numbers start over with every server process
+	if last, err := strconv.ParseUint(resp.Payload, 10, 64); err == nil && last < since {
+		atomic.StoreUint64(&u.lastEvent, 0)
+	}
 
 	return nil
+}
+
+// deliver wraps an event handler (if any), dropping the events (numbered by
+// the server) that have already been delivered, e.g. replayed after a
+// reconnect. The wrapper informs whether the event is to be delivered.
+func (u *unixSockClient) deliver(handler func(cmd string, args unixsock.Args)) func(seq uint64, cmd string, args unixsock.Args) bool {
+	return func(seq uint64, cmd string, args unixsock.Args) bool {
+		for seq > 0 {
+			last := atomic.LoadUint64(&u.lastEvent)
+			if seq <= last {
+				return false
+			}
+			if atomic.CompareAndSwapUint64(&u.lastEvent, last, seq) {
+				break
+			}
+		}
+		if handler != nil {
+			handler(cmd, args)
+		}
+		return true
+	}
+}
+
+// OnEvent registers a handler for events broadcast by the server
+func (u *unixSockClient) OnEvent(handler func(cmd string, args unixsock.Args)) {
+	u.mu.Lock()
+	u.onEvent = handler
+
+	// Drop the current connection, so that its successor delivers events
+	if u.sess != nil {
+		u.sess.close()
+		u.sess = nil
+	}
+	u.mu.Unlock()
+
+	u.listen()
+}
+
+// listen keeps the connection to the server open (see keepalive), so that
+// events are received while the client is idle
+func (u *unixSockClient) listen() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 
+	if !u.listening {
+		u.listening = true
+		go u.keepalive()
+	}
+}
+
+// keepalive keeps the connection to the server open by pinging it
+// periodically, so that events can be received while the client is idle
+func (u *unixSockClient) keepalive() {
+	for {
+		u.mu.Lock()
+		interval := u.timeout / 2
+		u.mu.Unlock()
+		if interval <= 0 {
+			interval = time.Second
+		}
+
+		u.guarded(context.Background(), &Request{Cmd: u.health(), Args: unixsock.Args{}, Respond: true})
+
+		select {
+		case <-time.After(interval):
+		case <-u.quit:
+			return
+		}
+	}
 }
 
 // Quit closes the connection
 func (u *unixSockClient) Quit() {
-	if u.conn != nil {
-		u.conn.Close()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	select {
+	case <-u.quit:
+	default:
+		close(u.quit)
+	}
+
+	if u.sess != nil {
+		u.sess.close()
+		u.sess = nil
+	}
+
+	u.rawMu.Lock()
+	defer u.rawMu.Unlock()
+	if u.raw != nil {
+		u.raw.Close()
+		u.raw = nil
 	}
 }
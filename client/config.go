@@ -0,0 +1,82 @@
+package client
+
+import (
+	"strings"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// Config gathers the numeric settings of a client in a struct, e.g. decoded
+// from a configuration file, as an alternative to the corresponding options.
+// Start from DefaultConfig, since zero values disable the settings rather
+// than falling back to the defaults. Invalid settings make the client fail
+// at construction (see Validate), whichever way they have been passed.
+type Config struct {
+	MaxLength   int           `json:"max_length"`   // See WithMaxLength
+	Timeout     time.Duration `json:"timeout"`      // See WithTimeout
+	DialTimeout time.Duration `json:"dial_timeout"` // See WithDialTimeout
+	TTL         time.Duration `json:"ttl"`          // See WithTTL
+	Liveness    time.Duration `json:"liveness"`     // See WithLivenessCheck
+
+	Priority    unixsock.Priority `json:"priority"`     // See WithPriority
+	WriteBuffer int               `json:"write_buffer"` // See WithWriteBuffer
+
+	SubscriptionBuffer int            `json:"subscription_buffer"` // See WithSubscriptionBuffer
+	Overflow           OverflowPolicy `json:"overflow"`            // See WithSubscriptionBuffer
+}
+
+// DefaultConfig returns the default client settings
+func DefaultConfig() Config {
+	return Config{
+		MaxLength:          1 << 20,
+		Timeout:            5 * time.Second,
+		DialTimeout:        5 * time.Second,
+		SubscriptionBuffer: defaultSubscriptionBuffer,
+	}
+}
+
+// Validate returns a *unixsock.ConfigError listing the settings out of their
+// range
+func (c Config) Validate() error {
+	u := &unixSockClient{}
+	for _, opt := range c.Options() {
+		opt(u)
+	}
+	return u.validate()
+}
+
+// Options returns the options applying the configuration
+func (c Config) Options() []Option {
+	return []Option{
+		WithMaxLength(c.MaxLength),
+		WithTimeout(c.Timeout),
+		WithDialTimeout(c.DialTimeout),
+		WithTTL(c.TTL),
+		WithLivenessCheck(c.Liveness),
+		WithPriority(c.Priority),
+		WithWriteBuffer(c.WriteBuffer),
+		WithSubscriptionBuffer(c.SubscriptionBuffer, c.Overflow),
+	}
+}
+
+// validate returns a *unixsock.ConfigError listing the settings out of their
+// range
+func (u *unixSockClient) validate() error {
+	e := &unixsock.ConfigError{}
+
+	e.Check(u.maxLength >= 0 && int64(u.maxLength) <= unixsock.MaxMessageLength, "max length must be between 0 and %d, got %d", int64(unixsock.MaxMessageLength), u.maxLength)
+	e.Check(u.timeout >= 0, "timeout must not be negative, got %s", u.timeout)
+	e.Check(u.dialTimeout >= 0, "dial timeout must not be negative, got %s", u.dialTimeout)
+	e.Check(u.ttl >= 0, "TTL must not be negative, got %s", u.ttl)
+	e.Check(u.liveness >= 0, "liveness check must not be negative, got %s", u.liveness)
+
+	e.Check(u.priority >= unixsock.PriorityLow && u.priority <= unixsock.PriorityHigh, "priority must be between %d and %d, got %d", unixsock.PriorityLow, unixsock.PriorityHigh, u.priority)
+	e.Check(u.writeBuffer >= 0, "write buffer must not be negative, got %d", u.writeBuffer)
+
+	e.Check(u.subscriptionBuffer > 0, "subscription buffer must be positive, got %d", u.subscriptionBuffer)
+	e.Check(u.systemPrefix == "" || strings.HasSuffix(u.systemPrefix, "."), "system prefix must end with a dot, got '%s'", u.systemPrefix)
+	e.Check(u.overflow >= OverflowDropOldest && u.overflow <= OverflowError, "unknown overflow policy %d", u.overflow)
+
+	return e.Err()
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// sysClose is the event servers send right before closing a connection
+// deliberately
+const sysClose = unixsock.SysClose
+
+// Disconnect describes why a connection to the server has ended (see
+// OnDisconnect)
+type Disconnect struct {
+	// Reason is the reason announced by the server in its close frame,
+	// unixsock.CloseShutdown if the server announced its shutdown or
+	// unixsock.CloseNormal if the client closed the connection itself. It is
+	// empty if the connection broke without notice (e.g. the server
+	// crashed or does not send close frames).
+	Reason unixsock.CloseReason
+
+	// Message details the reason
+	Message string
+
+	// Err is the error that ended the connection (nil if the client closed
+	// it)
+	Err error
+}
+
+// Error implements the error interface
+func (d *Disconnect) Error() string {
+	switch {
+	case d.Reason == "" && d.Err != nil:
+		return fmt.Sprintf("connection lost: %s", d.Err.Error())
+	case d.Reason == "":
+		return "connection lost"
+	case d.Message == "":
+		return fmt.Sprintf("connection closed (%s)", d.Reason)
+	}
+	return fmt.Sprintf("connection closed (%s): %s", d.Reason, d.Message)
+}
+
+// newDisconnect parses the arguments of a _sys.close event
+func newDisconnect(args unixsock.Args) *Disconnect {
+	reason, _ := args["reason"].(string)
+	message, _ := args["message"].(string)
+	return &Disconnect{
+		Reason:  unixsock.CloseReason(reason),
+		Message: message,
+	}
+}
+
+// OnDisconnect registers a handler invoked whenever a connection to the
+// server ends. Handlers must not block.
+func (u *unixSockClient) OnDisconnect(handler func(d *Disconnect)) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.onDisconnect = handler
+}
+
+// OnDisconnect registers a handler invoked whenever a connection to any of
+// the servers ends
+func (m *multiClient) OnDisconnect(handler func(d *Disconnect)) {
+	for _, b := range m.backends {
+		b.client.OnDisconnect(handler)
+	}
+}
+
+// disconnected notifies the disconnect handler (if any)
+func (u *unixSockClient) disconnected(d *Disconnect) {
+	u.mu.Lock()
+	handler := u.onDisconnect
+	u.mu.Unlock()
+
+	if handler != nil {
+		handler(d)
+	}
+}
@@ -0,0 +1,35 @@
+package client_test
+
+import (
+	"log"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	"github.com/vaitekunas/unixsock/client"
+)
+
+// Clients used to be configured after construction via Options, whose
+// respond and close flags were ignored (Send takes them per message):
+//
+//	c, err := client.New("/run/app.sock")
+//	...
+//	c.Options(4<<20, 30*time.Second, true, false)
+//
+// The limits are now passed to New along with the other options. Options
+// keeps working, so callers can migrate one call site at a time.
+func ExampleNew_migration() {
+	c, err := client.New("/run/app.sock",
+		client.WithMaxLength(4<<20),
+		client.WithTimeout(30*time.Second),
+	)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	defer c.Quit()
+
+	resp, err := c.Send("stats", unixsock.Args{}, true, false)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Println(resp.Payload)
+}
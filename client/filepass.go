@@ -0,0 +1,38 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// passedFile hands the payload passed as f over to the caller: it is
+// written into sink (if any) or attached to the response. The file is closed
+// unless it is attached.
+func passedFile(f *os.File, sink io.Writer, resp *unixsock.Response) error {
+
+	if resp == nil {
+		f.Close()
+		return nil
+	}
+	if sink == nil {
+		resp.File = f
+		return nil
+	}
+
+	defer f.Close()
+	if _, err := io.Copy(sink, f); err != nil {
+		return fmt.Errorf("could not write the passed payload: %s", err.Error())
+	}
+
+	return nil
+}
+
+// closeFile closes the file passed along with a message nobody waits for
+func closeFile(msg unixsock.Communicator) {
+	if f := msg.GetFile(); f != nil {
+		f.Close()
+	}
+}
@@ -0,0 +1,37 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// GoAwayError is reported (along with StateGoingAway) to the state callback
+// when the server announces its shutdown. Commands in flight complete
+// normally, while new commands are sent over a new connection.
+type GoAwayError struct {
+	// Retry informs whether a replacement process is going to listen on the
+	// socket (e.g. during a restart), i.e. whether redialing makes sense
+	Retry bool
+
+	// Reason is the reason for the shutdown given by the server
+	Reason string
+}
+
+// Error implements the error interface
+func (g *GoAwayError) Error() string {
+	if g.Retry {
+		return fmt.Sprintf("server going away (retry): %s", g.Reason)
+	}
+	return fmt.Sprintf("server going away: %s", g.Reason)
+}
+
+// newGoAwayError parses the arguments of a _sys.goaway event
+func newGoAwayError(args unixsock.Args) *GoAwayError {
+	retry, _ := args["retry"].(bool)
+	reason, _ := args["reason"].(string)
+	return &GoAwayError{
+		Retry:  retry,
+		Reason: reason,
+	}
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// SessionState is the state of a connection handed over between clients
+// (see Detach and Attach). It can be encoded as JSON, e.g. in order to pass
+// it across an exec boundary along with the connection's file descriptor.
+type SessionState struct {
+	// Path is the socket path of the server
+	Path string `json:"path"`
+
+	// Features negotiated in the handshake
+	Compressed  bool `json:"compressed,omitempty"` // Stream compression (can not leave the process)
+	FrameHeader bool `json:"frame_header,omitempty"`
+	FrameCRC    bool `json:"frame_crc,omitempty"`
+	Cancellable bool `json:"cancellable,omitempty"`
+
+	// LastID is the ID of the last message sent over the connection
+	LastID uint64 `json:"last_id,omitempty"`
+
+	// LastEvent is the sequence number of the last event received, so that
+	// events are neither delivered twice nor missed after reconnecting
+	LastEvent uint64 `json:"last_event,omitempty"`
+
+	// Buffered is the data read from the connection but not consumed yet
+	Buffered []byte `json:"buffered,omitempty"`
+}
+
+// Detach stops using the connection to the server without closing it and
+// returns it along with its state, so that another client can take it over
+// (see Attach), e.g. a component started later or a process exec'd with the
+// connection's file descriptor. Everything the server associates with the
+// connection (peer credentials, tags, the event filter and subscriptions)
+// stays with it. Calls pending on the connection fail as if it had been
+// lost. The client itself remains usable and dials a new connection for
+// its next call. Detach returns a nil connection if the client is not
+// connected.
+func (u *unixSockClient) Detach() (net.Conn, SessionState) {
+
+	u.mu.Lock()
+	sess := u.sess
+	u.sess = nil
+	u.mu.Unlock()
+
+	if sess == nil || !sess.detach() {
+		return nil, SessionState{}
+	}
+
+	u.mu.Lock()
+	lastID := u.lastID
+	u.mu.Unlock()
+
+	return sess.conn, SessionState{
+		Path:        u.unixSockPath,
+		Compressed:  sess.conn.Compressed(),
+		FrameHeader: sess.conn.FrameHeader(),
+		FrameCRC:    u.frameCRC,
+		Cancellable: sess.cancellable,
+		LastID:      lastID,
+		LastEvent:   atomic.LoadUint64(&u.lastEvent),
+		Buffered:    sess.conn.Buffered(),
+	}
+}
+
+// Attach takes over a connection detached by another client (see Detach)
+// instead of dialing one. The client has to connect to the same socket
+// path; a connection it has dialed itself is closed once its pending calls
+// have completed. Event handlers should be registered before attaching,
+// since registering them afterwards replaces the connection. Connections
+// that left the process (e.g. rebuilt with net.FileConn) are resumed from
+// the data buffered at the time of detaching, which is not possible for
+// compressed connections.
+func (u *unixSockClient) Attach(conn net.Conn, state SessionState) error {
+
+	if conn == nil {
+		return fmt.Errorf("Attach: no connection")
+	}
+	if state.Path != "" && state.Path != u.unixSockPath {
+		return fmt.Errorf("Attach: connection to '%s' can not be attached to a client of '%s'", state.Path, u.unixSockPath)
+	}
+
+	c, inProcess := conn.(*unixsock.Conn)
+	if !inProcess {
+		if state.Compressed {
+			return fmt.Errorf("Attach: compressed connections can only be attached within the process that detached them")
+		}
+		if len(state.Buffered) > 0 {
+			conn = &resumedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(state.Buffered), conn)}
+		}
+		c = unixsock.NewConn(conn)
+		if state.FrameHeader {
+			c.EnableFrameHeader(state.FrameCRC)
+		}
+	}
+
+	u.mu.Lock()
+	if u.sess != nil {
+		u.sess.goAway()
+	}
+	if u.dumper != nil {
+		c.SetDump(u.dumper, "client "+u.unixSockPath)
+	}
+	if state.LastID > u.lastID {
+		u.lastID = state.LastID
+	}
+	if state.LastEvent > atomic.LoadUint64(&u.lastEvent) {
+		atomic.StoreUint64(&u.lastEvent, state.LastEvent)
+	}
+
+	u.sess = newSession(c, u.maxLength, u.deliver(u.onEvent), u.stateChanged, u.disconnected)
+	u.sess.cancellable = state.Cancellable
+	u.mu.Unlock()
+
+	u.stateChanged(StateConnected, nil)
+
+	return nil
+}
+
+// Detach detaches the connection of the first server the multi-client is
+// connected to (see unixSockClient.Detach)
+func (m *multiClient) Detach() (net.Conn, SessionState) {
+	for _, b := range m.backends {
+		if conn, state := b.client.Detach(); conn != nil {
+			return conn, state
+		}
+	}
+	return nil, SessionState{}
+}
+
+// Attach attaches a connection to the server it has been detached from (see
+// unixSockClient.Attach)
+func (m *multiClient) Attach(conn net.Conn, state SessionState) error {
+	for _, b := range m.backends {
+		if b.client.unixSockPath == state.Path {
+			return b.client.Attach(conn, state)
+		}
+	}
+	return fmt.Errorf("Attach: no server listening on '%s'", state.Path)
+}
+
+// resumedConn is a connection rebuilt in another process, whose reads start
+// with the data buffered before it was detached
+type resumedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+// Read reads the buffered data, followed by the connection
+func (c *resumedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
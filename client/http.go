@@ -0,0 +1,32 @@
+package client
+
+import (
+	"context" // Required by http.Transport
+	"net"
+	"net/http"
+	"time"
+)
+
+// NewHTTPTransport creates an http.Transport sending HTTP requests over the
+// unix socket at UnixSockPath (e.g. to a server started with
+// server.WithHTTPHandler), regardless of the host in the request's URL:
+//
+//	c := &http.Client{Transport: client.NewHTTPTransport("/run/app.sock")}
+//	resp, err := c.Get("http://unix/status")
+//
+// Of the client options only WithDialTimeout and WithTransport apply.
+func NewHTTPTransport(UnixSockPath string, opts ...Option) *http.Transport {
+
+	u := &unixSockClient{unixSockPath: UnixSockPath, dialTimeout: 5 * time.Second}
+	for _, opt := range opts {
+		opt(u)
+	}
+
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return u.dial(ctx)
+		},
+		MaxIdleConns:    10,
+		IdleConnTimeout: 90 * time.Second,
+	}
+}
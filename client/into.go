@@ -0,0 +1,164 @@
+package client
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// errorCodeMeta is the response metadata key carrying the code of an
+// application error (see server.Error)
+const errorCodeMeta = "error_code"
+
+// CallError is returned by CallInto for commands that did not succeed
+type CallError struct {
+	Cmd     string
+	Status  unixsock.Status
+	Message string // Error reported by the server
+	Code    string // Machine-readable code of the error (if any, see server.Error)
+
+	// Response is the complete response, e.g. for payloads describing the
+	// failure of a partly successful command
+	Response *unixsock.Response
+}
+
+// Error implements the error interface
+func (e *CallError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s: %s", e.Cmd, e.Status)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Cmd, e.Status, e.Message)
+}
+
+// CallInto sends cmd with the arguments taken from args and decodes the JSON
+// payload of the response into reply, e.g.:
+//
+//	var status UnitStatus
+//	err := client.CallInto(ctx, c, "unit.status", &UnitStatusArgs{Unit: "nginx"}, &status)
+//
+// args is a struct (or a pointer to one), whose exported fields become
+// arguments named after their json tags (honouring "-" and omitempty), a
+// map with string keys or nil. reply is skipped if nil. Commands that do not
+// succeed return a *CallError.
+func CallInto(ctx context.Context, c UnixSockClient, cmd string, args, reply interface{}, opts ...CallOption) error {
+
+	callArgs, err := structArgs(args)
+	if err != nil {
+		return fmt.Errorf("CallInto: %s", err.Error())
+	}
+
+	resp, err := c.Call(ctx, cmd, callArgs, opts...)
+	if err != nil {
+		return err
+	}
+	if resp == nil {
+		return fmt.Errorf("CallInto: no response")
+	}
+
+	if resp.Status != unixsock.STATUS_OK {
+		return &CallError{
+			Cmd:      cmd,
+			Status:   resp.Status,
+			Message:  resp.Error,
+			Code:     resp.Meta[errorCodeMeta],
+			Response: resp,
+		}
+	}
+
+	if reply == nil {
+		return nil
+	}
+	if err := resp.PayloadJSON(reply); err != nil {
+		return fmt.Errorf("CallInto: %s", err.Error())
+	}
+
+	return nil
+}
+
+// structArgs converts the fields of a struct (or the entries of a map) into
+// arguments
+func structArgs(args interface{}) (unixsock.Args, error) {
+
+	if args == nil {
+		return unixsock.Args{}, nil
+	}
+	if a, ok := args.(unixsock.Args); ok {
+		return a, nil
+	}
+
+	v := reflect.ValueOf(args)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return unixsock.Args{}, nil
+		}
+		v = v.Elem()
+	}
+
+	result := unixsock.Args{}
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("arguments must be a struct or a map with string keys, got %s", v.Type())
+		}
+		for _, key := range v.MapKeys() {
+			result[key.String()] = v.MapIndex(key).Interface()
+		}
+
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" { // Unexported
+				continue
+			}
+
+			name, omitEmpty := field.Name, false
+			if tag := field.Tag.Get("json"); tag != "" {
+				parts := strings.Split(tag, ",")
+				if parts[0] == "-" && len(parts) == 1 {
+					continue
+				}
+				if parts[0] != "" {
+					name = parts[0]
+				}
+				for _, option := range parts[1:] {
+					omitEmpty = omitEmpty || option == "omitempty"
+				}
+			}
+
+			value := v.Field(i)
+			if omitEmpty && isEmpty(value) {
+				continue
+			}
+			result[name] = value.Interface()
+		}
+
+	default:
+		return nil, fmt.Errorf("arguments must be a struct or a map with string keys, got %s", v.Type())
+	}
+
+	return result, nil
+}
+
+// isEmpty informs whether v is empty in the sense of encoding/json's
+// omitempty
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
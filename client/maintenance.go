@@ -0,0 +1,61 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// Metadata of the responses to commands refused by servers in maintenance
+const (
+	maintenanceReason  = "maintenance"
+	maintenanceETAMeta = "eta"
+)
+
+// MaintenanceError is returned (along with the response) for commands
+// refused because the server is in maintenance, so that callers can back off
+// until the maintenance is expected to end instead of failing hard
+type MaintenanceError struct {
+	// Message is the error reported by the server, including its
+	// description of the maintenance
+	Message string
+
+	// ETA is the expected end of the maintenance (zero if unknown)
+	ETA time.Time
+}
+
+// Error implements the error interface
+func (m *MaintenanceError) Error() string {
+	if m.ETA.IsZero() {
+		return m.Message
+	}
+	return fmt.Sprintf("%s (expected to end at %s)", m.Message, m.ETA.Format(time.RFC3339))
+}
+
+// RetryAfter returns the time until the expected end of the maintenance
+// (zero if unknown or overdue)
+func (m *MaintenanceError) RetryAfter() time.Duration {
+	if m.ETA.IsZero() {
+		return 0
+	}
+	if wait := time.Until(m.ETA); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// maintenanceError returns the error of a command refused due to
+// maintenance (nil if resp is not such a refusal)
+func maintenanceError(resp *unixsock.Response) *MaintenanceError {
+	if resp == nil || resp.Status != unixsock.StatusRetry || resp.Meta["reason"] != maintenanceReason {
+		return nil
+	}
+
+	m := &MaintenanceError{Message: resp.Error}
+	if eta, err := time.Parse(time.RFC3339, resp.Meta[maintenanceETAMeta]); err == nil {
+		m.ETA = eta
+	}
+
+	return m
+}
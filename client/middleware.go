@@ -0,0 +1,25 @@
+package client
+
+import (
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// Sender sends a single request to the server
+type Sender func(ctx context.Context, req *Request) (*unixsock.Response, error)
+
+// Middleware wraps a Sender, e.g. to inject auth tokens or tracing arguments,
+// retry failed calls or log them. Middleware may modify the request before
+// passing it on, but should copy its arguments rather than modify them in
+// place, since they belong to the caller.
+type Middleware func(next Sender) Sender
+
+// Use appends middleware wrapping every outgoing call
+func (u *unixSockClient) Use(middleware ...Middleware) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	chain := make([]Middleware, 0, len(u.middleware)+len(middleware))
+	chain = append(chain, u.middleware...)
+	u.middleware = append(chain, middleware...)
+}
@@ -0,0 +1,303 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// BalancePolicy determines how a multi-client (see NewMulti) distributes
+// commands across its servers
+type BalancePolicy int
+
+// Balance policies
+const (
+	RoundRobin   BalancePolicy = iota // Each server in turn
+	LeastPending                      // Server with the fewest commands in flight
+	Failover                          // First reachable server, in the given order
+)
+
+// String returns the name of the policy
+func (p BalancePolicy) String() string {
+	switch p {
+	case RoundRobin:
+		return "round-robin"
+	case LeastPending:
+		return "least-pending"
+	case Failover:
+		return "failover"
+	default:
+		return "unknown"
+	}
+}
+
+// backend is a single server of a multi-client
+type backend struct {
+	client  *unixSockClient
+	pending int64
+}
+
+// multiClient implements the UnixSockClient interface on top of several
+// servers exposing identical sockets (e.g. sharded workers)
+type multiClient struct {
+	backends []*backend
+	policy   BalancePolicy
+	next     uint64
+}
+
+// NewMulti creates a client distributing commands across the servers
+// listening on paths according to policy. Commands that can not be sent
+// because a server is unreachable are sent to the next one. All options
+// apply to each server; note that a CircuitBreaker would be shared by all of
+// them.
+func NewMulti(paths []string, policy BalancePolicy, opts ...Option) (UnixSockClient, error) {
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("NewMulti: no socket paths")
+	}
+
+	m := &multiClient{
+		policy: policy,
+	}
+
+	for _, path := range paths {
+		u, err := newClient(path, opts)
+		if err != nil {
+			m.Quit()
+			return nil, fmt.Errorf("NewMulti: %s: %s", path, err.Error())
+		}
+		m.backends = append(m.backends, &backend{client: u})
+	}
+
+	return m, nil
+}
+
+// order returns the backends in the order they should be tried
+func (m *multiClient) order() []*backend {
+
+	n := len(m.backends)
+	ordered := make([]*backend, 0, n)
+
+	switch m.policy {
+	case RoundRobin:
+		start := int(atomic.AddUint64(&m.next, 1)-1) % n
+		for i := 0; i < n; i++ {
+			ordered = append(ordered, m.backends[(start+i)%n])
+		}
+
+	case LeastPending:
+		ordered = append(ordered, m.backends...)
+		pending := make([]int64, n)
+		for i, b := range ordered {
+			pending[i] = atomic.LoadInt64(&b.pending)
+		}
+		// Stable insertion sort keeps the given order among equals
+		for i := 1; i < n; i++ {
+			for j := i; j > 0 && pending[j] < pending[j-1]; j-- {
+				ordered[j], ordered[j-1] = ordered[j-1], ordered[j]
+				pending[j], pending[j-1] = pending[j-1], pending[j]
+			}
+		}
+
+	default:
+		ordered = append(ordered, m.backends...)
+	}
+
+	return ordered
+}
+
+// do executes fn on the backends until one of them is reachable
+func (m *multiClient) do(fn func(u *unixSockClient) (*unixsock.Response, error)) (*unixsock.Response, error) {
+
+	var failures []string
+	var maintenance *MaintenanceError
+	shuttingDown := false
+	for _, b := range m.order() {
+		atomic.AddInt64(&b.pending, 1)
+		resp, err := fn(b.client)
+		atomic.AddInt64(&b.pending, -1)
+
+		if _, unreachable := err.(*connectError); unreachable || err == ErrCircuitOpen {
+			failures = append(failures, fmt.Sprintf("%s: %s", b.client.unixSockPath, err.Error()))
+			continue
+		}
+
+		// Servers in maintenance are skipped
+		if m, ok := err.(*MaintenanceError); ok {
+			maintenance = m
+			failures = append(failures, fmt.Sprintf("%s: %s", b.client.unixSockPath, err.Error()))
+			continue
+		}
+
+		// Servers shutting down have not executed the command
+		if err == ErrServerShuttingDown {
+			shuttingDown = true
+			failures = append(failures, fmt.Sprintf("%s: %s", b.client.unixSockPath, err.Error()))
+			continue
+		}
+
+		return resp, err
+	}
+
+	// No server available, some of them due to maintenance or shutdowns
+	if maintenance != nil {
+		return nil, maintenance
+	}
+	if shuttingDown {
+		return nil, ErrServerShuttingDown
+	}
+
+	return nil, fmt.Errorf("Send: no server reachable: %s", strings.Join(failures, "; "))
+}
+
+// Send sends a command to one of the servers
+func (m *multiClient) Send(cmd string, args unixsock.Args, respond, close bool) (*unixsock.Response, error) {
+	return m.do(func(u *unixSockClient) (*unixsock.Response, error) {
+		return u.Send(cmd, args, respond, close)
+	})
+}
+
+// Call sends a command to one of the servers
+func (m *multiClient) Call(ctx context.Context, cmd string, args unixsock.Args, opts ...CallOption) (*unixsock.Response, error) {
+	return m.do(func(u *unixSockClient) (*unixsock.Response, error) {
+		return u.Call(ctx, cmd, args, opts...)
+	})
+}
+
+// Notify sends a command to the first reachable server without waiting for
+// a response
+func (m *multiClient) Notify(ctx context.Context, cmd string, args unixsock.Args, opts ...CallOption) error {
+	_, err := m.do(func(u *unixSockClient) (*unixsock.Response, error) {
+		return nil, u.Notify(ctx, cmd, args, opts...)
+	})
+	return err
+}
+
+// Options sets the options of all servers' connections
+func (m *multiClient) Options(maxLength int, timeout time.Duration, respond, close bool) {
+	for _, b := range m.backends {
+		b.client.Options(maxLength, timeout, respond, close)
+	}
+}
+
+// SendFrom sends a command along with a request body to one of the servers
+func (m *multiClient) SendFrom(ctx context.Context, cmd string, args unixsock.Args, r io.Reader, size int64) (*unixsock.Response, error) {
+	return m.do(func(u *unixSockClient) (*unixsock.Response, error) {
+		return u.SendFrom(ctx, cmd, args, r, size)
+	})
+}
+
+// SendRaw writes a frame to one of the servers
+func (m *multiClient) SendRaw(ctx context.Context, frame []byte) ([]byte, error) {
+	var reply []byte
+	_, err := m.do(func(u *unixSockClient) (*unixsock.Response, error) {
+		var err error
+		reply, err = u.SendRaw(ctx, frame)
+		return nil, err
+	})
+	return reply, err
+}
+
+// SendTo sends a command to one of the servers and streams the response
+// payload into w
+func (m *multiClient) SendTo(ctx context.Context, cmd string, args unixsock.Args, w io.Writer) (*unixsock.Response, error) {
+	return m.do(func(u *unixSockClient) (*unixsock.Response, error) {
+		return u.SendTo(ctx, cmd, args, w)
+	})
+}
+
+// Ping checks the health of all servers. It fails only if none of them is
+// healthy.
+func (m *multiClient) Ping(ctx context.Context) error {
+
+	errs := make([]error, len(m.backends))
+	wg := &sync.WaitGroup{}
+	for i, b := range m.backends {
+		wg.Add(1)
+		go func(i int, u *unixSockClient) {
+			defer wg.Done()
+			errs[i] = u.Ping(ctx)
+		}(i, b.client)
+	}
+	wg.Wait()
+
+	var failures []string
+	for i, err := range errs {
+		if err == nil {
+			return nil
+		}
+		failures = append(failures, fmt.Sprintf("%s: %s", m.backends[i].client.unixSockPath, err.Error()))
+	}
+
+	return fmt.Errorf("Ping: no server healthy: %s", strings.Join(failures, "; "))
+}
+
+// OnEvent registers a handler for the events pushed by any of the servers
+func (m *multiClient) OnEvent(handler func(cmd string, args unixsock.Args)) {
+	for _, b := range m.backends {
+		b.client.OnEvent(handler)
+	}
+}
+
+// Subscribe returns a channel merging the events matching topic pushed by
+// all servers. The channel is closed once the subscriptions to all servers
+// have ended; a slow consumer triggers the overflow policy of every server's
+// subscription (see WithSubscriptionBuffer).
+func (m *multiClient) Subscribe(ctx context.Context, topic string) (<-chan Event, error) {
+
+	subs := make([]<-chan Event, 0, len(m.backends))
+	failures := []string{}
+	for _, b := range m.backends {
+		events, err := b.client.Subscribe(ctx, topic)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", b.client.unixSockPath, err.Error()))
+			continue
+		}
+		subs = append(subs, events)
+	}
+	if len(subs) == 0 {
+		return nil, fmt.Errorf("Subscribe: no server reachable: %s", strings.Join(failures, "; "))
+	}
+
+	merged := make(chan Event)
+	wg := &sync.WaitGroup{}
+	wg.Add(len(subs))
+	for _, events := range subs {
+		go func(events <-chan Event) {
+			defer wg.Done()
+			for e := range events {
+				select {
+				case merged <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(events)
+	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+
+	return merged, nil
+}
+
+// Use appends middleware wrapping every outgoing call to any of the servers
+func (m *multiClient) Use(middleware ...Middleware) {
+	for _, b := range m.backends {
+		b.client.Use(middleware...)
+	}
+}
+
+// Quit closes the connections to all servers
+func (m *multiClient) Quit() {
+	for _, b := range m.backends {
+		b.client.Quit()
+	}
+}
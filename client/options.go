@@ -0,0 +1,229 @@
+package client
+
+import (
+	"io"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// Option configures a UnixSockClient
+type Option func(*unixSockClient)
+
+// WithMaxLength sets the maximum size of a response (1MB by default)
+func WithMaxLength(maxLength int) Option {
+	return func(u *unixSockClient) {
+		u.maxLength = maxLength
+	}
+}
+
+// WithTimeout sets the time limit of a single exchange with the server (5
+// seconds by default). Contexts with an earlier deadline take precedence.
+func WithTimeout(timeout time.Duration) Option {
+	return func(u *unixSockClient) {
+		u.timeout = timeout
+	}
+}
+
+// WithCircuitBreaker makes the client fail fast with ErrCircuitOpen while the
+// server keeps failing (see CircuitBreaker)
+func WithCircuitBreaker(breaker *CircuitBreaker) Option {
+	return func(u *unixSockClient) {
+		u.breaker = breaker
+	}
+}
+
+// WithAdaptiveTimeout derives the timeout of every command from its observed
+// latencies (see AdaptiveTimeout). The static timeout (see WithTimeout)
+// applies to commands observed too few times, while per-call timeouts (see
+// WithCallTimeout) and context deadlines take precedence.
+func WithAdaptiveTimeout(adaptive *AdaptiveTimeout) Option {
+	return func(u *unixSockClient) {
+		u.adaptive = adaptive
+	}
+}
+
+// WithPriority sets the priority of all messages sent by the client. It is
+// honoured by servers running a dispatch queue.
+func WithPriority(priority unixsock.Priority) Option {
+	return func(u *unixSockClient) {
+		u.priority = priority
+	}
+}
+
+// WithTTL stamps all messages sent by the client with an expiry of ttl after
+// sending (or the deadline of the context, if earlier). Servers do not execute
+// messages that sat in their queues past the expiry and respond with
+// unixsock.STATUS_EXPIRED instead.
+func WithTTL(ttl time.Duration) Option {
+	return func(u *unixSockClient) {
+		u.ttl = ttl
+	}
+}
+
+// WithWriteBuffer makes the client write messages through a buffered writer
+// of the given size, flushed explicitly after each message
+func WithWriteBuffer(size int) Option {
+	return func(u *unixSockClient) {
+		u.writeBuffer = size
+	}
+}
+
+// WithStreamCompression asks the server to compress the whole connection
+// (in both directions) with the given algorithm, e.g.
+// unixsock.CompressionFlate. It pays off for long-lived connections carrying
+// many small, similar messages. If the server does not support the algorithm
+// the connection stays uncompressed.
+func WithStreamCompression(algorithm string) Option {
+	return func(u *unixSockClient) {
+		u.compression = algorithm
+	}
+}
+
+// WithResponseCompression tells the server that the client accepts
+// compressed response payloads, which are decompressed transparently. Unlike
+// stream compression (see WithStreamCompression) only large payloads are
+// compressed (see server.WithResponseCompression). Servers that do not
+// support it send uncompressed payloads.
+func WithResponseCompression() Option {
+	return func(u *unixSockClient) {
+		u.acceptEncoding = unixsock.CompressionFlate
+	}
+}
+
+// WithFrameHeader asks the server to frame messages with the fixed header
+// (see unixsock.FrameMagic), which identifies the protocol version and, if
+// crc is set, carries a checksum of every message. Servers that do not
+// support the header keep using the original framing.
+func WithFrameHeader(crc bool) Option {
+	return func(u *unixSockClient) {
+		u.frameHeader = true
+		u.frameCRC = crc
+	}
+}
+
+// WithCancellation makes the client cancel the commands it gives up on (the
+// context of the call is done or the call times out), so that the server
+// stops executing them (see the reserved _sys.cancel command). Handlers
+// observe the cancellation through their context. Servers that do not support
+// it execute abandoned commands to completion.
+func WithCancellation() Option {
+	return func(u *unixSockClient) {
+		u.cancellation = true
+	}
+}
+
+// WithTags sets tags on the client's connections (e.g. "role": "worker",
+// "shard": "3") in the handshake, so that the server can push events to
+// selected clients only (see server.UnixSockSrv.BroadcastTo)
+func WithTags(tags map[string]string) Option {
+	return func(u *unixSockClient) {
+		u.tags = tags
+	}
+}
+
+// WithFilePassing accepts large response payloads passed by the server as
+// open files (see server.WithFilePassing) instead of streamed through the
+// socket. Such responses carry the file in unixsock.Response.File (which the
+// caller has to close) and an empty payload, unless the call writes the
+// payload into a writer (see SendTo), which receives the content of the
+// file. It has no effect on connections that cannot pass files, e.g. over
+// other transports or on Windows.
+func WithFilePassing() Option {
+	return func(u *unixSockClient) {
+		u.filePassing = true
+	}
+}
+
+// WithEventFilter makes the server deliver only the events whose arguments
+// match filter, a list of comma-separated key=value matchers (e.g.
+// "unit=nginx.service, state=failed"). The filter is sent on every
+// connection (see the reserved _sys.subscribe command); connecting fails if
+// the server rejects it. Reserved system events are always delivered.
+func WithEventFilter(filter string) Option {
+	return func(u *unixSockClient) {
+		u.eventFilter = filter
+	}
+}
+
+// WithSessionResumption asks servers supporting it (see
+// server.WithSessionResumption) for a resumption token on every connection.
+// When redialing after the connection dropped, the client presents the token
+// in the handshake, so that the server restores the connection's tags and
+// event filter and sends the events missed in the meantime without a separate
+// subscription round trip. Tokens are valid once and not shared between
+// clients.
+func WithSessionResumption() Option {
+	return func(u *unixSockClient) {
+		u.resumption = true
+	}
+}
+
+// WithSubscriptionBuffer sets the number of events buffered for every
+// subscription (see Subscribe, default 64) and what happens once a consumer
+// falls behind (default OverflowDropOldest)
+func WithSubscriptionBuffer(size int, policy OverflowPolicy) Option {
+	return func(u *unixSockClient) {
+		u.subscriptionBuffer = size
+		u.overflow = policy
+	}
+}
+
+// WithLivenessCheck makes the client ping the server before reusing a
+// connection that has been idle for longer than idle, so that a connection
+// silently dropped by the server is redialed before a command is sent over it
+func WithLivenessCheck(idle time.Duration) Option {
+	return func(u *unixSockClient) {
+		u.liveness = idle
+	}
+}
+
+// WithStateCallback registers a callback invoked whenever the connection to
+// the server is established or lost. Callbacks must not block.
+func WithStateCallback(callback func(state ConnState, err error)) Option {
+	return func(u *unixSockClient) {
+		u.onState = callback
+	}
+}
+
+// WithDebugDump writes a hex dump of every frame exchanged with the server
+// (direction, length and timing included) to w, e.g. in order to debug the
+// protocol. Raw frames (see SendRaw) are not dumped.
+func WithDebugDump(w io.Writer) Option {
+	return func(u *unixSockClient) {
+		u.dumper = unixsock.NewDumper(w)
+	}
+}
+
+// WithDialTimeout limits the time spent dialing the server (default 5s)
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(u *unixSockClient) {
+		u.dialTimeout = timeout
+	}
+}
+
+// WithSystemPrefix tells the client the namespace of the server's system
+// commands (see server.WithSystemPrefix), so that pinging the server (see
+// Ping and WithLivenessCheck) uses its health check
+func WithSystemPrefix(prefix string) Option {
+	return func(u *unixSockClient) {
+		u.systemPrefix = prefix
+	}
+}
+
+// WithTransport connects to the server via transport (see unixsock.Transport)
+// instead of dialing the unix socket, the path of which is then passed to the
+// transport as the address of the server
+func WithTransport(transport unixsock.Transport) Option {
+	return func(u *unixSockClient) {
+		u.transport = transport
+	}
+}
+
+// WithEagerConnect makes New connect to the server immediately, so that a
+// misconfigured socket path fails at startup instead of on the first call
+func WithEagerConnect() Option {
+	return func(u *unixSockClient) {
+		u.eager = true
+	}
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// rawFlags are the message fields SendRaw needs to know about in order to
+// forward a frame
+type rawFlags struct {
+	Respond bool `json:"respond"`
+	Close   bool `json:"close"`
+	Event   bool `json:"event"`
+	More    bool `json:"more"`
+}
+
+// peekFrame returns the flags of the message carried by frame
+func peekFrame(frame []byte) (rawFlags, error) {
+	flags := rawFlags{}
+	message, err := unixsock.FrameMessage(frame)
+	if err != nil {
+		return flags, err
+	}
+	err = json.Unmarshal(message, &flags)
+	return flags, err
+}
+
+// SendRaw writes a complete, already encoded frame to the server and returns
+// the frames of the response as they were received (nil if the message does
+// not ask for a response). Frames are sent over a connection of their own,
+// since their message IDs may clash with those of the client.
+func (u *unixSockClient) SendRaw(ctx context.Context, frame []byte) ([]byte, error) {
+
+	flags, err := peekFrame(frame)
+	if err != nil {
+		return nil, fmt.Errorf("SendRaw: invalid frame: %s", err.Error())
+	}
+
+	u.mu.Lock()
+	maxLength, timeout := u.maxLength, u.timeout
+	u.mu.Unlock()
+
+	u.rawMu.Lock()
+	defer u.rawMu.Unlock()
+
+	for attempt := 1; ; attempt++ {
+
+		reused := u.raw != nil
+		if !reused {
+			conn, err := u.dial(ctx)
+			if err != nil {
+				return nil, &connectError{fmt.Errorf("SendRaw: could not connect to the unix socket: %s", err.Error())}
+			}
+			u.raw = conn
+		}
+
+		reply, stale, err := exchangeRaw(ctx, u.raw, frame, flags, maxLength, timeout)
+		if err != nil || flags.Close {
+			u.raw.Close()
+			u.raw = nil
+		}
+
+		// The server may have closed the idle connection in the meantime
+		if stale && reused && attempt == 1 {
+			continue
+		}
+
+		return reply, err
+	}
+}
+
+// exchangeRaw writes frame to conn and reads the frames of the response
+// (skipping events). The exchange is aborted when ctx is done and times out
+// after timeout or ctx's deadline, whichever comes first. It also reports
+// whether the connection turned out to be closed by the server before the
+// frame was read.
+func exchangeRaw(ctx context.Context, conn net.Conn, frame []byte, flags rawFlags, maxLength int, timeout time.Duration) ([]byte, bool, error) {
+
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	if _, err := conn.Write(frame); err != nil {
+		return nil, true, fmt.Errorf("SendRaw: could not send the frame: %s", err.Error())
+	}
+	if !flags.Respond {
+		return nil, false, nil
+	}
+
+	var reply []byte
+	for {
+		received, err := unixsock.ReadFrame(conn, maxLength)
+		if err != nil {
+			re, ok := err.(*unixsock.ReceiveError)
+			closed := ok && re.Kind == unixsock.ErrClosed && reply == nil
+			return nil, closed, fmt.Errorf("SendRaw: failed receiving a response: %s", err.Error())
+		}
+
+		receivedFlags, err := peekFrame(received)
+		if err != nil {
+			return nil, false, fmt.Errorf("SendRaw: invalid response: %s", err.Error())
+		}
+		if receivedFlags.Event {
+			continue
+		}
+
+		reply = append(reply, received...)
+		if !receivedFlags.More {
+			return reply, false, nil
+		}
+	}
+}
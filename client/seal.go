@@ -0,0 +1,27 @@
+package client
+
+import (
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// SealArgs returns middleware sealing the arguments under keys (e.g.
+// passwords or tokens) of every outgoing call with sealer, so that they
+// never appear in plaintext in recordings, audit logs or debug output. The
+// server opens them with the same key (see server.OpenSealed). Middleware
+// registered before it (e.g. logging) still sees the plaintext.
+func SealArgs(sealer *unixsock.Sealer, keys ...string) Middleware {
+	return func(next Sender) Sender {
+		return func(ctx context.Context, req *Request) (*unixsock.Response, error) {
+			args, err := sealer.Seal(req.Args, keys...)
+			if err != nil {
+				return nil, err
+			}
+
+			sealed := *req
+			sealed.Args = args
+
+			return next(ctx, &sealed)
+		}
+	}
+}
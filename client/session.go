@@ -0,0 +1,332 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// session is a single connection to a UnixSockSrv. A background reader
+// routes responses to the callers waiting for them (by message ID) and
+// events to the client's event handler, so that several calls can share
+// the connection and events are received while the client is idle.
+type session struct {
+	conn *unixsock.Conn
+
+	mu        sync.Mutex
+	pending   map[uint64]*call
+	closed    bool
+	goingAway bool        // Server shutting down: no new calls, closed once idle
+	local     bool        // Connection closed by the client
+	detaching bool        // Connection handed over (see detach)
+	reason    *Disconnect // Close frame or shutdown announced by the server
+	lastUsed  time.Time
+	subs      map[*subscription]struct{}
+	done      chan struct{} // Closed once the reader has stopped
+
+	// cancellable is set (before the session is used) if the server
+	// accepts cancellations (see WithCancellation)
+	cancellable bool
+}
+
+// call is a caller waiting for the response(s) to a message. Streamed
+// responses consist of several messages sharing the same ID.
+type call struct {
+	replies   chan unixsock.Communicator // Closed if the connection is lost
+	abandoned chan struct{}              // Closed if the caller gave up
+}
+
+// newSession starts reading from conn. onEvent decides whether an event is
+// delivered (i.e. has not been seen before). onState is invoked once the
+// server announces its shutdown and once the connection has been lost, along
+// with onDisconnect.
+func newSession(conn *unixsock.Conn, maxLength int, onEvent func(seq uint64, cmd string, args unixsock.Args) bool, onState func(state ConnState, err error), onDisconnect func(d *Disconnect)) *session {
+
+	s := &session{
+		conn:     conn,
+		pending:  make(map[uint64]*call),
+		lastUsed: time.Now(),
+		subs:     make(map[*subscription]struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go s.read(maxLength, onEvent, onState, onDisconnect)
+
+	return s
+}
+
+// expect registers a caller waiting for the response to message id
+func (s *session) expect(id uint64) (*call, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, false
+	}
+
+	c := &call{
+		replies:   make(chan unixsock.Communicator, 1),
+		abandoned: make(chan struct{}),
+	}
+	s.pending[id] = c
+
+	return c, true
+}
+
+// forget unregisters a caller that is done waiting
+func (s *session) forget(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.pending[id]; ok {
+		close(c.abandoned)
+		delete(s.pending, id)
+	}
+
+	if s.goingAway && len(s.pending) == 0 && !s.detaching {
+		s.local = true
+		s.conn.Close()
+	}
+}
+
+// cancel tells the server that the caller has given up on message id (if
+// the server accepts cancellations). Failures are ignored: the command then
+// simply runs to completion.
+func (s *session) cancel(id uint64) {
+	if !s.cancellable || !s.alive() {
+		return
+	}
+
+	msg := unixsock.NewSender(s.conn, sysCancel, unixsock.Args{"id": id}, false, false, unixsock.WithTimeout(cancelTimeout))
+	msg.Send()
+}
+
+// touch marks the session as used
+func (s *session) touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastUsed = time.Now()
+}
+
+// idle returns the time since the session was last used
+func (s *session) idle() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastUsed)
+}
+
+// alive informs whether the connection is still usable. Connections closed
+// by the client are not, even before the reader has noticed.
+func (s *session) alive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.closed && !s.local && !s.goingAway && !s.detaching
+}
+
+// goAway stops new calls from using the session, which is closed as soon as
+// the pending calls have completed
+func (s *session) goAway() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.goingAway = true
+	if len(s.pending) == 0 && !s.detaching {
+		s.local = true
+		s.conn.Close()
+	}
+}
+
+// subscribe registers a subscription to the events received over the
+// connection. It returns false if the connection has been lost.
+func (s *session) subscribe(sub *subscription) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.subs[sub] = struct{}{}
+
+	return true
+}
+
+// unsubscribe removes a subscription
+func (s *session) unsubscribe(sub *subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subs, sub)
+}
+
+// publish passes an event to the matching subscriptions
+func (s *session) publish(e Event) {
+	s.mu.Lock()
+	subs := make([]*subscription, 0, len(s.subs))
+	for sub := range s.subs {
+		if sub.matches(e.Cmd) {
+			subs = append(subs, sub)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, sub := range subs {
+		if !sub.deliver(e) {
+			s.unsubscribe(sub)
+		}
+	}
+}
+
+// close closes the connection, which also stops the reader
+func (s *session) close() {
+	s.mu.Lock()
+	s.local = true
+	s.mu.Unlock()
+
+	s.conn.Close()
+}
+
+// detachPoll is the interval at which a detaching session interrupts its
+// reader until it has stopped
+const detachPoll = 10 * time.Millisecond
+
+// detach stops the reader without closing the connection, so that it can be
+// handed over (see Detach). Pending calls fail as if the connection had been
+// lost. It returns false if the connection has been lost already.
+func (s *session) detach() bool {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return false
+	}
+	s.detaching = true
+	s.mu.Unlock()
+
+	// The reader resets the deadline before every message, so it is
+	// interrupted until it notices
+	for stopped := false; !stopped; {
+		s.conn.SetReadDeadline(time.Now())
+		select {
+		case <-s.done:
+			stopped = true
+		case <-time.After(detachPoll):
+		}
+	}
+	s.conn.SetReadDeadline(time.Time{})
+
+	return true
+}
+
+// lost returns why the connection has ended (nil while it is open)
+func (s *session) lost() *Disconnect {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		return nil
+	}
+	return s.reason
+}
+
+// read reads messages until the connection breaks. Events are passed to
+// onEvent along with their sequence number (0 if not numbered).
+func (s *session) read(maxLength int, onEvent func(seq uint64, cmd string, args unixsock.Args) bool, onState func(state ConnState, err error), onDisconnect func(d *Disconnect)) {
+
+	var readErr error
+	for {
+		msg := unixsock.NewReceiver(s.conn, unixsock.WithMaxLength(maxLength), unixsock.WithTimeout(0)) // Wait for messages indefinitely
+		if readErr = msg.Receive(); readErr != nil {
+			break
+		}
+
+		// Server shutting down
+		if msg.IsEvent() && msg.GetCmd() == sysGoAway {
+			goAway := newGoAwayError(msg.GetArgs())
+			s.mu.Lock()
+			if s.reason == nil {
+				s.reason = &Disconnect{Reason: unixsock.CloseShutdown, Message: goAway.Reason}
+			}
+			s.mu.Unlock()
+			s.goAway()
+			if onState != nil {
+				onState(StateGoingAway, goAway)
+			}
+			continue
+		}
+
+		// Connection about to be closed by the server
+		if msg.IsEvent() && msg.GetCmd() == sysClose {
+			s.mu.Lock()
+			s.reason = newDisconnect(msg.GetArgs())
+			s.mu.Unlock()
+			continue
+		}
+
+		// Unsolicited event
+		if msg.IsEvent() {
+			if onEvent(msg.GetID(), msg.GetCmd(), msg.GetArgs()) {
+				s.publish(Event{Seq: msg.GetID(), Cmd: msg.GetCmd(), Args: msg.GetArgs()})
+			}
+			continue
+		}
+
+		// Response (the last one, unless more chunks follow)
+		s.mu.Lock()
+		c, ok := s.pending[msg.GetID()]
+		if !ok && msg.GetID() == 0 && len(s.pending) == 1 {
+			for _, pending := range s.pending { // Server not echoing message IDs
+				c, ok = pending, true
+			}
+		}
+		s.mu.Unlock()
+
+		if !ok {
+			closeFile(msg)
+			continue
+		}
+		select {
+		case c.replies <- msg:
+		case <-c.abandoned:
+			closeFile(msg)
+		}
+	}
+
+	// Connection lost (or handed over): release all waiting callers
+	s.mu.Lock()
+	if s.detaching {
+		readErr = nil
+	}
+	d := &Disconnect{Err: readErr}
+	if s.reason != nil {
+		d.Reason, d.Message = s.reason.Reason, s.reason.Message
+	}
+	if s.local || s.detaching {
+		d.Err = nil
+		if d.Reason == "" {
+			d.Reason = unixsock.CloseNormal
+		}
+	}
+	s.reason = d
+	s.closed = true
+	if !s.detaching {
+		s.conn.Close()
+	}
+	for id, c := range s.pending {
+		close(c.replies)
+		delete(s.pending, id)
+	}
+	subs := s.subs
+	s.subs = make(map[*subscription]struct{})
+	s.mu.Unlock()
+
+	for sub := range subs {
+		sub.close()
+	}
+	close(s.done)
+
+	if onState != nil {
+		onState(StateDisconnected, readErr)
+	}
+	if onDisconnect != nil {
+		onDisconnect(d)
+	}
+}
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// shutdownReason is the metadata "reason" of the responses to commands
+// refused by servers shutting down
+const shutdownReason = "shutting_down"
+
+// ErrServerShuttingDown is returned for commands that were not executed
+// because the server is shutting down: the server refused them, closed the
+// connection before answering or could not be redialed after announcing its
+// shutdown. Callers may retry them once a replacement process (if any) is
+// listening, or against another server.
+var ErrServerShuttingDown = errors.New("Send: server shutting down")
+
+// refusedOnShutdown informs whether resp refuses a command because the
+// server is shutting down
+func refusedOnShutdown(resp *unixsock.Response) bool {
+	return resp != nil && resp.Status == unixsock.StatusRetry && resp.Meta["reason"] == shutdownReason
+}
+
+// shutDown informs whether the last connection ended because the server
+// announced its shutdown
+func (u *unixSockClient) shutDown() bool {
+	u.mu.Lock()
+	sess := u.sess
+	u.mu.Unlock()
+
+	if sess == nil {
+		return false
+	}
+	return sess.shutDown()
+}
+
+// shutDown informs whether the server announced its shutdown (by a goaway
+// event or a close frame)
+func (s *session) shutDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reason != nil && s.reason.Reason == unixsock.CloseShutdown
+}
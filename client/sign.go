@@ -0,0 +1,49 @@
+package client
+
+import (
+	"io"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// VerifyResponses returns middleware verifying the signature of every
+// response with signer, so that responses sent by a process interposing on
+// the socket path (e.g. a proxy) instead of the server holding the key (see
+// server.WithResponseSigning) are rejected. Every call carries a fresh nonce
+// the signature is bound to, which prevents the replay of recorded
+// responses. Calls whose response is missing or has an invalid signature
+// fail without returning it.
+func VerifyResponses(signer *unixsock.Signer) Middleware {
+	return func(next Sender) Sender {
+		return func(ctx context.Context, req *Request) (*unixsock.Response, error) {
+			nonce, err := signer.Nonce()
+			if err != nil {
+				return nil, err
+			}
+
+			signed := *req
+			signed.Meta = make(map[string]string, len(req.Meta)+1)
+			for key, value := range req.Meta {
+				signed.Meta[key] = value
+			}
+			signed.Meta[unixsock.SignNonceMeta] = nonce
+
+			// Streamed data written to a sink is not collected in the payload
+			digest := signer.Digest(nonce, req.Cmd)
+			if req.sink != nil {
+				signed.sink = io.MultiWriter(req.sink, digest)
+			}
+
+			resp, err := next(ctx, &signed)
+			if err != nil || resp == nil {
+				return resp, err
+			}
+			if err := digest.Verify(resp); err != nil {
+				return nil, err
+			}
+
+			return resp, nil
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// latencyBounds are the upper bounds of the latency histogram's buckets
+var latencyBounds = []time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Stats are the client-side metrics of the calls made so far (see
+// UnixSockClient.Stats). Calls are counted once they pass the middleware
+// (see Use), i.e. a retrying middleware counts every attempt, while the
+// transparent redial of a broken connection counts as a retry.
+type Stats struct {
+	Calls    uint64                     `json:"calls"`    // Calls sent (or attempted)
+	Statuses map[unixsock.Status]uint64 `json:"statuses"` // Responses received by status
+	Failures uint64                     `json:"failures"` // Calls that failed without a response (e.g. timeouts)
+	Retries  uint64                     `json:"retries"`  // Calls resent over a fresh connection
+
+	Dials      uint64 `json:"dials"`       // Connections dialed (the first one included)
+	DialErrors uint64 `json:"dial_errors"` // Failed attempts to dial
+
+	InFlight    int `json:"in_flight"`   // Calls awaiting their responses
+	Connections int `json:"connections"` // Open connections to the servers
+
+	Latency Histogram `json:"latency"` // Latencies of the calls that got a response
+}
+
+// Histogram counts latencies in buckets of increasing upper bounds
+type Histogram struct {
+	Bounds []time.Duration `json:"bounds"` // Upper bounds of the buckets (inclusive)
+	Counts []uint64        `json:"counts"` // Calls per bucket, followed by the calls above all bounds
+	Count  uint64          `json:"count"`
+	Sum    time.Duration   `json:"sum"`
+	Max    time.Duration   `json:"max"`
+}
+
+// Quantile estimates the q-th quantile (e.g. 0.99) of the latencies as the
+// upper bound of the bucket it falls in (Max above the largest bound)
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+
+	rank := uint64(q*float64(h.Count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i, count := range h.Counts {
+		seen += count
+		if seen >= rank && i < len(h.Bounds) {
+			return h.Bounds[i]
+		}
+	}
+
+	return h.Max
+}
+
+// observe counts a single latency
+func (h *Histogram) observe(latency time.Duration) {
+	if h.Counts == nil {
+		h.Bounds = latencyBounds
+		h.Counts = make([]uint64, len(latencyBounds)+1)
+	}
+
+	i := 0
+	for i < len(h.Bounds) && latency > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += latency
+	if latency > h.Max {
+		h.Max = latency
+	}
+}
+
+// merge adds the latencies counted by other
+func (h *Histogram) merge(other Histogram) {
+	if other.Count == 0 {
+		return
+	}
+	if h.Counts == nil {
+		h.Bounds = latencyBounds
+		h.Counts = make([]uint64, len(latencyBounds)+1)
+	}
+
+	for i, count := range other.Counts {
+		h.Counts[i] += count
+	}
+	h.Count += other.Count
+	h.Sum += other.Sum
+	if other.Max > h.Max {
+		h.Max = other.Max
+	}
+}
+
+// metrics accumulates the statistics of a client
+type metrics struct {
+	mu         sync.Mutex
+	calls      uint64
+	statuses   map[unixsock.Status]uint64
+	failures   uint64
+	retries    uint64
+	dials      uint64
+	dialErrors uint64
+	inFlight   int
+	latency    Histogram
+}
+
+// begin counts a call sent
+func (m *metrics) begin() {
+	m.mu.Lock()
+	m.calls++
+	m.inFlight++
+	m.mu.Unlock()
+}
+
+// end records the outcome of a call
+func (m *metrics) end(latency time.Duration, resp *unixsock.Response, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.inFlight--
+	switch {
+	case resp != nil:
+		if m.statuses == nil {
+			m.statuses = make(map[unixsock.Status]uint64)
+		}
+		m.statuses[resp.Status]++
+		m.latency.observe(latency)
+	case err != nil:
+		m.failures++
+	}
+}
+
+// retry counts a call resent over a fresh connection
+func (m *metrics) retry() {
+	m.mu.Lock()
+	m.retries++
+	m.mu.Unlock()
+}
+
+// dialed records an attempt to connect
+func (m *metrics) dialed(err error) {
+	m.mu.Lock()
+	if err != nil {
+		m.dialErrors++
+	} else {
+		m.dials++
+	}
+	m.mu.Unlock()
+}
+
+// snapshot returns a copy of the statistics
+func (m *metrics) snapshot() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := Stats{
+		Calls:      m.calls,
+		Statuses:   make(map[unixsock.Status]uint64, len(m.statuses)),
+		Failures:   m.failures,
+		Retries:    m.retries,
+		Dials:      m.dials,
+		DialErrors: m.dialErrors,
+		InFlight:   m.inFlight,
+	}
+	for status, count := range m.statuses {
+		stats.Statuses[status] = count
+	}
+	stats.Latency.merge(m.latency)
+
+	return stats
+}
+
+// merge adds the statistics of another client
+func (s *Stats) merge(other Stats) {
+	s.Calls += other.Calls
+	for status, count := range other.Statuses {
+		s.Statuses[status] += count
+	}
+	s.Failures += other.Failures
+	s.Retries += other.Retries
+	s.Dials += other.Dials
+	s.DialErrors += other.DialErrors
+	s.InFlight += other.InFlight
+	s.Connections += other.Connections
+	s.Latency.merge(other.Latency)
+}
+
+// Stats returns the metrics of the calls made so far
+func (u *unixSockClient) Stats() Stats {
+	stats := u.metrics.snapshot()
+
+	u.mu.Lock()
+	if u.sess != nil && u.sess.alive() {
+		stats.Connections = 1
+	}
+	u.mu.Unlock()
+
+	return stats
+}
+
+// Stats returns the metrics of the calls made to all servers
+func (m *multiClient) Stats() Stats {
+	stats := Stats{Statuses: make(map[unixsock.Status]uint64)}
+	for _, b := range m.backends {
+		stats.merge(b.client.Stats())
+	}
+	return stats
+}
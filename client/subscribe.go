@@ -0,0 +1,172 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// ErrSlowConsumer is delivered as the last event of a subscription with the
+// OverflowError policy whose consumer has fallen behind
+var ErrSlowConsumer = errors.New("subscription buffer overflow: consumer too slow")
+
+// Event is a single event pushed by the server
+type Event struct {
+	Seq  uint64 // Sequence number assigned by the server (0 if not numbered)
+	Cmd  string
+	Args unixsock.Args
+	Err  error // Reason the subscription ended (only set on its last event)
+}
+
+// OverflowPolicy decides what happens to the events of a subscription whose
+// buffer is full, i.e. whose consumer has fallen behind
+type OverflowPolicy int
+
+// Overflow policies
+const (
+	// OverflowDropOldest discards the oldest buffered event to make room
+	OverflowDropOldest OverflowPolicy = iota
+
+	// OverflowBlock waits for the consumer. Since events are read by the
+	// connection's reader, responses are delayed in the meantime.
+	OverflowBlock
+
+	// OverflowError ends the subscription with an event carrying
+	// ErrSlowConsumer
+	OverflowError
+)
+
+// Default subscription buffer
+const defaultSubscriptionBuffer = 64
+
+// subscription delivers the events matching a topic to a channel
+type subscription struct {
+	topic  string
+	size   int
+	policy OverflowPolicy
+
+	events chan Event
+	done   chan struct{} // Closed once the subscription ends
+	once   sync.Once
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// newSubscription creates a subscription to the events matching topic. The
+// channel has room for one more event, which is reserved for the error
+// ending a subscription with the OverflowError policy.
+func newSubscription(topic string, size int, policy OverflowPolicy) *subscription {
+	if size < 1 {
+		size = 1
+	}
+	return &subscription{
+		topic:  topic,
+		size:   size,
+		policy: policy,
+		events: make(chan Event, size+1),
+		done:   make(chan struct{}),
+	}
+}
+
+// matches informs whether the subscription is interested in cmd
+func (s *subscription) matches(cmd string) bool {
+	matched, _ := path.Match(s.topic, cmd)
+	return matched
+}
+
+// deliver passes an event to the consumer according to the overflow policy.
+// It returns false once the subscription has ended.
+func (s *subscription) deliver(e Event) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	switch s.policy {
+	case OverflowBlock:
+		select {
+		case s.events <- e:
+		case <-s.done:
+			return false
+		}
+
+	case OverflowError:
+		if len(s.events) >= s.size {
+			s.events <- Event{Err: ErrSlowConsumer}
+			s.end()
+			return false
+		}
+		s.events <- e
+
+	default:
+		for len(s.events) >= s.size {
+			select {
+			case <-s.events:
+			default:
+			}
+		}
+		s.events <- e
+	}
+
+	return true
+}
+
+// close ends the subscription, closing its channel
+func (s *subscription) close() {
+	s.once.Do(func() { close(s.done) })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.end()
+}
+
+// end closes the channel of the subscription. The caller must hold the lock.
+func (s *subscription) end() {
+	if !s.closed {
+		s.closed = true
+		s.once.Do(func() { close(s.done) })
+		close(s.events)
+	}
+}
+
+// Subscribe returns a channel delivering the events whose command matches
+// topic (a path.Match pattern, e.g. "unit.*"). The channel is closed once ctx
+// is done or the connection to the server is lost; subscribers interested in
+// the events of the next connection subscribe again. Events are buffered
+// (see WithSubscriptionBuffer).
+func (u *unixSockClient) Subscribe(ctx context.Context, topic string) (<-chan Event, error) {
+
+	if _, err := path.Match(topic, ""); err != nil {
+		return nil, fmt.Errorf("Subscribe: invalid topic '%s': %s", topic, err.Error())
+	}
+
+	u.listen()
+
+	sess, err := u.session(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Subscribe: %s", err.Error())
+	}
+
+	sub := newSubscription(topic, u.subscriptionBuffer, u.overflow)
+	if !sess.subscribe(sub) {
+		return nil, fmt.Errorf("Subscribe: connection lost")
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			sess.unsubscribe(sub)
+			sub.close()
+		case <-sub.done:
+		}
+	}()
+
+	return sub.events, nil
+}
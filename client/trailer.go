@@ -0,0 +1,45 @@
+package client
+
+import (
+	"fmt"
+	"hash"
+	"strconv"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// streamSummary sums up the chunks of a streamed response in order to verify
+// them against its trailer
+type streamSummary struct {
+	length int64
+	sum    hash.Hash32
+}
+
+// add accounts for a received chunk
+func (s *streamSummary) add(chunk []byte) {
+	s.length += int64(len(chunk))
+	s.sum.Write(chunk)
+}
+
+// verify checks the received chunks against the length and checksum sent in
+// the trailer of the response (if any)
+func (s *streamSummary) verify(trailer map[string]string) error {
+
+	if value, ok := trailer[unixsock.TrailerLength]; ok {
+		length, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid stream length '%s' in the trailer", value)
+		}
+		if length != s.length {
+			return fmt.Errorf("incomplete stream: received %d bytes (expected %d)", s.length, length)
+		}
+	}
+
+	if value, ok := trailer[unixsock.TrailerCRC32]; ok {
+		if sum := fmt.Sprintf("%08x", s.sum.Sum32()); sum != value {
+			return fmt.Errorf("corrupted stream: checksum %s (expected %s)", sum, value)
+		}
+	}
+
+	return nil
+}
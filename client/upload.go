@@ -0,0 +1,69 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// uploadChunkSize is the size of the chunks a request body is split into
+const uploadChunkSize = 64 << 10
+
+// upload streams the body of req in chunks sharing the ID of the request. The
+// final message (without more chunks) completes the request.
+func (u *unixSockClient) upload(sess *session, id uint64, req *Request, maxLength int, timeout time.Duration) error {
+
+	buf := make([]byte, uploadChunkSize)
+	for {
+		n, err := io.ReadFull(req.source, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+
+		msg := unixsock.NewSender(sess.conn, req.Cmd, nil, req.Respond, req.Close && last, unixsock.WithMaxLength(maxLength), unixsock.WithTimeout(timeout))
+		msg.SetID(id)
+		msg.SetPriority(u.priority)
+		msg.SetWriteBuffer(u.writeBuffer)
+		msg.SetChunk(buf[:n], !last)
+		if err := msg.Send(); err != nil {
+			return err
+		}
+		sess.touch()
+
+		if last {
+			return nil
+		}
+	}
+}
+
+// exactReader reads exactly left bytes from r
+type exactReader struct {
+	r    io.Reader
+	left int64
+}
+
+// Read implements io.Reader
+func (e *exactReader) Read(p []byte) (int, error) {
+	if e.left <= 0 {
+		// The body must end here
+		var probe [1]byte
+		if n, _ := e.r.Read(probe[:]); n > 0 {
+			return 0, fmt.Errorf("body is longer than the declared size")
+		}
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > e.left {
+		p = p[:e.left]
+	}
+	n, err := e.r.Read(p)
+	e.left -= int64(n)
+	if err == io.EOF && e.left > 0 {
+		return n, fmt.Errorf("body is shorter than the declared size (%d bytes missing)", e.left)
+	}
+
+	return n, err
+}
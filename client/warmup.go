@@ -0,0 +1,64 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	context "golang.org/x/net/context"
+)
+
+// Warmup connects to the server (completing the handshake and event
+// subscriptions) unless already connected. Since all calls are multiplexed
+// over a single connection, any n > 0 establishes just that one.
+func (u *unixSockClient) Warmup(ctx context.Context, n int) (int, error) {
+
+	if n <= 0 {
+		return 0, nil
+	}
+
+	if _, err := u.session(ctx); err != nil {
+		return 0, &connectError{fmt.Errorf("Warmup: %s", err.Error())}
+	}
+
+	return 1, nil
+}
+
+// Warmup connects to the first n servers concurrently. It fails if any of
+// them is unreachable, but still reports the connections established to the
+// others.
+func (m *multiClient) Warmup(ctx context.Context, n int) (int, error) {
+
+	if n > len(m.backends) {
+		n = len(m.backends)
+	}
+	if n <= 0 {
+		return 0, nil
+	}
+
+	errs := make([]error, n)
+	wg := &sync.WaitGroup{}
+	for i, b := range m.backends[:n] {
+		wg.Add(1)
+		go func(i int, u *unixSockClient) {
+			defer wg.Done()
+			_, errs[i] = u.Warmup(ctx, 1)
+		}(i, b.client)
+	}
+	wg.Wait()
+
+	established := 0
+	var failures []string
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", m.backends[i].client.unixSockPath, err.Error()))
+			continue
+		}
+		established++
+	}
+	if len(failures) > 0 {
+		return established, fmt.Errorf("Warmup: %s", strings.Join(failures, "; "))
+	}
+
+	return established, nil
+}
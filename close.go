@@ -0,0 +1,16 @@
+package unixsock
+
+// CloseReason tells why a connection has been closed deliberately. Servers
+// send it in a final close frame (the reserved event _sys.close, along with
+// a human-readable message) right before closing a connection, so that
+// clients can tell a shutdown from an idle timeout or a rejected peer.
+type CloseReason string
+
+// Close reasons
+const (
+	CloseNormal        CloseReason = "normal"         // Closed by the client itself
+	CloseShutdown      CloseReason = "shutdown"       // Server shutting down (see _sys.goaway)
+	CloseIdleTimeout   CloseReason = "idle-timeout"   // Connection idle for too long
+	CloseProtocolError CloseReason = "protocol-error" // Peer violated the protocol, e.g. sent a message too long
+	CloseUnauthorized  CloseReason = "unauthorized"   // Peer not allowed to use the server at all
+)
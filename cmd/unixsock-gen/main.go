@@ -0,0 +1,58 @@
+// Command unixsock-gen generates a typed Go client (see package codegen) from
+// the command schemas of a server, stored as JSON (e.g. written by the
+// daemon from server.Router.Schemas). It is meant to be run by go generate:
+//
+//	//go:generate unixsock-gen -schemas api.json -package api -out client_gen.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/vaitekunas/unixsock/codegen"
+	"github.com/vaitekunas/unixsock/server"
+)
+
+func main() {
+
+	schemasPath := flag.String("schemas", "", "JSON file with the command schemas (command => schema)")
+	pkg := flag.String("package", "", "package of the generated file")
+	out := flag.String("out", "", "generated file (standard output if empty)")
+	flag.Parse()
+
+	if *schemasPath == "" || *pkg == "" || flag.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s -schemas file -package name [-out file]\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	data, err := ioutil.ReadFile(*schemasPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read the schemas: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	schemas := map[string]server.Schema{}
+	if err := json.Unmarshal(data, &schemas); err != nil {
+		fmt.Fprintf(os.Stderr, "malformed schemas: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	source := &bytes.Buffer{}
+	if err := codegen.Generate(source, *pkg, schemas); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if *out == "" {
+		os.Stdout.Write(source.Bytes())
+		return
+	}
+	if err := ioutil.WriteFile(*out, source.Bytes(), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write the generated file: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,77 @@
+// Command unixsock-replay re-sends traffic recorded by a unixsock server (see
+// server.WithRecorder) against a server and reports requests whose outcome
+// differs from the recorded one:
+//
+//	$ unixsock-replay -socket /run/app.sock -paced traffic.jsonl
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/vaitekunas/unixsock/client"
+	"github.com/vaitekunas/unixsock/record"
+)
+
+func main() {
+
+	socket := flag.String("socket", "", "path to the server's socket")
+	paced := flag.Bool("paced", false, "keep the original pauses between requests")
+	verbose := flag.Bool("v", false, "report every request, not only diverging ones")
+	flag.Parse()
+
+	if *socket == "" || flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s -socket path [-paced] [-v] recording\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not open the recording: %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	c, err := client.New(*socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not connect: %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer c.Quit()
+
+	total, diverged := 0, 0
+	err = record.Replay(c, f, *paced, func(r *record.Result) {
+		total++
+		if !r.Diverged() && !*verbose {
+			return
+		}
+		if r.Diverged() {
+			diverged++
+		}
+
+		recorded := "no response"
+		if r.Record.Response != nil {
+			recorded = r.Record.Response.Status.String()
+		}
+		replayed := "no response"
+		switch {
+		case r.Err != nil:
+			replayed = r.Err.Error()
+		case r.Response != nil:
+			replayed = r.Response.Status.String()
+		}
+
+		fmt.Printf("%s %s: recorded %s, replayed %s\n", r.Record.Time.Format("15:04:05.000"), r.Record.Cmd, recorded, replayed)
+	})
+
+	fmt.Printf("replayed %d requests, %d diverged\n", total, diverged)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	if diverged > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,214 @@
+// Command unixsockctl sends commands to a unixsock server and renders the
+// documentation of the commands served by it (see server.Router.Describe):
+//
+//	$ unixsockctl -socket /run/app.sock help
+//	$ unixsockctl -socket /run/app.sock unit.restart --help
+//	$ unixsockctl -socket /run/app.sock unit.restart unit=nginx.service
+//
+// Argument values are sent as JSON if they parse as such (e.g. numbers,
+// booleans, lists) and as strings otherwise.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	"github.com/vaitekunas/unixsock/client"
+	"github.com/vaitekunas/unixsock/server"
+	context "golang.org/x/net/context"
+)
+
+func main() {
+
+	socket := flag.String("socket", "", "path to the server's socket")
+	timeout := flag.Duration("timeout", 30*time.Second, "timeout of the command")
+	flag.Parse()
+
+	if *socket == "" || flag.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s -socket path [-timeout d] (help | command [--help] [key=value ...])\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	c, err := client.New(*socket, client.WithTimeout(*timeout))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not connect: %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer c.Quit()
+
+	cmd, params := flag.Arg(0), flag.Args()[1:]
+
+	// Documentation
+	isHelp := func(arg string) bool { return arg == "help" || arg == "--help" || arg == "-h" }
+	switch {
+	case isHelp(cmd):
+		commands, err := describe(c, unixsock.Args{})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		renderList(os.Stdout, commands)
+		return
+
+	case len(params) > 0 && isHelp(params[0]):
+		commands, err := describe(c, unixsock.Args{"cmd": cmd})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		renderHelp(os.Stdout, commands[0])
+		return
+	}
+
+	// Command
+	args := unixsock.Args{}
+	for _, param := range params {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			fmt.Fprintf(os.Stderr, "malformed argument '%s' (expected key=value)\n", param)
+			os.Exit(2)
+		}
+
+		var value interface{}
+		if err := json.Unmarshal([]byte(parts[1]), &value); err != nil {
+			value = parts[1]
+		}
+		args[parts[0]] = value
+	}
+
+	resp, err := c.SendTo(context.Background(), cmd, args, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	if resp.Warning != "" {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", resp.Warning)
+	}
+	if err := resp.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// describe fetches the documentation of the server's commands
+func describe(c client.UnixSockClient, args unixsock.Args) ([]server.CommandInfo, error) {
+
+	resp, err := c.Call(context.Background(), unixsock.SysCommands, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+
+	var commands []server.CommandInfo
+	if err := resp.PayloadJSON(&commands); err != nil {
+		return nil, fmt.Errorf("malformed command list: %s", err.Error())
+	}
+	if len(commands) == 0 && args["cmd"] != nil {
+		return nil, fmt.Errorf("unknown command '%s'", args["cmd"])
+	}
+
+	return commands, nil
+}
+
+// renderList writes a summary line of every command
+func renderList(w io.Writer, commands []server.CommandInfo) {
+
+	width := 0
+	for _, info := range commands {
+		if len(info.Name) > width {
+			width = len(info.Name)
+		}
+	}
+
+	fmt.Fprintln(w, "Commands:")
+	for _, info := range commands {
+		usage := ""
+		if info.Help != nil {
+			usage = info.Help.Usage
+		}
+		if info.Deprecated {
+			usage = strings.TrimSpace(usage + " (deprecated)")
+		}
+		fmt.Fprintln(w, strings.TrimRight(fmt.Sprintf("  %-*s  %s", width, info.Name, usage), " "))
+	}
+}
+
+// renderHelp writes the documentation of a single command
+func renderHelp(w io.Writer, info server.CommandInfo) {
+
+	help := info.Help
+	if help == nil {
+		help = &server.Help{}
+	}
+
+	usage := info.Name
+	var required, optional []string
+	if info.Schema != nil {
+		required, optional = info.Schema.Required, info.Schema.Optional
+	}
+	for _, key := range required {
+		usage += " " + key + "=..."
+	}
+	for _, key := range optional {
+		usage += " [" + key + "=...]"
+	}
+
+	fmt.Fprintf(w, "Usage: %s\n", usage)
+	if help.Usage != "" {
+		fmt.Fprintf(w, "\n%s\n", help.Usage)
+	}
+	if info.Deprecated {
+		fmt.Fprintf(w, "\nDeprecated.\n")
+	}
+
+	// Documented and declared arguments
+	keys := append(append([]string(nil), required...), optional...)
+	declared := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		declared[key] = true
+	}
+	var undeclared []string
+	for key := range help.Args {
+		if !declared[key] {
+			undeclared = append(undeclared, key)
+		}
+	}
+	sort.Strings(undeclared)
+	keys = append(keys, undeclared...)
+
+	if len(keys) > 0 {
+		fmt.Fprintf(w, "\nArguments:\n")
+		for _, key := range keys {
+			line := "  " + key
+			if info.Schema != nil && info.Schema.Types[key] != "" {
+				line += " (" + info.Schema.Types[key] + ")"
+			}
+			if description := help.Args[key]; description != "" {
+				line += ": " + description
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+
+	if len(help.Examples) > 0 {
+		fmt.Fprintf(w, "\nExamples:\n")
+		for _, example := range help.Examples {
+			fmt.Fprintf(w, "  %s %s\n", filepath.Base(os.Args[0]), example)
+		}
+	}
+
+	fmt.Fprintf(w, "\nTier: %s\n", info.Tier)
+	if len(info.Aliases) > 0 {
+		fmt.Fprintf(w, "Aliases: %s\n", strings.Join(info.Aliases, ", "))
+	}
+}
@@ -0,0 +1,433 @@
+package unixsock
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// Frame header. Frames either start with a fixed header:
+//
+//	magic (2 bytes) | version (1) | flags (1) | length (4) | [crc32 (4)] | json
+//
+// or, in the original format still accepted from (and sent to) older peers,
+// with the length alone:
+//
+//	length (4) | ':' | json
+//
+// The two are told apart by the first two bytes, which would require a
+// message of more than 1GB in the original format. The length is big-endian
+// in both formats and the CRC (IEEE) covers the JSON message.
+const (
+	FrameMagic   = "US"
+	FrameVersion = 1
+)
+
+// Frame header flags
+const (
+	frameFlagCRC        byte = 1 << 0 // The length is followed by a CRC-32 of the message
+	frameFlagCompressed byte = 1 << 1 // The stream is compressed (informational)
+	frameFlagStream     byte = 1 << 2 // The message is a chunk of a stream (more chunks follow)
+	frameCodecMask      byte = 3 << 4 // Codec of the message (0 = JSON)
+)
+
+// encoder writes whole messages to a connection. If the connection is a
+// *Conn, messages written concurrently (by any number of encoders) do not
+// interleave.
+type encoder struct {
+	conn        net.Conn
+	writeBuffer int      // Size of the buffered writer (0 = unbuffered)
+	file        *os.File // Passed along with the message (see Conn.PassFiles)
+}
+
+// encode writes a single JSON message, framed according to the protocol the
+// peer speaks. Chunks of streamed data and large messages are written in the
+// bulk lane, i.e. after any waiting small message (see laneLock).
+func (e encoder) encode(message []byte, stream, chunk bool, deadline time.Time) error {
+
+	c, isConn := e.conn.(*Conn)
+	if isConn {
+		c.writeMu.lock(chunk || len(message) > laneBulkSize)
+		defer c.writeMu.unlock()
+	}
+
+	// Set while holding the lane, so that waiting senders do not change the
+	// deadline of the message being written
+	e.conn.SetWriteDeadline(deadline)
+	defer e.conn.SetWriteDeadline(time.Time{})
+
+	// Line protocol: one message per line
+	if isConn && c.LineMode() {
+		line := append(message, '\n')
+		if n, err := writeFull(e.conn, line, deadline); err != nil {
+			return fmt.Errorf("Send: sent only %d bytes (message was %d): %s", n, len(message)+1, err.Error())
+		}
+		c.dumpSent(line)
+		return nil
+	}
+
+	// Prepare message header
+	var header []byte
+	if isConn && c.FrameHeader() {
+		header = frameHeader(message, c.frameFlags(stream))
+	} else {
+		header = make([]byte, 5)
+		binary.BigEndian.PutUint32(header, uint32(len(message)))
+		header[4] = ':'
+	}
+
+	// Pass the file along with the first byte of the message
+	if e.file != nil {
+		if !isConn || !c.FilePassing() {
+			return fmt.Errorf("Send: the connection does not pass files")
+		}
+		byteMsg := append(append(make([]byte, 0, len(header)+len(message)), header...), message...)
+		if n, err := writeFile(c, byteMsg, e.file, deadline); err != nil {
+			return fmt.Errorf("Send: sent only %d bytes (message was %d): %s", n, len(byteMsg), err.Error())
+		}
+		c.dumpSent(byteMsg)
+		return nil
+	}
+
+	// Send via a buffered writer, flushing explicitly
+	if e.writeBuffer > 0 {
+		w := bufio.NewWriterSize(&fullWriter{conn: e.conn, deadline: deadline}, e.writeBuffer)
+		w.Write(header)
+		w.Write(message)
+		if err := w.Flush(); err != nil {
+			return fmt.Errorf("Send: failed writing to the socket: %s", err.Error())
+		}
+		if isConn {
+			c.dumpSent(header, message)
+		}
+		return nil
+	}
+
+	// Send message
+	byteMsg := make([]byte, 0, len(header)+len(message))
+	byteMsg = append(byteMsg, header...)
+	byteMsg = append(byteMsg, message...)
+
+	if n, err := writeFull(e.conn, byteMsg, deadline); err != nil {
+		return fmt.Errorf("Send: sent only %d bytes (message was %d): %s", n, len(byteMsg), err.Error())
+	}
+	if isConn {
+		c.dumpSent(byteMsg)
+	}
+
+	return nil
+}
+
+// frameHeader returns the fixed header of a frame carrying message
+func frameHeader(message []byte, flags byte) []byte {
+	header := make([]byte, 8, 12)
+	copy(header, FrameMagic)
+	header[2] = FrameVersion
+	header[3] = flags
+	binary.BigEndian.PutUint32(header[4:], uint32(len(message)))
+	if flags&frameFlagCRC != 0 {
+		header = header[:12]
+		binary.BigEndian.PutUint32(header[8:], crc32.ChecksumIEEE(message))
+	}
+	return header
+}
+
+// decoder reads whole messages from a connection. If the connection is a
+// *Conn, messages read concurrently (by any number of decoders) do not
+// interleave, i.e. each decoder gets a complete message.
+type decoder struct {
+	conn      net.Conn
+	maxLength int // Maximum size of a message (0 = unlimited)
+}
+
+// decode reads a single message into msg and returns its size. Framed
+// messages are decoded while they are being read, without buffering the
+// frame first. Messages of peers speaking the line protocol default to
+// respond=true, since humans should not have to ask for a response.
+// Failures are reported as a *ReceiveError.
+func (d decoder) decode(msg *communicator, deadline time.Time) (int, error) {
+
+	c, isConn := d.conn.(*Conn)
+	if isConn {
+		c.readMu.Lock()
+		defer c.readMu.Unlock()
+		c.startReading()
+		defer c.dumpRead()
+	}
+
+	d.conn.SetReadDeadline(deadline)
+
+	// Detect the protocol
+	if isConn {
+		lineMode, err := c.sniff()
+		if err != nil {
+			return 0, readError("reading the length of the message failed", err, false)
+		}
+		if lineMode {
+			content, err := d.readLine(c)
+			c.read(content)
+			if err != nil {
+				return 0, err
+			}
+			msg.Respond = true
+			if err := json.Unmarshal(content, msg); err != nil {
+				return 0, &ReceiveError{Kind: ErrMalformed, Msg: "cannot unmarshal response", Err: err}
+			}
+			return len(content), nil
+		}
+	}
+
+	size, err := d.readFrame(msg)
+	if err != nil || !msg.File {
+		return size, err
+	}
+
+	// Claim the file passed along with the message
+	if isConn {
+		msg.file = c.nextFile()
+	}
+	if msg.file == nil {
+		return 0, &ReceiveError{Kind: ErrMalformed, Msg: "file passed along with the message missing"}
+	}
+
+	return size, nil
+}
+
+// readFrame reads a single frame (in either format) into msg
+func (d decoder) readFrame(msg *communicator) (int, error) {
+
+	// Retrieve incoming message length (or the start of the header)
+	length := make([]byte, 4)
+	if n, err := io.ReadFull(d.conn, length); err != nil {
+		return 0, readError("reading the length of the message failed", err, n > 0)
+	}
+
+	if string(length[:2]) == FrameMagic {
+		return d.readHeaderFrame(msg, length[2], length[3])
+	}
+
+	msgLen := binary.BigEndian.Uint32(length)
+	if d.maxLength > 0 && msgLen > uint32(d.maxLength) {
+		return 0, &ReceiveError{Kind: ErrTooLong, Msg: fmt.Sprintf("message too long: %d bytes (maximum is %d)", msgLen, d.maxLength)}
+	}
+
+	// Message will start with ":"
+	if err := d.readFull(make([]byte, 1)); err != nil {
+		return 0, err
+	}
+
+	return int(msgLen), d.stream(msg, msgLen, nil)
+}
+
+// readHeaderFrame reads the rest of a frame starting with the fixed header
+// into msg. Frames that cannot be understood (unknown version or codec,
+// corrupted message) are consumed entirely, so that the connection remains
+// usable.
+func (d decoder) readHeaderFrame(msg *communicator, version, flags byte) (int, error) {
+
+	size := 4
+	if flags&frameFlagCRC != 0 {
+		size += 4
+	}
+
+	rest := make([]byte, size)
+	if err := d.readFull(rest); err != nil {
+		return 0, err
+	}
+
+	msgLen := binary.BigEndian.Uint32(rest)
+	if d.maxLength > 0 && msgLen > uint32(d.maxLength) {
+		return 0, &ReceiveError{Kind: ErrTooLong, Msg: fmt.Sprintf("message too long: %d bytes (maximum is %d)", msgLen, d.maxLength)}
+	}
+
+	var unsupported string
+	switch {
+	case version != FrameVersion:
+		unsupported = fmt.Sprintf("unsupported frame version %d", version)
+	case flags&frameCodecMask != 0:
+		unsupported = fmt.Sprintf("unsupported codec %d", (flags&frameCodecMask)>>4)
+	}
+	if unsupported != "" {
+		if err := d.stream(nil, msgLen, nil); err != nil {
+			return 0, err
+		}
+		return 0, &ReceiveError{Kind: ErrMalformed, Msg: unsupported}
+	}
+
+	var sum hash.Hash32
+	if flags&frameFlagCRC != 0 {
+		sum = crc32.NewIEEE()
+	}
+	if err := d.stream(msg, msgLen, sum); err != nil {
+		return 0, err
+	}
+	if sum != nil && sum.Sum32() != binary.BigEndian.Uint32(rest[4:]) {
+		return 0, &ReceiveError{Kind: ErrMalformed, Msg: "checksum mismatch"}
+	}
+
+	// Peers sending headers understand them, so answer in kind
+	if c, ok := d.conn.(*Conn); ok && !c.FrameHeader() {
+		c.EnableFrameHeader(flags&frameFlagCRC != 0)
+	}
+
+	return int(msgLen), nil
+}
+
+// stream decodes a message of length bytes directly from the connection into
+// msg (or skips it, if msg is nil), feeding it to sum (if any) on the way.
+// The message is consumed entirely, even if it cannot be decoded, so that
+// the connection remains usable.
+func (d decoder) stream(msg *communicator, length uint32, sum hash.Hash32) error {
+
+	// Small messages are read into the buffer of the connection
+	if c, ok := d.conn.(*Conn); ok && msg != nil && length <= maxReadBuffer {
+		return d.buffered(c, msg, length, sum)
+	}
+
+	body := &frameReader{r: d.conn, left: int64(length)}
+	var r io.Reader = body
+	if sum != nil {
+		r = io.TeeReader(body, sum)
+	}
+
+	var decodeErr error
+	trailing := false
+	if msg != nil {
+		dec := json.NewDecoder(r)
+		decodeErr = dec.Decode(msg)
+		trailing = !blank(dec.Buffered())
+	}
+
+	// Consume the rest (e.g. trailing whitespace or an undecodable remainder)
+	if !blank(r) {
+		trailing = true
+	}
+
+	if body.err != nil {
+		if body.err == io.EOF || body.err == io.ErrUnexpectedEOF {
+			return readError(fmt.Sprintf("incorrect message length: %d (was expecting %d)", body.n, length), body.err, true)
+		}
+		return readError("failed reading from unix socket", body.err, true)
+	}
+
+	if decodeErr != nil {
+		return &ReceiveError{Kind: ErrMalformed, Msg: "cannot unmarshal response", Err: decodeErr}
+	}
+	if msg != nil && trailing {
+		return &ReceiveError{Kind: ErrMalformed, Msg: "cannot unmarshal response: invalid data after the message"}
+	}
+
+	return nil
+}
+
+// buffered reads a message of at most maxReadBuffer bytes into the read
+// buffer of c and decodes it into msg, feeding it to sum (if any) on the
+// way. It is called with readMu held.
+func (d decoder) buffered(c *Conn, msg *communicator, length uint32, sum hash.Hash32) error {
+
+	buf := c.readBuffer(int(length))
+	if err := d.readFull(buf); err != nil {
+		return err
+	}
+	if sum != nil {
+		sum.Write(buf)
+	}
+
+	// Unlike a json.Decoder, Unmarshal also rejects data after the message
+	if err := json.Unmarshal(buf, msg); err != nil {
+		return &ReceiveError{Kind: ErrMalformed, Msg: "cannot unmarshal response", Err: err}
+	}
+
+	return nil
+}
+
+// blank consumes r and informs whether it contained only whitespace
+func blank(r io.Reader) bool {
+	buf := make([]byte, 512)
+	isBlank := true
+	for {
+		n, err := r.Read(buf)
+		for _, b := range buf[:n] {
+			if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+				isBlank = false
+			}
+		}
+		if err != nil {
+			return isBlank
+		}
+	}
+}
+
+// readFull reads the next part of a frame
+func (d decoder) readFull(buf []byte) error {
+	if n, err := io.ReadFull(d.conn, buf); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return readError(fmt.Sprintf("incorrect message length: %d (was expecting %d)", n, len(buf)), err, true)
+		}
+		return readError("failed reading from unix socket", err, true)
+	}
+	return nil
+}
+
+// frameReader reads the remainder of a frame. Unlike io.LimitedReader it
+// remembers the error that cut the frame short (if any).
+type frameReader struct {
+	r    io.Reader
+	left int64
+	n    int
+	err  error
+}
+
+// Read reads at most the remainder of the frame
+func (f *frameReader) Read(p []byte) (int, error) {
+	if f.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > f.left {
+		p = p[:f.left]
+	}
+
+	n, err := f.r.Read(p)
+	f.left -= int64(n)
+	f.n += n
+	if err != nil && f.left > 0 {
+		f.err = err
+	}
+
+	return n, err
+}
+
+// readLine reads a single line of JSON
+func (d decoder) readLine(c *Conn) ([]byte, error) {
+
+	reader := c.bufReader()
+
+	// Lines reuse the read buffer of the connection, unless they outgrow it
+	line := c.readBuffer(0)
+	defer func() {
+		if cap(line) <= maxReadBuffer {
+			c.readBuf = line[:0]
+		}
+	}()
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if d.maxLength > 0 && len(line) > d.maxLength+1 {
+			return nil, &ReceiveError{Kind: ErrTooLong, Msg: fmt.Sprintf("message too long: more than %d bytes", d.maxLength)}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, readError("failed reading from unix socket", err, len(line) > 0)
+		}
+		return line, nil
+	}
+}
@@ -0,0 +1,284 @@
+// Package codegen generates typed Go clients from the declared schemas of a
+// server's commands (see server.Schema and server.Router.Schemas), sparing
+// callers the manual assembly of Args. For every command it emits a request
+// struct (if the command takes arguments), a reply struct (if the schema
+// declares one) and a method of the generated Client:
+//
+//	status, err := api.NewClient(c).UnitStatus(ctx, &api.UnitStatusRequest{Unit: "nginx.service"})
+//
+// Required arguments become plain fields, optional ones pointers that are
+// only sent if set. Argument and reply field types are declared by the
+// following names:
+//
+//	string, bool, int, int64, uint64, float64   the Go types of the same name
+//	duration, time, bytes                       time.Duration, time.Time, []byte
+//	strings                                     []string
+//	object                                      map[string]interface{}
+//	any (or undeclared)                         interface{}
+//
+// The generator is usually run via go generate (see cmd/unixsock-gen).
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/vaitekunas/unixsock/server"
+)
+
+// goTypes maps declared type names to Go types
+var goTypes = map[string]string{
+	"":         "interface{}",
+	"any":      "interface{}",
+	"string":   "string",
+	"bool":     "bool",
+	"int":      "int",
+	"int64":    "int64",
+	"uint64":   "uint64",
+	"float64":  "float64",
+	"duration": "time.Duration",
+	"time":     "time.Time",
+	"bytes":    "[]byte",
+	"strings":  "[]string",
+	"object":   "map[string]interface{}",
+}
+
+// field is a single argument or reply field
+type field struct {
+	Name     string // Go name
+	Key      string // Argument key or JSON field
+	Type     string // Go type
+	Optional bool
+}
+
+// command is a single command along with its generated names
+type command struct {
+	Cmd     string
+	Name    string // Method name
+	Args    []field
+	Reply   []field
+	Request string // Request struct (empty if the command takes no arguments)
+	Result  string // Reply struct (empty if no reply is declared)
+}
+
+// file is the generated file
+type file struct {
+	Package  string
+	Commands []*command
+	Time     bool // The time package is used
+}
+
+// Generate writes a Go file of package pkg containing typed request and reply
+// structs and a Client with a method for every command of schemas
+func Generate(w io.Writer, pkg string, schemas map[string]server.Schema) error {
+
+	f := &file{Package: pkg}
+
+	cmds := make([]string, 0, len(schemas))
+	for cmd := range schemas {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+
+	methods := make(map[string]string, len(cmds))
+	for _, cmd := range cmds {
+		c, err := newCommand(cmd, schemas[cmd])
+		if err != nil {
+			return fmt.Errorf("Generate: %s", err.Error())
+		}
+		if other, ok := methods[c.Name]; ok {
+			return fmt.Errorf("Generate: commands '%s' and '%s' both map to %s", other, cmd, c.Name)
+		}
+		methods[c.Name] = cmd
+
+		for _, fl := range append(c.Args, c.Reply...) {
+			if strings.HasPrefix(fl.Type, "time.") {
+				f.Time = true
+			}
+		}
+
+		f.Commands = append(f.Commands, c)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := goTemplate.Execute(buf, f); err != nil {
+		return fmt.Errorf("Generate: %s", err.Error())
+	}
+
+	source, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("Generate: could not format the generated code: %s", err.Error())
+	}
+
+	if _, err := w.Write(source); err != nil {
+		return fmt.Errorf("Generate: %s", err.Error())
+	}
+
+	return nil
+}
+
+// newCommand derives the generated names and fields of a command
+func newCommand(cmd string, schema server.Schema) (*command, error) {
+
+	c := &command{Cmd: cmd, Name: goName(cmd)}
+	if c.Name == "" {
+		return nil, fmt.Errorf("command '%s' has no usable name", cmd)
+	}
+
+	var err error
+	args := append(append([]string(nil), schema.Required...), schema.Optional...)
+	if c.Args, err = fields(cmd, args, len(schema.Required), schema.Types); err != nil {
+		return nil, err
+	}
+
+	reply := make([]string, 0, len(schema.Reply))
+	for key := range schema.Reply {
+		reply = append(reply, key)
+	}
+	sort.Strings(reply)
+	if c.Reply, err = fields(cmd, reply, len(reply), schema.Reply); err != nil {
+		return nil, err
+	}
+
+	if len(c.Args) > 0 {
+		c.Request = c.Name + "Request"
+	}
+	if len(c.Reply) > 0 {
+		c.Result = c.Name + "Reply"
+	}
+
+	return c, nil
+}
+
+// fields maps keys to struct fields. The keys after the first required ones
+// are optional.
+func fields(cmd string, keys []string, required int, types map[string]string) ([]field, error) {
+
+	out := make([]field, 0, len(keys))
+	names := make(map[string]string, len(keys))
+	for i, key := range keys {
+		typ, ok := goTypes[types[key]]
+		if !ok {
+			return nil, fmt.Errorf("command '%s': unknown type '%s' of '%s'", cmd, types[key], key)
+		}
+
+		name := goName(key)
+		if name == "" {
+			return nil, fmt.Errorf("command '%s': '%s' has no usable name", cmd, key)
+		}
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("command '%s': '%s' and '%s' both map to %s", cmd, other, key, name)
+		}
+		names[name] = key
+
+		out = append(out, field{Name: name, Key: key, Type: typ, Optional: i >= required})
+	}
+
+	return out, nil
+}
+
+// goName converts a command or argument name (e.g. "unit.status" or
+// "max_age") into an exported Go identifier (e.g. "UnitStatus", "MaxAge")
+func goName(s string) string {
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	name := ""
+	for _, word := range words {
+		runes := []rune(word)
+		runes[0] = unicode.ToUpper(runes[0])
+		name += string(runes)
+	}
+
+	if name != "" && !unicode.IsLetter([]rune(name)[0]) {
+		name = "X" + name
+	}
+
+	return name
+}
+
+var goTemplate = template.Must(template.New("go").Parse(`// Code generated by unixsock-gen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{- if .Time}}
+	"time"
+{{end}}
+	"github.com/vaitekunas/unixsock"
+	"github.com/vaitekunas/unixsock/client"
+	context "golang.org/x/net/context"
+)
+
+// Client sends typed commands to the server
+type Client struct {
+	c client.UnixSockClient
+}
+
+// NewClient creates a typed client sending commands via c
+func NewClient(c client.UnixSockClient) *Client {
+	return &Client{c: c}
+}
+{{range .Commands}}
+{{- if .Request}}
+// {{.Request}} are the arguments of the command "{{.Cmd}}"
+type {{.Request}} struct {
+{{- range .Args}}
+	{{.Name}} {{if .Optional}}*{{end}}{{.Type}}{{if .Optional}} // Optional{{end}}
+{{- end}}
+}
+{{end}}
+{{- if .Result}}
+// {{.Result}} is the reply to the command "{{.Cmd}}"
+type {{.Result}} struct {
+{{- range .Reply}}
+	{{.Name}} {{.Type}} ` + "`" + `json:"{{.Key}}"` + "`" + `
+{{- end}}
+}
+{{end}}
+// {{.Name}} sends the command "{{.Cmd}}"{{if not .Result}} and returns its response{{end}}
+func (c *Client) {{.Name}}(ctx context.Context{{if .Request}}, req *{{.Request}}{{end}}, opts ...client.CallOption) ({{if .Result}}*{{.Result}}{{else}}*unixsock.Response{{end}}, error) {
+{{- if .Request}}
+	if req == nil {
+		req = &{{.Request}}{}
+	}
+
+	args := unixsock.Args{
+{{- range .Args}}{{if not .Optional}}
+		"{{.Key}}": req.{{.Name}},
+{{- end}}{{end}}
+	}
+{{- range .Args}}{{if .Optional}}
+	if req.{{.Name}} != nil {
+		args["{{.Key}}"] = *req.{{.Name}}
+	}
+{{- end}}{{end}}
+{{else}}
+	args := unixsock.Args{}
+{{end}}
+	resp, err := c.c.Call(ctx, "{{.Cmd}}", args, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.Err(); err != nil {
+		return {{if .Result}}nil{{else}}resp{{end}}, err
+	}
+{{if .Result}}
+	reply := &{{.Result}}{}
+	if err := resp.PayloadJSON(reply); err != nil {
+		return nil, err
+	}
+
+	return reply, nil
+{{- else}}
+	return resp, nil
+{{- end}}
+}
+{{end}}`))
@@ -0,0 +1,64 @@
+package codegen
+
+import (
+	"bytes"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+
+	"github.com/vaitekunas/unixsock"
+	"github.com/vaitekunas/unixsock/server"
+)
+
+func TestGenerate(t *testing.T) {
+
+	noop := func(cmd string, args unixsock.Args) *unixsock.Response {
+		return unixsock.NewResponse().OK()
+	}
+
+	units := server.NewRouter()
+	units.Register("status", server.TierReadOnly, noop)
+	units.Declare("status", server.Schema{
+		Required: []string{"unit"},
+		Optional: []string{"max_age"},
+		Types:    map[string]string{"unit": "string", "max_age": "duration"},
+		Reply:    map[string]string{"state": "string", "since": "time"},
+	})
+
+	router := server.NewRouter()
+	router.Register("ping", server.TierReadOnly, noop)
+	router.Declare("ping", server.Schema{})
+	router.Mount("unit.", units)
+
+	source := &bytes.Buffer{}
+	if err := Generate(source, "api", router.Schemas()); err != nil {
+		t.Fatalf("TestGenerate: could not generate: %s", err.Error())
+	}
+
+	if _, err := parser.ParseFile(token.NewFileSet(), "client_gen.go", source.Bytes(), 0); err != nil {
+		t.Fatalf("TestGenerate: invalid code: %s\n%s", err.Error(), source.String())
+	}
+
+	for _, expected := range []string{
+		"package api",
+		"func (c *Client) Ping(ctx context.Context, opts ...client.CallOption) (*unixsock.Response, error)",
+		"func (c *Client) UnitStatus(ctx context.Context, req *UnitStatusRequest, opts ...client.CallOption) (*UnitStatusReply, error)",
+		"MaxAge *time.Duration",
+		"Since time.Time `json:\"since\"`",
+		`c.c.Call(ctx, "unit.status", args, opts...)`,
+	} {
+		if !strings.Contains(source.String(), expected) {
+			t.Errorf("TestGenerate: expected '%s' in the generated code:\n%s", expected, source.String())
+		}
+	}
+
+	// Invalid schemas
+	if err := Generate(&bytes.Buffer{}, "api", map[string]server.Schema{"x": {Required: []string{"a"}, Types: map[string]string{"a": "complex"}}}); err == nil {
+		t.Errorf("TestGenerate: expected an unknown type to be rejected")
+	}
+	if err := Generate(&bytes.Buffer{}, "api", map[string]server.Schema{"unit.status": {}, "unit_status": {}}); err == nil {
+		t.Errorf("TestGenerate: expected clashing method names to be rejected")
+	}
+
+}
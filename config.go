@@ -0,0 +1,70 @@
+package unixsock
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaxMessageLength is the largest message the framing can carry (the length
+// prefix is a uint32)
+const MaxMessageLength = 1<<32 - 1
+
+// Config gathers the message options (see MessageOption) in a struct, e.g.
+// decoded from a configuration file. Start from DefaultConfig, since zero
+// values disable the limits rather than falling back to the defaults.
+type Config struct {
+	MaxLength int           `json:"max_length"` // Maximum size of a received message (0 for no limit)
+	Timeout   time.Duration `json:"timeout"`    // Time limit for sending or receiving a message (0 for no limit)
+}
+
+// DefaultConfig returns the default message settings
+func DefaultConfig() Config {
+	return Config{
+		MaxLength: 1 << 20,
+		Timeout:   5 * time.Second,
+	}
+}
+
+// Validate returns a *ConfigError listing the settings out of their range
+func (c Config) Validate() error {
+	e := &ConfigError{}
+	e.Check(c.MaxLength >= 0 && int64(c.MaxLength) <= MaxMessageLength, "max length must be between 0 and %d, got %d", int64(MaxMessageLength), c.MaxLength)
+	e.Check(c.Timeout >= 0, "timeout must not be negative, got %s", c.Timeout)
+	return e.Err()
+}
+
+// Options returns the message options applying the configuration
+func (c Config) Options() []MessageOption {
+	return []MessageOption{
+		WithMaxLength(c.MaxLength),
+		WithTimeout(c.Timeout),
+	}
+}
+
+// ConfigError lists every setting found out of its range while validating a
+// configuration, so that misconfigured clients and servers fail at
+// construction rather than misbehaving at runtime
+type ConfigError struct {
+	Problems []string
+}
+
+// Error implements the error interface
+func (e *ConfigError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// Check records a problem described by format unless ok
+func (e *ConfigError) Check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+	}
+}
+
+// Err returns the error if any problem has been recorded, nil otherwise
+func (e *ConfigError) Err() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,252 @@
+package unixsock
+
+import (
+	"bufio"
+	"compress/flate"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// Stream compression algorithms
+const (
+	CompressionFlate = "flate"
+)
+
+// Conn wraps a net.Conn with the state shared by all messages exchanged over
+// a single connection. On its first message a Conn detects which protocol
+// the peer speaks: the framed protocol (length:json) or the line protocol
+// (one JSON message per line), which makes it possible to talk to a live
+// server with tools like socat or nc -U:
+//
+//	$ socat - UNIX-CONNECT:/path/to/server.sock
+//	{"cmd": "_sys.health"}
+//
+// The two are told apart by the first byte: a JSON message starts with '{',
+// while the first byte of a frame length would require a message of almost
+// 2GB to be '{'.
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	mu          sync.Mutex
+	sniffed     bool
+	lineMode    bool
+	compressor  *flate.Writer
+	header      bool       // Outgoing frames carry the fixed header
+	crc         bool       // Outgoing frame headers carry a checksum
+	dump        *connDump  // Frames are dumped (see SetDump)
+	passFiles   bool       // Files are passed along with outgoing messages (see PassFiles)
+	acceptFiles bool       // Files passed by the peer are received (see AcceptFiles)
+	files       []*os.File // Files received but not claimed by a message yet
+
+	writeMu laneLock   // Serializes whole messages written by concurrent senders
+	readMu  sync.Mutex // Serializes whole messages read by concurrent receivers
+	readBuf []byte     // Reused by the messages read (guarded by readMu)
+}
+
+// NewConn wraps conn. Reads from the returned Conn are buffered.
+func NewConn(conn net.Conn) *Conn {
+	if c, ok := conn.(*Conn); ok {
+		return c
+	}
+	return &Conn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// Read reads buffered data from the connection
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.bufReader().Read(p)
+	c.read(p[:n])
+	return n, err
+}
+
+// minReadBuffer is the initial size of the read buffer of a connection
+const minReadBuffer = 512
+
+// maxReadBuffer is the size up to which the read buffer of a connection is
+// reused. Larger messages are streamed instead (see decoder.stream), so that
+// a single large message does not pin its memory for the lifetime of the
+// connection.
+const maxReadBuffer = 64 << 10
+
+// readBuffer returns a buffer of n bytes for reading a message. The buffer is
+// reused by all messages read over the connection and grows geometrically up
+// to maxReadBuffer, so that connections exchanging many messages do not
+// allocate (and collect) a buffer for every one of them. Larger buffers are
+// not kept. It is called with readMu held.
+func (c *Conn) readBuffer(n int) []byte {
+	if n <= cap(c.readBuf) {
+		return c.readBuf[:n]
+	}
+	if n > maxReadBuffer {
+		return make([]byte, n)
+	}
+
+	size := 2 * cap(c.readBuf)
+	if size < minReadBuffer {
+		size = minReadBuffer
+	}
+	if size > maxReadBuffer {
+		size = maxReadBuffer
+	}
+	if size < n {
+		size = n
+	}
+	c.readBuf = make([]byte, size)
+
+	return c.readBuf[:n]
+}
+
+// Peek returns the next n bytes without consuming them, e.g. in order to
+// detect a protocol spoken over the socket besides unixsock's
+func (c *Conn) Peek(n int) ([]byte, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	return c.bufReader().Peek(n)
+}
+
+// Buffered returns a copy of the data read from the connection but not
+// consumed yet, e.g. in order to hand the connection over to another process
+// along with its file descriptor
+func (c *Conn) Buffered() []byte {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	reader := c.bufReader()
+	buffered, _ := reader.Peek(reader.Buffered())
+	return append([]byte(nil), buffered...)
+}
+
+// bufReader returns the buffered reader of the connection, which is replaced
+// when compression is enabled
+func (c *Conn) bufReader() *bufio.Reader {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reader
+}
+
+// Write writes data to the connection, compressing it if stream compression
+// is enabled. Compressed data is flushed at the end of every write, so that
+// the peer can decode every message as soon as it arrives.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	compressor := c.compressor
+	c.mu.Unlock()
+
+	if compressor == nil {
+		return c.Conn.Write(p)
+	}
+
+	n, err := compressor.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, compressor.Flush()
+}
+
+// EnableCompression wraps the rest of the stream (in both directions) in the
+// given compression algorithm. Both sides must enable it at the same point
+// of the conversation, which is agreed on during the handshake.
+func (c *Conn) EnableCompression(algorithm string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.compressor != nil {
+		return fmt.Errorf("EnableCompression: compression already enabled")
+	}
+
+	switch algorithm {
+	case CompressionFlate:
+		compressor, err := flate.NewWriter(&fullWriter{conn: c.Conn}, flate.DefaultCompression)
+		if err != nil {
+			return fmt.Errorf("EnableCompression: %s", err.Error())
+		}
+		c.compressor = compressor
+		c.reader = bufio.NewReader(flate.NewReader(c.reader))
+	default:
+		return fmt.Errorf("EnableCompression: unsupported algorithm '%s'", algorithm)
+	}
+
+	return nil
+}
+
+// Compressed informs whether stream compression is enabled
+func (c *Conn) Compressed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.compressor != nil
+}
+
+// EnableFrameHeader makes outgoing frames carry the fixed header (see
+// FrameMagic), optionally along with a checksum of every message. The peer
+// must understand the header, which is agreed on during the handshake;
+// incoming frames are accepted in either format.
+func (c *Conn) EnableFrameHeader(crc bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header = true
+	c.crc = crc
+}
+
+// FrameHeader informs whether outgoing frames carry the fixed header
+func (c *Conn) FrameHeader() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.header
+}
+
+// frameFlags returns the header flags of an outgoing frame
+func (c *Conn) frameFlags(stream bool) byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	flags := byte(0)
+	if c.crc {
+		flags |= frameFlagCRC
+	}
+	if c.compressor != nil {
+		flags |= frameFlagCompressed
+	}
+	if stream {
+		flags |= frameFlagStream
+	}
+	return flags
+}
+
+// LineMode informs whether the peer speaks the line protocol
+func (c *Conn) LineMode() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lineMode
+}
+
+// sniff detects the protocol on the first message and reports whether the
+// connection is in line mode. It is called with readMu held; mu is not held
+// while waiting for the first byte, so that concurrent senders are not
+// blocked.
+func (c *Conn) sniff() (bool, error) {
+	c.mu.Lock()
+	sniffed, lineMode, reader := c.sniffed, c.lineMode, c.reader
+	c.mu.Unlock()
+
+	if sniffed {
+		return lineMode, nil
+	}
+
+	first, err := reader.Peek(1)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sniffed = true
+	c.lineMode = first[0] == '{'
+
+	return c.lineMode, nil
+}
@@ -0,0 +1,218 @@
+package kvd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/vaitekunas/unixsock"
+	"github.com/vaitekunas/unixsock/client"
+	"github.com/vaitekunas/unixsock/server"
+	context "golang.org/x/net/context"
+)
+
+// Errors reported by the client for the corresponding error codes
+var (
+	ErrNotFound = errors.New("kvd: key not found")
+	ErrConflict = errors.New("kvd: version conflict")
+)
+
+// Change is a change of a watched key
+type Change struct {
+	Op string // OpSet or OpDelete
+	Entry
+}
+
+// Client reads, writes and watches the keys of a store
+type Client struct {
+	c      client.UnixSockClient
+	prefix string
+}
+
+// NewClient creates a client of the store reached via c, whose commands are
+// prefixed by prefix (e.g. "kv." if the store has been mounted under it, or
+// "" if it is served on its own)
+func NewClient(c client.UnixSockClient, prefix string) *Client {
+	return &Client{c: c, prefix: prefix}
+}
+
+// Get returns the entry of key. It fails with ErrNotFound if the key does not
+// exist.
+func (k *Client) Get(ctx context.Context, key string) (*Entry, error) {
+	entry := &Entry{}
+	if err := k.call(ctx, "get", unixsock.Args{"key": key}, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Set sets the value of key
+func (k *Client) Set(ctx context.Context, key, value string) (*Entry, error) {
+	entry := &Entry{}
+	if err := k.call(ctx, "set", unixsock.Args{"key": key, "value": value}, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// CompareAndSet sets the value of key if the key is still at version (0 if
+// it must not exist). It fails with ErrConflict otherwise.
+func (k *Client) CompareAndSet(ctx context.Context, key, value string, version uint64) (*Entry, error) {
+	entry := &Entry{}
+	if err := k.call(ctx, "set", unixsock.Args{"key": key, "value": value, "version": version}, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Delete deletes key. It fails with ErrNotFound if the key does not exist.
+func (k *Client) Delete(ctx context.Context, key string) error {
+	return k.call(ctx, "delete", unixsock.Args{"key": key}, nil)
+}
+
+// List returns the entries whose key starts with prefix, along with the
+// version of the store the listing corresponds to
+func (k *Client) List(ctx context.Context, prefix string) ([]Entry, uint64, error) {
+
+	buf := &bytes.Buffer{}
+	resp, err := k.c.SendTo(ctx, k.prefix+"list", unixsock.Args{"prefix": prefix}, buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := k.fail(resp); err != nil {
+		return nil, 0, err
+	}
+
+	version, err := strconv.ParseUint(resp.Trailer[VersionTrailer], 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("List: invalid version '%s' in the trailer", resp.Trailer[VersionTrailer])
+	}
+
+	entries := []Entry{}
+	dec := json.NewDecoder(buf)
+	for {
+		entry := Entry{}
+		if err := dec.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, fmt.Errorf("List: malformed entry: %s", err.Error())
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, version, nil
+}
+
+// Watch delivers the entries whose key starts with prefix as OpSet changes,
+// followed by all the changes of such keys, until ctx is done or the
+// connection is lost, at which point the channel is closed
+func (k *Client) Watch(ctx context.Context, prefix string) (<-chan Change, error) {
+
+	// Subscribe before listing, so that no change is missed in between
+	ctx, cancel := context.WithCancel(ctx)
+	events, err := k.c.Subscribe(ctx, EventChanged)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	entries, version, err := k.List(ctx, prefix)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	changes := make(chan Change)
+	go func() {
+		defer cancel()
+		defer close(changes)
+
+		deliver := func(change Change) bool {
+			select {
+			case changes <- change:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for _, entry := range entries {
+			if !deliver(Change{Op: OpSet, Entry: entry}) {
+				return
+			}
+		}
+
+		for event := range events {
+			change, ok := parseChange(event.Args)
+
+			// Changes already reflected by the listing are skipped
+			if !ok || change.Version <= version || !strings.HasPrefix(change.Key, prefix) {
+				continue
+			}
+			if !deliver(change) {
+				return
+			}
+		}
+	}()
+
+	return changes, nil
+}
+
+// parseChange parses the arguments of an EventChanged event
+func parseChange(args unixsock.Args) (Change, bool) {
+	change := Change{}
+	change.Op, _ = args["op"].(string)
+	change.Key, _ = args["key"].(string)
+	change.Value, _ = args["value"].(string)
+
+	switch version := args["version"].(type) {
+	case uint64:
+		change.Version = version
+	case float64:
+		change.Version = uint64(version)
+	default:
+		return change, false
+	}
+
+	return change, change.Op != "" && change.Key != ""
+}
+
+// call sends a command of the store and decodes its result into v (if not
+// nil)
+func (k *Client) call(ctx context.Context, cmd string, args unixsock.Args, v interface{}) error {
+
+	resp, err := k.c.Call(ctx, k.prefix+cmd, args)
+	if err != nil {
+		return err
+	}
+	if err := k.fail(resp); err != nil {
+		return err
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return resp.PayloadJSON(v)
+}
+
+// fail maps a failed response to an error (nil if it succeeded)
+func (k *Client) fail(resp *unixsock.Response) error {
+	err := resp.Err()
+	if err == nil || resp == nil {
+		return err
+	}
+
+	switch resp.Meta[server.ErrorCodeMeta] {
+	case CodeNotFound:
+		return ErrNotFound
+	case CodeConflict:
+		return ErrConflict
+	default:
+		return err
+	}
+}
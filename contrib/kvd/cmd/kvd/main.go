@@ -0,0 +1,48 @@
+// Command kvd serves the key-value store (see package kvd) on a unix socket
+// until it is interrupted:
+//
+//	$ kvd -socket /run/kvd.sock -history 1000
+//	$ echo '{"cmd":"set","args":{"key":"mode","value":"maintenance"}}' | socat - UNIX-CONNECT:/run/kvd.sock
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/vaitekunas/unixsock/contrib/kvd"
+	"github.com/vaitekunas/unixsock/server"
+)
+
+func main() {
+
+	socket := flag.String("socket", "", "path of the socket to listen on")
+	history := flag.Int("history", 0, "changes kept for clients catching up after a reconnect")
+	flag.Parse()
+
+	if *socket == "" || flag.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s -socket path [-history n]\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	store := kvd.New()
+	srv, err := server.NewWithHandler(*socket, store.Router(), server.WithEventHistory(*history))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not start the server: %s\n", err.Error())
+		os.Exit(1)
+	}
+	store.Publish(srv)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case <-signals:
+		srv.Stop()
+	case <-srv.Done():
+		fmt.Fprintf(os.Stderr, "server failed: %s\n", srv.Err())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,255 @@
+// Package kvd is a small in-memory key-value store built on unixsock, serving
+// as a template for daemons built on the package. Listing keys uses the
+// streaming layer, watching them the pub/sub layer: every change is
+// broadcast as an EventChanged event, which clients watch by subscribing to
+// it (see Client.Watch).
+//
+// The store registers its commands on a router (see Store.Router), which can
+// be served on its own (see cmd/kvd) or mounted into the router of an
+// existing daemon:
+//
+//	store := kvd.New()
+//	router.Mount("kv.", store.Router())
+//	srv, err := server.NewWithHandler(path, router)
+//	store.Publish(srv)
+//
+// Commands (arguments in parentheses):
+//
+//	get    (key)                     returns an entry
+//	set    (key, value, [version])   sets a value, if its version still matches (0 if it must not exist)
+//	delete (key)                     deletes an entry
+//	list   ([prefix])                streams the entries (JSON lines) and the store version (trailer)
+package kvd
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vaitekunas/unixsock"
+	"github.com/vaitekunas/unixsock/server"
+	context "golang.org/x/net/context"
+)
+
+// EventChanged is the event broadcast for every change of the store, with
+// the arguments "op" (OpSet or OpDelete), "key", "value" and "version"
+const EventChanged = "kv.changed"
+
+// Operations of a change
+const (
+	OpSet    = "set"
+	OpDelete = "delete"
+)
+
+// Error codes of failed commands (see server.Error)
+const (
+	CodeNotFound = "not_found" // The key does not exist
+	CodeConflict = "conflict"  // The version of the key does not match
+	CodeInvalid  = "invalid"   // Invalid arguments
+)
+
+// VersionTrailer is the trailer key of the store version a listing
+// corresponds to
+const VersionTrailer = "version"
+
+// Entry is a single key along with its value and the version of the store
+// it was last changed in
+type Entry struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Version uint64 `json:"version"`
+}
+
+// Publisher broadcasts events, e.g. a server.UnixSockSrv
+type Publisher interface {
+	Broadcast(cmd string, args unixsock.Args) int
+}
+
+// Store is an in-memory key-value store. Every change increments the version
+// of the store.
+type Store struct {
+	mu        sync.RWMutex
+	entries   map[string]*Entry
+	version   uint64
+	publisher Publisher
+}
+
+// New creates a new empty store
+func New() *Store {
+	return &Store{entries: make(map[string]*Entry)}
+}
+
+// Publish broadcasts the changes of the store with publisher, typically the
+// server serving the store
+func (s *Store) Publish(publisher Publisher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.publisher = publisher
+}
+
+// Router returns a router serving the commands of the store
+func (s *Store) Router() *server.Router {
+	r := server.NewRouter()
+
+	r.RegisterHandler("get", server.TierReadOnly, server.ResultFunc(s.get))
+	r.RegisterHandler("set", server.TierMutating, server.ResultFunc(s.set))
+	r.RegisterHandler("delete", server.TierMutating, server.ResultFunc(s.delete))
+	r.RegisterHandler("list", server.TierReadOnly, server.ResultFunc(s.list))
+
+	r.Declare("get", server.Schema{Required: []string{"key"}, Strict: true})
+	r.Declare("set", server.Schema{Required: []string{"key", "value"}, Optional: []string{"version"}, Strict: true})
+	r.Declare("delete", server.Schema{Required: []string{"key"}, Strict: true})
+	r.Declare("list", server.Schema{Optional: []string{"prefix"}, Strict: true})
+
+	return r
+}
+
+// changed bumps the version of the store and broadcasts a change. The caller
+// has to hold s.mu. Broadcasting under the lock keeps the events in order.
+func (s *Store) changed(op string, entry *Entry) {
+	if s.publisher == nil {
+		return
+	}
+	s.publisher.Broadcast(EventChanged, unixsock.Args{
+		"op":      op,
+		"key":     entry.Key,
+		"value":   entry.Value,
+		"version": entry.Version,
+	})
+}
+
+// get returns the entry of a key
+func (s *Store) get(ctx context.Context, req *server.Request) (interface{}, error) {
+
+	key, err := keyArg(req.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, server.Errorf(CodeNotFound, "key '%s' not found", key)
+	}
+	found := *entry
+
+	return &found, nil
+}
+
+// set sets the value of a key, optionally only if its version matches
+func (s *Store) set(ctx context.Context, req *server.Request) (interface{}, error) {
+
+	key, err := keyArg(req.Args)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := req.Args["value"].(string)
+	if !ok {
+		return nil, server.Errorf(CodeInvalid, "argument 'value' must be a string")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := req.Args["version"]; ok {
+		expected, err := versionArg(req.Args)
+		if err != nil {
+			return nil, err
+		}
+		var current uint64
+		if entry, ok := s.entries[key]; ok {
+			current = entry.Version
+		}
+		if current != expected {
+			return nil, server.Errorf(CodeConflict, "key '%s' is at version %d (expected %d)", key, current, expected)
+		}
+	}
+
+	s.version++
+	entry := &Entry{Key: key, Value: value, Version: s.version}
+	s.entries[key] = entry
+	s.changed(OpSet, entry)
+	stored := *entry
+
+	return &stored, nil
+}
+
+// delete deletes a key
+func (s *Store) delete(ctx context.Context, req *server.Request) (interface{}, error) {
+
+	key, err := keyArg(req.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[key]; !ok {
+		return nil, server.Errorf(CodeNotFound, "key '%s' not found", key)
+	}
+	delete(s.entries, key)
+
+	s.version++
+	s.changed(OpDelete, &Entry{Key: key, Version: s.version})
+
+	return nil, nil
+}
+
+// list streams the entries whose key starts with prefix (sorted by key) as
+// JSON lines. The trailer carries the version of the store the listing
+// corresponds to.
+func (s *Store) list(ctx context.Context, req *server.Request) (interface{}, error) {
+
+	prefix, _ := req.Args["prefix"].(string)
+
+	s.mu.RLock()
+	entries := make([]Entry, 0, len(s.entries))
+	for key, entry := range s.entries {
+		if strings.HasPrefix(key, prefix) {
+			entries = append(entries, *entry)
+		}
+	}
+	version := s.version
+	s.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for i := range entries {
+		if err := enc.Encode(&entries[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return unixsock.NewResponse().OK().
+		WithStream(buf).
+		WithTrailer(VersionTrailer, strconv.FormatUint(version, 10)), nil
+}
+
+// keyArg returns the key argument
+func keyArg(args unixsock.Args) (string, error) {
+	key, _ := args["key"].(string)
+	if key == "" {
+		return "", server.Errorf(CodeInvalid, "argument 'key' must be a non-empty string")
+	}
+	return key, nil
+}
+
+// versionArg returns the version argument
+func versionArg(args unixsock.Args) (uint64, error) {
+	switch value := args["version"].(type) {
+	case uint64:
+		return value, nil
+	case float64: // Clients not using the uint64 type envelope
+		return uint64(value), nil
+	default:
+		return 0, server.Errorf(CodeInvalid, "argument 'version' must be a number, got %v", value)
+	}
+}
@@ -0,0 +1,98 @@
+package kvd
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/vaitekunas/unixsock/client"
+	"github.com/vaitekunas/unixsock/server"
+	context "golang.org/x/net/context"
+)
+
+func TestKVD(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_kvd.sock"
+	defer os.Remove(unixSockPath + ".lock")
+
+	store := New()
+	router := server.NewRouter()
+	router.Mount("kv.", store.Router())
+
+	srv, err := server.NewWithHandler(unixSockPath, router)
+	if err != nil {
+		t.Fatalf("TestKVD: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+	store.Publish(srv)
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestKVD: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	kv := NewClient(c, "kv.")
+
+	// Reading and writing
+	if _, err := kv.Get(ctx, "app/mode"); err != ErrNotFound {
+		t.Errorf("TestKVD: expected ErrNotFound, got %v", err)
+	}
+	created, err := kv.CompareAndSet(ctx, "app/mode", "normal", 0)
+	if err != nil {
+		t.Fatalf("TestKVD: could not create a key: %s", err.Error())
+	}
+	if _, err := kv.CompareAndSet(ctx, "app/mode", "normal", 0); err != ErrConflict {
+		t.Errorf("TestKVD: expected ErrConflict, got %v", err)
+	}
+	if _, err := kv.Set(ctx, "other/key", "x"); err != nil {
+		t.Fatalf("TestKVD: could not set a key: %s", err.Error())
+	}
+	if entry, err := kv.Get(ctx, "app/mode"); err != nil || entry.Value != "normal" || entry.Version != created.Version {
+		t.Errorf("TestKVD: expected the created entry, got %v (%v)", entry, err)
+	}
+
+	// Listing
+	entries, version, err := kv.List(ctx, "app/")
+	if err != nil || len(entries) != 1 || entries[0].Key != "app/mode" || version != 2 {
+		t.Errorf("TestKVD: expected a single entry at version 2, got %v at %d (%v)", entries, version, err)
+	}
+
+	// Watching
+	changes, err := kv.Watch(ctx, "app/")
+	if err != nil {
+		t.Fatalf("TestKVD: could not watch: %s", err.Error())
+	}
+	if _, err := kv.Set(ctx, "other/key", "y"); err != nil {
+		t.Fatalf("TestKVD: could not set a key: %s", err.Error())
+	}
+	if _, err := kv.CompareAndSet(ctx, "app/mode", "maintenance", created.Version); err != nil {
+		t.Fatalf("TestKVD: could not update a key: %s", err.Error())
+	}
+	if err := kv.Delete(ctx, "app/mode"); err != nil {
+		t.Fatalf("TestKVD: could not delete a key: %s", err.Error())
+	}
+
+	expected := []Change{
+		{OpSet, Entry{"app/mode", "normal", 1}},
+		{OpSet, Entry{"app/mode", "maintenance", 4}},
+		{OpDelete, Entry{"app/mode", "", 5}},
+	}
+	for i, want := range expected {
+		select {
+		case change, ok := <-changes:
+			if !ok || change != want {
+				t.Errorf("TestKVD: change %d: expected %v, got %v", i+1, want, change)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("TestKVD: change %d: timed out", i+1)
+		}
+	}
+
+	cancel()
+	for range changes {
+	}
+
+}
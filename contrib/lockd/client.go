@@ -0,0 +1,112 @@
+package lockd
+
+import (
+	"errors"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	"github.com/vaitekunas/unixsock/client"
+	"github.com/vaitekunas/unixsock/server"
+	context "golang.org/x/net/context"
+)
+
+// Errors reported by the client for the corresponding error codes
+var (
+	ErrHeld    = errors.New("lockd: lock held by someone else")
+	ErrNotHeld = errors.New("lockd: lease expired or released")
+)
+
+// waitMargin is the time a waiting call is given on top of its wait for the
+// exchange itself
+const waitMargin = 5 * time.Second
+
+// Client acquires and releases leases of a lock service
+type Client struct {
+	c      client.UnixSockClient
+	prefix string
+}
+
+// NewClient creates a client of the lock service reached via c, whose
+// commands are prefixed by prefix (e.g. "lock." if the service has been
+// mounted under it, or "" if it is served on its own)
+func NewClient(c client.UnixSockClient, prefix string) *Client {
+	return &Client{c: c, prefix: prefix}
+}
+
+// Acquire acquires the lock name for ttl, waiting for it for up to wait. It
+// fails with ErrHeld if the lock could not be acquired in time.
+func (l *Client) Acquire(ctx context.Context, name string, ttl, wait time.Duration) (*Lease, error) {
+
+	args := unixsock.Args{"name": name, "ttl": ttl.String()}
+	if wait > 0 {
+		args["wait"] = wait.String()
+	}
+
+	lease := &Lease{}
+	if err := l.call(ctx, "acquire", args, wait, lease); err != nil {
+		return nil, err
+	}
+
+	return lease, nil
+}
+
+// Renew extends lease by ttl from now. It fails with ErrNotHeld if the lease
+// has expired in the meantime.
+func (l *Client) Renew(ctx context.Context, lease *Lease, ttl time.Duration) error {
+	renewed := &Lease{}
+	if err := l.call(ctx, "renew", unixsock.Args{"name": lease.Name, "token": lease.Token, "ttl": ttl.String()}, 0, renewed); err != nil {
+		return err
+	}
+	lease.Expires = renewed.Expires
+	return nil
+}
+
+// Release releases lease. It fails with ErrNotHeld if the lease has expired
+// in the meantime.
+func (l *Client) Release(ctx context.Context, lease *Lease) error {
+	return l.call(ctx, "release", unixsock.Args{"name": lease.Name, "token": lease.Token}, 0, nil)
+}
+
+// Status returns the held leases
+func (l *Client) Status(ctx context.Context) ([]Lease, error) {
+	var leases []Lease
+	if err := l.call(ctx, "status", unixsock.Args{}, 0, &leases); err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// call sends a command of the service and decodes its result into v (if
+// not nil). The call may take wait longer than the client's timeout.
+func (l *Client) call(ctx context.Context, cmd string, args unixsock.Args, wait time.Duration, v interface{}) error {
+
+	var opts []client.CallOption
+	if wait > 0 {
+		opts = append(opts, client.WithCallTimeout(wait+waitMargin))
+	}
+
+	resp, err := l.c.Call(ctx, l.prefix+cmd, args, opts...)
+	if err != nil {
+		return err
+	}
+
+	if err := resp.Err(); err != nil {
+		if resp == nil {
+			return err
+		}
+		switch resp.Meta[server.ErrorCodeMeta] {
+		case CodeHeld:
+			return ErrHeld
+		case CodeNotHeld:
+			return ErrNotHeld
+		default:
+			return err
+		}
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return resp.PayloadJSON(v)
+}
@@ -0,0 +1,60 @@
+// Command lockd serves the lock service (see package lockd) on a unix socket
+// until it is interrupted:
+//
+//	$ lockd -socket /run/lockd.sock -mode 0666
+//	$ echo '{"cmd":"acquire","args":{"name":"backup","ttl":"10m"}}' | socat - UNIX-CONNECT:/run/lockd.sock
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/vaitekunas/unixsock/contrib/lockd"
+	"github.com/vaitekunas/unixsock/server"
+)
+
+func main() {
+
+	socket := flag.String("socket", "", "path of the socket to listen on")
+	mode := flag.String("mode", "", "permissions of the socket (e.g. 0666)")
+	concurrency := flag.Int("concurrency", 64, "commands executed concurrently per connection (waiting acquires included)")
+	flag.Parse()
+
+	if *socket == "" || flag.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s -socket path [-mode perm] [-concurrency n]\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	var perm uint64
+	if *mode != "" {
+		var err error
+		if perm, err = strconv.ParseUint(*mode, 8, 32); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid permissions '%s': %s\n", *mode, err.Error())
+			os.Exit(2)
+		}
+	}
+
+	srv, err := server.NewWithHandler(*socket, lockd.New().Router(),
+		server.WithConcurrentPerConn(*concurrency),
+		server.WithSocketMode(os.FileMode(perm)),
+	)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not start the server: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case <-signals:
+		srv.Stop()
+	case <-srv.Done():
+		fmt.Fprintf(os.Stderr, "server failed: %s\n", srv.Err())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,314 @@
+// Package lockd is a small lock service built on unixsock, coordinating
+// sibling processes on one host (e.g. cron jobs that must not overlap). Locks
+// are leases: they expire unless renewed, so that a crashed holder does not
+// keep a lock forever. Every lease carries a fencing token, which increases
+// with every grant.
+//
+// The service registers its commands on a router (see Service.Router), which
+// can be served on its own (see cmd/lockd) or mounted into the router of an
+// existing daemon:
+//
+//	router.Mount("lock.", lockd.New().Router())
+//
+// Commands (arguments in parentheses, durations like "30s"):
+//
+//	acquire (name, [owner], [ttl], [wait])  grants a lease, waiting for it up to wait
+//	renew   (name, token, [ttl])            extends a lease
+//	release (name, token)                   releases a lease
+//	status  ([name])                        lists the held leases
+package lockd
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	"github.com/vaitekunas/unixsock/server"
+	context "golang.org/x/net/context"
+)
+
+// Error codes of failed commands (see server.Error)
+const (
+	CodeHeld    = "held"     // The lock is held by someone else
+	CodeNotHeld = "not_held" // The lease has expired or has been released
+	CodeInvalid = "invalid"  // Invalid arguments
+)
+
+// DefaultTTL is the lifetime of leases acquired without a ttl
+const DefaultTTL = 30 * time.Second
+
+// Lease is a lock held until it is released or expires
+type Lease struct {
+	Name    string    `json:"name"`
+	Owner   string    `json:"owner"`
+	Token   uint64    `json:"token"` // Fencing token, increasing with every grant
+	Expires time.Time `json:"expires"`
+}
+
+// Service grants and tracks leases
+type Service struct {
+	mu      sync.Mutex
+	leases  map[string]*Lease
+	token   uint64
+	changed chan struct{} // Closed (and replaced) whenever a lock is released
+}
+
+// New creates a new lock service without any lease
+func New() *Service {
+	return &Service{
+		leases:  make(map[string]*Lease),
+		changed: make(chan struct{}),
+	}
+}
+
+// Router returns a router serving the commands of the service. Acquiring
+// with wait blocks the connection, unless the server executes several
+// commands per connection (see server.WithConcurrentPerConn).
+func (s *Service) Router() *server.Router {
+	r := server.NewRouter()
+
+	r.RegisterHandler("acquire", server.TierMutating, server.ResultFunc(s.acquire))
+	r.RegisterHandler("renew", server.TierMutating, server.ResultFunc(s.renew))
+	r.RegisterHandler("release", server.TierMutating, server.ResultFunc(s.release))
+	r.RegisterHandler("status", server.TierReadOnly, server.ResultFunc(s.status))
+
+	r.Declare("acquire", server.Schema{Required: []string{"name"}, Optional: []string{"owner", "ttl", "wait"}, Strict: true})
+	r.Declare("renew", server.Schema{Required: []string{"name", "token"}, Optional: []string{"ttl"}, Strict: true})
+	r.Declare("release", server.Schema{Required: []string{"name", "token"}, Strict: true})
+	r.Declare("status", server.Schema{Optional: []string{"name"}, Strict: true})
+
+	return r
+}
+
+// held returns the unexpired lease of a lock (nil if it is free). The caller
+// has to hold s.mu.
+func (s *Service) held(name string) *Lease {
+	lease, ok := s.leases[name]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(lease.Expires) {
+		delete(s.leases, name)
+		return nil
+	}
+	return lease
+}
+
+// notify wakes up the callers waiting for a lock. The caller has to hold
+// s.mu.
+func (s *Service) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// acquire grants a lease, waiting for the lock to be released (or to expire)
+// for up to wait
+func (s *Service) acquire(ctx context.Context, req *server.Request) (interface{}, error) {
+
+	name, err := stringArg(req.Args, "name")
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := ttlArg(req.Args)
+	if err != nil {
+		return nil, err
+	}
+	wait, err := durationArg(req.Args, "wait", 0)
+	if err != nil {
+		return nil, err
+	}
+	owner, _ := req.Args["owner"].(string)
+	if owner == "" {
+		owner = req.Peer.String()
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		s.mu.Lock()
+		current := s.held(name)
+		if current == nil {
+			s.token++
+			lease := &Lease{Name: name, Owner: owner, Token: s.token, Expires: time.Now().Add(ttl)}
+			s.leases[name] = lease
+			granted := *lease
+			s.mu.Unlock()
+			return &granted, nil
+		}
+		changed, holder, expires := s.changed, current.Owner, current.Expires
+		s.mu.Unlock()
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, server.Errorf(CodeHeld, "lock '%s' held by %s until %s", name, holder, expires.Format(time.RFC3339))
+		}
+		if untilExpiry := time.Until(expires); untilExpiry < remaining {
+			remaining = untilExpiry
+		}
+
+		timer := time.NewTimer(remaining)
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+// renew extends a lease by ttl from now
+func (s *Service) renew(ctx context.Context, req *server.Request) (interface{}, error) {
+
+	name, err := stringArg(req.Args, "name")
+	if err != nil {
+		return nil, err
+	}
+	token, err := tokenArg(req.Args)
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := ttlArg(req.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lease := s.held(name)
+	if lease == nil || lease.Token != token {
+		return nil, server.Errorf(CodeNotHeld, "lease %d of lock '%s' not held", token, name)
+	}
+	lease.Expires = time.Now().Add(ttl)
+	renewed := *lease
+
+	return &renewed, nil
+}
+
+// release releases a lease, waking up the callers waiting for the lock
+func (s *Service) release(ctx context.Context, req *server.Request) (interface{}, error) {
+
+	name, err := stringArg(req.Args, "name")
+	if err != nil {
+		return nil, err
+	}
+	token, err := tokenArg(req.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lease := s.held(name)
+	if lease == nil || lease.Token != token {
+		return nil, server.Errorf(CodeNotHeld, "lease %d of lock '%s' not held", token, name)
+	}
+	delete(s.leases, name)
+	s.notify()
+
+	return nil, nil
+}
+
+// status lists the held leases (sorted by name), or the lease of a single
+// lock
+func (s *Service) status(ctx context.Context, req *server.Request) (interface{}, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := req.Args["name"]; ok {
+		name, err := stringArg(req.Args, "name")
+		if err != nil {
+			return nil, err
+		}
+		leases := []Lease{}
+		if lease := s.held(name); lease != nil {
+			leases = append(leases, *lease)
+		}
+		return leases, nil
+	}
+
+	leases := make([]Lease, 0, len(s.leases))
+	for name := range s.leases {
+		if lease := s.held(name); lease != nil {
+			leases = append(leases, *lease)
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Name < leases[j].Name })
+
+	return leases, nil
+}
+
+// stringArg returns a non-empty string argument
+func stringArg(args unixsock.Args, key string) (string, error) {
+	value, _ := args[key].(string)
+	if value == "" {
+		return "", server.Errorf(CodeInvalid, "argument '%s' must be a non-empty string", key)
+	}
+	return value, nil
+}
+
+// durationArg returns a duration argument (e.g. "30s"), or def if it is
+// missing
+func durationArg(args unixsock.Args, key string, def time.Duration) (time.Duration, error) {
+	raw, ok := args[key]
+	if !ok {
+		return def, nil
+	}
+
+	value, _ := raw.(string)
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, server.Errorf(CodeInvalid, "argument '%s' must be a duration like \"30s\", got %v", key, raw)
+	}
+
+	return d, nil
+}
+
+// ttlArg returns the lease duration argument "ttl" (DefaultTTL if missing),
+// which must be positive: a lease expiring right away would fence nothing
+func ttlArg(args unixsock.Args) (time.Duration, error) {
+	ttl, err := durationArg(args, "ttl", DefaultTTL)
+	if err == nil && ttl <= 0 {
+		return 0, server.Errorf(CodeInvalid, "argument 'ttl' must be a positive duration, got %v", args["ttl"])
+	}
+	return ttl, err
+}
+
+// tokenArg returns the fencing token argument, passed as any integer kind
+// (e.g. by in-process callers or as plain numbers, see unixsock.Args)
+func tokenArg(args unixsock.Args) (uint64, error) {
+	var token int64
+	switch value := args["token"].(type) {
+	case uint64:
+		return value, nil
+	case uint:
+		return uint64(value), nil
+	case uint32:
+		return uint64(value), nil
+	case int:
+		token = int64(value)
+	case int64:
+		token = value
+	case int32:
+		token = int64(value)
+	case float64: // Clients not using the uint64 type envelope
+		token = int64(value)
+	default:
+		return 0, server.Errorf(CodeInvalid, "argument 'token' must be a number, got %v", value)
+	}
+
+	if token < 0 {
+		return 0, server.Errorf(CodeInvalid, "argument 'token' must not be negative, got %d", token)
+	}
+	return uint64(token), nil
+}
+
+// String describes the lease
+func (l *Lease) String() string {
+	return fmt.Sprintf("%s (token %d, held by %s until %s)", l.Name, l.Token, l.Owner, l.Expires.Format(time.RFC3339))
+}
@@ -0,0 +1,122 @@
+package lockd
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	"github.com/vaitekunas/unixsock/client"
+	"github.com/vaitekunas/unixsock/server"
+	context "golang.org/x/net/context"
+)
+
+func TestLockd(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_lockd.sock"
+	defer os.Remove(unixSockPath + ".lock")
+
+	router := server.NewRouter()
+	router.Mount("lock.", New().Router())
+
+	srv, err := server.NewWithHandler(unixSockPath, router, server.WithConcurrentPerConn(8))
+	if err != nil {
+		t.Fatalf("TestLockd: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestLockd: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	ctx := context.Background()
+	locks := NewClient(c, "lock.")
+
+	first, err := locks.Acquire(ctx, "backup", time.Minute, 0)
+	if err != nil {
+		t.Fatalf("TestLockd: could not acquire: %s", err.Error())
+	}
+	if _, err := locks.Acquire(ctx, "backup", time.Minute, 0); err != ErrHeld {
+		t.Errorf("TestLockd: expected ErrHeld, got %v", err)
+	}
+
+	// Waiting for a release
+	released := make(chan error, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		released <- locks.Release(ctx, first)
+	}()
+	second, err := locks.Acquire(ctx, "backup", 100*time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatalf("TestLockd: could not acquire after the release: %s", err.Error())
+	}
+	if err := <-released; err != nil {
+		t.Errorf("TestLockd: could not release: %s", err.Error())
+	}
+	if second.Token <= first.Token {
+		t.Errorf("TestLockd: expected an increasing fencing token, got %d after %d", second.Token, first.Token)
+	}
+	if err := locks.Release(ctx, first); err != ErrNotHeld {
+		t.Errorf("TestLockd: expected ErrNotHeld for a released lease, got %v", err)
+	}
+
+	// Renewing
+	if err := locks.Renew(ctx, second, 200*time.Millisecond); err != nil {
+		t.Errorf("TestLockd: could not renew: %s", err.Error())
+	}
+	leases, err := locks.Status(ctx)
+	if err != nil || len(leases) != 1 || leases[0].Token != second.Token {
+		t.Errorf("TestLockd: expected the renewed lease, got %v (%v)", leases, err)
+	}
+
+	// Waiting for the expiry
+	third, err := locks.Acquire(ctx, "backup", time.Minute, time.Second)
+	if err != nil {
+		t.Fatalf("TestLockd: could not acquire after the expiry: %s", err.Error())
+	}
+	if err := locks.Renew(ctx, second, time.Minute); err != ErrNotHeld {
+		t.Errorf("TestLockd: expected ErrNotHeld for an expired lease, got %v", err)
+	}
+	if err := locks.Release(ctx, third); err != nil {
+		t.Errorf("TestLockd: could not release: %s", err.Error())
+	}
+
+	// Invalid arguments
+	resp, err := c.Send("lock.acquire", unixsock.Args{"name": "backup", "ttl": "soon"}, true, false)
+	if err != nil || resp.Meta[server.ErrorCodeMeta] != CodeInvalid {
+		t.Errorf("TestLockd: expected the invalid ttl to be rejected, got %v (%v)", resp, err)
+	}
+	resp, err = c.Send("lock.acquire", unixsock.Args{"name": "backup", "ttl": "0s"}, true, false)
+	if err != nil || resp.Meta[server.ErrorCodeMeta] != CodeInvalid {
+		t.Errorf("TestLockd: expected a zero ttl to be rejected, got %v (%v)", resp, err)
+	}
+
+}
+
+func TestTokenArg(t *testing.T) {
+
+	tests := []struct {
+		token interface{}
+		valid bool
+	}{
+		{uint64(42), true},
+		{uint(42), true},
+		{int(42), true},
+		{int64(42), true},
+		{int32(42), true},
+		{float64(42), true},
+		{int(-1), false},
+		{"42", false},
+		{nil, false},
+	}
+
+	for i, test := range tests {
+		token, err := tokenArg(unixsock.Args{"token": test.token})
+		if (err == nil) != test.valid || (test.valid && token != 42) {
+			t.Errorf("TestTokenArg: test %d failed: got %d (%v) for %T", i+1, token, err, test.token)
+		}
+	}
+
+}
@@ -0,0 +1,126 @@
+package unixsock
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Directions of dumped frames
+const (
+	dumpIn  = "<<<"
+	dumpOut = ">>>"
+)
+
+// Dumper writes hex dumps of the frames exchanged over connections (see
+// Conn.SetDump) to a writer, e.g. in order to debug the protocol without
+// external tooling. Dumps of concurrent connections do not interleave.
+type Dumper struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewDumper creates a dumper writing to w
+func NewDumper(w io.Writer) *Dumper {
+	return &Dumper{w: w}
+}
+
+// dump writes a single frame sent or received over the connection labelled
+// label, elapsed after the previous frame of the connection
+func (d *Dumper) dump(label, direction string, frame []byte, at time.Time, elapsed time.Duration) {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s %s %d bytes at %s (+%s)\n", direction, label, len(frame), at.Format("15:04:05.000000"), elapsed)
+	buf.WriteString(hex.Dump(frame))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.w.Write(buf.Bytes())
+}
+
+// connDump is the dump state of a single connection
+type connDump struct {
+	dumper *Dumper
+	label  string
+
+	mu      sync.Mutex
+	last    time.Time     // Time of the previous frame
+	reading *bytes.Buffer // Bytes of the frame being read (nil if none)
+}
+
+// frame dumps a frame sent (out) or received over the connection
+func (cd *connDump) frame(direction string, frame []byte) {
+	now := time.Now()
+
+	cd.mu.Lock()
+	var elapsed time.Duration
+	if !cd.last.IsZero() {
+		elapsed = now.Sub(cd.last)
+	}
+	cd.last = now
+	cd.mu.Unlock()
+
+	cd.dumper.dump(cd.label, direction, frame, now, elapsed)
+}
+
+// SetDump dumps every frame subsequently sent or received over the
+// connection to dumper (nil stops dumping), labelled with label (e.g. the
+// peer of the connection). Frames are dumped before compression, along with
+// their direction ("<<<" received, ">>>" sent), length and the time elapsed
+// since the previous frame.
+func (c *Conn) SetDump(dumper *Dumper, label string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if dumper == nil {
+		c.dump = nil
+		return
+	}
+	c.dump = &connDump{dumper: dumper, label: label}
+}
+
+// dumpState returns the dump state of the connection (nil if not dumped)
+func (c *Conn) dumpState() *connDump {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dump
+}
+
+// dumpSent dumps a frame written to the connection (made of parts)
+func (c *Conn) dumpSent(parts ...[]byte) {
+	cd := c.dumpState()
+	if cd == nil {
+		return
+	}
+	cd.frame(dumpOut, bytes.Join(parts, nil))
+}
+
+// startReading starts collecting the bytes of a frame read from the
+// connection. It is called with readMu held.
+func (c *Conn) startReading() {
+	if cd := c.dumpState(); cd != nil {
+		cd.reading = &bytes.Buffer{}
+	}
+}
+
+// dumpRead dumps the frame read since startReading (if any). It is called
+// with readMu held.
+func (c *Conn) dumpRead() {
+	cd := c.dumpState()
+	if cd == nil || cd.reading == nil {
+		return
+	}
+	if cd.reading.Len() > 0 {
+		cd.frame(dumpIn, cd.reading.Bytes())
+	}
+	cd.reading = nil
+}
+
+// read records bytes read as a part of the current frame (if dumped)
+func (c *Conn) read(p []byte) {
+	if cd := c.dumpState(); cd != nil && cd.reading != nil {
+		cd.reading.Write(p)
+	}
+}
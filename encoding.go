@@ -0,0 +1,66 @@
+package unixsock
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+)
+
+// EncodePayload compresses the payload of the response with algorithm (see
+// CompressionFlate). The compressed payload is base64 encoded and the
+// algorithm is recorded in the Encoding of the response, so that the
+// receiver can restore the payload via DecodePayload.
+func (r *Response) EncodePayload(algorithm string) error {
+
+	if r.Encoding != "" {
+		return fmt.Errorf("EncodePayload: payload already encoded")
+	}
+
+	switch algorithm {
+	case CompressionFlate:
+		buf := &bytes.Buffer{}
+		w, err := flate.NewWriter(buf, flate.DefaultCompression)
+		if err != nil {
+			return fmt.Errorf("EncodePayload: %s", err.Error())
+		}
+		w.Write([]byte(r.Payload))
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("EncodePayload: %s", err.Error())
+		}
+		r.Payload = base64.StdEncoding.EncodeToString(buf.Bytes())
+	default:
+		return fmt.Errorf("EncodePayload: unsupported algorithm '%s'", algorithm)
+	}
+
+	r.Encoding = algorithm
+
+	return nil
+}
+
+// DecodePayload restores a payload encoded by EncodePayload. Payloads that are
+// not encoded are left untouched.
+func (r *Response) DecodePayload() error {
+
+	switch r.Encoding {
+	case "":
+		return nil
+	case CompressionFlate:
+		compressed, err := base64.StdEncoding.DecodeString(r.Payload)
+		if err != nil {
+			return fmt.Errorf("DecodePayload: %s", err.Error())
+		}
+		payload, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+		if err != nil {
+			return fmt.Errorf("DecodePayload: %s", err.Error())
+		}
+		r.Payload = string(payload)
+	default:
+		return fmt.Errorf("DecodePayload: unsupported encoding '%s'", r.Encoding)
+	}
+
+	r.Encoding = ""
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package unixsock
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// Kinds of receive failures (see ReceiveError)
+var (
+	ErrClosed    = errors.New("connection closed") // Peer closed the connection between messages
+	ErrTimeout   = errors.New("timed out")         // Read deadline exceeded
+	ErrTruncated = errors.New("truncated message") // Connection closed in the middle of a message
+	ErrTooLong   = errors.New("message too long")  // Message exceeds the maximum length
+	ErrMalformed = errors.New("malformed message") // Message could not be decoded
+	ErrIO        = errors.New("failed reading")    // Other I/O failures
+)
+
+// ReceiveError is returned by Communicator.Receive. Its Kind tells apart a
+// peer that closed the connection cleanly from timeouts, truncated or
+// malformed messages:
+//
+//	if err, ok := err.(*unixsock.ReceiveError); ok && err.Kind == unixsock.ErrClosed {
+//	  // Normal closure
+//	}
+//
+// After ErrMalformed the connection is still usable, since the malformed
+// message has been read completely.
+type ReceiveError struct {
+	Kind error  // One of ErrClosed, ErrTimeout, ErrTruncated, ErrTooLong, ErrMalformed or ErrIO
+	Msg  string // Description of the failure
+	Err  error  // Underlying error (if any)
+}
+
+// Error implements the error interface
+func (e *ReceiveError) Error() string {
+	if e.Err == nil {
+		return "Receive: " + e.Msg
+	}
+	return "Receive: " + e.Msg + ": " + e.Err.Error()
+}
+
+// Timeout informs whether the read deadline has been exceeded
+func (e *ReceiveError) Timeout() bool {
+	return e.Kind == ErrTimeout
+}
+
+// Unwrap returns the kind of the failure, so that it can be checked with
+// errors.Is
+func (e *ReceiveError) Unwrap() error {
+	return e.Kind
+}
+
+// readError classifies a failed read. started informs whether a part of the
+// message has been read already.
+func readError(msg string, err error, started bool) *ReceiveError {
+
+	kind := ErrIO
+	switch {
+	case isTimeout(err):
+		kind = ErrTimeout
+	case err == io.EOF && !started:
+		kind = ErrClosed
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		kind = ErrTruncated
+	}
+
+	return &ReceiveError{
+		Kind: kind,
+		Msg:  msg,
+		Err:  err,
+	}
+}
+
+// isTimeout informs whether err is a timeout
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,49 @@
+package unixsock_test
+
+import (
+	"net"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// Messages used to be configured after construction via Options, which also
+// repeated the respond and close flags:
+//
+//	msg := unixsock.NewSender(conn, "stats", args, true, false)
+//	msg.Options(4<<20, 30*time.Second, true, false)
+//
+// The limits are now passed to the constructor. Options keeps working, so
+// callers can migrate one call site at a time.
+func ExampleNewSender_migration() {
+	conn, err := net.Dial("unix", "/run/app.sock")
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	msg := unixsock.NewSender(conn, "stats", unixsock.Args{}, true, false,
+		unixsock.WithMaxLength(4<<20),
+		unixsock.WithTimeout(30*time.Second),
+	)
+	if err := msg.Send(); err != nil {
+		return
+	}
+}
+
+// Receivers take the same options, e.g. to wait for a message indefinitely:
+//
+//	msg := unixsock.NewReceiver(conn)
+//	msg.Options(1<<20, 0, false, false)
+func ExampleNewReceiver_migration() {
+	conn, err := net.Dial("unix", "/run/app.sock")
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	msg := unixsock.NewReceiver(unixsock.NewConn(conn), unixsock.WithTimeout(0))
+	if err := msg.Receive(); err != nil {
+		return
+	}
+}
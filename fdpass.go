@@ -0,0 +1,134 @@
+package unixsock
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+// maxPassedFiles is the number of descriptors accepted along with a single
+// read from the connection
+const maxPassedFiles = 16
+
+// msgConn is implemented by connections passing control messages along
+// with their data, e.g. *net.UnixConn. Connections wrapping a unix socket
+// can implement it in order to pass files.
+type msgConn interface {
+	ReadMsgUnix(b, oob []byte) (n, oobn, flags int, addr *net.UnixAddr, err error)
+	WriteMsgUnix(b, oob []byte, addr *net.UnixAddr) (n, oobn int, err error)
+}
+
+// passingConn returns the connection passing the files of c
+func (c *Conn) passingConn() (msgConn, error) {
+	mc, ok := c.Conn.(msgConn)
+	if !ok {
+		return nil, fmt.Errorf("not a unix socket connection (%T)", c.Conn)
+	}
+	if !filePassingSupported {
+		return nil, fmt.Errorf("not supported on this platform")
+	}
+	return mc, nil
+}
+
+// PassFiles allows passing open files along with outgoing messages (see
+// Communicator.SetFile), i.e. as SCM_RIGHTS control messages, so that large
+// payloads can be handed over without copying them through the socket. The
+// peer must accept them (see AcceptFiles), which is agreed on during the
+// handshake. It fails for connections other than unix sockets, compressed
+// connections and on platforms that cannot pass descriptors.
+func (c *Conn) PassFiles() error {
+	if _, err := c.passingConn(); err != nil {
+		return fmt.Errorf("PassFiles: %s", err.Error())
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.compressor != nil {
+		return fmt.Errorf("PassFiles: files can not be passed over a compressed connection")
+	}
+	c.passFiles = true
+
+	return nil
+}
+
+// FilePassing informs whether files may be passed along with outgoing
+// messages (see PassFiles)
+func (c *Conn) FilePassing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.passFiles
+}
+
+// AcceptFiles makes the connection receive the files passed by the peer
+// along with its messages (see PassFiles). It fails for connections other
+// than unix sockets, compressed connections and on platforms that cannot
+// pass descriptors.
+func (c *Conn) AcceptFiles() error {
+
+	mc, err := c.passingConn()
+	if err != nil {
+		return fmt.Errorf("AcceptFiles: %s", err.Error())
+	}
+
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.compressor != nil {
+		return fmt.Errorf("AcceptFiles: files can not be passed over a compressed connection")
+	}
+	if c.acceptFiles {
+		return nil
+	}
+
+	// Data read ahead is consumed before any further read, which receives
+	// the passed descriptors
+	buffered, _ := c.reader.Peek(c.reader.Buffered())
+	rest := append([]byte(nil), buffered...)
+	c.reader = bufio.NewReader(io.MultiReader(bytes.NewReader(rest), newRightsReader(mc, c)))
+	c.acceptFiles = true
+
+	return nil
+}
+
+// pushFile queues a file received over the connection
+func (c *Conn) pushFile(f *os.File) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files = append(c.files, f)
+}
+
+// nextFile returns the oldest file received but not claimed by a message
+// (nil if none)
+func (c *Conn) nextFile() *os.File {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.files) == 0 {
+		return nil
+	}
+	f := c.files[0]
+	c.files = c.files[1:]
+
+	return f
+}
+
+// Close closes the connection along with the files received but not claimed
+// by any message
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	files := c.files
+	c.files = nil
+	c.mu.Unlock()
+
+	for _, f := range files {
+		f.Close()
+	}
+
+	return c.Conn.Close()
+}
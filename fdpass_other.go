@@ -0,0 +1,25 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!dragonfly,!netbsd,!openbsd
+
+package unixsock
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// filePassingSupported informs whether descriptors can be passed on this
+// platform
+const filePassingSupported = false
+
+// newRightsReader is never used on platforms that cannot pass descriptors
+func newRightsReader(mc msgConn, c *Conn) io.Reader {
+	return c.Conn
+}
+
+// writeFile fails, since descriptors can not be passed on this platform
+func writeFile(c *Conn, buf []byte, f *os.File, deadline time.Time) (int, error) {
+	return 0, fmt.Errorf("writeFile: passing files is not supported on this platform")
+}
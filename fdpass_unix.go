@@ -0,0 +1,83 @@
+//go:build linux || darwin || freebsd || dragonfly || netbsd || openbsd
+// +build linux darwin freebsd dragonfly netbsd openbsd
+
+package unixsock
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// filePassingSupported informs whether descriptors can be passed on this
+// platform
+const filePassingSupported = true
+
+// rightsReader reads from a unix socket, queueing the descriptors passed
+// along with the data on the connection
+type rightsReader struct {
+	mc  msgConn
+	c   *Conn
+	oob []byte
+}
+
+// newRightsReader creates a reader of mc queueing passed descriptors on c
+func newRightsReader(mc msgConn, c *Conn) io.Reader {
+	return &rightsReader{
+		mc:  mc,
+		c:   c,
+		oob: make([]byte, syscall.CmsgSpace(4*maxPassedFiles)),
+	}
+}
+
+// Read reads data along with any passed descriptors
+func (r *rightsReader) Read(p []byte) (int, error) {
+	n, oobn, _, _, err := r.mc.ReadMsgUnix(p, r.oob)
+	if n < 0 {
+		n = 0
+	}
+	if oobn == 0 {
+		return n, err
+	}
+
+	msgs, errParse := syscall.ParseSocketControlMessage(r.oob[:oobn])
+	if errParse != nil {
+		return n, err
+	}
+	for i := range msgs {
+		fds, errRights := syscall.ParseUnixRights(&msgs[i])
+		if errRights != nil {
+			continue
+		}
+		for _, fd := range fds {
+			r.c.pushFile(os.NewFile(uintptr(fd), "unixsock-passed"))
+		}
+	}
+
+	return n, err
+}
+
+// writeFile writes buf to c, passing the descriptor of f along with its first
+// byte. Short writes are continued until deadline (see writeFull).
+func writeFile(c *Conn, buf []byte, f *os.File, deadline time.Time) (int, error) {
+
+	mc, err := c.passingConn()
+	if err != nil {
+		return 0, err
+	}
+
+	n, _, err := mc.WriteMsgUnix(buf, syscall.UnixRights(int(f.Fd())), nil)
+	if n < 0 {
+		n = 0
+	}
+	if err != nil {
+		return n, err
+	}
+	if n < len(buf) {
+		rest, err := writeFull(c.Conn, buf[n:], deadline)
+		return n + rest, err
+	}
+
+	return n, nil
+}
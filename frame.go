@@ -0,0 +1,111 @@
+package unixsock
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// ReadFrame reads a single frame (in either format, see FrameMagic) from r
+// without decoding its message, e.g. in order to forward it to another
+// server. Frames whose message exceeds maxLength (if positive) are rejected.
+// Failures are reported as a *ReceiveError.
+func ReadFrame(r io.Reader, maxLength int) ([]byte, error) {
+
+	// Retrieve the length (or the start of the header)
+	start := make([]byte, 4)
+	if n, err := io.ReadFull(r, start); err != nil {
+		return nil, readError("reading the length of the message failed", err, n > 0)
+	}
+
+	// Rest of the header
+	header := start
+	if string(start[:2]) == FrameMagic {
+		size := 4
+		if start[3]&frameFlagCRC != 0 {
+			size += 4
+		}
+		header = append(header, make([]byte, size)...)
+	} else {
+		header = append(header, 0)
+	}
+	if n, err := io.ReadFull(r, header[4:]); err != nil {
+		return nil, readError(fmt.Sprintf("incorrect message length: %d (was expecting %d)", n, len(header)-4), err, true)
+	}
+
+	length, _, err := frameLength(header)
+	if err != nil {
+		return nil, err
+	}
+	if maxLength > 0 && length > uint32(maxLength) {
+		return nil, &ReceiveError{Kind: ErrTooLong, Msg: fmt.Sprintf("message too long: %d bytes (maximum is %d)", length, maxLength)}
+	}
+
+	frame := make([]byte, len(header)+int(length))
+	copy(frame, header)
+	if n, err := io.ReadFull(r, frame[len(header):]); err != nil {
+		return nil, readError(fmt.Sprintf("incorrect message length: %d (was expecting %d)", n, length), err, true)
+	}
+
+	return frame, nil
+}
+
+// FrameMessage returns the (JSON) message carried by a complete frame, e.g.
+// one read by ReadFrame, verifying its length and checksum (if any)
+func FrameMessage(frame []byte) ([]byte, error) {
+
+	if len(frame) < 4 {
+		return nil, &ReceiveError{Kind: ErrTruncated, Msg: "frame too short"}
+	}
+
+	size := 5
+	if string(frame[:2]) == FrameMagic {
+		size = 8
+		if frame[3]&frameFlagCRC != 0 {
+			size += 4
+		}
+	}
+	if len(frame) < size {
+		return nil, &ReceiveError{Kind: ErrTruncated, Msg: "frame too short"}
+	}
+
+	length, sum, err := frameLength(frame[:size])
+	if err != nil {
+		return nil, err
+	}
+
+	message := frame[size:]
+	if uint32(len(message)) != length {
+		return nil, &ReceiveError{Kind: ErrTruncated, Msg: fmt.Sprintf("incorrect message length: %d (was expecting %d)", len(message), length)}
+	}
+	if sum != nil && crc32.ChecksumIEEE(message) != *sum {
+		return nil, &ReceiveError{Kind: ErrMalformed, Msg: "checksum mismatch"}
+	}
+
+	return message, nil
+}
+
+// frameLength parses a complete frame header and returns the length of the
+// message along with its checksum (nil if the frame does not carry one)
+func frameLength(header []byte) (uint32, *uint32, error) {
+
+	if string(header[:2]) != FrameMagic {
+		return binary.BigEndian.Uint32(header), nil, nil
+	}
+
+	switch version, flags := header[2], header[3]; {
+	case version != FrameVersion:
+		return 0, nil, &ReceiveError{Kind: ErrMalformed, Msg: fmt.Sprintf("unsupported frame version %d", version)}
+	case flags&frameCodecMask != 0:
+		return 0, nil, &ReceiveError{Kind: ErrMalformed, Msg: fmt.Sprintf("unsupported codec %d", (flags&frameCodecMask)>>4)}
+	}
+
+	length := binary.BigEndian.Uint32(header[4:])
+	if header[3]&frameFlagCRC == 0 {
+		return length, nil, nil
+	}
+	sum := binary.BigEndian.Uint32(header[8:])
+
+	return length, &sum, nil
+}
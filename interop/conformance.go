@@ -0,0 +1,263 @@
+package interop
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// Implementation is an implementation of the wire protocol under test
+type Implementation interface {
+
+	// Encode returns the frame the implementation sends for v
+	Encode(v Vector) ([]byte, error)
+
+	// Decode returns the message contained in frame
+	Decode(frame []byte) (Vector, error)
+}
+
+// Result is the outcome of a single conformance check
+type Result struct {
+	Vector    string // Name of the vector
+	Direction string // "encode" or "decode"
+	Err       error  // nil if the implementation conforms
+}
+
+// RunConformance checks impl against vectors. Every vector is decoded and
+// compared to the expected message; vectors not marked DecodeOnly are also
+// encoded and compared byte-for-byte to the expected frame.
+func RunConformance(impl Implementation, vectors []Vector) []Result {
+
+	results := []Result{}
+	for _, v := range vectors {
+
+		expected, err := hex.DecodeString(v.Frame)
+		if err != nil {
+			results = append(results, Result{v.Name, "decode", fmt.Errorf("invalid vector frame: %s", err.Error())})
+			continue
+		}
+
+		// Decode
+		decoded, err := impl.Decode(expected)
+		if err == nil {
+			err = compareMessages(v, decoded)
+		}
+		results = append(results, Result{v.Name, "decode", err})
+
+		if v.DecodeOnly {
+			continue
+		}
+
+		// Encode
+		frame, err := impl.Encode(v)
+		if err == nil && !bytes.Equal(frame, expected) {
+			err = fmt.Errorf("frame mismatch:\nexpected:\n%sgot:\n%s", hex.Dump(expected), hex.Dump(frame))
+		}
+		results = append(results, Result{v.Name, "encode", err})
+	}
+
+	return results
+}
+
+// compareMessages compares the message parts (all but name and frame) of two
+// vectors
+func compareMessages(expected, got Vector) error {
+
+	strip := func(v Vector) ([]byte, error) {
+		v.Name, v.Frame, v.DecodeOnly = "", "", false
+		return json.Marshal(v)
+	}
+
+	e, err := strip(expected)
+	if err != nil {
+		return err
+	}
+	g, err := strip(got)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(e, g) {
+		return fmt.Errorf("message mismatch:\nexpected: %s\ngot:      %s", e, g)
+	}
+
+	return nil
+}
+
+// LoadGolden loads the golden vectors stored in dir. Every vector consists of
+// name.json (the decoded message) and name.hex (the frame as a hex dump).
+func LoadGolden(dir string) ([]Vector, error) {
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("LoadGolden: %s", err.Error())
+	}
+
+	vectors := []Vector{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("LoadGolden: %s", err.Error())
+		}
+
+		v := Vector{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("LoadGolden: %s: %s", file, err.Error())
+		}
+
+		dump, err := ioutil.ReadFile(strings.TrimSuffix(file, ".json") + ".hex")
+		if err != nil {
+			return nil, fmt.Errorf("LoadGolden: %s", err.Error())
+		}
+		frame, err := ParseHexDump(dump)
+		if err != nil {
+			return nil, fmt.Errorf("LoadGolden: %s: %s", file, err.Error())
+		}
+
+		v.Name = strings.TrimSuffix(filepath.Base(file), ".json")
+		v.Frame = hex.EncodeToString(frame)
+		vectors = append(vectors, v)
+	}
+
+	return vectors, nil
+}
+
+// ParseHexDump parses the output of hex.Dump (or `hexdump -C`)
+func ParseHexDump(dump []byte) ([]byte, error) {
+
+	frame := []byte{}
+	scanner := bufio.NewScanner(bytes.NewReader(dump))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "|"); i >= 0 {
+			text = text[:i]
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, field := range fields[1:] {
+			b, err := hex.DecodeString(field)
+			if err != nil || len(b) != 1 {
+				return nil, fmt.Errorf("ParseHexDump: line %d: invalid byte '%s'", line, field)
+			}
+			frame = append(frame, b[0])
+		}
+	}
+
+	return frame, scanner.Err()
+}
+
+// GoImplementation returns the reference implementation (this repository)
+func GoImplementation() Implementation {
+	return goImplementation{}
+}
+
+// goImplementation implements Implementation using the unixsock package
+type goImplementation struct{}
+
+// Encode encodes v using unixsock
+func (goImplementation) Encode(v Vector) ([]byte, error) {
+	return Encode(v)
+}
+
+// Decode decodes frame using unixsock
+func (goImplementation) Decode(frame []byte) (Vector, error) {
+
+	msg := unixsock.NewReceiver(&replayConn{Reader: bytes.NewReader(frame)})
+	if err := msg.Receive(); err != nil {
+		return Vector{}, err
+	}
+
+	resp := msg.GetResponse()
+	if resp != nil && reflect.DeepEqual(*resp, unixsock.Response{}) {
+		resp = nil
+	}
+
+	return Vector{
+		ID:       msg.GetID(),
+		Cmd:      msg.GetCmd(),
+		Args:     msg.GetArgs(),
+		Response: resp,
+		Respond:  msg.ShouldRespond(),
+		Close:    msg.ShouldClose(),
+		Priority: msg.GetPriority(),
+		Meta:     msg.GetMeta(),
+	}, nil
+}
+
+// CommandImplementation returns an Implementation backed by an external
+// program, which makes it possible to verify implementations in other
+// languages. The program is invoked as `name args... encode` with a vector
+// (JSON) on stdin and must print the hex encoded frame, or as
+// `name args... decode` with a hex encoded frame on stdin and must print the
+// decoded vector (JSON).
+func CommandImplementation(name string, args ...string) Implementation {
+	return &commandImplementation{name: name, args: args}
+}
+
+// commandImplementation implements Implementation via an external program
+type commandImplementation struct {
+	name string
+	args []string
+}
+
+// Encode runs the external encoder
+func (c *commandImplementation) Encode(v Vector) ([]byte, error) {
+	input, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	out, err := c.run("encode", input)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(out)))
+}
+
+// Decode runs the external decoder
+func (c *commandImplementation) Decode(frame []byte) (Vector, error) {
+	out, err := c.run("decode", []byte(hex.EncodeToString(frame)))
+	if err != nil {
+		return Vector{}, err
+	}
+	v := Vector{}
+	err = json.Unmarshal(out, &v)
+	return v, err
+}
+
+// run runs the external program
+func (c *commandImplementation) run(mode string, input []byte) ([]byte, error) {
+	cmd := exec.Command(c.name, append(c.args, mode)...)
+	cmd.Stdin = bytes.NewReader(input)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed: %s", c.name, mode, err.Error())
+	}
+	return out, nil
+}
+
+// replayConn is a fake connection replaying a recorded stream
+type replayConn struct {
+	io.Reader
+}
+
+func (c *replayConn) Write(b []byte) (int, error)        { return 0, fmt.Errorf("replayConn: read only") }
+func (c *replayConn) Close() error                       { return nil }
+func (c *replayConn) LocalAddr() net.Addr                { return nil }
+func (c *replayConn) RemoteAddr() net.Addr               { return nil }
+func (c *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return nil }
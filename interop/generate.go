@@ -0,0 +1,115 @@
+package interop
+
+import (
+	"fmt"
+	"io"
+	"text/template"
+)
+
+// GeneratePython writes a minimal Python 3 client speaking the framed
+// protocol described by spec
+func GeneratePython(w io.Writer, spec *Spec) error {
+	if err := pythonTemplate.Execute(w, spec); err != nil {
+		return fmt.Errorf("GeneratePython: %s", err.Error())
+	}
+	return nil
+}
+
+// GenerateShell writes a bash function sending a single command to a server
+// via socat, using the line protocol described by spec
+func GenerateShell(w io.Writer, spec *Spec) error {
+	if err := shellTemplate.Execute(w, spec); err != nil {
+		return fmt.Errorf("GenerateShell: %s", err.Error())
+	}
+	return nil
+}
+
+var pythonTemplate = template.Must(template.New("python").Parse(`# Generated from the unixsock wire specification (version {{.Version}}).
+# Do not edit: regenerate with interop.GeneratePython instead.
+import json
+import socket
+import struct
+
+LENGTH_BYTES = {{.Framing.LengthBytes}}
+SEPARATOR = b"{{.Framing.Separator}}"
+MAX_LENGTH = {{.Framing.MaxLength}}
+
+
+class UnixSockError(Exception):
+    pass
+
+
+class UnixSockClient:
+    """Minimal client for a unixsock server."""
+
+    def __init__(self, path, timeout=5.0):
+        self.path = path
+        self.timeout = timeout
+        self.sock = None
+        self.last_id = 0
+
+    def connect(self):
+        if self.sock is None:
+            self.sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+            self.sock.settimeout(self.timeout)
+            self.sock.connect(self.path)
+
+    def close(self):
+        if self.sock is not None:
+            self.sock.close()
+            self.sock = None
+
+    def send(self, cmd, args=None, respond=True, close=False, priority=0, meta=None):
+        """Sends cmd and returns the response dict (or None if respond is False)."""
+        self.connect()
+        self.last_id += 1
+        message = {
+            "id": self.last_id,
+            "cmd": cmd,
+            "args": args or {},
+            "response": None,
+            "respond": respond,
+            "close": close,
+        }
+        if priority:
+            message["priority"] = priority
+        if meta:
+            message["meta"] = meta
+
+        body = json.dumps(message).encode("utf-8")
+        self.sock.sendall(struct.pack(">I", len(body)) + SEPARATOR + body)
+
+        response = None
+        if respond:
+            response = self._receive()["response"]
+        if close:
+            self.close()
+        return response
+
+    def _receive(self):
+        length = struct.unpack(">I", self._read_exactly(LENGTH_BYTES))[0]
+        if length > MAX_LENGTH:
+            raise UnixSockError("message too long: %d bytes" % length)
+        content = self._read_exactly(length + len(SEPARATOR))
+        return json.loads(content[len(SEPARATOR):].decode("utf-8"))
+
+    def _read_exactly(self, n):
+        data = b""
+        while len(data) < n:
+            chunk = self.sock.recv(n - len(data))
+            if not chunk:
+                raise UnixSockError("connection closed by the server")
+            data += chunk
+        return data
+`))
+
+var shellTemplate = template.Must(template.New("shell").Parse(`# Generated from the unixsock wire specification (version {{.Version}}).
+# Do not edit: regenerate with interop.GenerateShell instead.
+#
+# Usage: unixsock_send /path/to/server.sock command '{"key": "value"}'
+unixsock_send() {
+  local path="$1" cmd="$2" args="${3:-{\}}"
+  printf '{"cmd": "%s", "args": %s, "respond": true, "close": true}\n' "$cmd" "$args" \
+    | socat -t 5 - "UNIX-CONNECT:${path}"
+}
+`))
@@ -0,0 +1,122 @@
+package interop
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// goldenDir contains the golden vectors
+var goldenDir = filepath.Join("testdata", "golden")
+
+func TestVectors(t *testing.T) {
+
+	vectors, err := Vectors()
+	if err != nil {
+		t.Fatalf("TestVectors: could not generate vectors: %s", err.Error())
+	}
+
+	for _, v := range vectors {
+		frame, _ := hex.DecodeString(v.Frame)
+		base := filepath.Join(goldenDir, v.Name)
+
+		if *update {
+			msg := v
+			msg.Name, msg.Frame = "", ""
+			data, err := json.MarshalIndent(msg, "", "  ")
+			if err != nil {
+				t.Fatalf("TestVectors: could not marshal vector %s: %s", v.Name, err.Error())
+			}
+			if err := ioutil.WriteFile(base+".json", append(data, '\n'), 0644); err != nil {
+				t.Fatalf("TestVectors: could not update golden file: %s", err.Error())
+			}
+			if err := ioutil.WriteFile(base+".hex", []byte(hex.Dump(frame)), 0644); err != nil {
+				t.Fatalf("TestVectors: could not update golden file: %s", err.Error())
+			}
+		}
+
+		dump, err := ioutil.ReadFile(base + ".hex")
+		if err != nil {
+			t.Errorf("TestVectors: missing golden frame for %s: %s", v.Name, err.Error())
+			continue
+		}
+		expected, err := ParseHexDump(dump)
+		if err != nil {
+			t.Errorf("TestVectors: invalid golden frame for %s: %s", v.Name, err.Error())
+			continue
+		}
+		if !bytes.Equal(expected, frame) {
+			t.Errorf("TestVectors: wire format of %s changed (run with -update if intended):\nexpected:\n%sgot:\n%s", v.Name, hex.Dump(expected), hex.Dump(frame))
+		}
+	}
+
+}
+
+func TestConformance(t *testing.T) {
+
+	vectors, err := LoadGolden(goldenDir)
+	if err != nil {
+		t.Fatalf("TestConformance: could not load golden vectors: %s", err.Error())
+	}
+	if len(vectors) == 0 {
+		t.Fatalf("TestConformance: no golden vectors in %s", goldenDir)
+	}
+
+	for _, result := range RunConformance(GoImplementation(), vectors) {
+		if result.Err != nil {
+			t.Errorf("TestConformance: %s (%s): %s", result.Vector, result.Direction, result.Err.Error())
+		}
+	}
+
+}
+
+func TestSpec(t *testing.T) {
+
+	data, err := WireSpec().JSON()
+	if err != nil {
+		t.Fatalf("TestSpec: could not marshal spec: %s", err.Error())
+	}
+	data = append(data, '\n')
+
+	path := filepath.Join("testdata", "spec.json")
+	if *update {
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("TestSpec: could not update golden file: %s", err.Error())
+		}
+	}
+
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("TestSpec: missing golden spec: %s", err.Error())
+	}
+	if !bytes.Equal(expected, data) {
+		t.Errorf("TestSpec: wire specification changed (run with -update if intended):\nexpected:\n%s\ngot:\n%s", expected, data)
+	}
+
+}
+
+func TestGenerate(t *testing.T) {
+
+	spec := WireSpec()
+
+	if _, err := spec.JSON(); err != nil {
+		t.Errorf("TestGenerate: could not marshal spec: %s", err.Error())
+	}
+
+	buf := &bytes.Buffer{}
+	if err := GeneratePython(buf, spec); err != nil || !bytes.Contains(buf.Bytes(), []byte("class UnixSockClient")) {
+		t.Errorf("TestGenerate: could not generate python client: %v", err)
+	}
+
+	buf.Reset()
+	if err := GenerateShell(buf, spec); err != nil || !bytes.Contains(buf.Bytes(), []byte("socat")) {
+		t.Errorf("TestGenerate: could not generate shell snippet: %v", err)
+	}
+
+}
@@ -0,0 +1,138 @@
+// Package interop describes the unixsock wire protocol in a machine-readable
+// form and generates reference clients for non-Go processes. The Go
+// implementation remains the source of truth: the golden test vectors in
+// testdata/golden (hex dumps of frames along with their decoded messages) are
+// produced by the unixsock package itself, and RunConformance verifies other
+// implementations (see CommandImplementation) against them byte-for-byte.
+package interop
+
+import (
+	"encoding/json"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// SpecVersion is the version of the wire specification
+const SpecVersion = "1"
+
+// Field describes a single field of a message
+type Field struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Required    bool   `json:"required"`
+	Description string `json:"description"`
+}
+
+// Framing describes the framed protocol (length:json)
+type Framing struct {
+	LengthBytes int    `json:"length_bytes"`
+	ByteOrder   string `json:"byte_order"`
+	Separator   string `json:"separator"`
+	MaxLength   int    `json:"max_length"`
+	Description string `json:"description"`
+}
+
+// FrameHeader describes the fixed frame header, which replaces the length
+// prefix of the framed protocol once negotiated
+type FrameHeader struct {
+	Magic       string          `json:"magic"`
+	Version     int             `json:"version"`
+	Layout      string          `json:"layout"`
+	Flags       map[string]byte `json:"flags"`
+	Negotiation string          `json:"negotiation"`
+}
+
+// LineProtocol describes the line protocol (one JSON message per line)
+type LineProtocol struct {
+	Delimiter   string `json:"delimiter"`
+	Detection   string `json:"detection"`
+	Description string `json:"description"`
+}
+
+// TypeEnvelope describes how values of registered types are wrapped in Args
+type TypeEnvelope struct {
+	TypeKey  string   `json:"type_key"`
+	ValueKey string   `json:"value_key"`
+	Types    []string `json:"types"`
+}
+
+// Spec is the machine-readable wire specification
+type Spec struct {
+	Version      string            `json:"version"`
+	Framing      Framing           `json:"framing"`
+	FrameHeader  FrameHeader       `json:"frame_header"`
+	LineProtocol LineProtocol      `json:"line_protocol"`
+	Message      []Field           `json:"message"`
+	Response     []Field           `json:"response"`
+	Statuses     []unixsock.Status `json:"statuses"`
+	TypeEnvelope TypeEnvelope      `json:"type_envelope"`
+	Reserved     []string          `json:"reserved_commands"`
+}
+
+// WireSpec returns the specification of the current wire protocol
+func WireSpec() *Spec {
+	return &Spec{
+		Version: SpecVersion,
+		Framing: Framing{
+			LengthBytes: 4,
+			ByteOrder:   "big-endian",
+			Separator:   ":",
+			MaxLength:   1 << 20,
+			Description: "Every message is sent as a 4 byte unsigned length of the JSON body, followed by the separator and the JSON body itself",
+		},
+		FrameHeader: FrameHeader{
+			Magic:   unixsock.FrameMagic,
+			Version: unixsock.FrameVersion,
+			Layout:  "magic (2 bytes) | version (1) | flags (1) | big-endian length (4) | CRC-32 IEEE of the JSON body (4, if flagged) | JSON body",
+			Flags: map[string]byte{
+				"crc":        1 << 0,
+				"compressed": 1 << 1,
+				"stream":     1 << 2,
+				"codec":      3 << 4,
+			},
+			Negotiation: "Requested with frame_header=true (and frame_crc) in the _sys.hello arguments; a server supporting it answers with a header. Readers accept both formats, told apart by the magic.",
+		},
+		LineProtocol: LineProtocol{
+			Delimiter:   "\n",
+			Detection:   "The server switches a connection to the line protocol if its first byte is '{'",
+			Description: "Every message is a single line of JSON. Messages default to respond=true.",
+		},
+		Message: []Field{
+			{"id", "uint64", false, "Message ID, echoed in the response; the sequence number of events (see _sys.subscribe)"},
+			{"cmd", "string", true, "Command"},
+			{"args", "object", false, "Command arguments"},
+			{"response", "object", false, "Response to the message (set by the server)"},
+			{"respond", "bool", false, "Whether the server should respond"},
+			{"close", "bool", false, "Whether the server should close the connection after the message"},
+			{"priority", "int", false, "Scheduling priority (-1 low, 0 normal, 1 high)"},
+			{"expires", "int64", false, "Expiry as unix time in nanoseconds; stale messages are answered with status 'expired'"},
+			{"event", "bool", false, "Unsolicited event pushed by the server"},
+			{"chunk", "bytes", false, "Chunk of a streamed request body or response (base64), sharing the ID of the request"},
+			{"more", "bool", false, "Whether further chunks follow; the final response has more=false"},
+			{"meta", "object", false, "Metadata (string values, e.g. trace IDs or auth tokens) kept apart from the command arguments"},
+			{"ack", "bool", false, "With respond=true: the server acknowledges the receipt of the message (same ID, ack=true, no response) and does not respond after executing it"},
+			{"file", "bool", false, "An open file is passed along with the message as an SCM_RIGHTS control message, holding the payload of the response (only on connections agreeing on file_passing in _sys.hello)"},
+		},
+		Response: []Field{
+			{"status", "string", true, "Outcome of the command"},
+			{"error", "string", false, "Error message (for failures)"},
+			{"payload", "string", false, "Command output"},
+			{"warning", "string", false, "Non-fatal issue, e.g. the use of a deprecated command"},
+			{"meta", "object", false, "String metadata about the payload, e.g. units or pagination cursors"},
+			{"encoding", "string", false, "Compression of the payload (base64 encoded), only used for clients sending accept_encoding in _sys.hello"},
+			{"trailer", "object", false, "String summary of a streamed response (e.g. stream_length and stream_crc32 of its chunks), sent in the final message"},
+		},
+		Statuses: []unixsock.Status{unixsock.StatusOK, unixsock.StatusFail, unixsock.StatusPartial, unixsock.StatusRetry, unixsock.StatusExpired, unixsock.StatusRejected},
+		TypeEnvelope: TypeEnvelope{
+			TypeKey:  "$type",
+			ValueKey: "$value",
+			Types:    unixsock.RegisteredTypes(),
+		},
+		Reserved: unixsock.ReservedCommands(),
+	}
+}
+
+// JSON returns the indented JSON representation of the specification
+func (s *Spec) JSON() ([]byte, error) {
+	return json.MarshalIndent(s, "", "  ")
+}
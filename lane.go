@@ -0,0 +1,49 @@
+package unixsock
+
+import "sync"
+
+// laneBulkSize is the size above which messages are written in the bulk lane
+const laneBulkSize = 64 << 10
+
+// laneLock serializes whole frames written to a connection in two lanes.
+// Frames of the control lane (small messages like pings, cancellations,
+// responses and admin commands) are written before any waiting frame of the
+// bulk lane (chunks of streams and large messages), so that they are not
+// blocked behind a multi-megabyte transfer sharing the connection. They only
+// wait for the frame currently being written.
+type laneLock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	busy    bool // A frame is being written
+	control int  // Control frames waiting
+}
+
+// lock waits until a frame of the given lane may be written
+func (l *laneLock) lock(bulk bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.cond == nil {
+		l.cond = sync.NewCond(&l.mu)
+	}
+
+	if !bulk {
+		l.control++
+		defer func() { l.control-- }()
+	}
+	for l.busy || (bulk && l.control > 0) {
+		l.cond.Wait()
+	}
+	l.busy = true
+}
+
+// unlock lets the next frame be written
+func (l *laneLock) unlock() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.busy = false
+	if l.cond != nil {
+		l.cond.Broadcast()
+	}
+}
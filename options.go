@@ -0,0 +1,24 @@
+package unixsock
+
+import (
+	"time"
+)
+
+// MessageOption configures a message (see NewSender and NewReceiver)
+type MessageOption func(*communicator)
+
+// WithMaxLength sets the maximum size of a received message (1MB by
+// default, 0 for no limit)
+func WithMaxLength(maxLength int) MessageOption {
+	return func(s *communicator) {
+		s.maxLength = maxLength
+	}
+}
+
+// WithTimeout sets the time limit for sending or receiving the message (5
+// seconds by default, 0 for no limit)
+func WithTimeout(timeout time.Duration) MessageOption {
+	return func(s *communicator) {
+		s.timeout = timeout
+	}
+}
@@ -0,0 +1,97 @@
+package unixsock
+
+import (
+	"fmt"
+	"net"
+)
+
+// PeerCred contains the credentials of the process on the other side of a
+// unix socket connection
+type PeerCred struct {
+	PID int32  `json:"pid"` // Process ID of the peer
+	UID uint32 `json:"uid"` // User ID of the peer
+	GID uint32 `json:"gid"` // Group ID of the peer
+}
+
+// String returns a human readable representation of the credentials
+func (p *PeerCred) String() string {
+	if p == nil {
+		return "unknown peer"
+	}
+	return fmt.Sprintf("pid=%d uid=%d gid=%d", p.PID, p.UID, p.GID)
+}
+
+// PeerProcess identifies the process on the other side of a connection by
+// its executable and control group (see PeerCred.Process), e.g. in order to
+// log which binary issued a command
+type PeerProcess struct {
+	Exe    string `json:"exe"`              // Path of the executable
+	Cgroup string `json:"cgroup,omitempty"` // Control group, e.g. "/system.slice/backup.service"
+}
+
+// String returns a human readable representation of the process
+func (p *PeerProcess) String() string {
+	if p == nil {
+		return "unknown process"
+	}
+	if p.Cgroup == "" {
+		return p.Exe
+	}
+	return fmt.Sprintf("%s (%s)", p.Exe, p.Cgroup)
+}
+
+// PeerCreds returns the credentials of the peer connected to conn, read from
+// the socket by the platform's mechanism: SO_PEERCRED on Linux and OpenBSD,
+// LOCAL_PEERCRED on macOS, FreeBSD and DragonFly BSD (the PID is only
+// available on macOS) and LOCAL_PEEREID on NetBSD. Other platforms (e.g.
+// Windows) do not support peer credentials, so credential-based features
+// (e.g. policies) see unknown peers there.
+//
+// Connections reporting their own credentials via a method
+// PeerCreds() (*PeerCred, error), like CredConn, are not asked the socket.
+func PeerCreds(conn net.Conn) (*PeerCred, error) {
+
+	if c, ok := conn.(*Conn); ok {
+		conn = c.Conn
+	}
+	if c, ok := conn.(interface {
+		PeerCreds() (*PeerCred, error)
+	}); ok {
+		return c.PeerCreds()
+	}
+
+	uc, err := unixConn(conn)
+	if err != nil {
+		return nil, fmt.Errorf("PeerCreds: %s", err.Error())
+	}
+
+	return peerCreds(uc)
+}
+
+// CredConn is a connection carrying the credentials of its peer, e.g. the
+// connection of a transport authenticating its peers itself (see Transport)
+// or a fake connection testing credential-based features on any platform
+type CredConn struct {
+	net.Conn
+	Cred *PeerCred
+}
+
+// PeerCreds returns the credentials carried by the connection
+func (c *CredConn) PeerCreds() (*PeerCred, error) {
+	if c.Cred == nil {
+		return nil, fmt.Errorf("PeerCreds: no credentials")
+	}
+	return c.Cred, nil
+}
+
+// unixConn returns the underlying *net.UnixConn of conn (if any)
+func unixConn(conn net.Conn) (*net.UnixConn, error) {
+	if c, ok := conn.(*Conn); ok {
+		conn = c.Conn
+	}
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("unixConn: not a unix socket connection (%T)", conn)
+	}
+	return uc, nil
+}
@@ -0,0 +1,53 @@
+//go:build darwin || freebsd || dragonfly || netbsd || openbsd
+// +build darwin freebsd dragonfly netbsd openbsd
+
+package unixsock
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// solLocal is the socket option level of unix sockets on BSD systems
+const solLocal = 0
+
+// peerCreds reads the credentials of the peer connected to uc via the
+// platform's socket option (see readPeerCreds)
+func peerCreds(uc *net.UnixConn) (*PeerCred, error) {
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("PeerCreds: could not access the raw connection: %s", err.Error())
+	}
+
+	var cred *PeerCred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = readPeerCreds(int(fd))
+	}); err != nil {
+		return nil, fmt.Errorf("PeerCreds: could not control the raw connection: %s", err.Error())
+	}
+	if credErr != nil {
+		return nil, fmt.Errorf("PeerCreds: %s", credErr.Error())
+	}
+
+	return cred, nil
+}
+
+// getsockopt reads the socket option opt of fd into the size bytes at val
+func getsockopt(fd, level, opt int, val unsafe.Pointer, size uintptr) error {
+	length := uint32(size)
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt), uintptr(val), uintptr(unsafe.Pointer(&length)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Process resolves the executable and control group of the peer. Resolving
+// processes is not supported on this platform.
+func (p *PeerCred) Process() (*PeerProcess, error) {
+	return nil, fmt.Errorf("Process: resolving processes is not supported on this platform")
+}
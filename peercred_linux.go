@@ -0,0 +1,89 @@
+//go:build linux
+// +build linux
+
+package unixsock
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// peerCreds reads the credentials of the peer connected to uc via
+// SO_PEERCRED
+func peerCreds(uc *net.UnixConn) (*PeerCred, error) {
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("PeerCreds: could not access the raw connection: %s", err.Error())
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, fmt.Errorf("PeerCreds: could not control the raw connection: %s", err.Error())
+	}
+	if credErr != nil {
+		return nil, fmt.Errorf("PeerCreds: could not read SO_PEERCRED: %s", credErr.Error())
+	}
+
+	return &PeerCred{
+		PID: ucred.Pid,
+		UID: ucred.Uid,
+		GID: ucred.Gid,
+	}, nil
+}
+
+// Process resolves the executable and control group of the peer from /proc.
+// The PID is only meaningful while the peer is connected: processes that
+// exited in the meantime cannot be resolved (or worse, their PID may have
+// been reused), so the process should be resolved right after accepting the
+// connection. Resolving the executable of processes of other users requires
+// privileges (e.g. CAP_SYS_PTRACE).
+func (p *PeerCred) Process() (*PeerProcess, error) {
+
+	if p == nil || p.PID <= 0 {
+		return nil, fmt.Errorf("Process: unknown peer")
+	}
+	proc := fmt.Sprintf("/proc/%d", p.PID)
+
+	exe, err := os.Readlink(proc + "/exe")
+	if err != nil {
+		return nil, fmt.Errorf("Process: could not resolve the executable: %s", err.Error())
+	}
+
+	cgroups, err := ioutil.ReadFile(proc + "/cgroup")
+	if err != nil {
+		return nil, fmt.Errorf("Process: could not read the control group: %s", err.Error())
+	}
+
+	return &PeerProcess{
+		Exe:    exe,
+		Cgroup: parseCgroup(string(cgroups)),
+	}, nil
+}
+
+// parseCgroup returns the control group of a process from the contents of
+// /proc/<pid>/cgroup: the group of the unified hierarchy (cgroup v2), or of
+// systemd's hierarchy on hosts still using cgroup v1
+func parseCgroup(cgroups string) string {
+	var fallback string
+	for _, line := range strings.Split(cgroups, "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		switch {
+		case fields[0] == "0" && fields[1] == "":
+			return fields[2]
+		case fields[1] == "name=systemd":
+			fallback = fields[2]
+		}
+	}
+	return fallback
+}
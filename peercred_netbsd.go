@@ -0,0 +1,35 @@
+//go:build netbsd
+// +build netbsd
+
+package unixsock
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// localPeerEID is the socket option LOCAL_PEEREID of unix sockets
+const localPeerEID = 3
+
+// unpcbid is the struct unpcbid returned by LOCAL_PEEREID
+type unpcbid struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// readPeerCreds reads the credentials of the peer connected to fd via
+// LOCAL_PEEREID
+func readPeerCreds(fd int) (*PeerCred, error) {
+
+	id := unpcbid{}
+	if err := getsockopt(fd, solLocal, localPeerEID, unsafe.Pointer(&id), unsafe.Sizeof(id)); err != nil {
+		return nil, fmt.Errorf("could not read LOCAL_PEEREID: %s", err.Error())
+	}
+
+	return &PeerCred{
+		PID: id.PID,
+		UID: id.UID,
+		GID: id.GID,
+	}, nil
+}
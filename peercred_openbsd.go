@@ -0,0 +1,36 @@
+//go:build openbsd
+// +build openbsd
+
+package unixsock
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// soPeerCred is the socket option SO_PEERCRED
+const soPeerCred = 0x1022
+
+// sockpeercred is the struct sockpeercred returned by SO_PEERCRED
+type sockpeercred struct {
+	UID uint32
+	GID uint32
+	PID int32
+}
+
+// readPeerCreds reads the credentials of the peer connected to fd via
+// SO_PEERCRED
+func readPeerCreds(fd int) (*PeerCred, error) {
+
+	cred := sockpeercred{}
+	if err := getsockopt(fd, syscall.SOL_SOCKET, soPeerCred, unsafe.Pointer(&cred), unsafe.Sizeof(cred)); err != nil {
+		return nil, fmt.Errorf("could not read SO_PEERCRED: %s", err.Error())
+	}
+
+	return &PeerCred{
+		PID: cred.PID,
+		UID: cred.UID,
+		GID: cred.GID,
+	}, nil
+}
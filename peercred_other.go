@@ -0,0 +1,22 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!dragonfly,!netbsd,!openbsd
+
+package unixsock
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerCreds reads the credentials of the peer connected to uc. Peer
+// credentials are not supported on this platform (e.g. Windows, whose unix
+// sockets do not expose the peer).
+func peerCreds(uc *net.UnixConn) (*PeerCred, error) {
+	return nil, fmt.Errorf("PeerCreds: peer credentials are not supported on this platform")
+}
+
+// Process resolves the executable and control group of the peer. Resolving
+// processes is not supported on this platform.
+func (p *PeerCred) Process() (*PeerProcess, error) {
+	return nil, fmt.Errorf("Process: resolving processes is not supported on this platform")
+}
@@ -0,0 +1,51 @@
+//go:build darwin || freebsd || dragonfly
+// +build darwin freebsd dragonfly
+
+package unixsock
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+// Socket options of unix sockets on macOS, FreeBSD and DragonFly BSD
+const (
+	localPeerCred = 1 // LOCAL_PEERCRED: struct xucred of the peer
+	localPeerPID  = 2 // LOCAL_PEERPID: PID of the peer (macOS only)
+)
+
+// xucred is the struct xucred returned by LOCAL_PEERCRED
+type xucred struct {
+	Version uint32
+	UID     uint32
+	NGroups int16
+	Groups  [16]uint32
+}
+
+// readPeerCreds reads the credentials of the peer connected to fd via
+// LOCAL_PEERCRED. The effective GID of the peer is its first group. Its PID
+// is only available on macOS (0 elsewhere).
+func readPeerCreds(fd int) (*PeerCred, error) {
+
+	cred := xucred{}
+	if err := getsockopt(fd, solLocal, localPeerCred, unsafe.Pointer(&cred), unsafe.Sizeof(cred)); err != nil {
+		return nil, fmt.Errorf("could not read LOCAL_PEERCRED: %s", err.Error())
+	}
+	if cred.Version != 0 || cred.NGroups < 1 {
+		return nil, fmt.Errorf("unexpected LOCAL_PEERCRED (version %d, %d groups)", cred.Version, cred.NGroups)
+	}
+
+	peer := &PeerCred{
+		UID: cred.UID,
+		GID: cred.Groups[0],
+	}
+
+	if runtime.GOOS == "darwin" {
+		if err := getsockopt(fd, solLocal, localPeerPID, unsafe.Pointer(&peer.PID), unsafe.Sizeof(peer.PID)); err != nil {
+			return nil, fmt.Errorf("could not read LOCAL_PEERPID: %s", err.Error())
+		}
+	}
+
+	return peer, nil
+}
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// header is the part of a message the proxy peeks at
+type header struct {
+	ID      uint64 `json:"id"`
+	Cmd     string `json:"cmd"`
+	Respond bool   `json:"respond"`
+}
+
+// answer is a response sent by the proxy itself
+type answer struct {
+	ID       uint64             `json:"id,omitempty"`
+	Cmd      string             `json:"cmd"`
+	Args     unixsock.Args      `json:"args"`
+	Response *unixsock.Response `json:"response"`
+	Respond  bool               `json:"respond"`
+	Close    bool               `json:"close"`
+}
+
+// serve forwards the messages of a single client to the server over a
+// connection of its own, and the responses and events of the server back
+func (p *Proxy) serve(conn net.Conn) {
+	defer conn.Close()
+
+	peer, _ := unixsock.PeerCreds(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.dialTimeout)
+	upstream, err := p.dial(ctx)
+	cancel()
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	// Clients speaking the line protocol are served in lines, which the
+	// server answers in kind
+	fromClient := bufio.NewReader(conn)
+	first, err := fromClient.Peek(1)
+	if err != nil {
+		return
+	}
+	lineMode := first[0] == '{'
+
+	// Responses of the proxy and the server must not interleave
+	writeMu := &sync.Mutex{}
+	write := func(msg []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		_, err := conn.Write(msg)
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer conn.Close()
+
+		fromServer := bufio.NewReader(upstream)
+		for {
+			msg, _, err := readMessage(fromServer, lineMode, p.maxLength)
+			if err != nil || write(msg) != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		msg, message, err := readMessage(fromClient, lineMode, p.maxLength)
+		if err != nil {
+			break
+		}
+
+		// Messages of the line protocol default to respond=true
+		h := header{Respond: lineMode}
+		if err := json.Unmarshal(message, &h); err != nil {
+			break
+		}
+
+		var resp *unixsock.Response
+		if h.Cmd == sysHello {
+			resp = unixsock.NewResponse().OK()
+		} else if err := p.authorize(peer, h); err != nil {
+			resp = unixsock.NewResponse().Fail(err)
+		}
+
+		if resp == nil {
+			if _, err := upstream.Write(msg); err != nil {
+				break
+			}
+			continue
+		}
+
+		if h.Respond && write(encodeAnswer(h, resp, lineMode)) != nil {
+			break
+		}
+	}
+
+	upstream.Close()
+	<-done
+}
+
+// authorize checks whether peer may send the command, recording the decision
+// in the audit log (if any)
+func (p *Proxy) authorize(peer *unixsock.PeerCred, h header) error {
+
+	err := p.allows(peer, h.Cmd)
+
+	if p.audit != nil {
+		entry := &AuditEntry{
+			Time:    time.Now(),
+			Peer:    peer,
+			ID:      h.ID,
+			Cmd:     h.Cmd,
+			Allowed: err == nil,
+		}
+		if err != nil {
+			entry.Reason = err.Error()
+		}
+
+		p.auditMu.Lock()
+		p.audit.Encode(entry)
+		p.auditMu.Unlock()
+	}
+
+	return err
+}
+
+// allows checks cmd against the allowed patterns and the filters
+func (p *Proxy) allows(peer *unixsock.PeerCred, cmd string) error {
+
+	if len(p.allowed) > 0 {
+		allowed := false
+		for _, pattern := range p.allowed {
+			if matched, _ := path.Match(pattern, cmd); matched {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("proxy: command '%s' not allowed", cmd)
+		}
+	}
+
+	for _, filter := range p.filters {
+		if err := filter(peer, cmd); err != nil {
+			return fmt.Errorf("proxy: command '%s' denied: %s", cmd, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// readMessage reads a single message (a frame, or a line in line mode) and
+// returns it as it was received along with its JSON content
+func readMessage(r *bufio.Reader, lineMode bool, maxLength int) ([]byte, []byte, error) {
+
+	if !lineMode {
+		frame, err := unixsock.ReadFrame(r, maxLength)
+		if err != nil {
+			return nil, nil, err
+		}
+		message, err := unixsock.FrameMessage(frame)
+		return frame, message, err
+	}
+
+	line := []byte{}
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if maxLength > 0 && len(line) > maxLength+1 {
+			return nil, nil, fmt.Errorf("readMessage: message too long: more than %d bytes", maxLength)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return line, line, nil
+	}
+}
+
+// encodeAnswer encodes a response of the proxy itself to the message h in
+// the format spoken by the client
+func encodeAnswer(h header, resp *unixsock.Response, lineMode bool) []byte {
+
+	message, _ := json.Marshal(&answer{ID: h.ID, Cmd: h.Cmd, Args: unixsock.Args{}, Response: resp})
+	if lineMode {
+		return append(message, '\n')
+	}
+
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame, uint32(len(message)))
+	frame[4] = ':'
+
+	return append(frame, message...)
+}
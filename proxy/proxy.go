@@ -0,0 +1,263 @@
+// Package proxy exposes a unixsock server on another socket, e.g. in order to
+// grant unprivileged users access to a restricted subset of the commands of a
+// daemon running as root. Messages are forwarded to the server (over a unix
+// socket, TCP or TLS) without being decoded, except for peeking at their
+// command, which can be filtered and audited.
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// sysHello is the handshake command of the unixsock protocol. It is answered
+// by the proxy without negotiating any feature, since features such as
+// stream compression would keep the proxy from telling messages apart.
+const sysHello = unixsock.SysHello
+
+// Dialer connects to the proxied server
+type Dialer func(ctx context.Context) (net.Conn, error)
+
+// Unix dials a server listening on a unix socket
+func Unix(socketPath string) Dialer {
+	return func(ctx context.Context) (net.Conn, error) {
+		dialer := &net.Dialer{}
+		return dialer.DialContext(ctx, "unix", socketPath)
+	}
+}
+
+// TCP dials a server listening on a TCP address (see server.Serve)
+func TCP(addr string) Dialer {
+	return func(ctx context.Context) (net.Conn, error) {
+		dialer := &net.Dialer{}
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+}
+
+// TLS dials a server listening on a TCP address secured with TLS
+func TLS(addr string, config *tls.Config) Dialer {
+	return func(ctx context.Context) (net.Conn, error) {
+		dialer := &net.Dialer{}
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+
+		return tlsConn, nil
+	}
+}
+
+// Filter decides whether peer may send cmd. A non-nil error denies the
+// command and is reported to the client.
+type Filter func(peer *unixsock.PeerCred, cmd string) error
+
+// AuditEntry is a single forwarded (or denied) command (see WithAuditLog)
+type AuditEntry struct {
+	Time    time.Time          `json:"time"`
+	Peer    *unixsock.PeerCred `json:"peer,omitempty"` // Credentials of the client (if available)
+	ID      uint64             `json:"id,omitempty"`
+	Cmd     string             `json:"cmd"`
+	Allowed bool               `json:"allowed"`
+	Reason  string             `json:"reason,omitempty"` // Reason the command was denied
+}
+
+// Option configures a Proxy
+type Option func(*Proxy)
+
+// WithAllowed restricts the commands forwarded to the server to those
+// matching any of the patterns (see path.Match, e.g. "unit.status" or
+// "stats.*"). Reserved commands have to be allowed as well, e.g.
+// "_sys.health" for clients pinging the server.
+func WithAllowed(patterns ...string) Option {
+	return func(p *Proxy) {
+		p.allowed = append(p.allowed, patterns...)
+	}
+}
+
+// WithFilter adds a filter deciding which commands of which peers are
+// forwarded to the server
+func WithFilter(filter Filter) Option {
+	return func(p *Proxy) {
+		p.filters = append(p.filters, filter)
+	}
+}
+
+// WithAuditLog writes an entry (JSON line) for every command received by the
+// proxy to w
+func WithAuditLog(w io.Writer) Option {
+	return func(p *Proxy) {
+		p.audit = json.NewEncoder(w)
+	}
+}
+
+// WithMode sets the permissions of the proxy's socket, e.g. 0666 in order to
+// let every local user connect
+func WithMode(mode os.FileMode) Option {
+	return func(p *Proxy) {
+		p.mode = mode
+	}
+}
+
+// WithMaxLength sets the maximum size of a message (1MB by default)
+func WithMaxLength(maxLength int) Option {
+	return func(p *Proxy) {
+		p.maxLength = maxLength
+	}
+}
+
+// WithDialTimeout sets the time limit of connecting to the server (5 seconds
+// by default)
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(p *Proxy) {
+		p.dialTimeout = timeout
+	}
+}
+
+// Proxy listens on a unix socket and forwards every connection to the server
+// over a connection of its own
+type Proxy struct {
+	listener    net.Listener
+	dial        Dialer
+	allowed     []string
+	filters     []Filter
+	mode        os.FileMode
+	maxLength   int
+	dialTimeout time.Duration
+
+	auditMu sync.Mutex
+	audit   *json.Encoder
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// New starts a proxy listening on socketPath and forwarding to the server
+// reached via dial
+func New(socketPath string, dial Dialer, opts ...Option) (*Proxy, error) {
+
+	p := &Proxy{
+		dial:        dial,
+		maxLength:   1 << 20,
+		dialTimeout: 5 * time.Second,
+		conns:       make(map[net.Conn]struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	for _, pattern := range p.allowed {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("New: invalid pattern '%s': %s", pattern, err.Error())
+		}
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("New: could not listen on the unix socket: %s", err.Error())
+	}
+	if p.mode != 0 {
+		if err := os.Chmod(socketPath, p.mode); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("New: could not set the permissions of the socket: %s", err.Error())
+		}
+	}
+	p.listener = l
+
+	p.wg.Add(1)
+	go p.accept()
+
+	return p, nil
+}
+
+// Close stops the proxy and closes all proxied connections
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	err := p.listener.Close()
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+
+	return err
+}
+
+// accept accepts connections until the proxy is closed
+func (p *Proxy) accept() {
+	defer p.wg.Done()
+
+	var delay time.Duration
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				switch {
+				case delay == 0:
+					delay = 5 * time.Millisecond
+				case delay < time.Second:
+					delay *= 2
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return
+		}
+		delay = 0
+
+		if !p.track(conn, true) {
+			conn.Close()
+			return
+		}
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer p.track(conn, false)
+			p.serve(conn)
+		}()
+	}
+}
+
+// track adds (or removes) a connection to the set of open connections. It
+// returns false if the proxy has been closed.
+func (p *Proxy) track(conn net.Conn, open bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !open {
+		delete(p.conns, conn)
+		return true
+	}
+	if p.closed {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
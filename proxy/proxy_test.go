@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vaitekunas/unixsock"
+	"github.com/vaitekunas/unixsock/client"
+	"github.com/vaitekunas/unixsock/server"
+	context "golang.org/x/net/context"
+)
+
+// syncBuffer is a buffer safe for concurrent use
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestProxy(t *testing.T) {
+
+	serverPath := os.Getenv("HOME") + "/_test_proxy_server.sock"
+	proxyPath := os.Getenv("HOME") + "/_test_proxy.sock"
+	defer os.Remove(serverPath + ".lock")
+
+	srv, err := server.New(serverPath, func(cmd string, args unixsock.Args) *unixsock.Response {
+		return &unixsock.Response{Status: unixsock.STATUS_OK, Payload: fmt.Sprintf("%s:%v", cmd, args["unit"])}
+	})
+	if err != nil {
+		t.Fatalf("TestProxy: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	audit := &syncBuffer{}
+	p, err := New(proxyPath, Unix(serverPath),
+		WithAllowed("unit.status", "_sys.health"),
+		WithFilter(func(peer *unixsock.PeerCred, cmd string) error {
+			if peer == nil {
+				return fmt.Errorf("unknown peer")
+			}
+			return nil
+		}),
+		WithAuditLog(audit),
+		WithMode(0666),
+	)
+	if err != nil {
+		t.Fatalf("TestProxy: could not start proxy: %s", err.Error())
+	}
+	defer p.Close()
+
+	if info, err := os.Stat(proxyPath); err != nil || info.Mode().Perm() != 0666 {
+		t.Errorf("TestProxy: expected the socket to be accessible by everybody, got %v (%v)", info.Mode(), err)
+	}
+
+	tests := [][]client.Option{
+		{},
+		{client.WithFrameHeader(true), client.WithStreamCompression(unixsock.CompressionFlate)},
+	}
+
+	for i, opts := range tests {
+		c, err := client.New(proxyPath, opts...)
+		if err != nil {
+			t.Fatalf("TestProxy: test %d: could not create client: %s", i+1, err.Error())
+		}
+
+		resp, err := c.Send("unit.status", unixsock.Args{"unit": "nginx"}, true, false)
+		if err != nil || resp.Payload != "unit.status:nginx" {
+			t.Errorf("TestProxy: test %d: expected the command to be forwarded, got %v (%v)", i+1, resp, err)
+		}
+
+		resp, err = c.Send("unit.stop", unixsock.Args{"unit": "nginx"}, true, false)
+		if err != nil || resp.Status != unixsock.STATUS_FAIL || !strings.Contains(resp.Error, "not allowed") {
+			t.Errorf("TestProxy: test %d: expected the command to be denied, got %v (%v)", i+1, resp, err)
+		}
+
+		if err := c.Ping(context.Background()); err != nil {
+			t.Errorf("TestProxy: test %d: could not ping: %s", i+1, err.Error())
+		}
+
+		c.Quit()
+	}
+
+	// Line protocol
+	conn, err := net.Dial("unix", proxyPath)
+	if err != nil {
+		t.Fatalf("TestProxy: could not connect: %s", err.Error())
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for _, line := range []string{`{"cmd":"unit.status","args":{"unit":"sshd"}}`, `{"cmd":"unit.stop","args":{}}`} {
+		fmt.Fprintln(conn, line)
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("TestProxy: could not read the reply: %s", err.Error())
+		}
+		msg := struct{ Response *unixsock.Response }{}
+		if err := json.Unmarshal([]byte(reply), &msg); err != nil || msg.Response == nil {
+			t.Fatalf("TestProxy: malformed reply %q: %v", reply, err)
+		}
+		if strings.Contains(line, "unit.status") && msg.Response.Payload != "unit.status:sshd" {
+			t.Errorf("TestProxy: expected the line to be forwarded, got %q", reply)
+		}
+		if strings.Contains(line, "unit.stop") && msg.Response.Status != unixsock.STATUS_FAIL {
+			t.Errorf("TestProxy: expected the line to be denied, got %q", reply)
+		}
+	}
+
+	// Audit log
+	entries := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	denied := 0
+	for _, line := range entries {
+		entry := AuditEntry{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("TestProxy: malformed audit entry %q: %s", line, err.Error())
+		}
+		if !entry.Allowed {
+			denied++
+		}
+	}
+	if denied != 3 {
+		t.Errorf("TestProxy: expected 3 denied commands in the audit log, got %d:\n%s", denied, audit.String())
+	}
+
+}
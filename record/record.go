@@ -0,0 +1,167 @@
+// Package record captures the traffic of a unixsock server (see
+// server.WithRecorder) and replays it against a server, e.g. in order to
+// reproduce a bug reported against a running daemon. Records are stored as
+// JSON lines, one request/response pair per line.
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// Record is a single request/response pair
+type Record struct {
+	Time     time.Time             `json:"time"`              // Time the request was received
+	Peer     *unixsock.PeerCred    `json:"peer,omitempty"`    // Credentials of the client (if available)
+	Process  *unixsock.PeerProcess `json:"process,omitempty"` // Executable of the client (if resolved)
+	ID       uint64                `json:"id,omitempty"`
+	Cmd      string                `json:"cmd"`
+	Args     unixsock.Args         `json:"args"`
+	Priority unixsock.Priority     `json:"priority,omitempty"`
+	Response *unixsock.Response    `json:"response"`
+	Latency  time.Duration         `json:"latency"` // Time until the response was ready
+}
+
+// Recorder writes records to an io.Writer. It is safe for concurrent use.
+type Recorder struct {
+	mu       sync.Mutex
+	enc      *json.Encoder
+	redactor unixsock.Redactor
+}
+
+// Option configures a Recorder
+type Option func(*Recorder)
+
+// WithRedactor redacts every record with redactor before it is written, so
+// that secrets passed as arguments (or echoed in responses) do not end up in
+// the recording, e.g. unixsock.RedactKeys("password", "token")
+func WithRedactor(redactor unixsock.Redactor) Option {
+	return func(r *Recorder) {
+		r.redactor = redactor
+	}
+}
+
+// NewRecorder creates a recorder writing to w
+func NewRecorder(w io.Writer, opts ...Option) *Recorder {
+	r := &Recorder{enc: json.NewEncoder(w)}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Record writes a single record. Streamed request bodies are not recorded.
+func (r *Recorder) Record(rec *Record) error {
+
+	copied := *rec
+	copied.Args = unixsock.WithoutBody(rec.Args)
+	if r.redactor != nil {
+		copied.Args, copied.Response = r.redactor.Redact(rec.Cmd, copied.Args, rec.Response)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.enc.Encode(&copied); err != nil {
+		return fmt.Errorf("Record: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Reader reads records written by a Recorder
+type Reader struct {
+	scanner *bufio.Scanner
+}
+
+// NewReader creates a reader reading records from r
+func NewReader(r io.Reader) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 64<<20)
+	return &Reader{scanner: scanner}
+}
+
+// Next returns the next record, or io.EOF once all records have been read
+func (r *Reader) Next() (*Record, error) {
+
+	for r.scanner.Scan() {
+		line := r.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		rec := &Record{}
+		if err := json.Unmarshal(line, rec); err != nil {
+			return nil, fmt.Errorf("Next: malformed record: %s", err.Error())
+		}
+		return rec, nil
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Next: %s", err.Error())
+	}
+
+	return nil, io.EOF
+}
+
+// Sender sends commands to a server (e.g. a client.UnixSockClient)
+type Sender interface {
+	Send(cmd string, args unixsock.Args, respond, close bool) (*unixsock.Response, error)
+}
+
+// Result is the outcome of a replayed record
+type Result struct {
+	Record   *Record            // Recorded request and response
+	Response *unixsock.Response // Response to the replayed request
+	Err      error              // Error sending the replayed request
+}
+
+// Diverged informs whether the replayed request ended differently (i.e.
+// with a different status) than the recorded one
+func (r *Result) Diverged() bool {
+	if r.Err != nil {
+		return true
+	}
+
+	recorded, replayed := r.Record.Response, r.Response
+	if recorded == nil || replayed == nil {
+		return recorded != replayed
+	}
+
+	return recorded.Status != replayed.Status
+}
+
+// Replay re-sends the records read from r in order and passes the outcome
+// of every request to fn. If paced is set, the original pauses between the
+// requests are kept. Replay stops at the first malformed record.
+func Replay(s Sender, r io.Reader, paced bool, fn func(*Result)) error {
+
+	reader := NewReader(r)
+
+	var last time.Time
+	for {
+		rec, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Replay: %s", err.Error())
+		}
+
+		if paced && !last.IsZero() && rec.Time.After(last) {
+			time.Sleep(rec.Time.Sub(last))
+		}
+		last = rec.Time
+
+		resp, err := s.Send(rec.Cmd, rec.Args, true, false)
+		if fn != nil {
+			fn(&Result{Record: rec, Response: resp, Err: err})
+		}
+	}
+}
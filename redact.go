@@ -0,0 +1,88 @@
+package unixsock
+
+import (
+	"strings"
+)
+
+// Redacted replaces the values removed by RedactKeys
+const Redacted = "[redacted]"
+
+// Redactor removes secrets from a command and its response before they are
+// logged or recorded (see record.WithRedactor). It must not modify args or
+// resp, which belong to the caller, but return redacted copies (or the
+// originals if there is nothing to redact). resp may be nil.
+type Redactor interface {
+	Redact(cmd string, args Args, resp *Response) (Args, *Response)
+}
+
+// RedactorFunc is an adapter allowing the use of ordinary functions as
+// redactors
+type RedactorFunc func(cmd string, args Args, resp *Response) (Args, *Response)
+
+// Redact calls f(cmd, args, resp)
+func (f RedactorFunc) Redact(cmd string, args Args, resp *Response) (Args, *Response) {
+	return f(cmd, args, resp)
+}
+
+// RedactKeys returns a redactor replacing the values of the arguments under
+// keys (nested ones included) with Redacted. Redacted string values are
+// scrubbed from the error, warning and payload of the response as well, in
+// case the handler echoed them.
+func RedactKeys(keys ...string) Redactor {
+	redacted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		redacted[key] = true
+	}
+
+	return RedactorFunc(func(cmd string, args Args, resp *Response) (Args, *Response) {
+		var secrets []string
+		clean, _ := redactValue(map[string]interface{}(args), redacted, &secrets).(map[string]interface{})
+		if len(secrets) == 0 || resp == nil {
+			return Args(clean), resp
+		}
+
+		scrubbed := *resp
+		for _, secret := range secrets {
+			scrubbed.Error = strings.Replace(scrubbed.Error, secret, Redacted, -1)
+			scrubbed.Warning = strings.Replace(scrubbed.Warning, secret, Redacted, -1)
+			if scrubbed.Encoding == "" {
+				scrubbed.Payload = strings.Replace(scrubbed.Payload, secret, Redacted, -1)
+			}
+		}
+
+		return Args(clean), &scrubbed
+	})
+}
+
+// redactValue returns a copy of v whose values under the redacted keys are
+// replaced, collecting the non-empty strings replaced in secrets
+func redactValue(v interface{}, redacted map[string]bool, secrets *[]string) interface{} {
+	switch val := v.(type) {
+	case Args:
+		return redactValue(map[string]interface{}(val), redacted, secrets)
+	case map[string]interface{}:
+		if val == nil {
+			return val
+		}
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			if !redacted[k] {
+				out[k] = redactValue(item, redacted, secrets)
+				continue
+			}
+			if secret, ok := item.(string); ok && secret != "" {
+				*secrets = append(*secrets, secret)
+			}
+			out[k] = Redacted
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = redactValue(item, redacted, secrets)
+		}
+		return out
+	default:
+		return v
+	}
+}
@@ -0,0 +1,51 @@
+package unixsock
+
+import (
+	"strings"
+)
+
+// SysPrefix is the namespace of the reserved commands. Servers never pass
+// commands in it to their handlers, so that applications can not shadow
+// (or be shadowed by) the reserved commands.
+const SysPrefix = "_sys."
+
+// System commands, handled by servers themselves. Servers may move them to
+// another namespace or disable them (see server.WithSystemPrefix and
+// server.WithoutSystemCommands).
+const (
+	SysHealth      = SysPrefix + "health"      // Health check (see client's Ping)
+	SysDrain       = SysPrefix + "drain"       // Stop accepting connections
+	SysStats       = SysPrefix + "stats"       // Execution statistics of the commands
+	SysQueue       = SysPrefix + "queue"       // Metrics of the dispatch queue
+	SysClients     = SysPrefix + "clients"     // Connected clients
+	SysPprof       = SysPrefix + "pprof"       // Runtime profiles
+	SysExpvar      = SysPrefix + "expvar"      // Exported variables
+	SysCommands    = SysPrefix + "commands"    // Documented commands of the handler
+	SysMaintenance = SysPrefix + "maintenance" // Maintenance mode
+)
+
+// Protocol messages, exchanged by clients and servers as part of the wire
+// protocol. They always live in the SysPrefix namespace.
+const (
+	SysHello     = SysPrefix + "hello"     // Handshake negotiating connection features
+	SysSubscribe = SysPrefix + "subscribe" // Event filter and replay of missed events
+	SysCancel    = SysPrefix + "cancel"    // Cancellation of a command the client gave up on
+	SysGoAway    = SysPrefix + "goaway"    // Event announcing the server's shutdown
+	SysClose     = SysPrefix + "close"     // Event telling why the server closes the connection
+)
+
+// SystemCommands returns the system commands handled by servers
+func SystemCommands() []string {
+	return []string{SysHealth, SysDrain, SysStats, SysQueue, SysClients, SysPprof, SysExpvar, SysCommands, SysMaintenance}
+}
+
+// ReservedCommands returns all reserved commands, i.e. the system commands
+// and the protocol messages
+func ReservedCommands() []string {
+	return []string{SysHealth, SysHello, SysGoAway, SysDrain, SysStats, SysQueue, SysSubscribe, SysCancel, SysClients, SysPprof, SysExpvar, SysCommands, SysClose, SysMaintenance}
+}
+
+// IsReserved informs whether cmd belongs to the reserved namespace
+func IsReserved(cmd string) bool {
+	return strings.HasPrefix(cmd, SysPrefix)
+}
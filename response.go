@@ -0,0 +1,122 @@
+package unixsock
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// NewResponse creates a blank response to be completed by the chained
+// builder methods, e.g.:
+//
+//	return unixsock.NewResponse().OK().WithPayloadJSON(stats).WithMeta("unit", "ms")
+func NewResponse() *Response {
+	return &Response{}
+}
+
+// OK marks the response as successful
+func (r *Response) OK() *Response {
+	r.Status = STATUS_OK
+	r.Error = ""
+	return r
+}
+
+// Fail marks the response as failed due to err
+func (r *Response) Fail(err error) *Response {
+	r.Status = STATUS_FAIL
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// Failf marks the response as failed with a formatted error message
+func (r *Response) Failf(format string, args ...interface{}) *Response {
+	return r.Fail(fmt.Errorf(format, args...))
+}
+
+// WithStatus sets the status of the response, e.g. StatusPartial or
+// StatusRetry
+func (r *Response) WithStatus(status Status) *Response {
+	r.Status = status
+	return r
+}
+
+// WithPayload sets the payload of the response
+func (r *Response) WithPayload(payload string) *Response {
+	r.Payload = payload
+	return r
+}
+
+// WithPayloadJSON sets the payload of the response to the JSON encoding of
+// v. The response fails if v can not be encoded.
+func (r *Response) WithPayloadJSON(v interface{}) *Response {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return r.Failf("WithPayloadJSON: %s", err.Error())
+	}
+	r.Payload = string(payload)
+	return r
+}
+
+// WithWarning sets the warning of the response
+func (r *Response) WithWarning(warning string) *Response {
+	r.Warning = warning
+	return r
+}
+
+// WithMeta attaches a piece of metadata (e.g. units, versions or pagination
+// cursors) to the response
+func (r *Response) WithMeta(key, value string) *Response {
+	if r.Meta == nil {
+		r.Meta = make(map[string]string)
+	}
+	r.Meta[key] = value
+	return r
+}
+
+// WithTrailer attaches a piece of summary (e.g. a row count) to the trailer
+// of a streamed response
+func (r *Response) WithTrailer(key, value string) *Response {
+	if r.Trailer == nil {
+		r.Trailer = make(map[string]string)
+	}
+	r.Trailer[key] = value
+	return r
+}
+
+// WithStream sets the stream of the response (see Response.Stream)
+func (r *Response) WithStream(stream io.Reader) *Response {
+	r.Stream = stream
+	return r
+}
+
+// Succeeded informs whether the command succeeded
+func (r *Response) Succeeded() bool {
+	return r != nil && r.Status == STATUS_OK
+}
+
+// Err returns an error describing the failure of the command, or nil if it
+// succeeded
+func (r *Response) Err() error {
+	switch {
+	case r == nil:
+		return fmt.Errorf("no response")
+	case r.Status == STATUS_OK:
+		return nil
+	case r.Error != "":
+		return fmt.Errorf("%s: %s", r.Status, r.Error)
+	}
+	return fmt.Errorf("%s", r.Status)
+}
+
+// PayloadJSON decodes the JSON payload of the response into v
+func (r *Response) PayloadJSON(v interface{}) error {
+	if r == nil {
+		return fmt.Errorf("PayloadJSON: no response")
+	}
+	if err := json.Unmarshal([]byte(r.Payload), v); err != nil {
+		return fmt.Errorf("PayloadJSON: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package unixsock
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestResponseBuilder(t *testing.T) {
+
+	type stats struct {
+		Calls int `json:"calls"`
+	}
+
+	tests := []struct {
+		resp      *Response
+		status    Status
+		payload   string
+		meta      map[string]string
+		succeeded bool
+	}{
+		{NewResponse().OK().WithPayload("pong"), STATUS_OK, "pong", nil, true},
+		{NewResponse().OK().WithPayloadJSON(stats{3}).WithMeta("unit", "calls"), STATUS_OK, `{"calls":3}`, map[string]string{"unit": "calls"}, true},
+		{NewResponse().OK().WithPayloadJSON(func() {}), STATUS_FAIL, "", nil, false},
+		{NewResponse().Fail(fmt.Errorf("broken")), STATUS_FAIL, "", nil, false},
+		{NewResponse().Failf("broken %d", 2).OK(), STATUS_OK, "", nil, true},
+	}
+
+	for i, test := range tests {
+		if test.resp.Status != test.status || test.resp.Payload != test.payload || fmt.Sprint(test.resp.Meta) != fmt.Sprint(test.meta) {
+			t.Errorf("TestResponseBuilder: test %d failed: unexpected response %+v", i+1, test.resp)
+		}
+		if test.resp.Succeeded() != test.succeeded || (test.resp.Err() == nil) != test.succeeded {
+			t.Errorf("TestResponseBuilder: test %d failed: expected succeeded=%t, got error %v", i+1, test.succeeded, test.resp.Err())
+		}
+	}
+
+	// Round trip
+	encoded, _ := json.Marshal(NewResponse().OK().WithPayloadJSON(stats{7}).WithMeta("v", "2"))
+	decoded := &Response{}
+	json.Unmarshal(encoded, decoded)
+
+	s := stats{}
+	if err := decoded.PayloadJSON(&s); err != nil || s.Calls != 7 || decoded.Meta["v"] != "2" {
+		t.Errorf("TestResponseBuilder: round trip failed: %v (%+v)", err, decoded)
+	}
+
+}
+
+func TestStatus(t *testing.T) {
+
+	for _, status := range []Status{StatusOK, StatusFail, StatusPartial, StatusRetry, StatusExpired, StatusRejected} {
+		encoded, err := json.Marshal(&Response{Status: status})
+		if err != nil {
+			t.Fatalf("TestStatus: could not marshal %s: %s", status, err.Error())
+		}
+		if !strings.Contains(string(encoded), `"status":"`+string(status)+`"`) {
+			t.Errorf("TestStatus: %s not marshalled as a string: %s", status, encoded)
+		}
+		decoded := &Response{}
+		if err := json.Unmarshal(encoded, decoded); err != nil || decoded.Status != status {
+			t.Errorf("TestStatus: round trip of %s failed: %v", status, err)
+		}
+	}
+
+	if _, err := json.Marshal(&Response{Status: "done"}); err == nil {
+		t.Errorf("TestStatus: marshalled an unknown status")
+	}
+	if err := json.Unmarshal([]byte(`{"status":"done"}`), &Response{}); err == nil {
+		t.Errorf("TestStatus: unmarshalled an unknown status")
+	}
+	if err := json.Unmarshal([]byte(`{"status":""}`), &Response{}); err != nil {
+		t.Errorf("TestStatus: could not unmarshal an empty status: %s", err.Error())
+	}
+
+}
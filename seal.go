@@ -0,0 +1,111 @@
+package unixsock
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Sealed is an argument encrypted by a Sealer. It is sent (and recorded or
+// logged) as ciphertext only, so that secrets such as passwords or tokens
+// never appear in plaintext outside of the sender and the handler.
+type Sealed []byte
+
+// String hides the ciphertext in debug output
+func (s Sealed) String() string {
+	return "[sealed]"
+}
+
+// Sealer encrypts and decrypts selected arguments with a key shared by the
+// client and the server (AES-GCM). It is safe for concurrent use.
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+// NewSealer creates a sealer using key, which has to be 16, 24 or 32 bytes
+// long (AES-128, AES-192 or AES-256)
+func NewSealer(key []byte) (*Sealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("NewSealer: %s", err.Error())
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("NewSealer: %s", err.Error())
+	}
+
+	return &Sealer{aead: aead}, nil
+}
+
+// Seal returns a copy of args whose values under keys are sealed. Missing
+// keys and values sealed already are skipped. Every value is bound to its
+// key, so that sealed values can not be swapped between keys.
+func (s *Sealer) Seal(args Args, keys ...string) (Args, error) {
+	sealed := make(Args, len(args))
+	for key, value := range args {
+		sealed[key] = value
+	}
+
+	for _, key := range keys {
+		value, ok := args[key]
+		if _, isSealed := value.(Sealed); !ok || isSealed {
+			continue
+		}
+
+		encoded, err := encodeValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("Seal: %s", err.Error())
+		}
+		plaintext, err := json.Marshal(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("Seal: could not marshal '%s': %s", key, err.Error())
+		}
+
+		nonce := make([]byte, s.aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, fmt.Errorf("Seal: could not generate a nonce: %s", err.Error())
+		}
+
+		sealed[key] = Sealed(s.aead.Seal(nonce, nonce, plaintext, []byte(key)))
+	}
+
+	return sealed, nil
+}
+
+// Open returns a copy of args whose sealed values are decrypted. It fails if
+// a value has not been sealed with the key of the sealer or has been
+// tampered with.
+func (s *Sealer) Open(args Args) (Args, error) {
+	opened := make(Args, len(args))
+
+	for key, value := range args {
+		ciphertext, ok := value.(Sealed)
+		if !ok {
+			opened[key] = value
+			continue
+		}
+
+		nonceSize := s.aead.NonceSize()
+		if len(ciphertext) < nonceSize {
+			return nil, fmt.Errorf("Open: argument '%s' is too short to be sealed", key)
+		}
+		plaintext, err := s.aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], []byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("Open: could not open argument '%s': %s", key, err.Error())
+		}
+
+		var raw interface{}
+		if err := json.Unmarshal(plaintext, &raw); err != nil {
+			return nil, fmt.Errorf("Open: malformed argument '%s': %s", key, err.Error())
+		}
+		if opened[key], err = decodeValue(raw); err != nil {
+			return nil, fmt.Errorf("Open: %s", err.Error())
+		}
+	}
+
+	return opened, nil
+}
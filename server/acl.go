@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// Authorizer decides whether a peer may execute a command. It is invoked
+// before the handler (and after the tier policy, if any). A non-nil error
+// rejects the command and is returned to the client.
+type Authorizer interface {
+	Authorize(peer *unixsock.PeerCred, cmd string, args unixsock.Args) error
+}
+
+// AuthorizerFunc is an adapter allowing ordinary functions to be used as
+// Authorizers
+type AuthorizerFunc func(peer *unixsock.PeerCred, cmd string, args unixsock.Args) error
+
+// Authorize calls f(peer, cmd, args)
+func (f AuthorizerFunc) Authorize(peer *unixsock.PeerCred, cmd string, args unixsock.Args) error {
+	return f(peer, cmd, args)
+}
+
+// ACL actions
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// ACLRule allows the listed users and groups to execute the commands matching
+// Command, a pattern in path.Match syntax (e.g. "config.*")
+type ACLRule struct {
+	Command string   `json:"command"`
+	UIDs    []uint32 `json:"uids"`
+	GIDs    []uint32 `json:"gids"`
+}
+
+// ACL is an Authorizer based on UID/GID allowlists per command pattern. The
+// first rule matching a command decides whether the peer is allowed to
+// execute it. Commands not matching any rule are handled according to
+// Default ("allow" or "deny", defaults to "deny"). An ACL is typically loaded
+// from a JSON policy file:
+//
+//	{
+//	  "default": "deny",
+//	  "rules": [
+//	    {"command": "stats.*", "uids": [0, 1000], "gids": [100]},
+//	    {"command": "shutdown", "uids": [0]}
+//	  ]
+//	}
+type ACL struct {
+	Default string    `json:"default"`
+	Rules   []ACLRule `json:"rules"`
+}
+
+// LoadACL reads an ACL from a JSON policy file
+func LoadACL(filename string) (*ACL, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("LoadACL: could not read policy file: %s", err.Error())
+	}
+	return ParseACL(data)
+}
+
+// ParseACL parses and validates a JSON policy
+func ParseACL(data []byte) (*ACL, error) {
+
+	acl := &ACL{}
+	if err := json.Unmarshal(data, acl); err != nil {
+		return nil, fmt.Errorf("ParseACL: could not parse policy: %s", err.Error())
+	}
+
+	switch acl.Default {
+	case "":
+		acl.Default = ACLDeny
+	case ACLAllow, ACLDeny:
+	default:
+		return nil, fmt.Errorf("ParseACL: invalid default action '%s'", acl.Default)
+	}
+
+	for i, rule := range acl.Rules {
+		if _, err := path.Match(rule.Command, ""); err != nil {
+			return nil, fmt.Errorf("ParseACL: rule %d: invalid command pattern '%s'", i+1, rule.Command)
+		}
+	}
+
+	return acl, nil
+}
+
+// Authorize checks whether peer may execute cmd
+func (a *ACL) Authorize(peer *unixsock.PeerCred, cmd string, args unixsock.Args) error {
+
+	for _, rule := range a.Rules {
+		if ok, _ := path.Match(rule.Command, cmd); !ok {
+			continue
+		}
+		if peer != nil && (containsID(rule.UIDs, peer.UID) || containsID(rule.GIDs, peer.GID)) {
+			return nil
+		}
+		return fmt.Errorf("Authorize: access to command '%s' denied (%s)", cmd, peer)
+	}
+
+	if a.Default == ACLAllow {
+		return nil
+	}
+
+	return fmt.Errorf("Authorize: access to command '%s' denied by default (%s)", cmd, peer)
+}
+
+// containsID checks whether id is in ids
+func containsID(ids []uint32, id uint32) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
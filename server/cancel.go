@@ -0,0 +1,66 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// sysCancel is the reserved command a client sends in order to cancel one of
+// its commands (args "id") once the caller has given up on it. Clients send
+// it only to servers that acknowledged it in the handshake.
+const sysCancel = unixsock.SysCancel
+
+// cancelMeta is the key of the handshake response metadata acknowledging
+// that the server accepts cancellations
+const cancelMeta = "cancel"
+
+// cancelSet holds the cancel functions of the commands of a connection being
+// executed, by message ID
+type cancelSet struct {
+	mu      sync.Mutex
+	cancels map[uint64]func()
+}
+
+// newCancelSet creates an empty set of commands
+func newCancelSet() *cancelSet {
+	return &cancelSet{cancels: make(map[uint64]func())}
+}
+
+// add registers the cancel function of the command with the given ID
+func (f *cancelSet) add(id uint64, cancel func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cancels[id] = cancel
+}
+
+// remove forgets the command with the given ID
+func (f *cancelSet) remove(id uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.cancels, id)
+}
+
+// cancel cancels the context of the command with the given ID (if it is
+// still being executed)
+func (f *cancelSet) cancel(id uint64) {
+	f.mu.Lock()
+	cancel, ok := f.cancels[id]
+	f.mu.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
+
+// cancelID returns the ID of the command a cancellation refers to
+func cancelID(args unixsock.Args) (uint64, bool) {
+	switch value := args["id"].(type) {
+	case uint64:
+		return value, true
+	case float64: // Clients not using the uint64 type envelope
+		return uint64(value), true
+	default:
+		return 0, false
+	}
+}
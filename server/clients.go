@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// sysClients is the reserved command listing the connected clients
+const sysClients = unixsock.SysClients
+
+// ConnStats are the statistics of a single client connection. Connections
+// served by the HTTP or raw handler are not included.
+type ConnStats struct {
+	ID            uint64                `json:"id"` // Assigned in the order connections are accepted
+	Peer          *unixsock.PeerCred    `json:"peer,omitempty"`
+	Process       *unixsock.PeerProcess `json:"process,omitempty"`
+	Socket        string                `json:"socket,omitempty"`
+	Connected     time.Time             `json:"connected"`
+	LastActive    time.Time             `json:"last_active"`
+	Received      uint64                `json:"received"` // Messages received
+	Sent          uint64                `json:"sent"`     // Responses and events sent
+	BytesReceived uint64                `json:"bytes_received"`
+	BytesSent     uint64                `json:"bytes_sent"`
+	Errors        uint64                `json:"errors"` // Malformed messages and failed commands
+	InFlight      int64                 `json:"in_flight"`
+	Tags          map[string]string     `json:"tags,omitempty"`    // Set by the client in the handshake
+	Resumed       bool                  `json:"resumed,omitempty"` // Session of an earlier connection resumed (see WithSessionResumption)
+}
+
+// connContextKey is the context key of the activity of the connection a
+// command has been received over
+type connContextKey struct{}
+
+// ConnStatsFromContext returns the statistics of the connection the command
+// being handled has been received over (false if unavailable)
+func ConnStatsFromContext(ctx context.Context) (ConnStats, bool) {
+	activity, ok := ctx.Value(connContextKey{}).(*connActivity)
+	if !ok {
+		return ConnStats{}, false
+	}
+	return activity.stats(), true
+}
+
+// Clients returns the statistics of all connected clients (ordered by ID)
+func (u *unixSockSrv) Clients() []ConnStats {
+	u.mu.RLock()
+	clients := make([]ConnStats, 0, len(u.conns))
+	for _, activity := range u.conns {
+		clients = append(clients, activity.stats())
+	}
+	u.mu.RUnlock()
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+
+	return clients
+}
+
+// sysClientsHandler reports the statistics of all connected clients as JSON
+func sysClientsHandler(ctx context.Context, srv *unixSockSrv, args unixsock.Args) *unixsock.Response {
+	return unixsock.NewResponse().OK().WithPayloadJSON(srv.Clients())
+}
+
+// receivedMessage counts a message received over the connection
+func (a *connActivity) receivedMessage() {
+	atomic.AddUint64(&a.received, 1)
+}
+
+// sentMessage counts a response or an event sent over the connection
+func (a *connActivity) sentMessage() {
+	atomic.AddUint64(&a.sent, 1)
+}
+
+// failed counts a malformed message or a failed command
+func (a *connActivity) failed() {
+	atomic.AddUint64(&a.errors, 1)
+}
+
+// stats returns the current statistics of the connection
+func (a *connActivity) stats() ConnStats {
+	return ConnStats{
+		ID:            a.id,
+		Peer:          a.peer,
+		Process:       a.process,
+		Socket:        a.socket,
+		Connected:     a.connected,
+		LastActive:    time.Unix(0, atomic.LoadInt64(&a.last)),
+		Received:      atomic.LoadUint64(&a.received),
+		Sent:          atomic.LoadUint64(&a.sent),
+		BytesReceived: atomic.LoadUint64(&a.wire.read),
+		BytesSent:     atomic.LoadUint64(&a.wire.written),
+		Errors:        atomic.LoadUint64(&a.errors),
+		InFlight:      atomic.LoadInt64(&a.inFlight),
+		Tags:          a.tagged(),
+		Resumed:       atomic.LoadInt32(&a.resumed) == 1,
+	}
+}
+
+// countingConn counts the bytes read from and written to a connection
+type countingConn struct {
+	read    uint64 // atomic
+	written uint64 // atomic
+	net.Conn
+}
+
+// Read reads from the connection
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddUint64(&c.read, uint64(n))
+	return n, err
+}
+
+// Write writes to the connection
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddUint64(&c.written, uint64(n))
+	return n, err
+}
+
+// WriteMsgUnix writes to the connection along with control messages, e.g. in
+// order to pass files (see unixsock.Conn.PassFiles)
+func (c *countingConn) WriteMsgUnix(b, oob []byte, addr *net.UnixAddr) (int, int, error) {
+	uc, ok := c.Conn.(*net.UnixConn)
+	if !ok {
+		return 0, 0, fmt.Errorf("WriteMsgUnix: not a unix socket connection (%T)", c.Conn)
+	}
+	n, oobn, err := uc.WriteMsgUnix(b, oob, addr)
+	if n > 0 {
+		atomic.AddUint64(&c.written, uint64(n))
+	}
+	return n, oobn, err
+}
+
+// ReadMsgUnix reads from the connection along with control messages
+func (c *countingConn) ReadMsgUnix(b, oob []byte) (int, int, int, *net.UnixAddr, error) {
+	uc, ok := c.Conn.(*net.UnixConn)
+	if !ok {
+		return 0, 0, 0, nil, fmt.Errorf("ReadMsgUnix: not a unix socket connection (%T)", c.Conn)
+	}
+	n, oobn, flags, addr, err := uc.ReadMsgUnix(b, oob)
+	if n > 0 {
+		atomic.AddUint64(&c.read, uint64(n))
+	}
+	return n, oobn, flags, addr, err
+}
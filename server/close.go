@@ -0,0 +1,27 @@
+package server
+
+import (
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// sysClose is the reserved event sent to a client right before the server
+// closes its connection deliberately (args "reason", see
+// unixsock.CloseReason, and "message")
+const sysClose = unixsock.SysClose
+
+// closeTimeout is the time limit of sending a close frame, so that a client
+// not reading its connection does not hold up closing it
+const closeTimeout = 100 * time.Millisecond
+
+// sendClose tells the client why its connection is about to be closed.
+// Failures are ignored, since the connection is closed either way.
+func (u *unixSockSrv) sendClose(c *unixsock.Conn, reason unixsock.CloseReason, message string) {
+	frame := unixsock.NewSender(c, sysClose, unixsock.Args{
+		"reason":  string(reason),
+		"message": message,
+	}, false, false, unixsock.WithTimeout(closeTimeout))
+	frame.SetEvent(true)
+	frame.Send()
+}
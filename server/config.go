@@ -0,0 +1,134 @@
+package server
+
+import (
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// Config gathers the numeric settings of a server in a struct, e.g. decoded
+// from a configuration file, as an alternative to the corresponding options.
+// Start from DefaultConfig, since zero values disable the settings rather
+// than falling back to the defaults. Invalid settings make the server fail
+// at construction (see Validate), whichever way they have been passed.
+type Config struct {
+	ReceiveTimeout time.Duration `json:"receive_timeout"` // See WithReceiveTimeout
+	IdleTimeout    time.Duration `json:"idle_timeout"`    // See WithIdleTimeout
+	ReclaimIdle    time.Duration `json:"reclaim_idle"`    // See WithReclaimIdle
+	SocketWatch    time.Duration `json:"socket_watch"`    // See WithSocketWatch
+	SocketMode     os.FileMode   `json:"socket_mode"`     // See WithSocketMode
+
+	Workers       int     `json:"workers"`        // See WithDispatchQueue
+	QueueCapacity int     `json:"queue_capacity"` // See WithDispatchQueue
+	ShedWatermark float64 `json:"shed_watermark"` // See WithLoadShedding
+
+	ConcurrentPerConn int `json:"concurrent_per_conn"` // See WithConcurrentPerConn
+	MaxConnsPerPeer   int `json:"max_conns_per_peer"`  // See WithMaxConnsPerPeer
+
+	WriteBuffer     int           `json:"write_buffer"`      // See WithWriteBuffer
+	CompressMinSize int           `json:"compress_min_size"` // See WithResponseCompression
+	FileThreshold   int           `json:"file_threshold"`    // See WithFilePassing
+	EventHistory    int           `json:"event_history"`     // See WithEventHistory
+	ResumeTTL       time.Duration `json:"resume_ttl"`        // See WithSessionResumption
+	MessageSizes    []MessageSize `json:"message_sizes"`     // See WithMaxMessageSizeFor
+}
+
+// MessageSize is the maximum size of messages carrying commands matching
+// Pattern (see WithMaxMessageSizeFor)
+type MessageSize struct {
+	Pattern string `json:"pattern"`
+	Bytes   int    `json:"bytes"`
+}
+
+// Minimum interval between checks of the socket file (see WithSocketWatch)
+const minSocketWatch = 10 * time.Millisecond
+
+// DefaultConfig returns the default server settings
+func DefaultConfig() Config {
+	return Config{
+		ReceiveTimeout:  defaultReceiveTimeout,
+		CompressMinSize: defaultCompressMin,
+	}
+}
+
+// Validate returns a *unixsock.ConfigError listing the settings out of their
+// range
+func (c Config) Validate() error {
+	return validateOptions(c.Options())
+}
+
+// Options returns the options applying the configuration
+func (c Config) Options() []Option {
+	opts := []Option{
+		WithReceiveTimeout(c.ReceiveTimeout),
+		WithIdleTimeout(c.IdleTimeout),
+		WithReclaimIdle(c.ReclaimIdle),
+		WithSocketWatch(c.SocketWatch),
+		WithSocketMode(c.SocketMode),
+		WithDispatchQueue(c.Workers, c.QueueCapacity),
+		WithLoadShedding(c.ShedWatermark),
+		WithConcurrentPerConn(c.ConcurrentPerConn),
+		WithMaxConnsPerPeer(c.MaxConnsPerPeer),
+		WithWriteBuffer(c.WriteBuffer),
+		WithResponseCompression(c.CompressMinSize),
+		WithFilePassing(c.FileThreshold),
+		WithEventHistory(c.EventHistory),
+		WithSessionResumption(c.ResumeTTL),
+	}
+	for _, size := range c.MessageSizes {
+		opts = append(opts, WithMaxMessageSizeFor(size.Pattern, size.Bytes))
+	}
+	return opts
+}
+
+// validate returns a *unixsock.ConfigError listing the settings out of their
+// range
+func (o *options) validate() error {
+	e := &unixsock.ConfigError{}
+
+	e.Check(o.receiveTimeout >= 0, "receive timeout must not be negative, got %s", o.receiveTimeout)
+	e.Check(o.idleTimeout >= 0, "idle timeout must not be negative, got %s", o.idleTimeout)
+	e.Check(o.reclaimIdle >= 0, "reclaim idle must not be negative, got %s", o.reclaimIdle)
+	e.Check(o.socketWatch == 0 || o.socketWatch >= minSocketWatch, "socket watch interval must be 0 or at least %s, got %s", minSocketWatch, o.socketWatch)
+	e.Check(o.socketMode&^os.ModePerm == 0, "socket mode must only carry permission bits, got %s", o.socketMode)
+
+	e.Check(o.workers >= 0, "workers must not be negative, got %d", o.workers)
+	e.Check(o.queueCapacity >= 0, "queue capacity must not be negative, got %d", o.queueCapacity)
+	e.Check(o.queueCapacity == 0 || o.workers > 0, "queue capacity of %d requires workers", o.queueCapacity)
+	e.Check(o.shedWatermark >= 0 && o.shedWatermark <= 1, "shed watermark must be between 0 and 1, got %g", o.shedWatermark)
+	e.Check(o.shedWatermark == 0 || o.workers > 0, "load shedding requires a dispatch queue")
+
+	e.Check(o.concurrentPerConn >= 0, "concurrency per connection must not be negative, got %d", o.concurrentPerConn)
+	e.Check(o.maxConnsPerPeer >= 0, "connections per peer must not be negative, got %d", o.maxConnsPerPeer)
+	e.Check(o.writeBuffer >= 0, "write buffer must not be negative, got %d", o.writeBuffer)
+	e.Check(o.compressMinSize >= 0, "compression size must not be negative, got %d", o.compressMinSize)
+	e.Check(o.fileThreshold >= 0, "file passing threshold must not be negative, got %d", o.fileThreshold)
+	e.Check(o.eventHistory >= 0, "event history must not be negative, got %d", o.eventHistory)
+	e.Check(o.resumeTTL >= 0, "session resumption TTL must not be negative, got %s", o.resumeTTL)
+
+	e.Check(o.systemPrefix == "" || strings.HasSuffix(o.systemPrefix, "."), "system prefix must end with a dot, got '%s'", o.systemPrefix)
+	for cmd := range o.systemDisabled {
+		_, known := systemCommands[cmd]
+		e.Check(known, "unknown system command '%s'", cmd)
+	}
+
+	for _, limit := range o.sizeLimits {
+		_, err := path.Match(limit.pattern, "")
+		e.Check(err == nil, "message size pattern '%s' is malformed", limit.pattern)
+		e.Check(limit.bytes > 0 && int64(limit.bytes) <= unixsock.MaxMessageLength, "message size of '%s' must be between 1 and %d, got %d", limit.pattern, int64(unixsock.MaxMessageLength), limit.bytes)
+	}
+
+	return e.Err()
+}
+
+// validateOptions applies opts to the default settings and validates them
+func validateOptions(opts []Option) error {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o.validate()
+}
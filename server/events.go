@@ -0,0 +1,79 @@
+package server
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// Event history limits
+const eventTopics = 256 // Topics (event commands) whose history is kept
+
+// event is a single published event
+type event struct {
+	seq  uint64
+	cmd  string
+	args unixsock.Args
+}
+
+// eventLog numbers published events and keeps the most recent events of
+// every topic (i.e. event command), so that reconnecting subscribers can
+// catch up on the events they missed. Its lock is held while an event is
+// being delivered, so that replayed and live events do not interleave.
+type eventLog struct {
+	mu     sync.Mutex
+	seq    uint64
+	topics map[string][]event
+}
+
+// newEventLog creates an empty event log
+func newEventLog() *eventLog {
+	return &eventLog{topics: make(map[string][]event)}
+}
+
+// append numbers an event and keeps at most history events of its topic.
+// The caller must hold the lock.
+func (l *eventLog) append(cmd string, args unixsock.Args, history int) uint64 {
+	l.seq++
+
+	if history <= 0 {
+		return l.seq
+	}
+
+	// Do not let publishers of random topics exhaust the memory
+	events, ok := l.topics[cmd]
+	if !ok && len(l.topics) >= eventTopics {
+		return l.seq
+	}
+
+	events = append(events, event{l.seq, cmd, args})
+	if len(events) > history {
+		events = append(events[:0], events[len(events)-history:]...)
+	}
+	l.topics[cmd] = events
+
+	return l.seq
+}
+
+// since returns the kept events following seq that match filter, in the
+// order they were published. If seq is unknown (e.g. the subscriber saw the
+// events of a previous server process), all kept events are returned. The
+// caller must hold the lock.
+func (l *eventLog) since(seq uint64, filter eventFilter) []event {
+	if seq > l.seq {
+		seq = 0
+	}
+
+	missed := []event{}
+	for _, events := range l.topics {
+		for _, e := range events {
+			if e.seq > seq && filter.matches(e.args) {
+				missed = append(missed, e)
+			}
+		}
+	}
+	sort.Slice(missed, func(i, j int) bool { return missed[i].seq < missed[j].seq })
+
+	return missed
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// ExhaustedError is passed to the accept error callback (see OnAcceptError)
+// when accepting a connection fails because the process or the system has
+// run out of file descriptors or buffer space. Accepting is paused and
+// resumed with an exponential backoff.
+type ExhaustedError struct {
+	Err       error  // Error returned by accept
+	Reclaimed int    // Idle connections closed to free descriptors (see WithReclaimIdle)
+	Count     uint64 // Number of times the server has run out of resources so far
+}
+
+// Error implements the error interface
+func (e *ExhaustedError) Error() string {
+	return fmt.Sprintf("accept: resources exhausted (%d idle connections closed): %s", e.Reclaimed, e.Err.Error())
+}
+
+// isExhausted informs whether err signals the exhaustion of file descriptors
+// or buffer space
+func isExhausted(err error) bool {
+	if op, ok := err.(*net.OpError); ok {
+		err = op.Err
+	}
+	if sys, ok := err.(*os.SyscallError); ok {
+		err = sys.Err
+	}
+
+	switch err {
+	case syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM:
+		return true
+	}
+	return false
+}
+
+// exhausted frees descriptors after accept failed due to exhaustion by
+// closing idle connections (if enabled) and returns the error to report
+func (u *unixSockSrv) exhausted(err error) *ExhaustedError {
+	u.mu.Lock()
+	u.exhaustions++
+	count := u.exhaustions
+	u.mu.Unlock()
+
+	reclaimed := 0
+	if idle := u.options().reclaimIdle; idle > 0 {
+		reclaimed = u.closeIdle(idle, unixsock.CloseIdleTimeout, fmt.Sprintf("idle for more than %s", idle))
+	}
+
+	return &ExhaustedError{Err: err, Reclaimed: reclaimed, Count: count}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// filePassingMeta is the key of the handshake response metadata with which
+// servers agree to pass large payloads as files (see WithFilePassing)
+const filePassingMeta = "file_passing"
+
+// canPassFiles informs whether the wire of c is a unix socket, over which
+// files can be passed
+func canPassFiles(c *unixsock.Conn) bool {
+	wire, ok := c.Conn.(*countingConn)
+	if !ok {
+		return false
+	}
+	_, ok = wire.Conn.(*net.UnixConn)
+	return ok
+}
+
+// spill moves the payload of response into an unlinked temporary file passed
+// along with it (see WithFilePassing). Streams of regular files are passed
+// without copying them, reopened read-only (see reopenReadOnly). It returns the response to send and the file to pass (nil if
+// the payload is sent through the socket), which the caller closes once the
+// response has been sent.
+func spill(c *unixsock.Conn, response *unixsock.Response, o *options) (*unixsock.Response, *os.File) {
+
+	// Signatures do not cover passed files (see WithResponseSigning)
+	if o.fileThreshold <= 0 || o.signer != nil || response == nil || !c.FilePassing() || c.Compressed() {
+		return response, nil
+	}
+
+	if f, ok := response.Stream.(*os.File); ok && response.Payload == "" {
+		info, err := f.Stat()
+		if err != nil || !info.Mode().IsRegular() || info.Size() < int64(o.fileThreshold) {
+			return response, nil
+		}
+		passed, err := reopenReadOnly(f)
+		if err != nil {
+			return response, nil
+		}
+		f.Close()
+		spilled := *response
+		spilled.Stream = nil
+		return &spilled, passed
+	}
+
+	if response.Stream != nil || len(response.Payload) < o.fileThreshold {
+		return response, nil
+	}
+
+	f, err := ioutil.TempFile("", "unixsock-payload-")
+	if err != nil {
+		return response, nil
+	}
+	os.Remove(f.Name())
+
+	if _, err := io.WriteString(f, response.Payload); err != nil {
+		f.Close()
+		return response, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return response, nil
+	}
+
+	spilled := *response
+	spilled.Payload = ""
+
+	return &spilled, f
+}
+
+// reopenReadOnly opens the file of f anew for reading, at the offset of f,
+// so that the peer it is passed to neither shares the offset of the
+// handler's descriptor nor gets write access to the file. Linux reopens the
+// descriptor itself (see proc(5)), which works for unlinked files as well;
+// other systems reopen the path of f, as long as it still refers to the same
+// file.
+func reopenReadOnly(f *os.File) (*os.File, error) {
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	reopened, err := os.Open(fmt.Sprintf("/proc/self/fd/%d", f.Fd()))
+	if err != nil {
+		reopened, err = os.Open(f.Name())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if reopenedInfo, err := reopened.Stat(); err != nil || !os.SameFile(info, reopenedInfo) {
+		reopened.Close()
+		return nil, fmt.Errorf("reopenReadOnly: %s has been replaced", f.Name())
+	}
+	if _, err := reopened.Seek(offset, io.SeekStart); err != nil {
+		reopened.Close()
+		return nil, err
+	}
+
+	return reopened, nil
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	"github.com/vaitekunas/unixsock/client"
+	context "golang.org/x/net/context"
+)
+
+// Metadata keys of forwarded commands (see Forward)
+const (
+	ForwardedIDMeta   = "forwarded_id"   // ID assigned to the command by the original client
+	ForwardedPeerMeta = "forwarded_peer" // JSON encoded credentials of the original client
+)
+
+// forward is a single forwarding rule
+type forward struct {
+	pattern string
+	target  string
+	client  client.UnixSockClient
+}
+
+// forwardContextKey is the context key of the metadata of a forwarded command
+type forwardContextKey struct{}
+
+// ForwardedPeer returns the credentials of the client that originally sent a
+// command forwarded by another server (nil if the command has not been
+// forwarded). They must only be trusted if req.Peer is the forwarding server.
+func ForwardedPeer(req *Request) *unixsock.PeerCred {
+	data, ok := req.Meta[ForwardedPeerMeta]
+	if !ok {
+		return nil
+	}
+
+	peer := &unixsock.PeerCred{}
+	if err := json.Unmarshal([]byte(data), peer); err != nil {
+		return nil
+	}
+
+	return peer
+}
+
+// Forward proxies the commands matching pattern to the server listening on
+// targetPath
+func (u *unixSockSrv) Forward(pattern, targetPath string, opts ...client.Option) error {
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("Forward: invalid pattern '%s': %s", pattern, err.Error())
+	}
+
+	c, err := client.New(targetPath, append([]client.Option{client.WithCancellation()}, opts...)...)
+	if err != nil {
+		return fmt.Errorf("Forward: %s", err.Error())
+	}
+	c.Use(forwardMeta)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.forwards = append(u.forwards, &forward{pattern: pattern, target: targetPath, client: c})
+
+	return nil
+}
+
+// forwarding returns the first forwarding rule matching cmd (nil if none)
+func (u *unixSockSrv) forwarding(cmd string) *forward {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	for _, fw := range u.forwards {
+		if matched, _ := path.Match(fw.pattern, cmd); matched {
+			return fw
+		}
+	}
+
+	return nil
+}
+
+// closeForwards closes the clients of all forwarding rules
+func (u *unixSockSrv) closeForwards() {
+	u.mu.RLock()
+	forwards := u.forwards
+	u.mu.RUnlock()
+
+	for _, fw := range forwards {
+		fw.client.Quit()
+	}
+}
+
+// send forwards req to the target server, along with its metadata, expiry,
+// priority and body. The forwarded command is cancelled along with ctx.
+func (fw *forward) send(ctx context.Context, req *Request) *unixsock.Response {
+
+	meta := make(map[string]string, len(req.Meta)+2)
+	for key, value := range req.Meta {
+		meta[key] = value
+	}
+	meta[ForwardedIDMeta] = strconv.FormatUint(req.ID, 10)
+	if req.Peer != nil {
+		peer, _ := json.Marshal(req.Peer)
+		meta[ForwardedPeerMeta] = string(peer)
+	}
+	ctx = context.WithValue(ctx, forwardContextKey{}, meta)
+
+	opts := []client.CallOption{client.WithCallPriority(req.Priority)}
+	if !req.Expires.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, req.Expires)
+		defer cancel()
+		opts = append(opts, client.WithCallTTL(time.Until(req.Expires)))
+	}
+
+	var resp *unixsock.Response
+	var err error
+	if body := req.Body(); body != nil {
+		resp, err = fw.client.SendFrom(ctx, req.Cmd, req.Args, body, -1)
+	} else {
+		resp, err = fw.client.Call(ctx, req.Cmd, req.Args, opts...)
+	}
+	if err != nil {
+		return unixsock.NewResponse().Failf("forward: could not forward '%s' to %s: %s", req.Cmd, fw.target, err.Error())
+	}
+
+	return resp
+}
+
+// forwardMeta attaches the metadata of the forwarded command to the request
+// sent to the target server
+func forwardMeta(next client.Sender) client.Sender {
+	return func(ctx context.Context, req *client.Request) (*unixsock.Response, error) {
+		if meta, ok := ctx.Value(forwardContextKey{}).(map[string]string); ok {
+			for key, value := range meta {
+				req.SetMeta(key, value)
+			}
+		}
+		return next(ctx, req)
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"io"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// Handler responds to a command received by the server. Stateful handler
+// objects, generated handlers and middleware can implement it instead of
+// passing a bare function to New.
+type Handler interface {
+	ServeUnix(ctx context.Context, req *Request) *unixsock.Response
+}
+
+// HandlerFunc is an adapter allowing the use of ordinary functions as
+// handlers
+type HandlerFunc func(ctx context.Context, req *Request) *unixsock.Response
+
+// ServeUnix calls f(ctx, req)
+func (f HandlerFunc) ServeUnix(ctx context.Context, req *Request) *unixsock.Response {
+	return f(ctx, req)
+}
+
+// Middleware wraps a handler, e.g. in order to log or authenticate the
+// requests reaching it (see Router.Use)
+type Middleware func(next Handler) Handler
+
+// Request is a command received by the server
+type Request struct {
+	// ID is the message ID assigned by the client
+	ID uint64
+
+	// Cmd is the command
+	Cmd string
+
+	// Args are the command arguments
+	Args unixsock.Args
+
+	// Meta is the metadata sent along with the command (e.g. trace IDs, auth
+	// tokens or the locale), or nil if there is none
+	Meta map[string]string
+
+	// Priority is the scheduling priority requested by the client
+	Priority unixsock.Priority
+
+	// Expires is the time after which the command must not be executed
+	// anymore (zero if it never expires)
+	Expires time.Time
+
+	// Peer contains the credentials of the client (nil if unavailable)
+	Peer *unixsock.PeerCred
+
+	// Process identifies the executable and control group of the client
+	// (nil unless the server resolves them, see WithPeerProcess)
+	Process *unixsock.PeerProcess
+
+	// Socket is the address of the listener the connection was accepted on,
+	// i.e. the path of the server's socket (empty if unavailable)
+	Socket string
+
+	body io.Reader // Upload pipe of a streamed request body (see Body)
+}
+
+// Body returns the request body streamed by the client (see
+// client.SendFrom), or nil if there is none. It has to be consumed before the
+// handler returns.
+func (r *Request) Body() io.Reader {
+	return r.body
+}
+
+// funcHandler adapts the bare handler functions accepted by New
+type funcHandler func(cmd string, args unixsock.Args) *unixsock.Response
+
+// ServeUnix calls f with the arguments (and body) of req
+func (f funcHandler) ServeUnix(ctx context.Context, req *Request) *unixsock.Response {
+	args := req.Args
+	if body := req.Body(); body != nil {
+		args = unixsock.WithBody(args, body)
+	}
+	return f(req.Cmd, args)
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"github.com/vaitekunas/unixsock"
+)
+
+// sysHello is the reserved handshake command a client may send as the first
+// message of a connection in order to negotiate connection features
+const sysHello = unixsock.SysHello
+
+// handshake answers a client's hello and enables the negotiated features.
+// The response is sent before any feature is enabled, so that the client can
+// read it regardless of the outcome. It returns the encoding the client
+// accepts for response payloads (if any) and whether the client cancels the
+// commands it has given up on (see sysCancel).
+func handshake(c *unixsock.Conn, receiver unixsock.Communicator, o *options, meta map[string]string) (string, bool) {
+
+	// Pick the first supported stream compression algorithm
+	compression := ""
+	if !c.Compressed() {
+		compression = supported(receiver.GetArgs()["compression"])
+	}
+
+	// Frame headers are understood by the client regardless of the outcome,
+	// so they are enabled before responding
+	if requested, _ := receiver.GetArgs()["frame_header"].(bool); requested {
+		crc, _ := receiver.GetArgs()["frame_crc"].(bool)
+		c.EnableFrameHeader(crc)
+	}
+
+	// Cancellations are acknowledged in the metadata, which older clients
+	// ignore
+	resp := &unixsock.Response{
+		Status:  unixsock.STATUS_OK,
+		Payload: compression,
+	}
+	cancellable, _ := receiver.GetArgs()["cancel"].(bool)
+	if cancellable {
+		resp.WithMeta(cancelMeta, "true")
+	}
+
+	// Large payloads are passed as files to clients accepting them, unless
+	// the stream is compressed
+	if requested, _ := receiver.GetArgs()["file_passing"].(bool); requested && o.fileThreshold > 0 && compression == "" && !c.Compressed() {
+		if canPassFiles(c) && c.PassFiles() == nil {
+			resp.WithMeta(filePassingMeta, "true")
+		}
+	}
+
+	for key, value := range meta {
+		resp.WithMeta(key, value)
+	}
+
+	receiver.SetWriteBuffer(o.writeBuffer)
+	receiver.SetResponse(resp)
+	if err := receiver.Send(); err != nil {
+		return "", false
+	}
+
+	if compression != "" {
+		c.EnableCompression(compression)
+	}
+
+	// Compressing payloads of a compressed stream is a waste of time
+	if compression != "" || c.Compressed() {
+		return "", cancellable
+	}
+
+	return supported(receiver.GetArgs()["accept_encoding"]), cancellable
+}
+
+// supported returns the first supported compression algorithm of a list
+// advertised by the client
+func supported(advertised interface{}) string {
+	list, _ := advertised.([]interface{})
+	for _, item := range list {
+		if item == unixsock.CompressionFlate {
+			return unixsock.CompressionFlate
+		}
+	}
+	return ""
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// sysCommands is the reserved command listing the documented commands
+const sysCommands = unixsock.SysCommands
+
+// Help documents a command for operators (see Router.Describe), e.g. for
+// rendering the --help of a command line tool
+type Help struct {
+	// Usage summarizes what the command does
+	Usage string `json:"usage,omitempty"`
+
+	// Args describes the arguments of the command
+	Args map[string]string `json:"args,omitempty"`
+
+	// Examples are sample invocations, e.g. "unit.restart unit=nginx.service"
+	Examples []string `json:"examples,omitempty"`
+}
+
+// CommandInfo describes a single command served by a router
+type CommandInfo struct {
+	Name       string   `json:"name"`
+	Tier       string   `json:"tier"`
+	Aliases    []string `json:"aliases,omitempty"`
+	Deprecated bool     `json:"deprecated,omitempty"`
+	Schema     *Schema  `json:"schema,omitempty"`
+	Help       *Help    `json:"help,omitempty"`
+}
+
+// Describer is implemented by handlers documenting their commands (e.g.
+// Router), which are then listed by the reserved command _sys.commands
+type Describer interface {
+	Commands() []CommandInfo
+}
+
+// Describe attaches help to cmd (which has to be registered first)
+func (r *Router) Describe(cmd string, help Help) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rt, ok := r.routes[cmd]
+	if !ok {
+		return fmt.Errorf("Describe: unknown command '%s'", cmd)
+	}
+	described := *rt
+	described.help = &help
+	r.routes[cmd] = &described
+
+	return nil
+}
+
+// Commands describes the commands served by the router, including those of
+// mounted sub-routers (under their prefixed names), ordered by name
+func (r *Router) Commands() []CommandInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	aliases := make(map[string][]string)
+	for alias, cmd := range r.aliases {
+		aliases[cmd] = append(aliases[cmd], alias)
+	}
+
+	var commands []CommandInfo
+	for prefix, sub := range r.mounts {
+		for _, info := range sub.Commands() {
+			info.Name = prefix + info.Name
+			for i := range info.Aliases {
+				info.Aliases[i] = prefix + info.Aliases[i]
+			}
+			commands = append(commands, info)
+		}
+	}
+	for cmd, rt := range r.routes {
+		_, deprecated := r.deprecated[cmd]
+		sort.Strings(aliases[cmd])
+		commands = append(commands, CommandInfo{
+			Name:       cmd,
+			Tier:       rt.tier.String(),
+			Aliases:    aliases[cmd],
+			Deprecated: deprecated,
+			Schema:     rt.schema,
+			Help:       rt.help,
+		})
+	}
+
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+
+	return commands
+}
+
+// sysCommandsHandler lists the commands of a handler implementing Describer
+// as JSON
+func sysCommandsHandler(ctx context.Context, srv *unixSockSrv, args unixsock.Args) *unixsock.Response {
+	describer, ok := srv.handler.(Describer)
+	if !ok {
+		return unixsock.NewResponse().Failf("commands: the server does not document its commands")
+	}
+
+	commands := describer.Commands()
+	if cmd, _ := args["cmd"].(string); cmd != "" {
+		for _, info := range commands {
+			if info.Name == cmd {
+				return unixsock.NewResponse().OK().WithPayloadJSON([]CommandInfo{info})
+			}
+			for _, alias := range info.Aliases {
+				if alias == cmd {
+					return unixsock.NewResponse().OK().WithPayloadJSON([]CommandInfo{info})
+				}
+			}
+		}
+		return unixsock.NewResponse().Failf("commands: unknown command '%s'", cmd)
+	}
+
+	return unixsock.NewResponse().OK().WithPayloadJSON(commands)
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// peerContextKey is the context key of the credentials of an HTTP client
+type peerContextKey struct{}
+
+// PeerFromRequest returns the credentials of the peer that sent an HTTP
+// request served via WithHTTPHandler (nil if unavailable)
+func PeerFromRequest(r *http.Request) *unixsock.PeerCred {
+	peer, _ := r.Context().Value(peerContextKey{}).(*unixsock.PeerCred)
+	return peer
+}
+
+// isHTTP informs whether the client of a fresh connection speaks HTTP. HTTP
+// requests start with an uppercase method, unlike frames (see
+// unixsock.FrameMagic), whose length would have to exceed 1GB, and JSON lines.
+func isHTTP(c *unixsock.Conn, timeout time.Duration) bool {
+	if timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
+		defer c.SetReadDeadline(time.Time{})
+	}
+
+	first, err := c.Peek(1)
+	if err != nil {
+		return false
+	}
+	return first[0] >= 'A' && first[0] <= 'Z' && first[0] != unixsock.FrameMagic[0]
+}
+
+// httpTier returns the tier required by an HTTP request: safe methods only
+// inspect state, all others change it
+func httpTier(r *http.Request) Tier {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return TierReadOnly
+	default:
+		return TierMutating
+	}
+}
+
+// serveHTTP serves the HTTP requests sent over a single connection with
+// handler. Requests are authorized like commands named "METHOD /path" and
+// carry the credentials of the peer (see PeerFromRequest). The connection is
+// closed once the server stops.
+func (u *unixSockSrv) serveHTTP(c *unixsock.Conn, peer *unixsock.PeerCred, handler http.Handler) {
+
+	authorized := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o := u.options()
+		cmd := fmt.Sprintf("%s %s", r.Method, r.URL.Path)
+		err := authorize(o, peer, cmd, httpTier(r))
+		if err == nil && o.authorizer != nil {
+			err = o.authorizer.Authorize(peer, cmd, unixsock.Args{"method": r.Method, "path": r.URL.Path})
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerContextKey{}, peer)))
+	})
+
+	l := newConnListener(c)
+	go func() {
+		select {
+		case <-u.ctx.Done():
+			c.Close()
+		case <-l.done:
+		}
+	}()
+
+	o := u.options()
+	srv := &http.Server{
+		Handler:           authorized,
+		ReadHeaderTimeout: o.receiveTimeout,
+		IdleTimeout:       o.idleTimeout,
+	}
+	srv.Serve(l)
+}
+
+// connListener is a listener accepting a single connection. Once the
+// connection has been accepted, Accept blocks until it is closed.
+type connListener struct {
+	conn net.Conn
+	addr net.Addr
+	once sync.Once
+	done chan struct{}
+}
+
+// newConnListener creates a listener accepting conn
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{addr: conn.LocalAddr(), done: make(chan struct{})}
+	l.conn = &listenedConn{Conn: conn, l: l}
+	return l
+}
+
+// Accept returns the connection on the first call
+func (l *connListener) Accept() (net.Conn, error) {
+	if conn := l.conn; conn != nil {
+		l.conn = nil
+		return conn, nil
+	}
+	<-l.done
+	return nil, fmt.Errorf("Accept: connection closed")
+}
+
+// Close stops the listener
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr returns the address of the listener
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// listenedConn closes its listener once closed
+type listenedConn struct {
+	net.Conn
+	l *connListener
+}
+
+// Close closes the connection and its listener
+func (c *listenedConn) Close() error {
+	err := c.Conn.Close()
+	c.l.Close()
+	return err
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// connActivity tracks the activity of a connection for the idle reaper and
+// its statistics (see ConnStats)
+type connActivity struct {
+	last     int64        // Time of the last message received or response sent (unix nanoseconds)
+	inFlight int64        // Commands being executed
+	received uint64       // Messages received
+	sent     uint64       // Responses and events sent
+	errors   uint64       // Malformed messages and failed commands
+	reaped   int32        // Closed by the reaper
+	tags     atomic.Value // Tags set by the client in the handshake (map[string]string)
+	resumed  int32        // Session of an earlier connection resumed (see WithSessionResumption)
+	token    string       // Token resuming the session (guarded by the server's lock)
+
+	id        uint64
+	peer      *unixsock.PeerCred
+	process   *unixsock.PeerProcess // Resolved on accept (see WithPeerProcess)
+	socket    string
+	connected time.Time
+	wire      *countingConn // Bytes read and written
+}
+
+// newConnActivity creates the activity of a freshly accepted connection
+func newConnActivity(id uint64, peer *unixsock.PeerCred, socket string, wire *countingConn) *connActivity {
+	now := time.Now()
+	return &connActivity{
+		last:      now.UnixNano(),
+		id:        id,
+		peer:      peer,
+		socket:    socket,
+		connected: now,
+		wire:      wire,
+	}
+}
+
+// touch records activity on the connection
+func (a *connActivity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// begin records the start of a command
+func (a *connActivity) begin() {
+	atomic.AddInt64(&a.inFlight, 1)
+}
+
+// end records the end of a command
+func (a *connActivity) end() {
+	a.touch()
+	atomic.AddInt64(&a.inFlight, -1)
+}
+
+// idle returns how long the connection has been idle. Connections executing
+// commands are never idle.
+func (a *connActivity) idle(now time.Time) time.Duration {
+	if atomic.LoadInt64(&a.inFlight) > 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&a.last)))
+}
+
+// wasReaped informs whether the connection has been closed by the reaper
+func (a *connActivity) wasReaped() bool {
+	return atomic.LoadInt32(&a.reaped) == 1
+}
+
+// shutdownGrace is how long connections may stay idle once the server has
+// been stopped. Clients normally close them upon the shutdown notice, but
+// peers that do not would otherwise keep their goroutines running for good.
+const shutdownGrace = time.Second
+
+// reapIdle closes connections idle for longer than the idle timeout (see
+// WithIdleTimeout) until the server is stopped, and the connections left
+// open afterwards (see reapShutdown)
+func (u *unixSockSrv) reapIdle() {
+	for {
+		interval := time.Second
+		if timeout := u.options().idleTimeout; timeout > 0 {
+			if interval = timeout / 4; interval < time.Millisecond {
+				interval = time.Millisecond
+			}
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-u.ctx.Done():
+			u.reapShutdown()
+			return
+		}
+
+		if timeout := u.options().idleTimeout; timeout > 0 {
+			u.closeIdle(timeout, unixsock.CloseIdleTimeout, fmt.Sprintf("idle for more than %s", timeout))
+		}
+	}
+}
+
+// reapShutdown closes the connections idle for longer than shutdownGrace
+// after the server has been stopped, until none are left. Connections
+// executing commands are closed once they are done.
+func (u *unixSockSrv) reapShutdown() {
+	for {
+		u.mu.RLock()
+		open := len(u.conns)
+		u.mu.RUnlock()
+		if open == 0 {
+			return
+		}
+
+		u.closeIdle(shutdownGrace, unixsock.CloseShutdown, "server stopped")
+		time.Sleep(shutdownGrace / 10)
+	}
+}
+
+// closeIdle closes the connections idle for longer than threshold, telling
+// their clients why, and returns their number
+func (u *unixSockSrv) closeIdle(threshold time.Duration, reason unixsock.CloseReason, message string) int {
+
+	now := time.Now()
+	var idle []*unixsock.Conn
+	u.mu.RLock()
+	for c, activity := range u.conns {
+		if activity.idle(now) > threshold {
+			atomic.StoreInt32(&activity.reaped, 1)
+			idle = append(idle, c)
+		}
+	}
+	u.mu.RUnlock()
+
+	for _, c := range idle {
+		u.sendClose(c, reason, message)
+		c.Close()
+	}
+
+	return len(idle)
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrAlreadyRunning is returned by New when another process holds the lock
+// of the socket, i.e. serves (or is about to serve) it, or answers on the
+// socket without using the lock
+type ErrAlreadyRunning struct {
+	Path string // Path of the socket
+	PID  int    // Process holding the lock (0 if unknown)
+}
+
+// Error implements the error interface
+func (e *ErrAlreadyRunning) Error() string {
+	if e.PID > 0 {
+		return fmt.Sprintf("already running: %s is served by process %d", e.Path, e.PID)
+	}
+	return fmt.Sprintf("already running: %s is served by another process", e.Path)
+}
+
+// staleCheckTimeout is the time limit of connecting to an existing socket in
+// order to tell whether it is stale
+const staleCheckTimeout = time.Second
+
+// lockPath returns the path of the lock file guarding a socket
+func lockPath(socketPath string) string {
+	return socketPath + ".lock"
+}
+
+// listenLocked takes the lock of the socket (see lockSocket), removes a stale
+// socket left behind by a crashed process (unless somebody answers on it)
+// and listens on the socket, created with the
+// permissions mode (0 for the default ones). The lock is held until the
+// listener is closed, so that two processes racing at startup can not remove
+// and rebind each other's socket.
+func listenLocked(socketPath string, mode os.FileMode) (*lockedListener, error) {
+
+	lock, err := lockSocket(socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// No server using the lock serves a socket we hold the lock of, but
+	// others (e.g. older releases or other programs) might: only sockets
+	// nobody answers on are stale (without locking support the socket may
+	// well be served, though)
+	if lock != nil {
+		if info, err := os.Lstat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.DialTimeout("unix", socketPath, staleCheckTimeout); err == nil {
+				conn.Close()
+				lock.Close()
+				return nil, &ErrAlreadyRunning{Path: socketPath}
+			}
+			os.Remove(socketPath)
+		}
+	}
+
+	l, served, err := listenSocket(socketPath, mode)
+	if err != nil {
+		if lock != nil {
+			lock.Close()
+		}
+		return nil, err
+	}
+
+	return &lockedListener{l: l, path: socketPath, mode: mode, served: served, lock: lock}, nil
+}
+
+// listenSocket listens on a socket created with the given permissions (see
+// listenUnix) and returns the socket file along with the listener. The
+// listener does not remove the socket once closed, since by then the path
+// may well belong to another process (see lockedListener.Close).
+func listenSocket(socketPath string, mode os.FileMode) (net.Listener, os.FileInfo, error) {
+
+	l, err := listenUnix(socketPath, mode)
+	if err != nil {
+		return nil, nil, err
+	}
+	if unix, ok := l.(*net.UnixListener); ok {
+		unix.SetUnlinkOnClose(false)
+	}
+
+	served, err := os.Lstat(socketPath)
+	if err != nil {
+		l.Close()
+		return nil, nil, err
+	}
+
+	return l, served, nil
+}
+
+// lockedListener listens on a socket it holds the lock of (if locking is
+// supported) and releases the lock once closed. It can listen on the socket
+// again if the socket file is removed while serving (see rebind).
+type lockedListener struct {
+	mu     sync.RWMutex
+	l      net.Listener
+	path   string
+	mode   os.FileMode
+	served os.FileInfo // Socket file created by the listener
+	lock   *os.File
+	closed bool
+}
+
+// Accept waits for the next connection
+func (l *lockedListener) Accept() (net.Conn, error) {
+	for {
+		l.mu.RLock()
+		current := l.l
+		l.mu.RUnlock()
+
+		conn, err := current.Accept()
+		if err != nil {
+			// The socket has been replaced by rebind
+			l.mu.RLock()
+			rebound := l.l != current && !l.closed
+			l.mu.RUnlock()
+			if rebound {
+				continue
+			}
+		}
+
+		return conn, err
+	}
+}
+
+// Addr returns the address of the listener
+func (l *lockedListener) Addr() net.Addr {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.l.Addr()
+}
+
+// Close closes the listener and releases the lock. The socket file is
+// removed only if it is still the one created by the listener, i.e. has not
+// been replaced by another process in the meantime. Closing the listener
+// more than once is a no-op.
+func (l *lockedListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+
+	err := l.l.Close()
+	if info, errStat := os.Lstat(l.path); errStat == nil && os.SameFile(info, l.served) {
+		os.Remove(l.path)
+	}
+	if l.lock != nil {
+		l.lock.Close()
+	}
+
+	return err
+}
+
+// rebind listens on the socket path again, e.g. after the socket file has
+// been removed by a temp directory cleaner. The replaced socket is closed
+// without removing the new socket file, while the lock is kept.
+func (l *lockedListener) rebind() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return fmt.Errorf("rebind: listener closed")
+	}
+
+	next, served, err := listenSocket(l.path, l.mode)
+	if err != nil {
+		return fmt.Errorf("rebind: %s", err.Error())
+	}
+
+	l.l.Close()
+	l.l = next
+	l.served = served
+
+	return nil
+}
@@ -0,0 +1,39 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lockSocket takes an exclusive lock on the lock file of a socket and records
+// the PID of the process in it. The lock is released by closing the file
+// (or when the process exits).
+func lockSocket(socketPath string) (*os.File, error) {
+
+	f, err := os.OpenFile(lockPath(socketPath), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the lock file: %s", err.Error())
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if err == syscall.EWOULDBLOCK {
+			content, _ := ioutil.ReadAll(f)
+			pid, _ := strconv.Atoi(strings.TrimSpace(string(content)))
+			return nil, &ErrAlreadyRunning{Path: socketPath, PID: pid}
+		}
+		return nil, fmt.Errorf("could not lock %s: %s", f.Name(), err.Error())
+	}
+
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+
+	return f, nil
+}
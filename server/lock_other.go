@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"os"
+)
+
+// lockSocket is a no-op, since locking is not supported on this platform
+func lockSocket(socketPath string) (*os.File, error) {
+	return nil, nil
+}
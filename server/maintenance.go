@@ -0,0 +1,89 @@
+package server
+
+import (
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// sysMaintenance is the reserved command reporting and toggling the
+// maintenance mode (args "enabled", "message" and "eta", e.g. "15m")
+const sysMaintenance = unixsock.SysMaintenance
+
+// Metadata of the responses to commands refused during maintenance
+const (
+	MaintenanceReason  = "maintenance" // Value of the response metadata "reason"
+	MaintenanceETAMeta = "eta"         // Expected end of the maintenance (RFC 3339, if known)
+)
+
+// Maintenance describes a maintenance of the server (see SetMaintenance)
+type Maintenance struct {
+	Message string    // Reported to the clients, e.g. "migrating the database"
+	ETA     time.Time // Expected end (zero if unknown)
+}
+
+// SetMaintenance puts the server into maintenance mode (nil ends it). While
+// in maintenance, commands below TierAdmin (as classified by WithPolicy) are
+// refused with unixsock.StatusRetry, so that clients back off until the
+// ETA. Reserved commands and admin commands are executed normally.
+func (u *unixSockSrv) SetMaintenance(m *Maintenance) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.maintenance = m
+}
+
+// inMaintenance returns the current maintenance (nil if none)
+func (u *unixSockSrv) inMaintenance() *Maintenance {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.maintenance
+}
+
+// maintenanceResponse is returned for commands refused during maintenance
+func maintenanceResponse(cmd string, m *Maintenance) *unixsock.Response {
+	resp := unixsock.NewResponse().
+		Failf("dispatch: server in maintenance, command '%s' refused: %s", cmd, m.Message).
+		WithStatus(unixsock.StatusRetry).
+		WithMeta("reason", MaintenanceReason)
+	if !m.ETA.IsZero() {
+		resp.WithMeta(MaintenanceETAMeta, m.ETA.Format(time.RFC3339))
+	}
+	return resp
+}
+
+// sysMaintenanceHandler toggles the maintenance mode (if "enabled" is given)
+// and reports it as JSON
+func sysMaintenanceHandler(ctx context.Context, srv *unixSockSrv, args unixsock.Args) *unixsock.Response {
+
+	if enabled, ok := args["enabled"].(bool); ok {
+		if !enabled {
+			srv.SetMaintenance(nil)
+		} else {
+			m := &Maintenance{}
+			m.Message, _ = args["message"].(string)
+			if eta, _ := args["eta"].(string); eta != "" {
+				d, err := time.ParseDuration(eta)
+				if err != nil {
+					return unixsock.NewResponse().Failf("maintenance: invalid eta '%s': %s", eta, err.Error())
+				}
+				m.ETA = time.Now().Add(d)
+			}
+			srv.SetMaintenance(m)
+		}
+	} else if _, given := args["enabled"]; given {
+		return unixsock.NewResponse().Failf("maintenance: 'enabled' must be a boolean")
+	}
+
+	m := srv.inMaintenance()
+	if m == nil {
+		return unixsock.NewResponse().OK().WithPayloadJSON(map[string]interface{}{"enabled": false})
+	}
+
+	state := map[string]interface{}{"enabled": true, "message": m.Message}
+	if !m.ETA.IsZero() {
+		state["eta"] = m.ETA.Format(time.RFC3339)
+	}
+
+	return unixsock.NewResponse().OK().WithPayloadJSON(state)
+}
@@ -0,0 +1,529 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	"github.com/vaitekunas/unixsock/record"
+)
+
+// Receiving defaults
+const (
+	defaultMaxMessageSize = 1 << 20         // Applies to commands without a specific limit
+	defaultReceiveTimeout = 5 * time.Second // Idle connections are closed afterwards
+	defaultCompressMin    = 1 << 10         // Smaller payloads are not worth compressing
+)
+
+// Option configures a UnixSockSrv
+type Option func(*options)
+
+// options contains the optional settings of a UnixSockSrv
+type options struct {
+	policy   *Policy
+	classify func(cmd string) Tier
+
+	authorizer Authorizer
+
+	onAcceptError  func(err error)
+	onReceiveError func(err error)
+	onSocketLost   func(path string, err error)
+
+	socketWatch time.Duration
+	socketMode  os.FileMode
+	transport   unixsock.Transport
+
+	workers       int
+	queueCapacity int
+	shedWatermark float64
+
+	writeBuffer int
+
+	concurrentPerConn int
+
+	sizeLimits     []sizeLimit
+	receiveTimeout time.Duration
+	idleTimeout    time.Duration
+	reclaimIdle    time.Duration
+
+	maxConnsPerPeer int
+	peerProcess     bool
+
+	compressMinSize int
+	fileThreshold   int
+
+	systemd bool
+	inline  bool
+
+	acceptDispatcher bool // See withAcceptDispatcher
+
+	dumper     *unixsock.Dumper
+	dumpFilter func(peer *unixsock.PeerCred) bool
+
+	recorder *record.Recorder
+	signer   *unixsock.Signer
+
+	httpHandler http.Handler
+	rawHandler  RawHandler
+
+	eventHistory int
+	resumeTTL    time.Duration
+
+	systemPrefix   string          // Namespace of the system commands (see WithSystemPrefix)
+	systemDisabled map[string]bool // Disabled system commands (see WithoutSystemCommands)
+}
+
+// sizeLimit is the maximum message size of the commands matching pattern
+type sizeLimit struct {
+	pattern string
+	bytes   int
+}
+
+// defaultOptions returns the default server settings
+func defaultOptions() *options {
+	return &options{
+		receiveTimeout:  defaultReceiveTimeout,
+		compressMinSize: defaultCompressMin,
+	}
+}
+
+// clone returns a copy of the settings that can be modified independently
+func (o *options) clone() *options {
+	c := *o
+	c.sizeLimits = append([]sizeLimit(nil), o.sizeLimits...)
+	return &c
+}
+
+// fixed returns an error if next changes settings that are fixed at startup
+func (o *options) fixed(next *options) error {
+	switch {
+	case next.workers != o.workers || next.queueCapacity != o.queueCapacity:
+		return fmt.Errorf("the dispatch queue can not be changed at runtime")
+	case next.concurrentPerConn != o.concurrentPerConn:
+		return fmt.Errorf("the concurrency per connection can not be changed at runtime")
+	case next.systemd != o.systemd:
+		return fmt.Errorf("the systemd integration can not be changed at runtime")
+	}
+	return nil
+}
+
+// maxReceiveSize returns the maximum size of any message
+func (o *options) maxReceiveSize() int {
+	max := defaultMaxMessageSize
+	for _, limit := range o.sizeLimits {
+		if limit.bytes > max {
+			max = limit.bytes
+		}
+	}
+	return max
+}
+
+// maxMessageSize returns the maximum size of messages carrying cmd
+func (o *options) maxMessageSize(cmd string) int {
+	for _, limit := range o.sizeLimits {
+		if matched, _ := path.Match(limit.pattern, cmd); matched {
+			return limit.bytes
+		}
+	}
+	return defaultMaxMessageSize
+}
+
+// WithPolicy enables tier-based authorization of incoming commands. classify
+// returns the tier required by a command (e.g. Router.Tier), while policy
+// decides which tiers are available to the connected peer. Without classify,
+// only reserved commands (and peers granted no tier at all) are checked. Each server
+// (i.e. each listening socket) has its own policy, so that the same handler
+// can be exposed with different capability levels on different sockets.
+func WithPolicy(policy *Policy, classify func(cmd string) Tier) Option {
+	return func(o *options) {
+		o.policy = policy
+		o.classify = classify
+	}
+}
+
+// WithAuthorizer invokes authorizer before every command (including reserved
+// system commands) in order to decide whether the peer may execute it
+func WithAuthorizer(authorizer Authorizer) Option {
+	return func(o *options) {
+		o.authorizer = authorizer
+	}
+}
+
+// OnAcceptError registers a callback invoked whenever accepting a connection
+// fails. Temporary errors (e.g. running out of file descriptors) are retried
+// with an exponential backoff, other errors stop the server (see Err). Running
+// out of file descriptors or buffer space is reported as *ExhaustedError.
+func OnAcceptError(callback func(err error)) Option {
+	return func(o *options) {
+		o.onAcceptError = callback
+	}
+}
+
+// OnSocketLost registers a callback invoked once whenever the socket file has
+// been found removed or replaced (see WithSocketWatch). err is nil if the
+// server listens on the socket again, or the reason it could not (e.g.
+// another file has taken its place), in which case the server keeps retrying
+// with a backoff (from 100ms up to a minute) without invoking the callback
+// again until the socket is lost anew.
+func OnSocketLost(callback func(path string, err error)) Option {
+	return func(o *options) {
+		o.onSocketLost = callback
+	}
+}
+
+// OnReceiveError registers a callback invoked whenever receiving a message
+// fails for reasons other than the peer closing the connection or the
+// connection idling out, e.g. malformed messages (after which the connection
+// continues to be served), truncated or oversized messages (see
+// unixsock.ReceiveError).
+func OnReceiveError(callback func(err error)) Option {
+	return func(o *options) {
+		o.onReceiveError = callback
+	}
+}
+
+// WithHTTPHandler serves clients speaking HTTP over the socket (e.g. via
+// client.NewHTTPTransport) with handler, next to the unixsock protocol. The
+// protocol is detected on the first byte of a connection. HTTP requests are
+// subject to the policy (GET, HEAD and OPTIONS require TierReadOnly, other
+// methods TierMutating), the authorizer (as commands named "METHOD /path"),
+// connection quotas and timeouts like commands, and carry the credentials of
+// the peer (see PeerFromRequest).
+func WithHTTPHandler(handler http.Handler) Option {
+	return func(o *options) {
+		o.httpHandler = handler
+	}
+}
+
+// WithRawHandler passes the frames received over a connection to handler
+// without decoding them (besides peeking at the command), e.g. in order to
+// forward them to another server via client.SendRaw. The frames handler
+// returns are sent back verbatim. Raw frames are subject to the policy
+// (unclassified commands require any access at all), the authorizer (their
+// arguments are decoded for it) and the maintenance mode like commands.
+// Clients of the line protocol and HTTP are served as usual.
+func WithRawHandler(handler RawHandler) Option {
+	return func(o *options) {
+		o.rawHandler = handler
+	}
+}
+
+// WithRecorder records every request along with its response, the time it
+// was received and the credentials of the peer (see package record), so that
+// the traffic can be replayed later on. Failures to record are ignored.
+func WithRecorder(recorder *record.Recorder) Option {
+	return func(o *options) {
+		o.recorder = recorder
+	}
+}
+
+// WithFilePassing passes response payloads of at least threshold bytes to
+// clients that accept it (see client.WithFilePassing) as open files
+// (SCM_RIGHTS) instead of streaming them through the socket: the payload is
+// written to an unlinked temporary file, while streams of regular files (see
+// unixsock.Response.Stream) are passed without any copy: the file is reopened
+// read-only, so that the client neither shares the offset of the handler's
+// descriptor nor gets write access (streams of files that can not be reopened
+// are sent through the socket). Files are not passed over compressed
+// connections or if responses are signed.
+func WithFilePassing(threshold int) Option {
+	return func(o *options) {
+		o.fileThreshold = threshold
+	}
+}
+
+// WithResponseSigning signs every response with signer (see
+// unixsock.Signer), so that clients holding the same key can verify that it
+// has been sent by this server (see client.VerifyResponses) rather than by a
+// process interposing on the socket path, e.g. a proxy. Signatures cover
+// streamed payloads and are bound to the nonce the client sends with each
+// call, so that recorded responses can not be replayed.
+func WithResponseSigning(signer *unixsock.Signer) Option {
+	return func(o *options) {
+		o.signer = signer
+	}
+}
+
+// WithSystemPrefix moves the system commands (see unixsock.SystemCommands)
+// from the reserved "_sys." namespace to prefix (e.g. "_admin."), for
+// applications with "_sys." commands of their own. Commands with the prefix
+// are reserved instead and never reach the handler. Protocol messages (e.g.
+// unixsock.SysHello) stay in the "_sys." namespace. Clients pinging the
+// server need the same prefix (see client.WithSystemPrefix).
+func WithSystemPrefix(prefix string) Option {
+	return func(o *options) {
+		o.systemPrefix = prefix
+	}
+}
+
+// WithoutSystemCommands disables the given system commands (e.g.
+// unixsock.SysPprof, named by their default names regardless of
+// WithSystemPrefix), or all of them if none are given, e.g. in order not to
+// expose the internals of the server. Disabled commands fail like unknown
+// ones rather than reaching the handler. Clients can not ping servers
+// without unixsock.SysHealth.
+func WithoutSystemCommands(cmds ...string) Option {
+	return func(o *options) {
+		if len(cmds) == 0 {
+			cmds = unixsock.SystemCommands()
+		}
+		disabled := make(map[string]bool, len(o.systemDisabled)+len(cmds))
+		for cmd := range o.systemDisabled {
+			disabled[cmd] = true
+		}
+		for _, cmd := range cmds {
+			disabled[cmd] = true
+		}
+		o.systemDisabled = disabled
+	}
+}
+
+// WithEventHistory keeps the last size events of every event command (at
+// most 256 commands) in memory, so that clients reconnecting after a dropped
+// connection are sent the events they missed (see the reserved
+// _sys.subscribe command). Events are numbered regardless of this setting.
+func WithEventHistory(size int) Option {
+	return func(o *options) {
+		o.eventHistory = size
+	}
+}
+
+// WithSessionResumption issues resumption tokens to the clients asking for
+// them (see client.WithSessionResumption) and keeps the state of their
+// dropped connections for ttl. A client redialing within ttl presents its
+// token in the handshake and gets its tags, event filter and the events it
+// missed (see WithEventHistory) back without subscribing again. Tokens are
+// valid once and only for the user (and group) they have been issued to;
+// commands are authorized as usual, by the peer credentials of the new
+// connection. Sessions do not survive the server process.
+func WithSessionResumption(ttl time.Duration) Option {
+	return func(o *options) {
+		o.resumeTTL = ttl
+	}
+}
+
+// WithDispatchQueue executes commands on a fixed pool of workers fed by a
+// bounded priority queue instead of directly on the connection goroutines.
+// Queued commands are executed in order of their priority (see
+// unixsock.Priority), so that e.g. an operator's shutdown command is not
+// stuck behind a backlog of slow bulk requests. Reserved system commands
+// always run with unixsock.PriorityHigh.
+func WithDispatchQueue(workers, capacity int) Option {
+	return func(o *options) {
+		o.workers = workers
+		o.queueCapacity = capacity
+	}
+}
+
+// WithLoadShedding makes the dispatch queue (see WithDispatchQueue) reject
+// commands of unixsock.PriorityLow right away, with unixsock.StatusRetry and
+// the meta "reason" set to "overloaded", once it is filled to watermark (a
+// fraction of its capacity, e.g. 0.8) instead of making them wait for room.
+// Higher priority commands are queued as usual.
+func WithLoadShedding(watermark float64) Option {
+	return func(o *options) {
+		o.shedWatermark = watermark
+	}
+}
+
+// WithWriteBuffer makes the server write responses through a buffered writer
+// of the given size, flushed explicitly after each response
+func WithWriteBuffer(size int) Option {
+	return func(o *options) {
+		o.writeBuffer = size
+	}
+}
+
+// WithConcurrentPerConn lets the server handle up to n messages of the same
+// connection in parallel. Responses are sent as soon as they are ready, so
+// they may arrive out of order and must be matched to their requests by
+// message ID. Notifications (messages without a response) still complete
+// before the next message is handled. The default (n <= 1) handles messages
+// strictly sequentially.
+func WithConcurrentPerConn(n int) Option {
+	return func(o *options) {
+		o.concurrentPerConn = n
+	}
+}
+
+// WithMaxMessageSizeFor sets the maximum size of messages carrying commands
+// matching cmdPattern (see path.Match), e.g. to let an upload command accept
+// 100MB while all other commands stay capped at 1MB. The first matching
+// pattern applies; setting the limit of a pattern again replaces it.
+// Oversized messages are rejected with a failure. Since responses carry the
+// original message, clients need a matching limit (see
+// UnixSockClient.Options).
+func WithMaxMessageSizeFor(cmdPattern string, bytes int) Option {
+	return func(o *options) {
+		for i := range o.sizeLimits {
+			if o.sizeLimits[i].pattern == cmdPattern {
+				o.sizeLimits[i].bytes = bytes
+				return
+			}
+		}
+		o.sizeLimits = append(o.sizeLimits, sizeLimit{
+			pattern: cmdPattern,
+			bytes:   bytes,
+		})
+	}
+}
+
+// WithReceiveTimeout sets the time limit for receiving a message (5 seconds
+// by default). Connections idle for longer are closed.
+func WithReceiveTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.receiveTimeout = timeout
+	}
+}
+
+// WithIdleTimeout closes connections on which the client has not sent a
+// message for longer than timeout since the last one (or the last response),
+// unless a command is being executed. Events pushed to the client do not
+// count as activity. It prevents connections of crashed clients from leaking
+// when the receive timeout is disabled for long-lived sessions (see
+// WithReceiveTimeout).
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.idleTimeout = timeout
+	}
+}
+
+// WithSocketWatch checks every interval whether the socket file still exists
+// and listens on the socket again if it has been removed (e.g. by a temp
+// directory cleaner), which would leave the server running but unreachable
+// (see OnSocketLost). On Linux (inotify), macOS and the BSDs (kqueue) the
+// socket's directory is watched instead, so that removals are noticed right
+// away; the file is only checked every interval on other platforms or while
+// the directory can not be watched. Connected clients
+// are not affected. It only applies to servers created by New or
+// NewWithHandler.
+func WithSocketWatch(interval time.Duration) Option {
+	return func(o *options) {
+		o.socketWatch = interval
+	}
+}
+
+// WithSocketMode sets the permissions of the socket file (e.g. 0660), which
+// are applied while the socket is created instead of changing them
+// afterwards, so that the socket is never reachable by other users in the
+// meantime. It only applies to servers created by New or NewWithHandler.
+//
+// On Linux the permissions are applied by changing the umask, which is shared
+// by the whole process: files created by other goroutines while the socket is
+// being created get the same restricted permissions. Other systems change the
+// permissions of the socket right after creating it instead.
+func WithSocketMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.socketMode = mode
+	}
+}
+
+// WithTransport listens via transport (see unixsock.Transport) instead of on
+// a unix socket, passing it the path of the socket as the address to listen
+// on. The socket lock, WithSocketMode and WithSocketWatch do not apply to
+// such servers. It only applies to servers created by New or NewWithHandler.
+func WithTransport(transport unixsock.Transport) Option {
+	return func(o *options) {
+		o.transport = transport
+	}
+}
+
+// WithReclaimIdle closes the connections idle for longer than idle whenever
+// the server runs out of file descriptors while accepting a connection (see
+// ExhaustedError), so that new clients can be served
+func WithReclaimIdle(idle time.Duration) Option {
+	return func(o *options) {
+		o.reclaimIdle = idle
+	}
+}
+
+// WithMaxConnsPerPeer limits the number of simultaneous connections of a
+// single peer process (identified by its UID and PID), so that one buggy
+// client can not exhaust the server's connections. The first message on a
+// connection exceeding the limit is answered with unixsock.STATUS_REJECTED,
+// after which the connection is closed. Connections whose peer credentials
+// are unavailable are not limited.
+func WithMaxConnsPerPeer(n int) Option {
+	return func(o *options) {
+		o.maxConnsPerPeer = n
+	}
+}
+
+// WithResponseCompression sets the size from which the payloads of responses
+// are compressed for clients accepting compressed responses (see
+// client.WithResponseCompression), 1KB by default. Clients that do not
+// accept them always get uncompressed payloads. A size of 0 disables the
+// compression.
+func WithResponseCompression(minSize int) Option {
+	return func(o *options) {
+		o.compressMinSize = minSize
+	}
+}
+
+// WithInlineConnections serves every connection synchronously on the
+// goroutine accepting it, skipping the hand-off to a connection goroutine and
+// the dispatch queue (if any). It shaves the scheduling latency off a fresh
+// connection for single-client use cases like per-request shells, but serves
+// only one connection at a time: further clients wait in the listen backlog
+// until the current one disconnects.
+func WithInlineConnections() Option {
+	return func(o *options) {
+		o.inline = true
+	}
+}
+
+// WithDebugDump writes a hex dump of every frame exchanged with clients
+// (direction, length and timing included) to w, labelled with the connection
+// ID and peer, e.g. in order to debug the protocol. Connections served by the
+// HTTP or raw handler are not dumped.
+func WithDebugDump(w io.Writer) Option {
+	return func(o *options) {
+		o.dumper = unixsock.NewDumper(w)
+	}
+}
+
+// WithDebugDumpFilter limits the connections dumped by WithDebugDump to
+// those whose peer (nil if unavailable) filter accepts, e.g. a single
+// misbehaving client
+func WithDebugDumpFilter(filter func(peer *unixsock.PeerCred) bool) Option {
+	return func(o *options) {
+		o.dumpFilter = filter
+	}
+}
+
+// WithPeerProcess resolves the executable and control group of every
+// client right after accepting its connection (see unixsock.PeerCred.Process),
+// so that handlers (see Request.Process), recordings and _sys.clients tell
+// which binary issued a command. Processes that cannot be resolved (e.g.
+// owned by other users of an unprivileged server) are left unidentified.
+func WithPeerProcess() Option {
+	return func(o *options) {
+		o.peerProcess = true
+	}
+}
+
+// WithSystemdNotify integrates the server with systemd's readiness and
+// watchdog protocols (see sd_notify(3)): READY=1 is sent once the server is
+// accepting connections and STOPPING=1 once it is shutting down. If the
+// watchdog is enabled for the service, WATCHDOG=1 is sent periodically while
+// the server is healthy (see SetHealth). Without $NOTIFY_SOCKET (i.e. when
+// not started by systemd) the option has no effect.
+func WithSystemdNotify() Option {
+	return func(o *options) {
+		o.systemd = true
+	}
+}
+
+// withAcceptDispatcher hands accepted connections to a single dispatcher
+// goroutine over a channel, as the server used to, instead of serving them
+// right from the accept loop. It is only kept in order to compare the two in
+// BenchmarkConnectionBurst.
+func withAcceptDispatcher() Option {
+	return func(o *options) {
+		o.acceptDispatcher = true
+	}
+}
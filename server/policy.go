@@ -0,0 +1,91 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// Tier is the permission level required to execute a command
+type Tier int
+
+// Permission tiers (ordered from least to most privileged)
+const (
+	TierNone     Tier = iota // No access at all
+	TierReadOnly             // Commands that only inspect state
+	TierMutating             // Commands that change state
+	TierAdmin                // Commands that control the process itself
+)
+
+// String returns the name of the tier
+func (t Tier) String() string {
+	switch t {
+	case TierNone:
+		return "none"
+	case TierReadOnly:
+		return "read-only"
+	case TierMutating:
+		return "mutating"
+	case TierAdmin:
+		return "admin"
+	default:
+		return "unknown"
+	}
+}
+
+// Policy maps peer credentials to the highest tier a peer is allowed to use.
+// Rules are matched by UID first, then by GID. Peers not matching any rule
+// (or whose credentials cannot be read) are granted the default tier.
+type Policy struct {
+	mu      sync.RWMutex
+	def     Tier
+	uidRule map[uint32]Tier
+	gidRule map[uint32]Tier
+}
+
+// NewPolicy creates a new policy granting defaultTier to unmatched peers
+func NewPolicy(defaultTier Tier) *Policy {
+	return &Policy{
+		def:     defaultTier,
+		uidRule: make(map[uint32]Tier),
+		gidRule: make(map[uint32]Tier),
+	}
+}
+
+// AllowUID grants tier to all peers running as uid
+func (p *Policy) AllowUID(uid uint32, tier Tier) *Policy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.uidRule[uid] = tier
+	return p
+}
+
+// AllowGID grants tier to all peers running with the primary group gid
+func (p *Policy) AllowGID(gid uint32, tier Tier) *Policy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gidRule[gid] = tier
+	return p
+}
+
+// Grant returns the highest tier available to peer
+func (p *Policy) Grant(peer *unixsock.PeerCred) Tier {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if peer == nil {
+		return p.def
+	}
+	if tier, ok := p.uidRule[peer.UID]; ok {
+		return tier
+	}
+	if tier, ok := p.gidRule[peer.GID]; ok {
+		return tier
+	}
+	return p.def
+}
+
+// Allows checks whether peer may execute a command requiring tier
+func (p *Policy) Allows(peer *unixsock.PeerCred, tier Tier) bool {
+	return tier != TierNone && tier <= p.Grant(peer)
+}
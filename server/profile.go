@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// Reserved profiling commands
+const (
+	sysPprof  = unixsock.SysPprof
+	sysExpvar = unixsock.SysExpvar
+)
+
+// Profiling limits
+const (
+	profileCPU            = "cpu"           // Name of the CPU profile
+	profileDefault        = "goroutine"     // Profile written if none is requested
+	profileDefaultSeconds = 3               // Duration of CPU profiles if none is requested (below the default client timeout)
+	profileMaxDuration    = 5 * time.Minute // Longest CPU profile
+)
+
+// sysPprofHandler streams a runtime profile in the format of runtime/pprof
+// (readable by go tool pprof). The profile is selected by the argument
+// "profile" (goroutine by default, heap, allocs, block, mutex, threadcreate
+// or cpu), "debug" > 0 requests the text format of the named profiles and
+// "seconds" the duration of a CPU profile (3 by default, so that clients with
+// the default timeout receive it). A CPU profile blocks the command for its
+// whole duration, or until the command is cancelled or the server shuts
+// down.
+func sysPprofHandler(ctx context.Context, srv *unixSockSrv, args unixsock.Args) *unixsock.Response {
+
+	name, _ := args["profile"].(string)
+	if name == "" {
+		name = profileDefault
+	}
+
+	buf := &bytes.Buffer{}
+	if name == profileCPU {
+		seconds, ok := intArg(args, "seconds")
+		if !ok {
+			seconds = profileDefaultSeconds
+		}
+		duration := time.Duration(seconds) * time.Second
+		if duration <= 0 || duration > profileMaxDuration {
+			return unixsock.NewResponse().Failf("pprof: CPU profiles must last between 1s and %s", profileMaxDuration)
+		}
+
+		if err := pprof.StartCPUProfile(buf); err != nil {
+			return unixsock.NewResponse().Failf("pprof: %s", err.Error())
+		}
+		timer := time.NewTimer(duration)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		case <-srv.ctx.Done():
+			timer.Stop()
+		}
+		pprof.StopCPUProfile()
+
+		if err := ctx.Err(); err != nil {
+			return unixsock.NewResponse().Failf("pprof: CPU profile cancelled: %s", err.Error())
+		}
+
+	} else {
+		profile := pprof.Lookup(name)
+		if profile == nil {
+			return unixsock.NewResponse().Failf("pprof: unknown profile '%s'", name)
+		}
+
+		debug, _ := intArg(args, "debug")
+		if err := profile.WriteTo(buf, debug); err != nil {
+			return unixsock.NewResponse().Failf("pprof: %s", err.Error())
+		}
+	}
+
+	return unixsock.NewResponse().OK().WithMeta("profile", name).WithStream(buf)
+}
+
+// expvarPath is the path expvar publishes its variables on
+const expvarPath = "/debug/vars"
+
+// sysExpvarHandler reports all published expvar variables (including
+// memstats and cmdline) as a JSON object. The server does not import expvar,
+// which would register its handler on http.DefaultServeMux in every program
+// using the server: the variables are read from that handler if the program
+// has imported expvar itself, otherwise just memstats and cmdline are
+// reported.
+func sysExpvarHandler(ctx context.Context, srv *unixSockSrv, args unixsock.Args) *unixsock.Response {
+
+	req, err := http.NewRequest(http.MethodGet, expvarPath, nil)
+	if err != nil {
+		return unixsock.NewResponse().Fail(err)
+	}
+
+	if handler, pattern := http.DefaultServeMux.Handler(req); pattern == expvarPath {
+		w := &bufferedResponse{header: http.Header{}}
+		handler.ServeHTTP(w, req)
+
+		vars := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(w.body.Bytes(), &vars); err != nil {
+			return unixsock.NewResponse().Failf("expvar: malformed variables: %s", err.Error())
+		}
+		return unixsock.NewResponse().OK().WithPayloadJSON(vars)
+	}
+
+	memstats := &runtime.MemStats{}
+	runtime.ReadMemStats(memstats)
+
+	return unixsock.NewResponse().OK().WithPayloadJSON(map[string]interface{}{
+		"cmdline":  os.Args,
+		"memstats": memstats,
+	})
+}
+
+// bufferedResponse is an http.ResponseWriter keeping the response body
+type bufferedResponse struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponse) Header() http.Header         { return w.header }
+func (w *bufferedResponse) Write(p []byte) (int, error) { return w.body.Write(p) }
+func (w *bufferedResponse) WriteHeader(status int)      {}
+
+// intArg returns the integer argument key (false if missing or not a number)
+func intArg(args unixsock.Args, key string) (int, bool) {
+	switch value := args[key].(type) {
+	case int:
+		return value, true
+	case int64:
+		return int(value), true
+	case uint64:
+		return int(value), true
+	case float64: // Clients not using the type envelope
+		return int(value), true
+	default:
+		return 0, false
+	}
+}
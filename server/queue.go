@@ -0,0 +1,206 @@
+package server
+
+import (
+	"container/heap"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// job is a single queued command
+type job struct {
+	priority unixsock.Priority
+	seq      uint64 // Preserves FIFO order within a priority level
+	exec     func() *unixsock.Response
+	result   chan *unixsock.Response
+	queued   time.Time
+}
+
+// jobHeap orders jobs by priority (highest first) and arrival
+type jobHeap []*job
+
+func (h jobHeap) Len() int { return len(h) }
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h jobHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *jobHeap) Push(x interface{}) { *h = append(*h, x.(*job)) }
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// dispatchQueue is a bounded priority queue served by a fixed number of
+// workers. Commands submitted while the queue is full block until there is
+// room, so that a flood of bulk commands exerts backpressure on the clients
+// sending them while high priority commands still jump the queue.
+type dispatchQueue struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	jobs     jobHeap
+	workers  int
+	capacity int
+	seq      uint64
+	closed   bool
+
+	// Metrics
+	submitted uint64
+	shed      uint64
+	wait      samples
+	maxWait   time.Duration
+}
+
+// QueueStats are the metrics of the dispatch queue (see WithDispatchQueue).
+// Wait times are measured from the moment a command is queued until a worker
+// picks it up, and their percentiles are computed over the most recent
+// commands.
+type QueueStats struct {
+	Workers   int           `json:"workers"`
+	Capacity  int           `json:"capacity"`
+	Depth     int           `json:"depth"`     // Commands currently waiting
+	Submitted uint64        `json:"submitted"` // Commands queued so far
+	Shed      uint64        `json:"shed"`      // Commands rejected due to overload
+	WaitP50   time.Duration `json:"wait_p50"`
+	WaitP90   time.Duration `json:"wait_p90"`
+	WaitP99   time.Duration `json:"wait_p99"`
+	WaitMax   time.Duration `json:"wait_max"`
+}
+
+// newDispatchQueue creates a new queue and starts its workers
+func newDispatchQueue(workers, capacity int) *dispatchQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	q := &dispatchQueue{
+		workers:  workers,
+		capacity: capacity,
+	}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+
+	return q
+}
+
+// submit queues exec and waits for its response. Once the queue is filled to
+// watermark (a fraction of its capacity, 0 = never), low priority commands
+// are rejected right away instead of waiting for room.
+func (q *dispatchQueue) submit(priority unixsock.Priority, watermark float64, exec func() *unixsock.Response) *unixsock.Response {
+
+	j := &job{
+		priority: priority,
+		exec:     exec,
+		result:   make(chan *unixsock.Response, 1),
+	}
+
+	q.mu.Lock()
+	if watermark > 0 && priority < unixsock.PriorityNormal && len(q.jobs) >= int(math.Ceil(watermark*float64(q.capacity))) {
+		q.shed++
+		resp := overloadedResponse(len(q.jobs), q.capacity)
+		q.mu.Unlock()
+		return resp
+	}
+	for len(q.jobs) >= q.capacity && !q.closed {
+		q.notFull.Wait()
+	}
+	if q.closed {
+		q.mu.Unlock()
+		return shutdownResponse("")
+	}
+	q.seq++
+	q.submitted++
+	j.seq = q.seq
+	j.queued = time.Now()
+	heap.Push(&q.jobs, j)
+	q.notEmpty.Signal()
+	q.mu.Unlock()
+
+	return <-j.result
+}
+
+// work executes queued jobs until the queue is closed
+func (q *dispatchQueue) work() {
+	for {
+		q.mu.Lock()
+		for len(q.jobs) == 0 && !q.closed {
+			q.notEmpty.Wait()
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return
+		}
+		j := heap.Pop(&q.jobs).(*job)
+		q.notFull.Signal()
+		wait := time.Since(j.queued)
+		q.wait.add(wait)
+		if wait > q.maxWait {
+			q.maxWait = wait
+		}
+		q.mu.Unlock()
+
+		j.result <- j.exec()
+	}
+}
+
+// stats returns the current metrics of the queue
+func (q *dispatchQueue) stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p50, p90, p99 := q.wait.percentiles()
+	return QueueStats{
+		Workers:   q.workers,
+		Capacity:  q.capacity,
+		Depth:     len(q.jobs),
+		Submitted: q.submitted,
+		Shed:      q.shed,
+		WaitP50:   p50,
+		WaitP90:   p90,
+		WaitP99:   p99,
+		WaitMax:   q.maxWait,
+	}
+}
+
+// close stops the workers and fails all pending jobs
+func (q *dispatchQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+
+	for _, j := range q.jobs {
+		j.result <- shutdownResponse("")
+	}
+	q.jobs = nil
+
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+// overloadedResponse is returned for low priority commands shed because the
+// queue is (nearly) full. Clients may retry them later on.
+func overloadedResponse(depth, capacity int) *unixsock.Response {
+	return unixsock.NewResponse().
+		Failf("dispatch: server overloaded (%d of %d queue slots taken)", depth, capacity).
+		WithStatus(unixsock.StatusRetry).
+		WithMeta("reason", "overloaded")
+}
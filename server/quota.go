@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// peerKey identifies a peer process for connection quotas
+type peerKey struct {
+	uid uint32
+	pid int32
+}
+
+// admit counts a new connection of peer against the per-peer quota (see
+// WithMaxConnsPerPeer) and informs whether it may be served. Admitted
+// connections must be released once closed.
+func (u *unixSockSrv) admit(peer *unixsock.PeerCred) bool {
+	limit := u.options().maxConnsPerPeer
+	if peer == nil {
+		return true
+	}
+
+	key := peerKey{peer.UID, peer.PID}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if limit > 0 && u.peerConns[key] >= limit {
+		return false
+	}
+	u.peerConns[key]++
+
+	return true
+}
+
+// release stops counting a connection of peer against its quota
+func (u *unixSockSrv) release(peer *unixsock.PeerCred) {
+	if peer == nil {
+		return
+	}
+
+	key := peerKey{peer.UID, peer.PID}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.peerConns[key]--; u.peerConns[key] <= 0 {
+		delete(u.peerConns, key)
+	}
+}
+
+// rejectConn answers the first message of a connection exceeding its quota
+// with unixsock.STATUS_REJECTED. The connection is closed by the caller.
+func (u *unixSockSrv) rejectConn(c *unixsock.Conn, peer *unixsock.PeerCred) {
+	o := u.options()
+
+	receiver := unixsock.NewReceiver(c, unixsock.WithMaxLength(o.maxReceiveSize()), unixsock.WithTimeout(o.receiveTimeout))
+	if err := receiver.Receive(); err != nil || !receiver.ShouldRespond() {
+		return
+	}
+
+	reject := unixsock.NewSender(c, receiver.GetCmd(), nil, false, true) // Without echoing the arguments
+	reject.SetID(receiver.GetID())
+	reject.SetWriteBuffer(o.writeBuffer)
+	reject.SetResponse(sign(o.digest(receiver), &unixsock.Response{
+		Status: unixsock.STATUS_REJECTED,
+		Error:  fmt.Sprintf("accept: too many connections (at most %d per peer, %s)", o.maxConnsPerPeer, peer),
+	}))
+	reject.Send()
+}
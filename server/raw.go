@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// RawHandler handles a complete, undecoded frame (see WithRawHandler) and
+// returns the frames to send back verbatim (nil if none), e.g. those returned
+// by client.SendRaw when bridging to another server. Returning an error fails
+// the command.
+type RawHandler func(ctx context.Context, peer *unixsock.PeerCred, frame []byte) ([]byte, error)
+
+// rawHeader is the part of a message the server needs to know about in order
+// to authorize a raw frame and answer it if the raw handler fails
+type rawHeader struct {
+	ID      uint64        `json:"id"`
+	Cmd     string        `json:"cmd"`
+	Args    unixsock.Args `json:"args"`
+	Respond bool          `json:"respond"`
+	Close   bool          `json:"close"`
+}
+
+// isFramed informs whether the client of a fresh connection sends frames
+// (rather than lines of JSON)
+func isFramed(c *unixsock.Conn, timeout time.Duration) bool {
+	if timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
+		defer c.SetReadDeadline(time.Time{})
+	}
+
+	first, err := c.Peek(1)
+	return err == nil && first[0] != '{'
+}
+
+// serveRaw passes the frames received over a connection to handler. Frames
+// are authorized by the policy (see WithPolicy) and the authorizer based on
+// their command and arguments, and refused during maintenance like decoded
+// commands. Unclassified commands require the tier granted to the peer,
+// i.e. any access at all. The handshake is answered by the server itself
+// without enabling any feature, since the frames following it are not
+// decoded.
+func (u *unixSockSrv) serveRaw(c *unixsock.Conn, peer *unixsock.PeerCred, handler RawHandler) {
+
+	ctx, cancel := context.WithCancel(u.ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+
+	for {
+		o := u.options()
+		if o.receiveTimeout > 0 {
+			c.SetReadDeadline(time.Now().Add(o.receiveTimeout))
+		}
+
+		frame, err := unixsock.ReadFrame(c, o.maxReceiveSize())
+		if err != nil {
+			if re, ok := err.(*unixsock.ReceiveError); ok && re.Kind != unixsock.ErrClosed && re.Kind != unixsock.ErrTimeout && o.onReceiveError != nil {
+				o.onReceiveError(err)
+			}
+			return
+		}
+
+		header := rawHeader{}
+		message, err := unixsock.FrameMessage(frame)
+		if err == nil {
+			err = json.Unmarshal(message, &header)
+		}
+
+		var reply []byte
+		var answer *unixsock.Response // Response of the server itself (if any)
+		switch {
+		case err != nil:
+			answer = unixsock.NewResponse().Failf("receive: malformed frame: %s", err.Error())
+		case header.Cmd == sysHello:
+			answer = unixsock.NewResponse().OK()
+		default:
+			sys, isSys := o.systemCommand(header.Cmd)
+			tier := sys.tier
+			if !isSys && o.classify != nil {
+				tier = o.classify(header.Cmd)
+			}
+			required := tier
+			if !isSys && o.classify == nil && o.policy != nil {
+				required = o.policy.Grant(peer)
+			}
+			err = authorize(o, peer, header.Cmd, required)
+			if err == nil && o.authorizer != nil {
+				err = o.authorizer.Authorize(peer, header.Cmd, header.Args)
+			}
+			m := u.inMaintenance()
+			switch {
+			case err != nil:
+				answer = unixsock.NewResponse().Fail(err)
+			case m != nil && !isSys && tier < TierAdmin:
+				answer = maintenanceResponse(header.Cmd, m)
+			default:
+				if reply, err = handler(ctx, peer, frame); err != nil {
+					answer = unixsock.NewResponse().Fail(err)
+				}
+			}
+		}
+
+		// Answered by the server itself
+		if answer != nil && header.Respond {
+			msg := unixsock.NewSender(c, header.Cmd, nil, false, false)
+			msg.SetID(header.ID)
+			msg.SetWriteBuffer(o.writeBuffer)
+			msg.SetResponse(answer)
+			if msg.Send() != nil {
+				return
+			}
+		}
+
+		if len(reply) > 0 {
+			if _, err := c.Write(reply); err != nil {
+				return
+			}
+		}
+
+		if header.Close {
+			return
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// ErrorCodeMeta is the response metadata key carrying the code of a failed
+// command's *Error
+const ErrorCodeMeta = "error_code"
+
+// Error is an application error carrying a machine-readable code (e.g.
+// "not_found"), so that clients can act upon failures without parsing error
+// messages. Returned by a ResultFunc, it fails the response with its status
+// and sends the code as the response metadata ErrorCodeMeta.
+type Error struct {
+	Code    string
+	Message string
+	Status  unixsock.Status // Status of the response (STATUS_FAIL if empty)
+}
+
+// Errorf creates an application error with a formatted message
+func Errorf(code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// ResultFunc is an adapter allowing the use of functions returning the result
+// of a command as handlers, which spares them building responses. The result
+// becomes the payload of a successful response: strings and byte slices are
+// sent as they are, readers are streamed (see unixsock.Response.Stream),
+// responses are passed through and everything else is encoded as JSON. Errors
+// fail the response (see Error and ValidationError).
+type ResultFunc func(ctx context.Context, req *Request) (interface{}, error)
+
+// ServeUnix calls f(ctx, req) and maps its result into a response
+func (f ResultFunc) ServeUnix(ctx context.Context, req *Request) *unixsock.Response {
+	result, err := f(ctx, req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return resultResponse(result)
+}
+
+// resultResponse maps the result of a command into a successful response
+func resultResponse(result interface{}) *unixsock.Response {
+	switch r := result.(type) {
+	case nil:
+		return unixsock.NewResponse().OK()
+	case *unixsock.Response:
+		return r
+	case string:
+		return unixsock.NewResponse().OK().WithPayload(r)
+	case []byte:
+		return unixsock.NewResponse().OK().WithPayload(string(r))
+	case io.Reader:
+		return unixsock.NewResponse().OK().WithStream(r)
+	default:
+		return unixsock.NewResponse().OK().WithPayloadJSON(r)
+	}
+}
+
+// errorResponse maps the error of a command into a failed response
+func errorResponse(err error) *unixsock.Response {
+	switch e := err.(type) {
+	case *ValidationError:
+		return e.Response()
+	case *Error:
+		resp := unixsock.NewResponse().Fail(e).WithMeta(ErrorCodeMeta, e.Code)
+		if e.Status != "" {
+			resp.WithStatus(e.Status)
+		}
+		return resp
+	default:
+		return unixsock.NewResponse().Fail(err)
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// Metadata of the handshake responses of servers resuming sessions (see
+// WithSessionResumption)
+const (
+	resumeTokenMeta = "resume_token" // Token to present when redialing
+	resumedMeta     = "resumed"      // "true" if the presented session has been resumed
+)
+
+// Sessions kept for resumption at most, so that clients dropping their
+// connections in a loop can not exhaust the memory
+const maxResumable = 1024
+
+// resumable is the state of a dropped connection, kept for its client to
+// resume on redial
+type resumable struct {
+	uid, gid uint32 // Peer the token has been issued to
+	tags     map[string]string
+	filter   eventFilter
+	expires  time.Time
+}
+
+// newResumeToken returns a random resumption token
+func newResumeToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// hello negotiates connection features with a client (see handshake). Clients
+// asking for session resumption are issued a token for their next
+// connection, and the session they present (if any) is resumed: its tags
+// (unless given anew) and event filter are restored, and the kept events
+// following the client's last one (args "since") are sent right after the
+// response.
+func (u *unixSockSrv) hello(c *unixsock.Conn, activity *connActivity, receiver unixsock.Communicator, o *options) (string, bool) {
+
+	args := receiver.GetArgs()
+	activity.setTags(helloTags(args))
+
+	// Tokens are bound to the peer, so that they are useless to other users
+	presented, requested := args["resume"].(string)
+	if !requested || o.resumeTTL <= 0 || activity.peer == nil {
+		return handshake(c, receiver, o, nil)
+	}
+	token, err := newResumeToken()
+	if err != nil {
+		return handshake(c, receiver, o, nil)
+	}
+
+	// Live events must not overtake the replayed ones
+	u.events.mu.Lock()
+	defer u.events.mu.Unlock()
+
+	meta := map[string]string{resumeTokenMeta: token}
+	u.mu.Lock()
+	session, found := u.resumable[presented]
+	delete(u.resumable, presented)
+	_, open := u.conns[c]
+	resumed := open && found && time.Now().Before(session.expires) && session.uid == activity.peer.UID && session.gid == activity.peer.GID
+	if resumed {
+		if activity.tagged() == nil {
+			activity.setTags(session.tags)
+		}
+		u.filters[c] = session.filter
+		atomic.StoreInt32(&activity.resumed, 1)
+		meta[resumedMeta] = "true"
+	}
+	activity.token = token
+	u.mu.Unlock()
+
+	encoding, cancellable := handshake(c, receiver, o, meta)
+
+	if since, ok := sinceArg(args); ok && resumed {
+		u.replay(c, since, session.filter)
+	}
+
+	return encoding, cancellable
+}
+
+// suspend keeps the state of a connection that is being closed, so that its
+// client can resume it (see WithSessionResumption). Expired sessions are
+// dropped. The caller must hold the lock.
+func (u *unixSockSrv) suspend(c *unixsock.Conn, activity *connActivity) {
+
+	ttl := u.opts.resumeTTL
+	if activity.token == "" || ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	for token, session := range u.resumable {
+		if now.After(session.expires) {
+			delete(u.resumable, token)
+		}
+	}
+	if len(u.resumable) >= maxResumable {
+		return
+	}
+
+	u.resumable[activity.token] = &resumable{
+		uid:     activity.peer.UID,
+		gid:     activity.peer.GID,
+		tags:    activity.tagged(),
+		filter:  u.filters[c],
+		expires: now.Add(ttl),
+	}
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// route is a single registered command
+type route struct {
+	tier    Tier
+	handler Handler
+	schema  *Schema
+	help    *Help
+}
+
+// Router dispatches commands to individually registered handlers. Commands can
+// be renamed without breaking old tools by registering the old names as
+// aliases and marking them deprecated. Modules of a large daemon can own a
+// command namespace, along with its middleware, by registering their
+// commands on a sub-router mounted under a prefix (see Mount). Its Handle
+// method can be passed to New as the server's handler (or the router itself
+// to NewWithHandler) and its Tier method can be used to classify commands for
+// a Policy.
+type Router struct {
+	mu         sync.RWMutex
+	routes     map[string]*route
+	aliases    map[string]string
+	deprecated map[string]string
+	mounts     map[string]*Router
+	middleware []Middleware
+}
+
+// NewRouter creates a new empty router
+func NewRouter() *Router {
+	return &Router{
+		routes:     make(map[string]*route),
+		aliases:    make(map[string]string),
+		deprecated: make(map[string]string),
+		mounts:     make(map[string]*Router),
+	}
+}
+
+// Register registers handler for cmd, requiring the given permission tier
+func (r *Router) Register(cmd string, tier Tier, handler func(cmd string, args unixsock.Args) *unixsock.Response) {
+	r.RegisterHandler(cmd, tier, funcHandler(handler))
+}
+
+// RegisterHandler registers handler for cmd, requiring the given permission
+// tier
+func (r *Router) RegisterHandler(cmd string, tier Tier, handler Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[cmd] = &route{
+		tier:    tier,
+		handler: handler,
+	}
+}
+
+// Declare declares the arguments of cmd (which has to be registered first).
+// Requests with arguments not matching the schema fail with a
+// ValidationError without reaching the handler.
+func (r *Router) Declare(cmd string, schema Schema) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rt, ok := r.routes[cmd]
+	if !ok {
+		return fmt.Errorf("Declare: unknown command '%s'", cmd)
+	}
+	declared := *rt
+	declared.schema = &schema
+	r.routes[cmd] = &declared
+
+	return nil
+}
+
+// Schemas returns the declared schemas of the commands served by the router,
+// including those of mounted sub-routers (under their prefixed names), e.g.
+// in order to generate typed clients (see package codegen)
+func (r *Router) Schemas() map[string]Schema {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	schemas := make(map[string]Schema)
+	for prefix, sub := range r.mounts {
+		for cmd, schema := range sub.Schemas() {
+			schemas[prefix+cmd] = schema
+		}
+	}
+	for cmd, rt := range r.routes {
+		if rt.schema != nil {
+			schemas[cmd] = *rt.schema
+		}
+	}
+
+	return schemas
+}
+
+// Alias registers alias as another name of cmd. Aliases share the handler and
+// permission tier of cmd, which receives requests under its own name.
+func (r *Router) Alias(alias, cmd string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.aliases[alias] = cmd
+}
+
+// Deprecate marks cmd (or an alias) deprecated. Responses to it carry a
+// warning, optionally followed by a hint (e.g. "use new.cmd instead").
+func (r *Router) Deprecate(cmd, hint string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deprecated[cmd] = hint
+}
+
+// Mount dispatches the commands starting with prefix (e.g. "cache.") to sub,
+// which sees them without the prefix (e.g. "get" instead of "cache.get").
+// Commands registered on r itself take precedence, and of several matching
+// prefixes the longest wins.
+func (r *Router) Mount(prefix string, sub *Router) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mounts[prefix] = sub
+}
+
+// Use appends middleware to the stack wrapping every command served by the
+// router, including those of mounted sub-routers. Middleware registered first
+// sees the request first.
+func (r *Router) Use(middleware ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// mounted returns the sub-router cmd is dispatched to (nil if none) and the
+// name of cmd relative to it
+func (r *Router) mounted(cmd string) (*Router, string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var sub *Router
+	var prefix string
+	for p, m := range r.mounts {
+		if strings.HasPrefix(cmd, p) && (sub == nil || len(p) > len(prefix)) {
+			sub, prefix = m, p
+		}
+	}
+
+	return sub, strings.TrimPrefix(cmd, prefix)
+}
+
+// resolve returns the canonical name and route of cmd, along with a
+// deprecation warning (if any)
+func (r *Router) resolve(cmd string) (string, *route, string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var warning string
+	if hint, ok := r.deprecated[cmd]; ok {
+		warning = fmt.Sprintf("command '%s' is deprecated", cmd)
+		if hint != "" {
+			warning += ": " + hint
+		}
+	}
+
+	if target, ok := r.aliases[cmd]; ok {
+		cmd = target
+	}
+
+	return cmd, r.routes[cmd], warning
+}
+
+// known informs whether cmd is served by the router or one of its
+// sub-routers
+func (r *Router) known(cmd string) bool {
+	cmd, rt, _ := r.resolve(cmd)
+	if rt != nil {
+		return true
+	}
+	if sub, relative := r.mounted(cmd); sub != nil {
+		return sub.known(relative)
+	}
+	return false
+}
+
+// Tier returns the permission tier of cmd. Unknown commands require
+// TierAdmin, so that a misconfigured policy fails closed.
+func (r *Router) Tier(cmd string) Tier {
+	cmd, rt, _ := r.resolve(cmd)
+	if rt != nil {
+		return rt.tier
+	}
+	if sub, relative := r.mounted(cmd); sub != nil {
+		return sub.Tier(relative)
+	}
+	return TierAdmin
+}
+
+// Handle executes the handler registered for cmd
+func (r *Router) Handle(cmd string, args unixsock.Args) *unixsock.Response {
+	return r.ServeUnix(context.Background(), &Request{
+		Cmd:  cmd,
+		Args: unixsock.WithoutBody(args),
+		body: unixsock.Body(args),
+	})
+}
+
+// ServeUnix executes the handler registered for req.Cmd, wrapped in the
+// router's middleware
+func (r *Router) ServeUnix(ctx context.Context, req *Request) *unixsock.Response {
+	r.mu.RLock()
+	var handler Handler = HandlerFunc(r.dispatch)
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		handler = r.middleware[i](handler)
+	}
+	r.mu.RUnlock()
+
+	return handler.ServeUnix(ctx, req)
+}
+
+// dispatch executes the handler registered for req.Cmd, possibly on a
+// mounted sub-router
+func (r *Router) dispatch(ctx context.Context, req *Request) *unixsock.Response {
+	cmd, rt, warning := r.resolve(req.Cmd)
+	if rt == nil {
+		sub, relative := r.mounted(cmd)
+		if sub == nil || !sub.known(relative) {
+			return &unixsock.Response{
+				Status: unixsock.STATUS_FAIL,
+				Error:  fmt.Sprintf("Handle: unknown command '%s'", req.Cmd),
+			}
+		}
+
+		mounted := *req
+		mounted.Cmd = relative
+		return withWarning(sub.ServeUnix(ctx, &mounted), warning)
+	}
+
+	// Validate the arguments
+	if rt.schema != nil {
+		if invalid := rt.schema.Validate(req.Cmd, req.Args); invalid != nil {
+			return invalid.Response()
+		}
+	}
+
+	// Handlers see the canonical name of aliased commands
+	if cmd != req.Cmd {
+		aliased := *req
+		aliased.Cmd = cmd
+		req = &aliased
+	}
+
+	return withWarning(rt.handler.ServeUnix(ctx, req), warning)
+}
+
+// withWarning attaches a deprecation warning to resp, unless the handler has
+// set a warning of its own
+func withWarning(resp *unixsock.Response, warning string) *unixsock.Response {
+	if resp != nil && warning != "" && resp.Warning == "" {
+		resp.Warning = warning
+	}
+	return resp
+}
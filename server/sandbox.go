@@ -0,0 +1,249 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// Error codes of sandboxed commands exceeding their limits (see Sandbox)
+const (
+	CodeWallTime     = "wall_time_exceeded"
+	CodeResponseSize = "response_too_large"
+	CodeGoroutines   = "too_many_goroutines"
+)
+
+// Limits are the resources a sandboxed command may use (see Sandbox). Zero
+// values impose no limit.
+type Limits struct {
+	// WallTime is the time the command may run. Its context is cancelled
+	// once the time is up and the command fails without waiting for the
+	// handler to return.
+	WallTime time.Duration
+
+	// ResponseSize is the size of the response payload in bytes, streamed
+	// payloads included
+	ResponseSize int
+
+	// Goroutines is the number of goroutines the command may spawn via the
+	// group of its context (see GroupFromContext)
+	Goroutines int
+}
+
+// groupContextKey is the context key of the group of a sandboxed command
+type groupContextKey struct{}
+
+// GroupFromContext returns the group through which a sandboxed command
+// spawns its goroutines. Outside of a sandbox it returns an unlimited group
+// bound to ctx.
+func GroupFromContext(ctx context.Context) *Group {
+	if group, ok := ctx.Value(groupContextKey{}).(*Group); ok {
+		return group
+	}
+	return newGroup(ctx, 0)
+}
+
+// Group runs the goroutines of a command, like golang.org/x/sync/errgroup:
+// the first goroutine failing cancels the group's context and its error is
+// returned by Wait. The goroutines of a sandboxed command are limited by
+// Limits.Goroutines.
+type Group struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	limit    int
+	spawned  int
+	err      error  // First error returned by a goroutine
+	exceeded *Error // Goroutine refused due to the limit
+}
+
+// newGroup creates a group bound to ctx allowing limit goroutines (unlimited
+// if zero)
+func newGroup(ctx context.Context, limit int) *Group {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Group{
+		ctx:    ctx,
+		cancel: cancel,
+		limit:  limit,
+	}
+}
+
+// Context returns the context of the group's goroutines, which is cancelled
+// once one of them fails or the command has ended
+func (g *Group) Context() context.Context {
+	return g.ctx
+}
+
+// Go runs fn in a new goroutine. It fails without running fn if the command
+// has spawned all goroutines it may, which also fails the command.
+func (g *Group) Go(fn func() error) error {
+	g.mu.Lock()
+	if g.limit > 0 && g.spawned >= g.limit {
+		if g.exceeded == nil {
+			g.exceeded = Errorf(CodeGoroutines, "more than %d goroutines spawned", g.limit)
+		}
+		g.mu.Unlock()
+		return g.exceeded
+	}
+	g.spawned++
+	g.mu.Unlock()
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := fn(); err != nil {
+			g.mu.Lock()
+			if g.err == nil {
+				g.err = err
+				g.cancel()
+			}
+			g.mu.Unlock()
+		}
+	}()
+
+	return nil
+}
+
+// Wait waits for all goroutines of the group and returns the first error
+// returned by any of them
+func (g *Group) Wait() error {
+	g.wg.Wait()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
+
+// violation returns the goroutine limit violation (nil if none)
+func (g *Group) violation() *Error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.exceeded
+}
+
+// Sandbox returns middleware executing commands within limits, so that a
+// single greedy command cannot starve the daemon. Violations fail the
+// command with an *Error carrying one of the codes CodeWallTime,
+// CodeResponseSize and CodeGoroutines (see ErrorCodeMeta). Handlers are
+// not preempted: a handler exceeding its wall time keeps running in the
+// background until it notices the cancellation of its context.
+func Sandbox(limits Limits) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, req *Request) *unixsock.Response {
+
+			if limits.WallTime > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, limits.WallTime)
+				defer cancel()
+			}
+
+			group := newGroup(ctx, limits.Goroutines)
+			defer group.cancel()
+			ctx = context.WithValue(ctx, groupContextKey{}, group)
+
+			// Execute the command
+			done := make(chan *unixsock.Response, 1)
+			go func() {
+				done <- next.ServeUnix(ctx, req)
+			}()
+
+			var expired <-chan time.Time
+			if limits.WallTime > 0 {
+				timer := time.NewTimer(limits.WallTime)
+				defer timer.Stop()
+				expired = timer.C
+			}
+
+			var resp *unixsock.Response
+			select {
+			case resp = <-done:
+			case <-expired:
+				go discard(done)
+				return errorResponse(Errorf(CodeWallTime, "command '%s' exceeded its wall time of %s", req.Cmd, limits.WallTime))
+			}
+
+			// Enforce the limits of the result
+			if exceeded := group.violation(); exceeded != nil {
+				closeStream(resp)
+				return errorResponse(exceeded)
+			}
+			if resp == nil || limits.ResponseSize <= 0 {
+				return resp
+			}
+			if len(resp.Payload) > limits.ResponseSize {
+				closeStream(resp)
+				return errorResponse(Errorf(CodeResponseSize, "response of %d bytes exceeds the limit of %d bytes", len(resp.Payload), limits.ResponseSize))
+			}
+			if resp.Stream != nil {
+				resp.Stream = &limitedStream{
+					Reader:    resp.Stream,
+					limit:     limits.ResponseSize,
+					remaining: int64(limits.ResponseSize - len(resp.Payload)),
+				}
+			}
+
+			return resp
+		})
+	}
+}
+
+// discard releases the response of a handler that exceeded its wall time
+func discard(done <-chan *unixsock.Response) {
+	closeStream(<-done)
+}
+
+// closeStream closes the streamed payload of a response that is not sent
+func closeStream(resp *unixsock.Response) {
+	if resp == nil || resp.Stream == nil {
+		return
+	}
+	if closer, ok := resp.Stream.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// limitedStream fails a streamed payload once it exceeds the response size
+// limit. The trailer and closing of the underlying stream are passed
+// through.
+type limitedStream struct {
+	io.Reader
+	limit     int
+	remaining int64
+}
+
+// Read reads from the underlying stream until the limit has been exceeded
+func (s *limitedStream) Read(p []byte) (int, error) {
+	if s.remaining < 0 {
+		return 0, Errorf(CodeResponseSize, "streamed response exceeds the limit of %d bytes", s.limit)
+	}
+	if int64(len(p)) > s.remaining+1 {
+		p = p[:s.remaining+1]
+	}
+	n, err := s.Reader.Read(p)
+	s.remaining -= int64(n)
+	if s.remaining < 0 {
+		return n - 1, Errorf(CodeResponseSize, "streamed response exceeds the limit of %d bytes", s.limit)
+	}
+	return n, err
+}
+
+// Trailer returns the trailer of the underlying stream (if any)
+func (s *limitedStream) Trailer() map[string]string {
+	if t, ok := s.Reader.(unixsock.Trailer); ok {
+		return t.Trailer()
+	}
+	return nil
+}
+
+// Close closes the underlying stream (if closable)
+func (s *limitedStream) Close() error {
+	if closer, ok := s.Reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// Schema declares the arguments of a command (see Router.Declare)
+type Schema struct {
+	// Required arguments must be present
+	Required []string `json:"required,omitempty"`
+
+	// Optional arguments may be present
+	Optional []string `json:"optional,omitempty"`
+
+	// Strict rejects arguments that are neither required nor optional,
+	// catching typos like verbsoe=true that would otherwise be ignored
+	Strict bool `json:"strict,omitempty"`
+
+	// Types (if any) declares the types of the arguments, e.g. "string",
+	// "bool", "int64" or "duration" (see package codegen). They are not
+	// validated by the server, but let generated clients pass typed
+	// arguments.
+	Types map[string]string `json:"types,omitempty"`
+
+	// Reply (if any) declares the fields of the JSON object returned by the
+	// command and their types, letting generated clients decode it
+	Reply map[string]string `json:"reply,omitempty"`
+}
+
+// ValidationError is a structured validation failure. It is sent to the
+// client as the (JSON) payload of the failed response.
+type ValidationError struct {
+	Command string   `json:"command"`
+	Missing []string `json:"missing,omitempty"`
+	Unknown []string `json:"unknown,omitempty"`
+}
+
+// Error implements the error interface
+func (v *ValidationError) Error() string {
+	var problems []string
+	if len(v.Missing) > 0 {
+		problems = append(problems, fmt.Sprintf("missing arguments: %s", strings.Join(v.Missing, ", ")))
+	}
+	if len(v.Unknown) > 0 {
+		problems = append(problems, fmt.Sprintf("unknown arguments: %s", strings.Join(v.Unknown, ", ")))
+	}
+	return fmt.Sprintf("validate: invalid arguments for command '%s': %s", v.Command, strings.Join(problems, "; "))
+}
+
+// Response returns the failed response reporting v
+func (v *ValidationError) Response() *unixsock.Response {
+	payload, _ := json.Marshal(v)
+	return &unixsock.Response{
+		Status:  unixsock.STATUS_FAIL,
+		Error:   v.Error(),
+		Payload: string(payload),
+	}
+}
+
+// Validate checks args of cmd against the schema. It returns nil if they are
+// valid.
+func (s *Schema) Validate(cmd string, args unixsock.Args) *ValidationError {
+
+	v := &ValidationError{Command: cmd}
+
+	declared := make(map[string]bool, len(s.Required)+len(s.Optional))
+	for _, key := range s.Required {
+		declared[key] = true
+		if _, ok := args[key]; !ok {
+			v.Missing = append(v.Missing, key)
+		}
+	}
+	for _, key := range s.Optional {
+		declared[key] = true
+	}
+
+	if s.Strict {
+		for key := range args {
+			if !declared[key] {
+				v.Unknown = append(v.Unknown, key)
+			}
+		}
+		sort.Strings(v.Unknown)
+	}
+
+	if len(v.Missing) == 0 && len(v.Unknown) == 0 {
+		return nil
+	}
+
+	return v
+}
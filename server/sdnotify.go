@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends state (e.g. READY=1) to the service manager via the socket
+// in $NOTIFY_SOCKET (see sd_notify(3)). It does nothing if the process has
+// not been started by systemd.
+func sdNotify(state string) error {
+
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// Abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the interval at which the service manager
+// expects WATCHDOG=1 notifications (half of $WATCHDOG_USEC), or zero if the
+// watchdog is disabled for this process
+func sdWatchdogInterval() time.Duration {
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// sdWatchdog notifies the service manager periodically while the server is
+// running and healthy (see SetHealth)
+func (u *unixSockSrv) sdWatchdog(interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			u.mu.RLock()
+			check := u.health
+			u.mu.RUnlock()
+
+			if check == nil || check() == nil {
+				sdNotify("WATCHDOG=1")
+			}
+		case <-u.ctx.Done():
+			return
+		}
+	}
+}
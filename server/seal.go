@@ -0,0 +1,31 @@
+package server
+
+import (
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// CodeUnsealable is the error code of requests whose sealed arguments can not
+// be opened (see OpenSealed)
+const CodeUnsealable = "unsealable"
+
+// OpenSealed returns middleware opening the sealed arguments of every request
+// (see unixsock.Sealer) before passing it on, so that handlers see them in
+// plaintext. Only a copy of the request is modified, which keeps recordings
+// (see WithRecorder) free of plaintext secrets. Requests whose arguments can
+// not be opened fail with the error code CodeUnsealable.
+func OpenSealed(sealer *unixsock.Sealer) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, req *Request) *unixsock.Response {
+			args, err := sealer.Open(req.Args)
+			if err != nil {
+				return errorResponse(Errorf(CodeUnsealable, "%s", err.Error()))
+			}
+
+			opened := *req
+			opened.Args = args
+
+			return next.ServeUnix(ctx, &opened)
+		})
+	}
+}
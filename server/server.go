@@ -2,122 +2,1054 @@ package server
 
 import (
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/vaitekunas/unixsock"
+	"github.com/vaitekunas/unixsock/client"
+	"github.com/vaitekunas/unixsock/record"
 	context "golang.org/x/net/context"
 )
 
 // UnixSockSrv is a unix-socket server interface
 type UnixSockSrv interface {
-	// Stop stops the server and all supporting goroutines
+	// SetHealth sets the health check reported via the reserved _sys.health
+	// command. A non-nil error marks the server as degraded.
+	SetHealth(check func() error)
+
+	// SetMaintenance puts the server into maintenance mode (nil ends it),
+	// refusing all but admin and reserved commands, also toggled via the
+	// reserved admin command _sys.maintenance
+	SetMaintenance(m *Maintenance)
+
+	// Broadcast pushes an unsolicited event to all currently connected
+	// clients and returns the number of clients it was delivered to. Clients
+	// that subscribed with a filter (see the reserved _sys.subscribe
+	// command) only receive the events whose arguments match it.
+	Broadcast(cmd string, args unixsock.Args) int
+
+	// BroadcastTo pushes an unsolicited event to the connected clients
+	// whose connection tags (see client.WithTags) match selector and returns
+	// the number of clients it was delivered to
+	BroadcastTo(selector Selector, cmd string, args unixsock.Args) int
+
+	// Stats returns the execution statistics (calls, errors and latencies)
+	// of every command handled so far, also reported via the reserved
+	// _sys.stats command
+	Stats() map[string]CommandStats
+
+	// QueueStats returns the metrics of the dispatch queue (depth, wait
+	// times and shed commands), also reported via the reserved _sys.queue
+	// command. They are zero if the queue is disabled.
+	QueueStats() QueueStats
+
+	// Clients returns the statistics of every connected client (messages
+	// and bytes exchanged, errors and connect time), also reported via the
+	// reserved _sys.clients command. Handlers can read the statistics of
+	// their own connection with ConnStatsFromContext.
+	Clients() []ConnStats
+
+	// Done returns a channel that is closed once the server has stopped,
+	// either via Stop or due to a fatal error
+	Done() <-chan struct{}
+
+	// Err returns the fatal error that stopped the server, or nil if the
+	// server is running or has been stopped via Stop
+	Err() error
+
+	// Reconfigure changes the settings of the running server without
+	// rebinding the socket, e.g. on SIGHUP. The options are applied on top of
+	// the current settings and take effect with the next message. Settings
+	// fixed at startup (dispatch queue, concurrency per connection and
+	// systemd integration) can not be changed.
+	Reconfigure(opts ...Option) error
+
+	// Forward transparently proxies the commands matching pattern (a
+	// path.Match pattern, e.g. "billing.*") to the server listening on
+	// targetPath, so that several services can be composed behind one
+	// socket. Forwarded commands are authorized locally first and carry their
+	// metadata, expiry and priority, the original request ID (as
+	// ForwardedIDMeta) and the credentials of the client (see ForwardedPeer).
+	// They are cancelled along with the original command. opts configure the
+	// client connecting to the target (e.g. its timeout). Of several
+	// matching patterns the one registered first wins.
+	Forward(pattern, targetPath string, opts ...client.Option) error
+
+	// Drain stops accepting new connections, while the existing ones
+	// continue to be served until they are closed or the server is stopped.
+	// The socket file is removed, so that a replacement process can listen
+	// on it (e.g. during an upgrade).
+	Drain()
+
+	// Stop stops the server and all supporting goroutines. Connected clients
+	// are told that the server is going away for good (see Shutdown).
 	Stop()
+
+	// Shutdown stops the server like Stop. Connected clients are notified
+	// that the server is going away, so that they stop sending commands over
+	// their connections instead of timing out. retry tells them whether a
+	// replacement process is going to listen on the socket (e.g. during a
+	// restart or upgrade), so that they redial it.
+	Shutdown(retry bool, reason string)
 }
 
-// New starts a unix-socket server listening on UnixSockPath
-func New(UnixSockPath string, handler func(cmd string, args unixsock.Args) *unixsock.Response) (UnixSockSrv, error) {
+// New starts a unix-socket server listening on UnixSockPath (see
+// NewWithHandler)
+func New(UnixSockPath string, handler func(cmd string, args unixsock.Args) *unixsock.Response, opts ...Option) (UnixSockSrv, error) {
+	return NewWithHandler(UnixSockPath, funcHandler(handler), opts...)
+}
 
-	// Internal context
-	internalCTX, cancel := context.WithCancel(context.Background())
+// NewWithHandler starts a unix-socket server listening on UnixSockPath,
+// serving commands with handler. The socket is guarded by a lock file
+// (UnixSockPath + ".lock", held until the server is stopped or drained), so
+// that a stale socket left behind by a crashed process is replaced, while a
+// socket served by another process results in *ErrAlreadyRunning. Servers
+// created with WithTransport listen via the transport instead.
+func NewWithHandler(UnixSockPath string, handler Handler, opts ...Option) (UnixSockSrv, error) {
+
+	// Options needed before serving
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	if err := o.validate(); err != nil {
+		return nil, fmt.Errorf("New: %s", err.Error())
+	}
+
+	// Listen via a custom transport
+	if o.transport != nil {
+		l, err := o.transport.Listen(UnixSockPath)
+		if err != nil {
+			return nil, fmt.Errorf("New: could not listen via the transport: %s", err.Error())
+		}
+		return serve(l, handler, opts), nil
+	}
 
 	// Listen on to the unix socket
-	listenUnix, err := net.Listen("unix", UnixSockPath)
+	listenUnix, err := listenLocked(UnixSockPath, o.socketMode)
+	if running, ok := err.(*ErrAlreadyRunning); ok {
+		return nil, running
+	}
 	if err != nil {
 		return nil, fmt.Errorf("New: could not listen on the unix socket: %s", err.Error())
 	}
 
+	srv := serve(listenUnix, handler, opts)
+	srv.watchSocket(listenUnix)
+
+	return srv, nil
+}
+
+// Serve starts a server accepting connections on an existing listener (e.g.
+// a testing listener or a custom transport). The listener is closed by Stop.
+func Serve(l net.Listener, handler func(cmd string, args unixsock.Args) *unixsock.Response, opts ...Option) (UnixSockSrv, error) {
+	if l == nil {
+		return nil, fmt.Errorf("Serve: nil listener")
+	}
+	if err := validateOptions(opts); err != nil {
+		return nil, fmt.Errorf("Serve: %s", err.Error())
+	}
+
+	return serve(l, funcHandler(handler), opts), nil
+}
+
+// NewFromFD starts a server accepting connections on an inherited listening
+// socket (e.g. passed by systemd socket activation or a parent process).
+func NewFromFD(fd uintptr, handler func(cmd string, args unixsock.Args) *unixsock.Response, opts ...Option) (UnixSockSrv, error) {
+
+	if err := validateOptions(opts); err != nil {
+		return nil, fmt.Errorf("NewFromFD: %s", err.Error())
+	}
+
+	f := os.NewFile(fd, fmt.Sprintf("unixsock-fd-%d", fd))
+	if f == nil {
+		return nil, fmt.Errorf("NewFromFD: invalid file descriptor %d", fd)
+	}
+	defer f.Close()
+
+	// FileListener duplicates the descriptor
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("NewFromFD: file descriptor %d is not a listening socket: %s", fd, err.Error())
+	}
+
+	return serve(l, funcHandler(handler), opts), nil
+}
+
+// serve starts serving connections accepted on listenUnix
+func serve(listenUnix net.Listener, handler Handler, opts []Option) *unixSockSrv {
+
+	// Apply options
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	// Internal context
+	internalCTX, cancel := context.WithCancel(context.Background())
+
 	// New instance of unixSockSrv
 	srv := &unixSockSrv{
 		listenUnix: listenUnix,
+		ctx:        internalCTX,
 		cancelCTX:  cancel,
+		handler:    handler,
+		stats:      newStats(),
+		opts:       o,
+		conns:      make(map[*unixsock.Conn]*connActivity),
+		filters:    make(map[*unixsock.Conn]eventFilter),
+		events:     newEventLog(),
+		resumable:  make(map[string]*resumable),
+		peerConns:  make(map[peerKey]int),
 	}
 
-	// Unix handler
-	unixHandler := newUnixRequestHandler(handler)
+	// Dispatch queue
+	if o.workers > 0 && !o.inline {
+		srv.queue = newDispatchQueue(o.workers, o.queueCapacity)
+		go func() {
+			<-internalCTX.Done()
+			srv.queue.close()
+		}()
+	}
+
+	// Idle reaper
+	go srv.reapIdle()
 
-	// Serve socket requests
-	connChan := make(chan net.Conn, 1)
+	// Unix handler
+	unixHandler := newUnixRequestHandler(srv)
 
 	// Wait group for goroutine startup
 	wg := &sync.WaitGroup{}
-	wg.Add(2)
+	wg.Add(1)
+
+	// Dispatcher of accepted connections (see withAcceptDispatcher)
+	var connChan chan net.Conn
+	if o.acceptDispatcher {
+		connChan = make(chan net.Conn, 1)
+		go func() {
+			for {
+				select {
+				case conn := <-connChan:
+					go unixHandler(conn)
+				case <-internalCTX.Done():
+					return
+				}
+			}
+		}()
+	}
 
-	// Listen for incoming unix connections
+	// Listen for incoming unix connections, serving each of them on a
+	// goroutine of its own
 	go func() {
 		wg.Done()
+		var delay time.Duration
 	Loop:
 		for {
 			fd, errUnix := listenUnix.Accept()
 			if errUnix != nil {
+
+				// Listener closed by Stop or Drain
+				select {
+				case <-internalCTX.Done():
+					break Loop
+				default:
+				}
+				if srv.isDraining() {
+					break Loop
+				}
+
+				// Back off on temporary errors (e.g. EMFILE), freeing
+				// descriptors if the process has run out of them
+				ne, temporary := errUnix.(net.Error)
+				temporary = temporary && ne.Temporary()
+				if isExhausted(errUnix) {
+					temporary = true
+					errUnix = srv.exhausted(errUnix)
+				}
+
+				if callback := srv.options().onAcceptError; callback != nil {
+					callback(errUnix)
+				}
+
+				if temporary {
+					delay = acceptBackoff(delay)
+					select {
+					case <-time.After(delay):
+					case <-internalCTX.Done():
+						break Loop
+					}
+					continue
+				}
+
+				// Fatal error: the listener is broken
+				srv.fail(fmt.Errorf("accept: %s", errUnix.Error()))
+				break Loop
+			}
+			delay = 0
+
+			// Served right away (see WithInlineConnections)
+			if o.inline {
+				unixHandler(fd)
 				continue
 			}
-			select {
-			case connChan <- fd:
-			case <-internalCTX.Done():
-				break Loop
+
+			if connChan != nil {
+				select {
+				case connChan <- fd:
+					continue
+				case <-internalCTX.Done():
+					fd.Close()
+					break Loop
+				}
 			}
-		}
-	}()
 
-	// Process unix connections
-	go func() {
-		wg.Done()
-	Loop:
-		for {
 			select {
-			case conn := <-connChan:
-				go unixHandler(conn)
 			case <-internalCTX.Done():
+				fd.Close()
 				break Loop
+			default:
 			}
+
+			go unixHandler(fd)
 		}
 	}()
 
 	// Wait for goroutines
 	wg.Wait()
 
+	// Notify systemd
+	if o.systemd {
+		sdNotify("READY=1")
+		if interval := sdWatchdogInterval(); interval > 0 {
+			go srv.sdWatchdog(interval)
+		}
+	}
+
 	// New server
-	return srv, nil
+	return srv
 
 }
 
 // unixSockSrv implements the UnixSockSrv interface
 type unixSockSrv struct {
 	listenUnix net.Listener
+	ctx        context.Context
 	cancelCTX  func()
+	handler    Handler
+	queue      *dispatchQueue
+	stats      *stats
+
+	mu          sync.RWMutex
+	opts        *options // Replaced (never modified) by Reconfigure
+	health      func() error
+	maintenance *Maintenance
+	err         error
+	conns       map[*unixsock.Conn]*connActivity
+	filters     map[*unixsock.Conn]eventFilter // Event filters of subscribed connections
+	events      *eventLog
+	peerConns   map[peerKey]int // Open connections of every peer
+	exhaustions uint64          // Accept failures due to exhausted resources
+	lastConnID  uint64          // ID of the last connection accepted (atomic)
+	draining    bool
+	closed      bool // Listener closed by Drain or Shutdown
+	stopped     bool
+	forwards    []*forward // Commands proxied to other servers (see Forward)
+
+	resumable map[string]*resumable // Sessions of dropped connections by token (see WithSessionResumption)
+}
+
+// acceptBackoff returns the delay before retrying a failed accept
+func acceptBackoff(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > time.Second {
+		return time.Second
+	}
+	return delay
+}
+
+// fail stops the server due to a fatal error, which is reported by Err
+func (u *unixSockSrv) fail(err error) {
+	u.mu.Lock()
+	if u.err == nil {
+		u.err = err
+	}
+	u.mu.Unlock()
+
+	u.Shutdown(false, err.Error())
+}
+
+// Done returns a channel that is closed once the server has stopped
+func (u *unixSockSrv) Done() <-chan struct{} {
+	return u.ctx.Done()
+}
+
+// Err returns the fatal error that stopped the server (if any)
+func (u *unixSockSrv) Err() error {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.err
+}
+
+// SetHealth sets the health check reported via _sys.health
+func (u *unixSockSrv) SetHealth(check func() error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.health = check
+}
+
+// options returns the current settings
+func (u *unixSockSrv) options() *options {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.opts
+}
+
+// Reconfigure changes the settings of the running server
+func (u *unixSockSrv) Reconfigure(opts ...Option) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	o := u.opts.clone()
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if err := u.opts.fixed(o); err != nil {
+		return fmt.Errorf("Reconfigure: %s", err.Error())
+	}
+	if err := o.validate(); err != nil {
+		return fmt.Errorf("Reconfigure: %s", err.Error())
+	}
+
+	u.opts = o
+
+	return nil
+}
+
+// Drain stops accepting new connections
+func (u *unixSockSrv) Drain() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !u.draining {
+		u.draining = true
+		u.closeListener()
+	}
+}
+
+// closeListener closes the listener once. The caller has to hold u.mu.
+func (u *unixSockSrv) closeListener() {
+	if !u.closed {
+		u.closed = true
+		u.listenUnix.Close()
+	}
+}
+
+// isDraining informs whether the server has been drained
+func (u *unixSockSrv) isDraining() bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.draining
 }
 
 // Stop stops the server and all supporting goroutines
 func (u *unixSockSrv) Stop() {
+	u.Shutdown(false, "server stopped")
+}
+
+// Shutdown notifies all connected clients and stops the server. Calling it
+// more than once (or after Stop) is a no-op.
+func (u *unixSockSrv) Shutdown(retry bool, reason string) {
+
+	// Notify clients only once
+	u.mu.Lock()
+	stopped := u.stopped
+	u.stopped = true
+	u.mu.Unlock()
+	if stopped {
+		return
+	}
+
+	if u.options().systemd {
+		sdNotify("STOPPING=1")
+	}
+
+	// The context is cancelled first, so that the accept loop does not take
+	// the closed listener for a failure
 	u.cancelCTX()
-	u.listenUnix.Close()
+	u.mu.Lock()
+	u.closeListener()
+	u.mu.Unlock()
+
+	u.Broadcast(sysGoAway, unixsock.Args{
+		"retry":  retry,
+		"reason": reason,
+	})
+
+	u.closeForwards()
+}
+
+// ShutdownReason is the response metadata "reason" of the commands refused
+// because the server is shutting down
+const ShutdownReason = "shutting_down"
+
+// shutdownResponse is returned for commands that are not executed because
+// the server is shutting down (cmd is empty if unknown). Clients may retry
+// them against the replacement process (if any).
+func shutdownResponse(cmd string) *unixsock.Response {
+	refused := "command refused"
+	if cmd != "" {
+		refused = fmt.Sprintf("command '%s' refused", cmd)
+	}
+	return unixsock.NewResponse().
+		Failf("dispatch: server shutting down, %s", refused).
+		WithStatus(unixsock.StatusRetry).
+		WithMeta("reason", ShutdownReason)
+}
+
+// track adds a connection to the set of open connections
+func (u *unixSockSrv) track(c *unixsock.Conn, activity *connActivity) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.conns[c] = activity
 }
 
-// newUnixRequestHandler creates a new unix request handler using executor to
+// untrack removes a connection from the set of open connections
+func (u *unixSockSrv) untrack(c *unixsock.Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if activity, ok := u.conns[c]; ok {
+		u.suspend(c, activity)
+	}
+	delete(u.conns, c)
+	delete(u.filters, c)
+}
+
+// Stats returns the execution statistics of every command handled so far
+func (u *unixSockSrv) Stats() map[string]CommandStats {
+	return u.stats.snapshot()
+}
+
+// QueueStats returns the metrics of the dispatch queue
+func (u *unixSockSrv) QueueStats() QueueStats {
+	if u.queue == nil {
+		return QueueStats{}
+	}
+	return u.queue.stats()
+}
+
+// Broadcast pushes an event to all connected clients whose event filter (if
+// any) it matches. Events are numbered (see WithEventHistory), except for
+// reserved system events, which are delivered to all clients.
+func (u *unixSockSrv) Broadcast(cmd string, args unixsock.Args) int {
+
+	isSys := strings.HasPrefix(cmd, sysPrefix)
+
+	u.events.mu.Lock()
+	defer u.events.mu.Unlock()
+
+	var seq uint64
+	if !isSys {
+		seq = u.events.append(cmd, args, u.options().eventHistory)
+	}
+
+	u.mu.RLock()
+	conns := make([]*unixsock.Conn, 0, len(u.conns))
+	for c := range u.conns {
+		if isSys || u.filters[c].matches(args) {
+			conns = append(conns, c)
+		}
+	}
+	u.mu.RUnlock()
+
+	delivered := 0
+	for _, c := range conns {
+		if err := u.sendEvent(c, seq, cmd, args); err == nil {
+			delivered++
+		}
+	}
+
+	return delivered
+}
+
+// sendEvent sends a single event numbered seq to a client
+func (u *unixSockSrv) sendEvent(c *unixsock.Conn, seq uint64, cmd string, args unixsock.Args) error {
+	event := unixsock.NewSender(c, cmd, args, false, false)
+	event.SetID(seq)
+	event.SetEvent(true)
+	event.SetWriteBuffer(u.options().writeBuffer)
+	if err := event.Send(); err != nil {
+		return err
+	}
+
+	u.mu.RLock()
+	activity := u.conns[c]
+	u.mu.RUnlock()
+	if activity != nil {
+		activity.sentMessage()
+	}
+
+	return nil
+}
+
+// execute executes a received message, either directly or via the dispatch
+// queue (if enabled)
+func (u *unixSockSrv) execute(ctx context.Context, peer *unixsock.PeerCred, socket string, msg unixsock.Communicator) *unixsock.Response {
+
+	req := &Request{
+		ID:       msg.GetID(),
+		Cmd:      msg.GetCmd(),
+		Args:     msg.GetArgs(),
+		Meta:     msg.GetMeta(),
+		Priority: msg.GetPriority(),
+		Expires:  msg.GetExpiry(),
+		Peer:     peer,
+		Socket:   socket,
+	}
+	if activity, ok := ctx.Value(connContextKey{}).(*connActivity); ok {
+		req.Process = activity.process
+	}
+	if body, ok := msg.(*withBody); ok {
+		req.body = body.body
+	}
+
+	started := time.Now()
+	var resp *unixsock.Response
+	switch {
+	case u.ctx.Err() != nil:
+		// Received after the shutdown (e.g. before the goaway event)
+		resp = shutdownResponse(req.Cmd)
+	case u.queue == nil:
+		resp = u.dispatch(ctx, req)
+	default:
+		priority := req.Priority
+		if _, isSys := u.options().systemCommand(req.Cmd); isSys {
+			priority = unixsock.PriorityHigh
+		}
+
+		resp = u.queue.submit(priority, u.options().shedWatermark, func() *unixsock.Response {
+			// Cancelled while waiting in the queue
+			if err := ctx.Err(); err != nil {
+				return unixsock.NewResponse().Failf("dispatch: command '%s' cancelled: %s", req.Cmd, err.Error())
+			}
+			return u.dispatch(ctx, req)
+		})
+	}
+	latency := time.Since(started)
+
+	// Unknown statuses can not be sent, which would leave the client
+	// without a response
+	if resp != nil && !resp.Status.Valid() {
+		resp = unixsock.NewResponse().Failf("dispatch: command '%s' returned an unknown status '%s'", req.Cmd, resp.Status)
+	}
+	u.stats.record(req.Cmd, latency, resp)
+
+	if recorder := u.options().recorder; recorder != nil {
+		recorder.Record(&record.Record{
+			Time:     started,
+			Peer:     peer,
+			Process:  req.Process,
+			ID:       req.ID,
+			Cmd:      req.Cmd,
+			Args:     req.Args,
+			Priority: req.Priority,
+			Response: resp,
+			Latency:  latency,
+		})
+	}
+
+	return resp
+}
+
+// dispatch authorizes and executes a single command. Reserved system commands
+// are handled by the server itself, all others are passed to the handler.
+// Expired commands are not executed at all.
+func (u *unixSockSrv) dispatch(ctx context.Context, req *Request) *unixsock.Response {
+
+	// Drop stale commands (e.g. after sitting in the dispatch queue)
+	if !req.Expires.IsZero() && time.Now().After(req.Expires) {
+		return &unixsock.Response{
+			Status: unixsock.STATUS_EXPIRED,
+			Error:  fmt.Sprintf("dispatch: command '%s' expired %s ago", req.Cmd, time.Since(req.Expires)),
+		}
+	}
+
+	o := u.options()
+	sys, isSys := o.systemCommand(req.Cmd)
+
+	// Authorize (user commands only if classified, see WithPolicy)
+	tier := sys.tier
+	if !isSys && o.classify != nil {
+		tier = o.classify(req.Cmd)
+	}
+	if isSys || o.classify != nil {
+		if err := authorize(o, req.Peer, req.Cmd, tier); err != nil {
+			return &unixsock.Response{
+				Status: unixsock.STATUS_FAIL,
+				Error:  err.Error(),
+			}
+		}
+	}
+	if o.authorizer != nil {
+		if err := o.authorizer.Authorize(req.Peer, req.Cmd, req.Args); err != nil {
+			return &unixsock.Response{
+				Status: unixsock.STATUS_FAIL,
+				Error:  err.Error(),
+			}
+		}
+	}
+
+	// Refuse commands during maintenance
+	if !isSys && tier < TierAdmin {
+		if m := u.inMaintenance(); m != nil {
+			return maintenanceResponse(req.Cmd, m)
+		}
+	}
+
+	// Execute
+	if isSys {
+		return sys.handler(ctx, u, req.Args)
+	}
+	if fw := u.forwarding(req.Cmd); fw != nil {
+		return fw.send(ctx, req)
+	}
+
+	return u.handler.ServeUnix(ctx, req)
+}
+
+// newUnixRequestHandler creates a new unix request handler using srv to
 // execute incoming commands. The created function handles a request via a
 // unix socket connection. It expects to read only a single message and respond
 // to it immediately
-func newUnixRequestHandler(handler func(cmd string, args unixsock.Args) *unixsock.Response) func(net.Conn) {
-	return func(c net.Conn) {
+func newUnixRequestHandler(srv *unixSockSrv) func(net.Conn) {
+	execute := srv.execute
+	return func(fd net.Conn) {
+		// Peer credentials (nil if unavailable), read before the
+		// connection is wrapped
+		peer, _ := unixsock.PeerCreds(fd)
+
+		wire := &countingConn{Conn: fd}
+		c := unixsock.NewConn(wire)
 		defer c.Close()
 
+		// Socket the connection was accepted on
+		socket := ""
+		if addr := c.LocalAddr(); addr != nil {
+			socket = addr.String()
+		}
+
+		// Enforce the per-peer connection quota
+		if !srv.admit(peer) {
+			srv.rejectConn(c, peer)
+			return
+		}
+		defer srv.release(peer)
+
+		// Peers granted no access at all are turned away, whatever protocol
+		// they speak
+		if o := srv.options(); o.policy != nil && o.policy.Grant(peer) == TierNone {
+			srv.sendClose(c, unixsock.CloseUnauthorized, fmt.Sprintf("permission denied (%s)", peer))
+			return
+		}
+
+		// Clients speaking HTTP are served by the HTTP handler (if any)
+		if o := srv.options(); o.httpHandler != nil && isHTTP(c, o.receiveTimeout) {
+			srv.serveHTTP(c, peer, o.httpHandler)
+			return
+		}
+
+		// Frames are passed undecoded to the raw handler (if any)
+		if o := srv.options(); o.rawHandler != nil && isFramed(c, o.receiveTimeout) {
+			srv.serveRaw(c, peer, o.rawHandler)
+			return
+		}
+
+		// Track the connection (for broadcasts, the idle reaper and its
+		// statistics)
+		activity := newConnActivity(atomic.AddUint64(&srv.lastConnID, 1), peer, socket, wire)
+		if srv.options().peerProcess {
+			activity.process, _ = peer.Process()
+		}
+		srv.track(c, activity)
+		defer srv.untrack(c)
+
+		// Connections accepted while stopping missed the shutdown notice
+		// and would not be reaped once tracked after the last check (see
+		// reapShutdown)
+		if srv.ctx.Err() != nil {
+			srv.sendClose(c, unixsock.CloseShutdown, "server stopped")
+			return
+		}
+
+		// Dump the frames of the connection (see WithDebugDump)
+		if o := srv.options(); o.dumper != nil && (o.dumpFilter == nil || o.dumpFilter(peer)) {
+			c.SetDump(o.dumper, fmt.Sprintf("conn %d (%s)", activity.id, peer))
+		}
+
+		// Encoding of response payloads accepted by the client (if any)
+		encoding := ""
+
+		// Commands being executed (cancelled by sysCancel)
+		executing := newCancelSet()
+
+		// handle executes a received command and responds to it
+		handle := func(ctx context.Context, receiver unixsock.Communicator) {
+			activity.begin()
+			defer activity.end()
+
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			executing.add(receiver.GetID(), cancel)
+			defer executing.remove(receiver.GetID())
+
+			response := execute(ctx, peer, socket, receiver)
+			o := srv.options()
+			if response == nil || response.Status != unixsock.STATUS_OK {
+				activity.failed()
+			}
+
+			if receiver.ShouldRespond() && !receiver.IsAck() {
+				digest := o.digest(receiver)
+				var file *os.File
+				response, file = spill(c, response, o)
+				if response != nil && response.Stream != nil {
+					if err := streamResponse(c, receiver, response, o, digest); err != nil {
+						return
+					}
+				}
+				response = sign(digest, response)
+				if encoding != "" && response != nil && o.compressMinSize > 0 && len(response.Payload) >= o.compressMinSize {
+					encoded := *response
+					if encoded.EncodePayload(encoding) == nil {
+						response = &encoded
+					}
+				}
+				receiver.SetWriteBuffer(o.writeBuffer)
+				receiver.SetChunk(nil, false)
+				receiver.SetResponse(response)
+				receiver.SetFile(file)
+				if receiver.Send() == nil {
+					activity.sentMessage()
+				}
+				if file != nil {
+					file.Close()
+				}
+			} else if response != nil && response.Stream != nil {
+				if closer, ok := response.Stream.(io.Closer); ok {
+					closer.Close()
+				}
+			}
+		}
+
+		// Handlers' context, cancelled once the server is stopped or the
+		// connection has been closed
+		ctx, cancel := context.WithCancel(context.WithValue(srv.ctx, connContextKey{}, activity))
+		defer cancel()
+
+		// Concurrent handling of the messages of this connection
+		var sem chan struct{}
+		inFlight := &sync.WaitGroup{}
+		if n := srv.options().concurrentPerConn; n > 1 {
+			sem = make(chan struct{}, n)
+		}
+		defer inFlight.Wait()
+
+		// Request bodies being streamed to handlers (aborted if the
+		// connection is lost)
+		uploads := make(map[uint64]*io.PipeWriter)
+		defer func() {
+			for _, body := range uploads {
+				body.CloseWithError(io.ErrUnexpectedEOF)
+			}
+		}()
+
 	Loop:
 		for {
 
-			// Receive the command
-			receiver := unixsock.NewReceiver(c)
-			if err := receiver.Receive(); err != nil {
+			// Receive the command. Messages are rejected by their
+			// command's size limit after receiving, so reading is capped
+			// by the largest limit.
+			o := srv.options()
+			receiver := unixsock.NewReceiver(c, unixsock.WithMaxLength(o.maxReceiveSize()), unixsock.WithTimeout(o.receiveTimeout))
+			err := receiver.Receive()
+
+			// Settings may have been changed by Reconfigure in the meantime
+			o = srv.options()
+
+			if err != nil {
+				kind := unixsock.ErrIO
+				if re, ok := err.(*unixsock.ReceiveError); ok {
+					kind = re.Kind
+				}
+
+				// Normal closure or idle connection
+				if kind == unixsock.ErrClosed || activity.wasReaped() {
+					break Loop
+				}
+				if kind == unixsock.ErrTimeout {
+					srv.sendClose(c, unixsock.CloseIdleTimeout, fmt.Sprintf("no message received within %s", o.receiveTimeout))
+					break Loop
+				}
+
+				activity.failed()
+				if o.onReceiveError != nil {
+					o.onReceiveError(err)
+				}
+
+				// The malformed message has been consumed entirely
+				if kind == unixsock.ErrMalformed {
+					continue
+				}
+				if kind == unixsock.ErrTooLong {
+					srv.sendClose(c, unixsock.CloseProtocolError, err.Error())
+				}
 				break Loop
 			}
+			activity.touch()
+			activity.receivedMessage()
 
-			// Handle the command
-			response := handler(receiver.GetCmd(), receiver.GetArgs())
+			// Enforce the size limit of the command
+			if limit := o.maxMessageSize(receiver.GetCmd()); receiver.Size() > limit {
+				if receiver.ShouldRespond() {
+					reject := unixsock.NewSender(c, receiver.GetCmd(), nil, false, false) // Without echoing the arguments
+					reject.SetID(receiver.GetID())
+					reject.SetWriteBuffer(o.writeBuffer)
+					reject.SetResponse(sign(o.digest(receiver), &unixsock.Response{
+						Status: unixsock.STATUS_FAIL,
+						Error:  fmt.Sprintf("receive: message too long: %d bytes (maximum for '%s' is %d)", receiver.Size(), receiver.GetCmd(), limit),
+					}))
+					if reject.Send() == nil {
+						activity.sentMessage()
+					}
+				}
+				activity.failed()
+				if receiver.ShouldClose() {
+					break Loop
+				}
+				continue
+			}
 
-			// Respond
-			if receiver.ShouldRespond() {
-				receiver.SetResponse(response)
-				receiver.Send()
+			// Cancellation of a command the client has given up on,
+			// including the upload of its request body
+			if receiver.GetCmd() == sysCancel {
+				if id, ok := cancelID(receiver.GetArgs()); ok {
+					executing.cancel(id)
+					if body, ok := uploads[id]; ok {
+						body.CloseWithError(context.Canceled)
+						delete(uploads, id)
+					}
+				}
+				if receiver.ShouldClose() {
+					break Loop
+				}
+				continue
+			}
+
+			// Chunk of a request body. Chunks arriving after the handler
+			// has returned are dropped.
+			if body, ok := uploads[receiver.GetID()]; ok {
+				if chunk := receiver.GetChunk(); len(chunk) > 0 {
+					body.Write(chunk)
+				}
+				if !receiver.HasMore() {
+					body.Close()
+					delete(uploads, receiver.GetID())
+					if receiver.ShouldClose() {
+						break Loop
+					}
+				}
+				continue
+			}
+
+			// Negotiate connection features
+			if receiver.GetCmd() == sysHello {
+				inFlight.Wait()
+				var cancellable bool
+				encoding, cancellable = srv.hello(c, activity, receiver, o)
+
+				// Commands are executed in the background, one at a
+				// time, so that their cancellations can be received
+				if cancellable && sem == nil {
+					sem = make(chan struct{}, 1)
+				}
+				continue
+			}
+			if receiver.GetCmd() == sysSubscribe {
+				srv.subscribe(c, receiver, o)
+				if receiver.ShouldClose() {
+					break Loop
+				}
+				continue
+			}
+
+			// Acknowledge the receipt of the command, which is then
+			// executed without responding
+			if receiver.IsAck() && receiver.ShouldRespond() {
+				ack := unixsock.NewSender(c, receiver.GetCmd(), nil, false, false)
+				ack.SetID(receiver.GetID())
+				ack.SetAck(true)
+				ack.SetWriteBuffer(o.writeBuffer)
+				if ack.Send() != nil {
+					break Loop
+				}
+				activity.sentMessage()
+			}
+
+			// Command with a streamed request body: the handler runs while
+			// the body is being received
+			if receiver.HasMore() {
+				reader, body := io.Pipe()
+				uploads[receiver.GetID()] = body
+				receiver = &withBody{receiver, reader}
+
+				if sem != nil {
+					sem <- struct{}{}
+				}
+				inFlight.Add(1)
+				go func(receiver unixsock.Communicator) {
+					defer func() {
+						reader.Close()
+						if sem != nil {
+							<-sem
+						}
+						inFlight.Done()
+					}()
+					handle(ctx, receiver)
+				}(receiver)
+
+				if chunk := receiver.GetChunk(); len(chunk) > 0 {
+					body.Write(chunk)
+				}
+				continue
+			}
+
+			// Handle the command. Notifications (commands without a
+			// response) are executed before the next message is read, so
+			// that they take effect before the commands sent after them.
+			switch {
+			case sem == nil:
+				handle(ctx, receiver)
+			case !receiver.ShouldRespond():
+				sem <- struct{}{}
+				handle(ctx, receiver)
+				<-sem
+			default:
+				sem <- struct{}{}
+				inFlight.Add(1)
+				go func(receiver unixsock.Communicator) {
+					defer func() {
+						<-sem
+						inFlight.Done()
+					}()
+					handle(ctx, receiver)
+				}(receiver)
 			}
 
 			// Close connection
@@ -129,3 +1061,20 @@ func newUnixRequestHandler(handler func(cmd string, args unixsock.Args) *unixsoc
 
 	}
 }
+
+// withBody attaches a streamed request body to a received message
+type withBody struct {
+	unixsock.Communicator
+	body io.Reader
+}
+
+// authorize checks whether peer is allowed to execute cmd requiring tier
+func authorize(o *options, peer *unixsock.PeerCred, cmd string, tier Tier) error {
+	if o.policy == nil {
+		return nil
+	}
+	if !o.policy.Allows(peer, tier) {
+		return fmt.Errorf("authorize: permission denied: command '%s' requires tier '%s' (%s)", cmd, tier, peer)
+	}
+	return nil
+}
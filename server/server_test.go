@@ -1,11 +1,39 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"github.com/vaitekunas/unixsock"
+	"github.com/vaitekunas/unixsock/chaos"
 	"github.com/vaitekunas/unixsock/client"
+	"github.com/vaitekunas/unixsock/record"
+	context "golang.org/x/net/context"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+)
+
+// Soak test settings (see TestSoak), e.g. -soak.clients=64 -soak.duration=10m
+var (
+	soakClients  = flag.Int("soak.clients", 4, "number of clients of TestSoak")
+	soakDuration = flag.Duration("soak.duration", 250*time.Millisecond, "duration of every round of TestSoak")
 )
 
 func fakeHandler(cmd string, args unixsock.Args) *unixsock.Response {
@@ -81,3 +109,5226 @@ func TestNew(t *testing.T) {
 	}
 
 }
+
+func TestPolicy(t *testing.T) {
+
+	router := NewRouter()
+	router.Register("stats", TierReadOnly, fakeHandler)
+	router.Register("config.set", TierMutating, fakeHandler)
+	router.Register("shutdown", TierAdmin, fakeHandler)
+
+	policy := NewPolicy(TierReadOnly).AllowUID(0, TierAdmin).AllowGID(100, TierMutating)
+
+	tests := []struct {
+		peer    *unixsock.PeerCred
+		cmd     string
+		allowed bool
+	}{
+		{&unixsock.PeerCred{UID: 0, GID: 0}, "shutdown", true},
+		{&unixsock.PeerCred{UID: 1000, GID: 1000}, "stats", true},
+		{&unixsock.PeerCred{UID: 1000, GID: 1000}, "config.set", false},
+		{&unixsock.PeerCred{UID: 1000, GID: 100}, "config.set", true},
+		{&unixsock.PeerCred{UID: 1000, GID: 100}, "shutdown", false},
+		{nil, "stats", true},
+		{nil, "unknown", false},
+	}
+
+	o := &options{policy: policy, classify: router.Tier}
+	for i, test := range tests {
+		if err := authorize(o, test.peer, test.cmd, router.Tier(test.cmd)); (err == nil) != test.allowed {
+			t.Errorf("TestPolicy: test %d failed: expected allowed=%v, got error: %v", i+1, test.allowed, err)
+		}
+	}
+
+}
+
+func TestHealth(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_health.sock"
+
+	srv, err := New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestHealth: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestHealth: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := c.Ping(ctx); err != nil {
+		t.Errorf("TestHealth: expected healthy server, got: %s", err.Error())
+	}
+
+	srv.SetHealth(func() error { return fmt.Errorf("database unreachable") })
+	if err := c.Ping(ctx); err == nil {
+		t.Errorf("TestHealth: expected degraded server")
+	}
+
+}
+
+func TestDone(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_done.sock"
+
+	// Regular stop
+	srv, err := New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestDone: could not start server: %s", err.Error())
+	}
+	srv.Stop()
+
+	select {
+	case <-srv.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("TestDone: server not done after Stop")
+	}
+	if srv.Err() != nil {
+		t.Errorf("TestDone: expected no error after Stop, got: %s", srv.Err().Error())
+	}
+
+	// Listener closed from under the server
+	srv, err = New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestDone: could not start server: %s", err.Error())
+	}
+	srv.(*unixSockSrv).listenUnix.Close()
+
+	select {
+	case <-srv.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("TestDone: server not done after listener was closed")
+	}
+	if srv.Err() == nil {
+		t.Errorf("TestDone: expected an error after listener was closed")
+	}
+
+}
+
+func TestDispatchQueue(t *testing.T) {
+
+	q := newDispatchQueue(1, 10)
+	defer q.close()
+
+	// Block the only worker
+	release := make(chan struct{})
+	go q.submit(unixsock.PriorityNormal, 0, func() *unixsock.Response {
+		<-release
+		return nil
+	})
+	time.Sleep(20 * time.Millisecond)
+
+	// Queue commands of increasing priority
+	mu := &sync.Mutex{}
+	order := []unixsock.Priority{}
+	wg := &sync.WaitGroup{}
+	for _, p := range []unixsock.Priority{unixsock.PriorityLow, unixsock.PriorityNormal, unixsock.PriorityHigh} {
+		wg.Add(1)
+		go func(p unixsock.Priority) {
+			defer wg.Done()
+			q.submit(p, 0, func() *unixsock.Response {
+				mu.Lock()
+				order = append(order, p)
+				mu.Unlock()
+				return nil
+			})
+		}(p)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+
+	expected := []unixsock.Priority{unixsock.PriorityHigh, unixsock.PriorityNormal, unixsock.PriorityLow}
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		t.Errorf("TestDispatchQueue: expected execution order %v, got %v", expected, order)
+	}
+
+}
+
+func TestLoadShedding(t *testing.T) {
+
+	q := newDispatchQueue(1, 4)
+	defer q.close()
+
+	// Block the only worker and fill half of the queue
+	release := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.submit(unixsock.PriorityNormal, 0.5, func() *unixsock.Response {
+				<-release
+				return unixsock.NewResponse().OK()
+			})
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if s := q.stats(); s.Depth != 2 || s.Submitted != 3 {
+		t.Errorf("TestLoadShedding: unexpected stats before shedding: %+v", s)
+	}
+
+	// Low priority commands are shed, others are queued
+	resp := q.submit(unixsock.PriorityLow, 0.5, func() *unixsock.Response {
+		t.Errorf("TestLoadShedding: shed command was executed")
+		return nil
+	})
+	if resp.Status != unixsock.StatusRetry || resp.Meta["reason"] != "overloaded" {
+		t.Errorf("TestLoadShedding: expected an overloaded response, got %+v", resp)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if resp := q.submit(unixsock.PriorityNormal, 0.5, func() *unixsock.Response { return unixsock.NewResponse().OK() }); resp.Status != unixsock.StatusOK {
+			t.Errorf("TestLoadShedding: normal priority command not executed: %+v", resp)
+		}
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	s := q.stats()
+	if s.Depth != 0 || s.Submitted != 4 || s.Shed != 1 || s.Workers != 1 || s.Capacity != 4 || s.WaitMax < 20*time.Millisecond {
+		t.Errorf("TestLoadShedding: unexpected stats: %+v", s)
+	}
+
+}
+
+func TestLineProtocol(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_line.sock"
+
+	srv, err := New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestLineProtocol: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	conn, err := net.Dial("unix", unixSockPath)
+	if err != nil {
+		t.Fatalf("TestLineProtocol: could not connect: %s", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	reader := bufio.NewReader(conn)
+	for i := 1; i <= 2; i++ {
+		if _, err := conn.Write([]byte(`{"cmd": "hello.world", "args": {"code": 1}}` + "\n")); err != nil {
+			t.Fatalf("TestLineProtocol: could not write: %s", err.Error())
+		}
+
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("TestLineProtocol: message %d: could not read response: %s", i, err.Error())
+		}
+
+		msg := struct {
+			Response *unixsock.Response `json:"response"`
+		}{}
+		if err := json.Unmarshal(line, &msg); err != nil {
+			t.Fatalf("TestLineProtocol: message %d: could not decode response: %s", i, err.Error())
+		}
+		if msg.Response == nil || msg.Response.Status != unixsock.STATUS_OK {
+			t.Errorf("TestLineProtocol: message %d: expected STATUS_OK, got: %s", i, line)
+		}
+	}
+
+}
+
+func TestStreamCompression(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_compression.sock"
+
+	srv, err := New(unixSockPath, func(cmd string, args unixsock.Args) *unixsock.Response {
+		return &unixsock.Response{Status: unixsock.STATUS_OK, Payload: fmt.Sprint(args["n"])}
+	})
+	if err != nil {
+		t.Fatalf("TestStreamCompression: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath, client.WithStreamCompression(unixsock.CompressionFlate))
+	if err != nil {
+		t.Fatalf("TestStreamCompression: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	for i := 0; i < 20; i++ {
+		resp, err := c.Send("echo", unixsock.Args{"n": i}, true, false)
+		if err != nil {
+			t.Fatalf("TestStreamCompression: message %d failed: %s", i, err.Error())
+		}
+		if resp.Payload != fmt.Sprint(i) {
+			t.Errorf("TestStreamCompression: message %d: expected payload %d, got %s", i, i, resp.Payload)
+		}
+	}
+
+}
+
+func TestConcurrentPerConn(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_concurrent.sock"
+
+	handler := func(cmd string, args unixsock.Args) *unixsock.Response {
+		if cmd == "slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return &unixsock.Response{Status: unixsock.STATUS_OK, Payload: cmd}
+	}
+
+	srv, err := New(unixSockPath, handler, WithConcurrentPerConn(4))
+	if err != nil {
+		t.Fatalf("TestConcurrentPerConn: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	conn, err := net.Dial("unix", unixSockPath)
+	if err != nil {
+		t.Fatalf("TestConcurrentPerConn: could not connect: %s", err.Error())
+	}
+	defer conn.Close()
+
+	// Pipeline a slow and a fast command
+	for id, cmd := range []string{"slow", "fast"} {
+		msg := unixsock.NewSender(conn, cmd, unixsock.Args{}, true, false)
+		msg.SetID(uint64(id + 1))
+		if err := msg.Send(); err != nil {
+			t.Fatalf("TestConcurrentPerConn: could not send %s: %s", cmd, err.Error())
+		}
+	}
+
+	// The fast command must overtake the slow one
+	for _, expected := range []uint64{2, 1} {
+		msg := unixsock.NewReceiver(conn)
+		if err := msg.Receive(); err != nil {
+			t.Fatalf("TestConcurrentPerConn: could not receive: %s", err.Error())
+		}
+		if msg.GetID() != expected {
+			t.Errorf("TestConcurrentPerConn: expected response to message %d, got %d", expected, msg.GetID())
+		}
+	}
+
+}
+
+func TestACL(t *testing.T) {
+
+	acl, err := ParseACL([]byte(`{
+		"default": "deny",
+		"rules": [
+			{"command": "stats.*", "uids": [1000], "gids": [100]},
+			{"command": "shutdown", "uids": [0]}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("TestACL: could not parse policy: %s", err.Error())
+	}
+
+	tests := []struct {
+		peer    *unixsock.PeerCred
+		cmd     string
+		allowed bool
+	}{
+		{&unixsock.PeerCred{UID: 1000, GID: 1000}, "stats.get", true},
+		{&unixsock.PeerCred{UID: 1001, GID: 100}, "stats.list", true},
+		{&unixsock.PeerCred{UID: 1001, GID: 1001}, "stats.get", false},
+		{&unixsock.PeerCred{UID: 1000, GID: 1000}, "shutdown", false},
+		{&unixsock.PeerCred{UID: 0, GID: 0}, "shutdown", true},
+		{&unixsock.PeerCred{UID: 0, GID: 0}, "other", false},
+		{nil, "stats.get", false},
+	}
+
+	for i, test := range tests {
+		if err := acl.Authorize(test.peer, test.cmd, nil); (err == nil) != test.allowed {
+			t.Errorf("TestACL: test %d failed: expected allowed=%v, got error: %v", i+1, test.allowed, err)
+		}
+	}
+
+	if _, err := ParseACL([]byte(`{"default": "maybe"}`)); err == nil {
+		t.Errorf("TestACL: expected an error for an invalid default action")
+	}
+
+}
+
+func TestBroadcast(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_broadcast.sock"
+
+	srv, err := New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestBroadcast: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestBroadcast: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	events := make(chan string, 1)
+	c.OnEvent(func(cmd string, args unixsock.Args) {
+		events <- fmt.Sprintf("%s:%v", cmd, args["version"])
+	})
+
+	// Wait for the client to connect
+	deadline := time.Now().Add(time.Second)
+	for srv.Broadcast("config.reloaded", unixsock.Args{"version": 2}) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("TestBroadcast: client never connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case event := <-events:
+		if event != "config.reloaded:2" {
+			t.Errorf("TestBroadcast: unexpected event: %s", event)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("TestBroadcast: event not received")
+	}
+
+}
+
+func TestBroadcastTo(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_broadcast_to.sock"
+
+	srv, err := New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestBroadcastTo: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	events := make(chan string, 10)
+	for i, tags := range []map[string]string{{"role": "worker", "shard": "1"}, {"role": "worker", "shard": "2"}, nil} {
+		c, err := client.New(unixSockPath, client.WithTags(tags))
+		if err != nil {
+			t.Fatalf("TestBroadcastTo: could not create client: %s", err.Error())
+		}
+		defer c.Quit()
+
+		name := fmt.Sprintf("client%d", i+1)
+		c.OnEvent(func(cmd string, args unixsock.Args) {
+			events <- name + ":" + cmd
+		})
+	}
+
+	// Wait for the clients to connect
+	deadline := time.Now().Add(time.Second)
+	for {
+		tagged := 0
+		clients := srv.Clients()
+		for _, stats := range clients {
+			if stats.Tags["role"] == "worker" {
+				tagged++
+			}
+		}
+		if len(clients) == 3 && tagged == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("TestBroadcastTo: clients never connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tests := []struct {
+		selector Selector
+		expected []string
+	}{
+		{Selector{"role": "worker"}, []string{"client1", "client2"}},
+		{Selector{"role": "worker", "shard": "2"}, []string{"client2"}},
+		{Selector{"role": "scheduler"}, nil},
+		{Selector{}, []string{"client1", "client2", "client3"}},
+	}
+
+	for i, test := range tests {
+		cmd := fmt.Sprintf("job%d", i+1)
+		if n := srv.BroadcastTo(test.selector, cmd, unixsock.Args{}); n != len(test.expected) {
+			t.Errorf("TestBroadcastTo: test %d failed: delivered to %d clients, expected %d", i+1, n, len(test.expected))
+		}
+
+		var received []string
+		for range test.expected {
+			select {
+			case event := <-events:
+				received = append(received, event)
+			case <-time.After(time.Second):
+				t.Fatalf("TestBroadcastTo: test %d failed: event not received", i+1)
+			}
+		}
+		sort.Strings(received)
+		for j, name := range test.expected {
+			if received[j] != name+":"+cmd {
+				t.Errorf("TestBroadcastTo: test %d failed: expected %s, got %s", i+1, name+":"+cmd, received[j])
+			}
+		}
+	}
+
+	select {
+	case event := <-events:
+		t.Errorf("TestBroadcastTo: unexpected event %s", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+}
+
+func TestEventFilter(t *testing.T) {
+
+	tests := []struct {
+		expr    string
+		args    unixsock.Args
+		matches bool
+		valid   bool
+	}{
+		{"", unixsock.Args{"unit": "nginx"}, true, true},
+		{"unit=nginx", unixsock.Args{"unit": "nginx"}, true, true},
+		{" unit = nginx , code=2", unixsock.Args{"unit": "nginx", "code": 2}, true, true},
+		{"unit=nginx,code=2", unixsock.Args{"unit": "nginx", "code": 3}, false, true},
+		{"unit=nginx", unixsock.Args{}, false, true},
+		{"unit", nil, false, false},
+		{"=nginx", nil, false, false},
+	}
+
+	for i, test := range tests {
+		filter, err := parseFilter(test.expr)
+		if (err == nil) != test.valid {
+			t.Errorf("TestEventFilter: test %d failed: expected valid=%t, got error %v", i+1, test.valid, err)
+			continue
+		}
+		if test.valid && filter.matches(test.args) != test.matches {
+			t.Errorf("TestEventFilter: test %d failed: expected matches=%t", i+1, test.matches)
+		}
+	}
+
+	// Subscription
+	unixSockPath := os.Getenv("HOME") + "/_test_subscribe.sock"
+
+	srv, err := New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestEventFilter: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	connected := make(chan struct{}, 1)
+	c, err := client.New(unixSockPath, client.WithEventFilter("unit=nginx"), client.WithStateCallback(func(state client.ConnState, err error) {
+		if state == client.StateConnected {
+			connected <- struct{}{}
+		}
+	}))
+	if err != nil {
+		t.Fatalf("TestEventFilter: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	events := make(chan string, 10)
+	c.OnEvent(func(cmd string, args unixsock.Args) {
+		events <- fmt.Sprintf("%s:%v", cmd, args["unit"])
+	})
+
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatalf("TestEventFilter: client never connected")
+	}
+
+	if n := srv.Broadcast("unit.failed", unixsock.Args{"unit": "sshd"}); n != 0 {
+		t.Errorf("TestEventFilter: filtered event delivered to %d clients", n)
+	}
+	if n := srv.Broadcast("unit.failed", unixsock.Args{"unit": "nginx"}); n != 1 {
+		t.Errorf("TestEventFilter: matching event delivered to %d clients", n)
+	}
+
+	select {
+	case event := <-events:
+		if event != "unit.failed:nginx" {
+			t.Errorf("TestEventFilter: unexpected event: %s", event)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("TestEventFilter: event not received")
+	}
+
+	// Malformed filters are rejected
+	bad, err := client.New(unixSockPath, client.WithEventFilter("unit"))
+	if err != nil {
+		t.Fatalf("TestEventFilter: could not create client: %s", err.Error())
+	}
+	defer bad.Quit()
+	if _, err := bad.Send("hello", unixsock.Args{}, true, false); err == nil {
+		t.Errorf("TestEventFilter: malformed filter accepted")
+	}
+
+}
+
+func TestEventHistory(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_history.sock"
+
+	srv, err := New(unixSockPath, fakeHandler, WithEventHistory(10))
+	if err != nil {
+		t.Fatalf("TestEventHistory: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	states := make(chan client.ConnState, 10)
+	c, err := client.New(unixSockPath, client.WithTimeout(200*time.Millisecond), client.WithStateCallback(func(state client.ConnState, err error) {
+		states <- state
+	}))
+	if err != nil {
+		t.Fatalf("TestEventHistory: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	events := make(chan string, 10)
+	handler := func(cmd string, args unixsock.Args) {
+		events <- cmd
+	}
+	c.OnEvent(handler)
+
+	waitFor := func(expected client.ConnState) {
+		for {
+			select {
+			case state := <-states:
+				if state == expected {
+					return
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("TestEventHistory: client never %s", expected)
+			}
+		}
+	}
+	expect := func(expected string) {
+		select {
+		case event := <-events:
+			if event != expected {
+				t.Errorf("TestEventHistory: expected event %s, got %s", expected, event)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("TestEventHistory: event %s not received", expected)
+		}
+	}
+
+	// Wait for the server to serve the connection
+	waitFor(client.StateConnected)
+	deadline := time.Now().Add(time.Second)
+	for srv.Broadcast("first", unixsock.Args{}) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("TestEventHistory: connection never served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expect("first")
+
+	// Re-registering the handler drops the connection. The event published
+	// in the meantime is replayed once the client reconnects.
+	c.OnEvent(handler)
+	waitFor(client.StateDisconnected)
+	srv.Broadcast("missed", unixsock.Args{})
+	waitFor(client.StateConnected)
+	srv.Broadcast("last", unixsock.Args{})
+
+	expect("missed")
+	expect("last")
+
+	select {
+	case event := <-events:
+		t.Errorf("TestEventHistory: unexpected event %s", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+}
+
+func TestSubscribe(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_subscribe_chan.sock"
+
+	srv, err := New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestSubscribe: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	subscribe := func(policy client.OverflowPolicy) (<-chan client.Event, func()) {
+		c, err := client.New(unixSockPath, client.WithSubscriptionBuffer(2, policy))
+		if err != nil {
+			t.Fatalf("TestSubscribe: could not create client: %s", err.Error())
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		events, err := c.Subscribe(ctx, "unit.*")
+		if err != nil {
+			t.Fatalf("TestSubscribe: could not subscribe: %s", err.Error())
+		}
+
+		// Wait for the server to serve the connection
+		deadline := time.Now().Add(time.Second)
+		for srv.Broadcast("other", unixsock.Args{}) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("TestSubscribe: connection never served")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		return events, func() {
+			cancel()
+			c.Quit()
+		}
+	}
+	publish := func(units ...string) {
+		for _, unit := range units {
+			srv.Broadcast("unit.failed", unixsock.Args{"unit": unit})
+		}
+	}
+	receive := func(events <-chan client.Event) []string {
+		received := []string{}
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					return append(received, "closed")
+				}
+				if e.Err != nil {
+					received = append(received, e.Err.Error())
+					continue
+				}
+				if e.Cmd != "unit.failed" || e.Seq == 0 {
+					t.Errorf("TestSubscribe: unexpected event %+v", e)
+				}
+				received = append(received, fmt.Sprint(e.Args["unit"]))
+			case <-time.After(100 * time.Millisecond):
+				return received
+			}
+		}
+	}
+
+	tests := []struct {
+		policy   client.OverflowPolicy
+		expected []string
+	}{
+		{client.OverflowDropOldest, []string{"b", "c"}},
+		{client.OverflowError, []string{"a", "b", client.ErrSlowConsumer.Error(), "closed"}},
+	}
+
+	for i, test := range tests {
+		events, stop := subscribe(test.policy)
+		publish("a", "b", "c")
+		time.Sleep(50 * time.Millisecond)
+		if received := receive(events); fmt.Sprint(received) != fmt.Sprint(test.expected) {
+			t.Errorf("TestSubscribe: test %d failed: expected %v, got %v", i+1, test.expected, received)
+		}
+		stop()
+	}
+
+	// Blocking subscriptions deliver everything and end with the context
+	events, stop := subscribe(client.OverflowBlock)
+	go publish("a", "b", "c")
+	if received := receive(events); fmt.Sprint(received) != "[a b c]" {
+		t.Errorf("TestSubscribe: blocking subscription received %v", received)
+	}
+	stop()
+	if received := receive(events); fmt.Sprint(received) != "[closed]" {
+		t.Errorf("TestSubscribe: subscription not closed: %v", received)
+	}
+
+}
+
+func TestSocketLock(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_lock.sock"
+	defer os.Remove(unixSockPath + ".lock")
+
+	// Stale socket of a crashed process
+	l, err := net.Listen("unix", unixSockPath)
+	if err != nil {
+		t.Fatalf("TestSocketLock: could not listen: %s", err.Error())
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	srv, err := New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestSocketLock: stale socket not replaced: %s", err.Error())
+	}
+
+	// Second instance
+	_, err = New(unixSockPath, fakeHandler)
+	if running, ok := err.(*ErrAlreadyRunning); !ok || running.PID != os.Getpid() {
+		t.Errorf("TestSocketLock: expected ErrAlreadyRunning with PID %d, got %v", os.Getpid(), err)
+	}
+	if _, err := os.Stat(unixSockPath); err != nil {
+		t.Errorf("TestSocketLock: socket of the running instance removed: %s", err.Error())
+	}
+
+	// The lock is released by Stop
+	srv.Stop()
+	srv, err = New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestSocketLock: could not restart: %s", err.Error())
+	}
+	srv.Stop()
+
+	// Live socket of a server not using the lock (e.g. an older release)
+	l, err = net.Listen("unix", unixSockPath)
+	if err != nil {
+		t.Fatalf("TestSocketLock: could not listen: %s", err.Error())
+	}
+	defer l.Close()
+	_, err = New(unixSockPath, fakeHandler)
+	if _, ok := err.(*ErrAlreadyRunning); !ok {
+		t.Errorf("TestSocketLock: expected ErrAlreadyRunning for a live socket, got %v", err)
+	}
+	if _, err := os.Stat(unixSockPath); err != nil {
+		t.Errorf("TestSocketLock: live socket removed: %s", err.Error())
+	}
+
+}
+
+func TestIsServerAlive(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_alive.sock"
+	defer os.Remove(unixSockPath)
+
+	if alive, err := client.IsServerAlive(unixSockPath); alive || err != client.ErrNoSocket {
+		t.Errorf("TestIsServerAlive: expected ErrNoSocket, got %t/%v", alive, err)
+	}
+
+	// Regular file
+	if err := ioutil.WriteFile(unixSockPath, []byte{}, 0600); err != nil {
+		t.Fatalf("TestIsServerAlive: could not create file: %s", err.Error())
+	}
+	if alive, err := client.IsServerAlive(unixSockPath); alive || err == nil || err == client.ErrNoSocket || err == client.ErrStaleSocket {
+		t.Errorf("TestIsServerAlive: expected a regular file to be reported, got %t/%v", alive, err)
+	}
+	os.Remove(unixSockPath)
+
+	// Stale socket of a crashed process
+	l, err := net.Listen("unix", unixSockPath)
+	if err != nil {
+		t.Fatalf("TestIsServerAlive: could not listen: %s", err.Error())
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if alive, err := client.IsServerAlive(unixSockPath); alive || err != client.ErrStaleSocket {
+		t.Errorf("TestIsServerAlive: expected ErrStaleSocket, got %t/%v", alive, err)
+	}
+
+	srv, err := New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestIsServerAlive: could not start server: %s", err.Error())
+	}
+	defer os.Remove(unixSockPath + ".lock")
+	if alive, err := client.IsServerAlive(unixSockPath); !alive || err != nil {
+		t.Errorf("TestIsServerAlive: expected a live server, got %t/%v", alive, err)
+	}
+	srv.Stop()
+
+	if alive, err := client.IsServerAlive(unixSockPath); alive || err != client.ErrNoSocket {
+		t.Errorf("TestIsServerAlive: expected ErrNoSocket after Stop, got %t/%v", alive, err)
+	}
+
+}
+
+func TestSocketWatch(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_socketwatch.sock"
+
+	lost := make(chan error, 10)
+	srv, err := New(unixSockPath, fakeHandler, WithSocketWatch(10*time.Millisecond), OnSocketLost(func(path string, err error) {
+		lost <- err
+	}))
+	if err != nil {
+		t.Fatalf("TestSocketWatch: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	connected, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestSocketWatch: could not create client: %s", err.Error())
+	}
+	defer connected.Quit()
+	if _, err := connected.Send("ping", unixsock.Args{}, true, false); err != nil {
+		t.Fatalf("TestSocketWatch: could not send: %s", err.Error())
+	}
+
+	// Removed by a temp directory cleaner
+	if err := os.Remove(unixSockPath); err != nil {
+		t.Fatalf("TestSocketWatch: could not remove the socket: %s", err.Error())
+	}
+
+	select {
+	case err := <-lost:
+		if err != nil {
+			t.Fatalf("TestSocketWatch: could not rebind: %s", err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("TestSocketWatch: removal of the socket not detected")
+	}
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestSocketWatch: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+	if _, err := c.Send("ping", unixsock.Args{}, true, false); err != nil {
+		t.Errorf("TestSocketWatch: server unreachable after rebinding: %s", err.Error())
+	}
+	if _, err := connected.Send("ping", unixsock.Args{}, true, false); err != nil {
+		t.Errorf("TestSocketWatch: connected client affected by rebinding: %s", err.Error())
+	}
+
+	select {
+	case err := <-lost:
+		t.Errorf("TestSocketWatch: rebound socket reported lost (%v)", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The rebound socket is removed by Stop
+	srv.Stop()
+	if _, err := os.Stat(unixSockPath); !os.IsNotExist(err) {
+		t.Errorf("TestSocketWatch: socket left behind by Stop: %v", err)
+	}
+
+}
+
+func TestSocketWatchFailure(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_socketwatch_failure.sock"
+
+	lost := make(chan error, 100)
+	srv, err := New(unixSockPath, fakeHandler, WithSocketWatch(10*time.Millisecond), OnSocketLost(func(path string, err error) {
+		lost <- err
+	}))
+	if err != nil {
+		t.Fatalf("TestSocketWatchFailure: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	// Another file takes the place of the socket
+	if err := os.Remove(unixSockPath); err != nil {
+		t.Fatalf("TestSocketWatchFailure: could not remove the socket: %s", err.Error())
+	}
+	if f, err := os.Create(unixSockPath); err != nil {
+		t.Fatalf("TestSocketWatchFailure: could not create the file: %s", err.Error())
+	} else {
+		f.Close()
+	}
+
+	select {
+	case err := <-lost:
+		if err == nil {
+			t.Fatalf("TestSocketWatchFailure: rebound on top of another file")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("TestSocketWatchFailure: replacement of the socket not detected")
+	}
+
+	// The loss is reported once, however often the server retries
+	select {
+	case err := <-lost:
+		t.Errorf("TestSocketWatchFailure: loss reported again (%v)", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// The server listens again once the file is gone
+	if err := os.Remove(unixSockPath); err != nil {
+		t.Fatalf("TestSocketWatchFailure: could not remove the file: %s", err.Error())
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := client.New(unixSockPath)
+		if err == nil {
+			_, err = c.Send("ping", unixsock.Args{}, true, false)
+			c.Quit()
+		}
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("TestSocketWatchFailure: server unreachable after the file was removed: %s", err.Error())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+}
+
+func TestReconnect(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_reconnect.sock"
+
+	srv, err := New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestReconnect: could not start server: %s", err.Error())
+	}
+
+	states := make(chan client.ConnState, 10)
+	c, err := client.New(unixSockPath, client.WithStateCallback(func(state client.ConnState, err error) {
+		states <- state
+	}))
+	if err != nil {
+		t.Fatalf("TestReconnect: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	// The server closes the connection after this message
+	if _, err := c.Send("hello", unixsock.Args{}, true, true); err != nil {
+		t.Fatalf("TestReconnect: first send failed: %s", err.Error())
+	}
+
+	// Replace the server
+	srv.Stop()
+	srv, err = New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestReconnect: could not restart server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	if _, err := c.Send("hello", unixsock.Args{}, true, false); err != nil {
+		t.Fatalf("TestReconnect: send after restart failed: %s", err.Error())
+	}
+
+	expected := []client.ConnState{client.StateConnected, client.StateDisconnected, client.StateConnected}
+	for i, state := range expected {
+		select {
+		case got := <-states:
+			if got != state {
+				t.Errorf("TestReconnect: state %d: expected %s, got %s", i+1, state, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("TestReconnect: state %d (%s) not reported", i+1, state)
+		}
+	}
+
+}
+
+func TestEagerConnect(t *testing.T) {
+
+	if _, err := client.New(os.Getenv("HOME")+"/_test_missing.sock", client.WithEagerConnect()); err == nil {
+		t.Errorf("TestEagerConnect: expected an error for a missing socket")
+	}
+
+	if _, err := client.New(os.Getenv("HOME") + "/_test_missing.sock"); err != nil {
+		t.Errorf("TestEagerConnect: lazy client should not connect: %s", err.Error())
+	}
+
+}
+
+func TestSendTo(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_sendto.sock"
+
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+
+	srv, err := New(unixSockPath, func(cmd string, args unixsock.Args) *unixsock.Response {
+		return &unixsock.Response{
+			Status: unixsock.STATUS_OK,
+			Stream: bytes.NewReader(blob),
+		}
+	})
+	if err != nil {
+		t.Fatalf("TestSendTo: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestSendTo: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	// Streamed into a writer
+	buf := &bytes.Buffer{}
+	resp, err := c.SendTo(context.Background(), "dump", unixsock.Args{}, buf)
+	if err != nil {
+		t.Fatalf("TestSendTo: could not send: %s", err.Error())
+	}
+	if resp.Status != unixsock.STATUS_OK {
+		t.Errorf("TestSendTo: expected STATUS_OK, got: %s", resp.Status)
+	}
+	if !bytes.Equal(buf.Bytes(), blob) {
+		t.Errorf("TestSendTo: streamed payload mismatch: got %d bytes, expected %d", buf.Len(), len(blob))
+	}
+
+	// Collected into the payload
+	resp, err = c.Send("dump", unixsock.Args{}, true, false)
+	if err != nil {
+		t.Fatalf("TestSendTo: could not send: %s", err.Error())
+	}
+	if resp.Payload != string(blob) {
+		t.Errorf("TestSendTo: collected payload mismatch: got %d bytes, expected %d", len(resp.Payload), len(blob))
+	}
+
+}
+
+func TestSendFrom(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_sendfrom.sock"
+
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+
+	srv, err := New(unixSockPath, func(cmd string, args unixsock.Args) *unixsock.Response {
+		body := unixsock.Body(args)
+		if body == nil {
+			return &unixsock.Response{Status: unixsock.STATUS_FAIL, Error: "no body"}
+		}
+		received, err := ioutil.ReadAll(body)
+		if err != nil {
+			return &unixsock.Response{Status: unixsock.STATUS_FAIL, Error: err.Error()}
+		}
+		return &unixsock.Response{
+			Status:  unixsock.STATUS_OK,
+			Payload: fmt.Sprintf("%s:%d:%t", args["name"], len(received), bytes.Equal(received, blob)),
+		}
+	})
+	if err != nil {
+		t.Fatalf("TestSendFrom: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestSendFrom: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	tests := []struct {
+		size    int64
+		payload string
+		isErr   bool
+	}{
+		{int64(len(blob)), fmt.Sprintf("upload:%d:true", len(blob)), false},
+		{-1, fmt.Sprintf("upload:%d:true", len(blob)), false},
+		{int64(len(blob)) + 1, "", true},
+		{int64(len(blob)) - 1, "", true},
+	}
+
+	for i, test := range tests {
+		resp, err := c.SendFrom(context.Background(), "upload", unixsock.Args{"name": "upload"}, bytes.NewReader(blob), test.size)
+		if (err != nil) != test.isErr {
+			t.Errorf("TestSendFrom: test %d failed: unexpected error: %v", i+1, err)
+			continue
+		}
+		if test.isErr {
+			continue
+		}
+		if resp.Status != unixsock.STATUS_OK || resp.Payload != test.payload {
+			t.Errorf("TestSendFrom: test %d failed: got %s (%s), expected %s", i+1, resp.Payload, resp.Error, test.payload)
+		}
+	}
+
+	// Handlers read the body via the request
+	handlerSockPath := os.Getenv("HOME") + "/_test_sendfrom_handler.sock"
+	hsrv, err := NewWithHandler(handlerSockPath, HandlerFunc(func(ctx context.Context, req *Request) *unixsock.Response {
+		if req.Body() == nil {
+			return unixsock.NewResponse().Failf("no body")
+		}
+		received, err := ioutil.ReadAll(req.Body())
+		if err != nil {
+			return unixsock.NewResponse().Failf("%s", err.Error())
+		}
+		return unixsock.NewResponse().OK().WithPayload(strconv.Itoa(len(received)))
+	}))
+	if err != nil {
+		t.Fatalf("TestSendFrom: could not start server: %s", err.Error())
+	}
+	defer hsrv.Stop()
+
+	hc, err := client.New(handlerSockPath)
+	if err != nil {
+		t.Fatalf("TestSendFrom: could not create client: %s", err.Error())
+	}
+	defer hc.Quit()
+
+	resp, err := hc.SendFrom(context.Background(), "upload", unixsock.Args{}, bytes.NewReader(blob), -1)
+	if err != nil || resp.Payload != strconv.Itoa(len(blob)) {
+		t.Errorf("TestSendFrom: handler did not receive the body: %v (%v)", resp, err)
+	}
+	if resp, err := hc.Send("upload", unixsock.Args{}, true, false); err != nil || resp.Succeeded() {
+		t.Errorf("TestSendFrom: expected no body for a plain message, got %v (%v)", resp, err)
+	}
+
+}
+
+// counter is a stateful handler
+type counter struct {
+	mu    sync.Mutex
+	count int
+}
+
+func (c *counter) ServeUnix(ctx context.Context, req *Request) *unixsock.Response {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.count++
+	return &unixsock.Response{
+		Status:  unixsock.STATUS_OK,
+		Payload: fmt.Sprintf("%s:%d:%t", req.Cmd, c.count, req.Peer != nil && req.ID > 0),
+	}
+}
+
+func TestHandler(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_handler.sock"
+
+	// Middleware rejecting a command
+	reject := func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, req *Request) *unixsock.Response {
+			if req.Cmd == "rejected" {
+				return &unixsock.Response{Status: unixsock.STATUS_FAIL, Error: "rejected"}
+			}
+			return next.ServeUnix(ctx, req)
+		})
+	}
+
+	srv, err := NewWithHandler(unixSockPath, reject(&counter{}))
+	if err != nil {
+		t.Fatalf("TestHandler: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestHandler: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	tests := []struct {
+		cmd     string
+		status  unixsock.Status
+		payload string
+	}{
+		{"count", unixsock.STATUS_OK, "count:1:true"},
+		{"rejected", unixsock.STATUS_FAIL, ""},
+		{"count", unixsock.STATUS_OK, "count:2:true"},
+	}
+
+	for i, test := range tests {
+		resp, err := c.Send(test.cmd, unixsock.Args{}, true, false)
+		if err != nil {
+			t.Fatalf("TestHandler: test %d failed: %s", i+1, err.Error())
+		}
+		if resp.Status != test.status || resp.Payload != test.payload {
+			t.Errorf("TestHandler: test %d failed: got %s/%s, expected %s/%s", i+1, resp.Status, resp.Payload, test.status, test.payload)
+		}
+	}
+
+}
+
+func TestServe(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_serve.sock"
+	inheritedPath := os.Getenv("HOME") + "/_test_serve_fd.sock"
+
+	// Existing listener
+	l, err := net.Listen("unix", unixSockPath)
+	if err != nil {
+		t.Fatalf("TestServe: could not listen: %s", err.Error())
+	}
+	srv, err := Serve(l, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestServe: could not serve: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	// Inherited file descriptor
+	inherited, err := net.Listen("unix", inheritedPath)
+	if err != nil {
+		t.Fatalf("TestServe: could not listen: %s", err.Error())
+	}
+	defer inherited.Close()
+	f, err := inherited.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatalf("TestServe: could not get file descriptor: %s", err.Error())
+	}
+	defer f.Close()
+	srvFD, err := NewFromFD(f.Fd(), fakeHandler)
+	if err != nil {
+		t.Fatalf("TestServe: could not serve file descriptor: %s", err.Error())
+	}
+	defer srvFD.Stop()
+
+	for i, path := range []string{unixSockPath, inheritedPath} {
+		c, err := client.New(path)
+		if err != nil {
+			t.Fatalf("TestServe: test %d failed: could not create client: %s", i+1, err.Error())
+		}
+		resp, err := c.Send("hello.world", unixsock.Args{}, true, true)
+		if err != nil {
+			t.Errorf("TestServe: test %d failed: %s", i+1, err.Error())
+			continue
+		}
+		if resp.Status != unixsock.STATUS_OK {
+			t.Errorf("TestServe: test %d failed: expected STATUS_OK, got: %s", i+1, resp.Status)
+		}
+	}
+
+	if _, err := Serve(nil, fakeHandler); err == nil {
+		t.Errorf("TestServe: expected an error for a nil listener")
+	}
+
+}
+
+func TestExpiry(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_expiry.sock"
+
+	release := make(chan struct{})
+	executed := make(chan string, 2)
+	srv, err := New(unixSockPath, func(cmd string, args unixsock.Args) *unixsock.Response {
+		executed <- cmd
+		if cmd == "slow" {
+			<-release
+		}
+		return &unixsock.Response{Status: unixsock.STATUS_OK}
+	}, WithDispatchQueue(1, 10))
+	if err != nil {
+		t.Fatalf("TestExpiry: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	// Block the only worker
+	slow, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestExpiry: could not create client: %s", err.Error())
+	}
+	defer slow.Quit()
+	go slow.Send("slow", unixsock.Args{}, true, false)
+	<-executed
+
+	// Queue a command that expires before the worker is released
+	c, err := client.New(unixSockPath, client.WithTTL(20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("TestExpiry: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+	}()
+
+	resp, err := c.Send("stale", unixsock.Args{}, true, false)
+	if err != nil {
+		t.Fatalf("TestExpiry: could not send: %s", err.Error())
+	}
+	if resp.Status != unixsock.STATUS_EXPIRED {
+		t.Errorf("TestExpiry: expected %s, got: %s", unixsock.STATUS_EXPIRED, resp.Status)
+	}
+
+	select {
+	case cmd := <-executed:
+		t.Errorf("TestExpiry: stale command '%s' executed", cmd)
+	default:
+	}
+
+}
+
+func TestRouterAlias(t *testing.T) {
+
+	router := NewRouter()
+	router.Register("config.set", TierMutating, func(cmd string, args unixsock.Args) *unixsock.Response {
+		return &unixsock.Response{Status: unixsock.STATUS_OK, Payload: cmd}
+	})
+	router.Alias("set.config", "config.set")
+	router.Deprecate("set.config", "use config.set instead")
+	router.Alias("dangling", "missing")
+
+	tests := []struct {
+		cmd     string
+		status  unixsock.Status
+		payload string
+		warning string
+		tier    Tier
+	}{
+		{"config.set", unixsock.STATUS_OK, "config.set", "", TierMutating},
+		{"set.config", unixsock.STATUS_OK, "config.set", "command 'set.config' is deprecated: use config.set instead", TierMutating},
+		{"dangling", unixsock.STATUS_FAIL, "", "", TierAdmin},
+	}
+
+	for i, test := range tests {
+		resp := router.Handle(test.cmd, unixsock.Args{})
+		if resp.Status != test.status || resp.Payload != test.payload || resp.Warning != test.warning {
+			t.Errorf("TestRouterAlias: test %d failed: got %s/%s/%q", i+1, resp.Status, resp.Payload, resp.Warning)
+		}
+		if tier := router.Tier(test.cmd); tier != test.tier {
+			t.Errorf("TestRouterAlias: test %d failed: expected tier %s, got %s", i+1, test.tier, tier)
+		}
+	}
+
+}
+
+func TestRouterMount(t *testing.T) {
+
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(ctx context.Context, req *Request) *unixsock.Response {
+				calls = append(calls, name+":"+req.Cmd)
+				return next.ServeUnix(ctx, req)
+			})
+		}
+	}
+	echo := func(cmd string, args unixsock.Args) *unixsock.Response {
+		return &unixsock.Response{Status: unixsock.STATUS_OK, Payload: cmd}
+	}
+
+	cache := NewRouter()
+	cache.Use(trace("cache"))
+	cache.Register("get", TierReadOnly, echo)
+	cache.Register("flush", TierAdmin, echo)
+
+	stats := NewRouter()
+	stats.Register("get", TierReadOnly, echo)
+
+	router := NewRouter()
+	router.Use(trace("root"))
+	router.Register("ping", TierReadOnly, echo)
+	router.Register("cache.local", TierMutating, echo)
+	router.Mount("cache.", cache)
+	router.Mount("cache.stats.", stats)
+	router.Alias("flush", "cache.flush")
+
+	tests := []struct {
+		cmd     string
+		status  unixsock.Status
+		payload string
+		tier    Tier
+		calls   string
+	}{
+		{"ping", unixsock.STATUS_OK, "ping", TierReadOnly, "root:ping"},
+		{"cache.get", unixsock.STATUS_OK, "get", TierReadOnly, "root:cache.get,cache:get"},
+		{"cache.local", unixsock.STATUS_OK, "cache.local", TierMutating, "root:cache.local"},
+		{"cache.stats.get", unixsock.STATUS_OK, "get", TierReadOnly, "root:cache.stats.get"},
+		{"flush", unixsock.STATUS_OK, "flush", TierAdmin, "root:flush,cache:flush"},
+		{"cache.missing", unixsock.STATUS_FAIL, "", TierAdmin, "root:cache.missing"},
+	}
+
+	for i, test := range tests {
+		calls = nil
+		resp := router.Handle(test.cmd, unixsock.Args{})
+		if resp.Status != test.status || resp.Payload != test.payload {
+			t.Errorf("TestRouterMount: test %d failed: got %s/%s (%s)", i+1, resp.Status, resp.Payload, resp.Error)
+		}
+		if test.status == unixsock.STATUS_FAIL && !strings.Contains(resp.Error, test.cmd) {
+			t.Errorf("TestRouterMount: test %d failed: error '%s' does not name the command", i+1, resp.Error)
+		}
+		if tier := router.Tier(test.cmd); tier != test.tier {
+			t.Errorf("TestRouterMount: test %d failed: expected tier %s, got %s", i+1, test.tier, tier)
+		}
+		if got := strings.Join(calls, ","); got != test.calls {
+			t.Errorf("TestRouterMount: test %d failed: expected calls '%s', got '%s'", i+1, test.calls, got)
+		}
+	}
+
+}
+
+func TestCallInto(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_call_into.sock"
+
+	type statusArgs struct {
+		Unit    string `json:"unit"`
+		Lines   int    `json:"lines,omitempty"`
+		Verbose bool   `json:"verbose"`
+		Secret  string `json:"-"`
+		ignored string
+	}
+	type statusReply struct {
+		Unit  string `json:"unit"`
+		State string `json:"state"`
+		Args  int    `json:"args"`
+	}
+
+	srv, err := NewWithHandler(unixSockPath, ResultFunc(func(ctx context.Context, req *Request) (interface{}, error) {
+		switch req.Cmd {
+		case "unit.status":
+			if _, ok := req.Args["lines"]; ok {
+				return nil, fmt.Errorf("empty lines sent")
+			}
+			return &statusReply{Unit: fmt.Sprintf("%v", req.Args["unit"]), State: "running", Args: len(req.Args)}, nil
+		default:
+			return nil, Errorf("not_found", "unknown command '%s'", req.Cmd)
+		}
+	}))
+	if err != nil {
+		t.Fatalf("TestCallInto: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestCallInto: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	// Arguments from a struct, reply into a struct
+	reply := &statusReply{}
+	if err := client.CallInto(context.Background(), c, "unit.status", &statusArgs{Unit: "nginx", Secret: "x", ignored: "x"}, reply); err != nil {
+		t.Fatalf("TestCallInto: call failed: %s", err.Error())
+	}
+	if reply.Unit != "nginx" || reply.State != "running" || reply.Args != 2 {
+		t.Errorf("TestCallInto: unexpected reply: %+v", reply)
+	}
+
+	// Arguments from a map
+	if err := client.CallInto(context.Background(), c, "unit.status", map[string]string{"unit": "sshd"}, reply); err != nil || reply.Unit != "sshd" {
+		t.Errorf("TestCallInto: call with a map failed: %v (%+v)", err, reply)
+	}
+
+	// Failures
+	err = client.CallInto(context.Background(), c, "unit.restart", nil, nil)
+	if e, ok := err.(*client.CallError); !ok || e.Status != unixsock.STATUS_FAIL || e.Code != "not_found" || e.Response == nil {
+		t.Errorf("TestCallInto: expected a CallError, got %v", err)
+	}
+	if err := client.CallInto(context.Background(), c, "unit.status", []string{"nginx"}, nil); err == nil {
+		t.Errorf("TestCallInto: expected an error for arguments of an unsupported type")
+	}
+
+}
+
+func TestResultFunc(t *testing.T) {
+
+	handler := ResultFunc(func(ctx context.Context, req *Request) (interface{}, error) {
+		switch req.Cmd {
+		case "nil":
+			return nil, nil
+		case "string":
+			return "plain", nil
+		case "bytes":
+			return []byte("raw"), nil
+		case "json":
+			return map[string]int{"workers": 8}, nil
+		case "response":
+			return unixsock.NewResponse().WithStatus(unixsock.StatusPartial), nil
+		case "stream":
+			return strings.NewReader("streamed"), nil
+		case "invalid":
+			return nil, &ValidationError{Command: req.Cmd, Missing: []string{"unit"}}
+		case "missing":
+			return nil, Errorf("not_found", "unit '%s' not found", req.Args["unit"])
+		case "busy":
+			return nil, &Error{Code: "busy", Message: "try again later", Status: unixsock.StatusRetry}
+		default:
+			return nil, fmt.Errorf("unknown command")
+		}
+	})
+
+	tests := []struct {
+		cmd     string
+		status  unixsock.Status
+		payload string
+		err     string
+		code    string
+	}{
+		{"nil", unixsock.STATUS_OK, "", "", ""},
+		{"string", unixsock.STATUS_OK, "plain", "", ""},
+		{"bytes", unixsock.STATUS_OK, "raw", "", ""},
+		{"json", unixsock.STATUS_OK, `{"workers":8}`, "", ""},
+		{"response", unixsock.StatusPartial, "", "", ""},
+		{"stream", unixsock.STATUS_OK, "", "", ""},
+		{"invalid", unixsock.STATUS_FAIL, `{"command":"invalid","missing":["unit"]}`, "validate: invalid arguments for command 'invalid': missing arguments: unit", ""},
+		{"missing", unixsock.STATUS_FAIL, "", "not_found: unit 'nginx' not found", "not_found"},
+		{"busy", unixsock.StatusRetry, "", "busy: try again later", "busy"},
+		{"other", unixsock.STATUS_FAIL, "", "unknown command", ""},
+	}
+
+	for i, test := range tests {
+		resp := handler.ServeUnix(context.Background(), &Request{Cmd: test.cmd, Args: unixsock.Args{"unit": "nginx"}})
+		if resp.Status != test.status || resp.Payload != test.payload || resp.Error != test.err || resp.Meta[ErrorCodeMeta] != test.code {
+			t.Errorf("TestResultFunc: test %d failed: got %s/%s/%s/%s", i+1, resp.Status, resp.Payload, resp.Error, resp.Meta[ErrorCodeMeta])
+		}
+	}
+
+	if resp := handler.ServeUnix(context.Background(), &Request{Cmd: "stream"}); resp.Stream == nil {
+		t.Errorf("TestResultFunc: expected readers to be streamed")
+	}
+
+}
+
+func TestSandbox(t *testing.T) {
+
+	handler := Sandbox(Limits{WallTime: 50 * time.Millisecond, ResponseSize: 8, Goroutines: 2})(ResultFunc(func(ctx context.Context, req *Request) (interface{}, error) {
+		switch req.Cmd {
+		case "slow":
+			<-ctx.Done()
+			time.Sleep(50 * time.Millisecond) // Abandoned handler
+			return "late", nil
+		case "large":
+			return strings.Repeat("x", 9), nil
+		case "stream":
+			return strings.NewReader(strings.Repeat("x", 9)), nil
+		case "spawn":
+			group := GroupFromContext(ctx)
+			for i := 0; i < 3; i++ {
+				group.Go(func() error { return nil })
+			}
+			return "spawned", group.Wait()
+		case "fanout":
+			group := GroupFromContext(ctx)
+			group.Go(func() error { return nil })
+			group.Go(func() error { return fmt.Errorf("worker failed") })
+			return nil, group.Wait()
+		default:
+			return "fits", nil
+		}
+	}))
+
+	tests := []struct {
+		cmd  string
+		err  string
+		code string
+	}{
+		{"fits", "", ""},
+		{"slow", "wall_time_exceeded: command 'slow' exceeded its wall time of 50ms", CodeWallTime},
+		{"large", "response_too_large: response of 9 bytes exceeds the limit of 8 bytes", CodeResponseSize},
+		{"spawn", "too_many_goroutines: more than 2 goroutines spawned", CodeGoroutines},
+		{"fanout", "worker failed", ""},
+	}
+
+	for i, test := range tests {
+		started := time.Now()
+		resp := handler.ServeUnix(context.Background(), &Request{Cmd: test.cmd})
+		if resp.Error != test.err || resp.Meta[ErrorCodeMeta] != test.code {
+			t.Errorf("TestSandbox: test %d failed: got %s/%s/%s", i+1, resp.Status, resp.Error, resp.Meta[ErrorCodeMeta])
+		}
+		if time.Since(started) > time.Second {
+			t.Errorf("TestSandbox: test %d took %s", i+1, time.Since(started))
+		}
+	}
+
+	// Streamed payloads are cut off at the limit
+	resp := handler.ServeUnix(context.Background(), &Request{Cmd: "stream"})
+	payload, err := ioutil.ReadAll(resp.Stream)
+	if e, ok := err.(*Error); !ok || e.Code != CodeResponseSize || len(payload) != 8 {
+		t.Errorf("TestSandbox: expected the stream to be cut off after 8 bytes, got %d bytes (%v)", len(payload), err)
+	}
+
+}
+
+func TestSchema(t *testing.T) {
+
+	router := NewRouter()
+	router.Register("log.level", TierMutating, fakeHandler)
+	router.Register("log.rotate", TierMutating, fakeHandler)
+	if err := router.Declare("log.level", Schema{Required: []string{"level"}, Optional: []string{"verbose"}, Strict: true}); err != nil {
+		t.Fatalf("TestSchema: could not declare schema: %s", err.Error())
+	}
+	router.Declare("log.rotate", Schema{Optional: []string{"keep"}})
+	router.Alias("loglevel", "log.level")
+
+	if err := router.Declare("unknown", Schema{}); err == nil {
+		t.Errorf("TestSchema: expected an error for an unknown command")
+	}
+
+	tests := []struct {
+		cmd     string
+		args    unixsock.Args
+		status  unixsock.Status
+		payload string
+	}{
+		{"log.level", unixsock.Args{"level": "debug", "verbose": true}, unixsock.STATUS_OK, ""},
+		{"log.level", unixsock.Args{"level": "debug", "verbsoe": true}, unixsock.STATUS_FAIL, `{"command":"log.level","unknown":["verbsoe"]}`},
+		{"loglevel", unixsock.Args{"verbose": true}, unixsock.STATUS_FAIL, `{"command":"loglevel","missing":["level"]}`},
+		{"log.rotate", unixsock.Args{"kepe": 3}, unixsock.STATUS_OK, ""},
+	}
+
+	for i, test := range tests {
+		resp := router.Handle(test.cmd, test.args)
+		if resp.Status != test.status || resp.Payload != test.payload {
+			t.Errorf("TestSchema: test %d failed: got %s/%s (%s)", i+1, resp.Status, resp.Payload, resp.Error)
+		}
+	}
+
+}
+
+func TestGoAway(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_goaway.sock"
+
+	srv, err := New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestGoAway: could not start server: %s", err.Error())
+	}
+
+	goAway := make(chan error, 1)
+	c, err := client.New(unixSockPath, client.WithStateCallback(func(state client.ConnState, err error) {
+		if state == client.StateGoingAway {
+			goAway <- err
+		}
+	}))
+	if err != nil {
+		t.Fatalf("TestGoAway: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	if _, err := c.Send("hello.world", unixsock.Args{}, true, false); err != nil {
+		t.Fatalf("TestGoAway: could not send: %s", err.Error())
+	}
+
+	// Restart the server
+	srv.Shutdown(true, "upgrade")
+
+	select {
+	case err := <-goAway:
+		if g, ok := err.(*client.GoAwayError); !ok || !g.Retry || g.Reason != "upgrade" {
+			t.Errorf("TestGoAway: unexpected notification: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("TestGoAway: shutdown notification not received")
+	}
+
+	srv, err = New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestGoAway: could not restart server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	// The replacement is redialed
+	resp, err := c.Send("hello.world", unixsock.Args{}, true, false)
+	if err != nil {
+		t.Fatalf("TestGoAway: could not send after restart: %s", err.Error())
+	}
+	if resp.Status != unixsock.STATUS_OK {
+		t.Errorf("TestGoAway: expected STATUS_OK, got: %s", resp.Status)
+	}
+
+}
+
+func TestMulti(t *testing.T) {
+
+	paths := []string{
+		os.Getenv("HOME") + "/_test_multi_1.sock",
+		os.Getenv("HOME") + "/_test_multi_2.sock",
+	}
+	missing := os.Getenv("HOME") + "/_test_multi_missing.sock"
+
+	for i, path := range paths {
+		name := fmt.Sprintf("srv%d", i+1)
+		srv, err := New(path, func(cmd string, args unixsock.Args) *unixsock.Response {
+			return &unixsock.Response{Status: unixsock.STATUS_OK, Payload: name}
+		})
+		if err != nil {
+			t.Fatalf("TestMulti: could not start server: %s", err.Error())
+		}
+		defer srv.Stop()
+	}
+
+	tests := []struct {
+		paths    []string
+		policy   client.BalancePolicy
+		expected string
+	}{
+		{paths, client.RoundRobin, "srv1,srv2,srv1,srv2"},
+		{paths, client.LeastPending, "srv1,srv1,srv1,srv1"},
+		{[]string{missing, paths[1], paths[0]}, client.Failover, "srv2,srv2,srv2,srv2"},
+		{[]string{paths[0], missing}, client.RoundRobin, "srv1,srv1,srv1,srv1"},
+	}
+
+	for i, test := range tests {
+		c, err := client.NewMulti(test.paths, test.policy)
+		if err != nil {
+			t.Fatalf("TestMulti: test %d failed: could not create client: %s", i+1, err.Error())
+		}
+
+		served := []string{}
+		for j := 0; j < 4; j++ {
+			resp, err := c.Send("whoami", unixsock.Args{}, true, false)
+			if err != nil {
+				t.Fatalf("TestMulti: test %d failed: %s", i+1, err.Error())
+			}
+			served = append(served, resp.Payload)
+		}
+		if got := strings.Join(served, ","); got != test.expected {
+			t.Errorf("TestMulti: test %d (%s) failed: expected %s, got %s", i+1, test.policy, test.expected, got)
+		}
+
+		if err := c.Ping(context.Background()); err != nil {
+			t.Errorf("TestMulti: test %d failed: %s", i+1, err.Error())
+		}
+		c.Quit()
+	}
+
+	if _, err := client.NewMulti(nil, client.RoundRobin); err == nil {
+		t.Errorf("TestMulti: expected an error without paths")
+	}
+
+}
+
+func TestMaintenance(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_maintenance.sock"
+	otherPath := os.Getenv("HOME") + "/_test_maintenance_other.sock"
+
+	router := NewRouter()
+	router.Register("unit.status", TierReadOnly, fakeHandler)
+	router.Register("unit.restart", TierAdmin, fakeHandler)
+
+	srv, err := NewWithHandler(unixSockPath, router, WithPolicy(NewPolicy(TierAdmin), router.Tier))
+	if err != nil {
+		t.Fatalf("TestMaintenance: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestMaintenance: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	call := func(cmd string, args unixsock.Args) (*unixsock.Response, error) {
+		return c.Call(context.Background(), cmd, args)
+	}
+
+	// Toggled via the reserved command
+	if resp, err := call("_sys.maintenance", unixsock.Args{"enabled": true, "message": "migrating the database", "eta": "1h"}); err != nil || !resp.Succeeded() {
+		t.Fatalf("TestMaintenance: could not enable maintenance: %v (%+v)", err, resp)
+	}
+
+	resp, err := call("unit.status", unixsock.Args{})
+	m, ok := err.(*client.MaintenanceError)
+	if !ok || resp == nil || resp.Status != unixsock.StatusRetry {
+		t.Fatalf("TestMaintenance: expected a maintenance error, got %v (%+v)", err, resp)
+	}
+	if !strings.Contains(m.Message, "migrating the database") || m.RetryAfter() < 59*time.Minute || m.RetryAfter() > time.Hour {
+		t.Errorf("TestMaintenance: unexpected maintenance error: %s (retry after %s)", m.Error(), m.RetryAfter())
+	}
+
+	// Admin commands are executed normally
+	if resp, err := call("unit.restart", unixsock.Args{}); err != nil || !resp.Succeeded() {
+		t.Errorf("TestMaintenance: admin command refused during maintenance: %v (%+v)", err, resp)
+	}
+
+	// Multi-clients fail over to servers not in maintenance
+	other, err := NewWithHandler(otherPath, router)
+	if err != nil {
+		t.Fatalf("TestMaintenance: could not start server: %s", err.Error())
+	}
+	defer other.Stop()
+
+	multi, err := client.NewMulti([]string{unixSockPath, otherPath}, client.RoundRobin)
+	if err != nil {
+		t.Fatalf("TestMaintenance: could not create multi-client: %s", err.Error())
+	}
+	defer multi.Quit()
+	for i := 0; i < 4; i++ {
+		if resp, err := multi.Call(context.Background(), "unit.status", unixsock.Args{}); err != nil || !resp.Succeeded() {
+			t.Errorf("TestMaintenance: multi-client did not fail over: %v (%+v)", err, resp)
+		}
+	}
+
+	// Ended via the API
+	srv.SetMaintenance(nil)
+	if resp, err := call("unit.status", unixsock.Args{}); err != nil || !resp.Succeeded() {
+		t.Errorf("TestMaintenance: command refused after the maintenance: %v (%+v)", err, resp)
+	}
+
+}
+
+func TestDrain(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_drain.sock"
+
+	srv, err := New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestDrain: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath, client.WithEagerConnect())
+	if err != nil {
+		t.Fatalf("TestDrain: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	// Drain via the reserved command
+	resp, err := c.Send("_sys.drain", unixsock.Args{}, true, false)
+	if err != nil {
+		t.Fatalf("TestDrain: could not drain: %s", err.Error())
+	}
+	if resp.Status != unixsock.STATUS_OK {
+		t.Fatalf("TestDrain: expected STATUS_OK, got: %s (%s)", resp.Status, resp.Error)
+	}
+
+	// New connections are refused
+	if _, err := client.New(unixSockPath, client.WithEagerConnect()); err == nil {
+		t.Errorf("TestDrain: new connection accepted while draining")
+	}
+
+	// Existing connections are served
+	resp, err = c.Send("hello.world", unixsock.Args{}, true, false)
+	if err != nil {
+		t.Fatalf("TestDrain: existing connection not served: %s", err.Error())
+	}
+	if resp.Status != unixsock.STATUS_OK {
+		t.Errorf("TestDrain: expected STATUS_OK, got: %s", resp.Status)
+	}
+
+	select {
+	case <-srv.Done():
+		t.Errorf("TestDrain: drained server stopped")
+	default:
+	}
+
+}
+
+func TestMaxMessageSizeFor(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_maxsize.sock"
+
+	srv, err := New(unixSockPath, fakeHandler, WithMaxMessageSizeFor("upload.*", 4<<20))
+	if err != nil {
+		t.Fatalf("TestMaxMessageSizeFor: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestMaxMessageSizeFor: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+	c.Options(4<<20, 5*time.Second, true, false) // Responses echo the message
+
+	blob := strings.Repeat("x", 2<<20)
+
+	tests := []struct {
+		cmd    string
+		status unixsock.Status
+	}{
+		{"upload.config", unixsock.STATUS_OK},
+		{"config.set", unixsock.STATUS_FAIL},
+		{"hello.world", unixsock.STATUS_OK},
+	}
+
+	for i, test := range tests {
+		args := unixsock.Args{"blob": blob}
+		if test.cmd == "hello.world" {
+			args = unixsock.Args{}
+		}
+		resp, err := c.Send(test.cmd, args, true, false)
+		if err != nil {
+			t.Fatalf("TestMaxMessageSizeFor: test %d failed: %s", i+1, err.Error())
+		}
+		if resp.Status != test.status {
+			t.Errorf("TestMaxMessageSizeFor: test %d failed: expected %s, got %s (%s)", i+1, test.status, resp.Status, resp.Error)
+		}
+	}
+
+}
+
+func TestSystemdNotify(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_sdnotify.sock"
+	notifyPath := os.Getenv("HOME") + "/_test_sdnotify_notify.sock"
+
+	notifications, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: notifyPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("TestSystemdNotify: could not listen: %s", err.Error())
+	}
+	defer notifications.Close()
+	defer os.Remove(notifyPath)
+
+	os.Setenv("NOTIFY_SOCKET", notifyPath)
+	os.Setenv("WATCHDOG_USEC", "40000")
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	srv, err := New(unixSockPath, fakeHandler, WithSystemdNotify())
+	if err != nil {
+		t.Fatalf("TestSystemdNotify: could not start server: %s", err.Error())
+	}
+	time.Sleep(50 * time.Millisecond)
+	srv.Shutdown(false, "test")
+
+	received := map[string]bool{}
+	buf := make([]byte, 64)
+	notifications.SetReadDeadline(time.Now().Add(time.Second))
+	for !received["STOPPING=1"] {
+		n, err := notifications.Read(buf)
+		if err != nil {
+			t.Fatalf("TestSystemdNotify: got %v before failing: %s", received, err.Error())
+		}
+		received[string(buf[:n])] = true
+	}
+
+	for _, state := range []string{"READY=1", "WATCHDOG=1", "STOPPING=1"} {
+		if !received[state] {
+			t.Errorf("TestSystemdNotify: %s not received", state)
+		}
+	}
+
+}
+
+func TestReconfigure(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_reconfigure.sock"
+
+	srv, err := New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestReconfigure: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestReconfigure: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	status := func() unixsock.Status {
+		resp, err := c.Send("config.set", unixsock.Args{"blob": strings.Repeat("x", 1024)}, true, false)
+		if err != nil {
+			t.Fatalf("TestReconfigure: could not send: %s", err.Error())
+		}
+		return resp.Status
+	}
+
+	if s := status(); s != unixsock.STATUS_OK {
+		t.Errorf("TestReconfigure: expected %s before reconfiguring, got %s", unixsock.STATUS_OK, s)
+	}
+
+	// Deny everything and cap the command
+	deny := NewPolicy(TierNone)
+	classify := func(cmd string) Tier { return TierMutating }
+	if err := srv.Reconfigure(WithPolicy(deny, classify), WithMaxMessageSizeFor("config.*", 512)); err != nil {
+		t.Fatalf("TestReconfigure: could not reconfigure: %s", err.Error())
+	}
+	if s := status(); s != unixsock.STATUS_FAIL {
+		t.Errorf("TestReconfigure: expected %s after reconfiguring, got %s", unixsock.STATUS_FAIL, s)
+	}
+
+	// Allow everything and lift the cap again
+	if err := srv.Reconfigure(WithPolicy(nil, nil), WithMaxMessageSizeFor("config.*", 4096)); err != nil {
+		t.Fatalf("TestReconfigure: could not reconfigure: %s", err.Error())
+	}
+	if s := status(); s != unixsock.STATUS_OK {
+		t.Errorf("TestReconfigure: expected %s after reverting, got %s", unixsock.STATUS_OK, s)
+	}
+
+	// Settings fixed at startup
+	if err := srv.Reconfigure(WithDispatchQueue(2, 10)); err == nil {
+		t.Errorf("TestReconfigure: expected an error when changing the dispatch queue")
+	}
+
+}
+
+func TestClientMiddleware(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_middleware.sock"
+
+	srv, err := New(unixSockPath, func(cmd string, args unixsock.Args) *unixsock.Response {
+		return &unixsock.Response{Status: unixsock.STATUS_OK, Payload: fmt.Sprintf("%s:%v", cmd, args["token"])}
+	})
+	if err != nil {
+		t.Fatalf("TestClientMiddleware: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestClientMiddleware: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	var calls []string
+	trace := func(name string) client.Middleware {
+		return func(next client.Sender) client.Sender {
+			return func(ctx context.Context, req *client.Request) (*unixsock.Response, error) {
+				calls = append(calls, name+":"+req.Cmd)
+				return next(ctx, req)
+			}
+		}
+	}
+	auth := func(next client.Sender) client.Sender {
+		return func(ctx context.Context, req *client.Request) (*unixsock.Response, error) {
+			args := unixsock.Args{"token": "secret"}
+			for k, v := range req.Args {
+				args[k] = v
+			}
+			req.Args = args
+			return next(ctx, req)
+		}
+	}
+
+	c.Use(trace("outer"), auth)
+	c.Use(trace("inner"))
+
+	args := unixsock.Args{}
+	resp, err := c.Send("echo", args, true, false)
+	if err != nil {
+		t.Fatalf("TestClientMiddleware: could not send: %s", err.Error())
+	}
+	if resp.Payload != "echo:secret" {
+		t.Errorf("TestClientMiddleware: expected payload 'echo:secret', got '%v'", resp.Payload)
+	}
+	if _, ok := args["token"]; ok {
+		t.Errorf("TestClientMiddleware: middleware modified the caller's arguments")
+	}
+
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("TestClientMiddleware: could not ping: %s", err.Error())
+	}
+
+	expected := "outer:echo,inner:echo,outer:_sys.health,inner:_sys.health"
+	if got := strings.Join(calls, ","); got != expected {
+		t.Errorf("TestClientMiddleware: expected calls '%s', got '%s'", expected, got)
+	}
+
+}
+
+func TestRequestMeta(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_meta.sock"
+
+	srv, err := NewWithHandler(unixSockPath, HandlerFunc(func(ctx context.Context, req *Request) *unixsock.Response {
+		return &unixsock.Response{Status: unixsock.STATUS_OK, Payload: fmt.Sprintf("%s:%s:%d", req.Meta["trace_id"], req.Meta["locale"], len(req.Args))}
+	}))
+	if err != nil {
+		t.Fatalf("TestRequestMeta: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestRequestMeta: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	resp, err := c.Send("echo", unixsock.Args{"unit": "nginx.service"}, true, false)
+	if err != nil {
+		t.Fatalf("TestRequestMeta: could not send: %s", err.Error())
+	}
+	if resp.Payload != "::1" {
+		t.Errorf("TestRequestMeta: expected payload '::1' without metadata, got '%v'", resp.Payload)
+	}
+
+	c.Use(func(next client.Sender) client.Sender {
+		return func(ctx context.Context, req *client.Request) (*unixsock.Response, error) {
+			req.SetMeta("trace_id", "4bf92f35")
+			req.SetMeta("locale", "lt_LT")
+			return next(ctx, req)
+		}
+	})
+
+	resp, err = c.Send("echo", unixsock.Args{"unit": "nginx.service"}, true, false)
+	if err != nil {
+		t.Fatalf("TestRequestMeta: could not send: %s", err.Error())
+	}
+	if resp.Payload != "4bf92f35:lt_LT:1" {
+		t.Errorf("TestRequestMeta: expected payload '4bf92f35:lt_LT:1', got '%v'", resp.Payload)
+	}
+
+}
+
+func TestCallOptions(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_calloptions.sock"
+
+	done := make(chan string, 1)
+	srv, err := NewWithHandler(unixSockPath, HandlerFunc(func(ctx context.Context, req *Request) *unixsock.Response {
+		switch req.Cmd {
+		case "slow":
+			time.Sleep(300 * time.Millisecond)
+		case "notify":
+			done <- req.Cmd
+		}
+		return &unixsock.Response{Status: unixsock.STATUS_OK, Payload: fmt.Sprintf("%s:%d:%s:%t", req.Cmd, req.Priority, req.Meta["trace_id"], req.Expires.IsZero())}
+	}))
+	if err != nil {
+		t.Fatalf("TestCallOptions: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath, client.WithTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("TestCallOptions: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	ctx := context.Background()
+
+	if _, err := c.Call(ctx, "slow", unixsock.Args{}); err == nil {
+		t.Errorf("TestCallOptions: expected the client's timeout to apply")
+	}
+
+	resp, err := c.Call(ctx, "slow", unixsock.Args{}, client.WithCallTimeout(2*time.Second))
+	if err != nil || resp.Payload != "slow:0::true" {
+		t.Errorf("TestCallOptions: expected the call timeout to apply, got %v (%v)", resp, err)
+	}
+
+	resp, err = c.Call(ctx, "echo", unixsock.Args{}, client.WithCallPriority(unixsock.PriorityHigh), client.WithCallMeta("trace_id", "4bf92f35"), client.WithCallTTL(time.Minute))
+	if err != nil || resp.Payload != "echo:1:4bf92f35:false" {
+		t.Errorf("TestCallOptions: expected the call options to apply, got %v (%v)", resp, err)
+	}
+
+	resp, err = c.Call(ctx, "notify", unixsock.Args{}, client.WithNoResponse())
+	if err != nil || resp != nil {
+		t.Errorf("TestCallOptions: expected no response, got %v (%v)", resp, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("TestCallOptions: command sent without waiting for a response was not executed")
+	}
+
+	resp, err = c.Call(ctx, "echo", unixsock.Args{})
+	if err != nil || resp.Payload != "echo:0::true" {
+		t.Errorf("TestCallOptions: per-call options leaked into the client's settings, got %v (%v)", resp, err)
+	}
+
+}
+
+func TestRawBridge(t *testing.T) {
+
+	backendPath := os.Getenv("HOME") + "/_test_raw_backend.sock"
+	bridgePath := os.Getenv("HOME") + "/_test_raw_bridge.sock"
+
+	backend, err := New(backendPath, func(cmd string, args unixsock.Args) *unixsock.Response {
+		return &unixsock.Response{Status: unixsock.STATUS_OK, Payload: fmt.Sprintf("%s:%v", cmd, args["n"])}
+	})
+	if err != nil {
+		t.Fatalf("TestRawBridge: could not start backend: %s", err.Error())
+	}
+	defer backend.Stop()
+
+	forward, err := client.New(backendPath)
+	if err != nil {
+		t.Fatalf("TestRawBridge: could not create client: %s", err.Error())
+	}
+	defer forward.Quit()
+
+	policy := NewPolicy(TierMutating)
+	classify := func(cmd string) Tier {
+		if cmd == "shutdown" {
+			return TierAdmin
+		}
+		return TierReadOnly
+	}
+
+	bridge, err := New(bridgePath, fakeHandler, WithPolicy(policy, classify), WithRawHandler(func(ctx context.Context, peer *unixsock.PeerCred, frame []byte) ([]byte, error) {
+		return forward.SendRaw(ctx, frame)
+	}))
+	if err != nil {
+		t.Fatalf("TestRawBridge: could not start bridge: %s", err.Error())
+	}
+	defer bridge.Stop()
+
+	tests := [][]client.Option{
+		{},
+		{client.WithFrameHeader(true)},
+	}
+
+	for i, opts := range tests {
+		c, err := client.New(bridgePath, opts...)
+		if err != nil {
+			t.Fatalf("TestRawBridge: test %d: could not create client: %s", i+1, err.Error())
+		}
+
+		for n := 0; n < 3; n++ {
+			resp, err := c.Send("echo", unixsock.Args{"n": n}, true, false)
+			if expected := fmt.Sprintf("echo:%d", n); err != nil || resp.Payload != expected {
+				t.Errorf("TestRawBridge: test %d: expected '%s', got %v (%v)", i+1, expected, resp, err)
+			}
+		}
+
+		resp, err := c.Send("shutdown", unixsock.Args{}, true, false)
+		if err != nil || resp.Status != unixsock.STATUS_FAIL {
+			t.Errorf("TestRawBridge: test %d: expected the policy to deny the command, got %v (%v)", i+1, resp, err)
+		}
+
+		c.Quit()
+	}
+
+	// Frames not asking for a response
+	frame := append([]byte{0, 0, 0, 0, ':'}, `{"cmd":"echo","args":{},"respond":false}`...)
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-5))
+	if reply, err := forward.SendRaw(context.Background(), frame); err != nil || reply != nil {
+		t.Errorf("TestRawBridge: expected no reply, got %q (%v)", reply, err)
+	}
+	if _, err := forward.SendRaw(context.Background(), frame[:len(frame)-1]); err == nil {
+		t.Errorf("TestRawBridge: expected truncated frames to be rejected")
+	}
+
+}
+
+func TestRawAuthorization(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_raw_authorization.sock"
+
+	acl := AuthorizerFunc(func(peer *unixsock.PeerCred, cmd string, args unixsock.Args) error {
+		if cmd == "secret" && args["token"] != "letmein" {
+			return fmt.Errorf("acl: command '%s' denied", cmd)
+		}
+		return nil
+	})
+	srv, err := New(unixSockPath, fakeHandler, WithAuthorizer(acl), WithRawHandler(func(ctx context.Context, peer *unixsock.PeerCred, frame []byte) ([]byte, error) {
+		return nil, fmt.Errorf("raw handler reached")
+	}))
+	if err != nil {
+		t.Fatalf("TestRawAuthorization: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestRawAuthorization: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	tests := []struct {
+		cmd         string
+		args        unixsock.Args
+		maintenance bool
+		expected    string
+	}{
+		{"echo", unixsock.Args{}, false, "raw handler reached"},
+		{"secret", unixsock.Args{}, false, "acl: command 'secret' denied"},
+		{"secret", unixsock.Args{"token": "letmein"}, false, "raw handler reached"},
+		{"echo", unixsock.Args{}, true, "server in maintenance"},
+	}
+
+	for i, test := range tests {
+		if test.maintenance {
+			srv.SetMaintenance(&Maintenance{Message: "upgrading"})
+		}
+		resp, err := c.Send(test.cmd, test.args, true, false)
+		srv.SetMaintenance(nil)
+
+		// Refusals to retry later are returned as errors
+		got := ""
+		if err != nil {
+			got = err.Error()
+		} else {
+			got = resp.Error
+		}
+		if !strings.Contains(got, test.expected) {
+			t.Errorf("TestRawAuthorization: test %d failed: expected '%s', got '%s'", i+1, test.expected, got)
+		}
+	}
+
+}
+
+func TestFrameHeader(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_frameheader.sock"
+
+	srv, err := New(unixSockPath, func(cmd string, args unixsock.Args) *unixsock.Response {
+		return &unixsock.Response{Status: unixsock.STATUS_OK, Payload: fmt.Sprint(args["n"])}
+	})
+	if err != nil {
+		t.Fatalf("TestFrameHeader: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	tests := [][]client.Option{
+		{client.WithFrameHeader(false)},
+		{client.WithFrameHeader(true)},
+		{client.WithFrameHeader(true), client.WithStreamCompression(unixsock.CompressionFlate)},
+	}
+
+	for i, opts := range tests {
+		c, err := client.New(unixSockPath, opts...)
+		if err != nil {
+			t.Fatalf("TestFrameHeader: test %d: could not create client: %s", i+1, err.Error())
+		}
+
+		for n := 0; n < 5; n++ {
+			resp, err := c.Send("echo", unixsock.Args{"n": n}, true, false)
+			if err != nil {
+				t.Fatalf("TestFrameHeader: test %d: message %d failed: %s", i+1, n, err.Error())
+			}
+			if resp.Payload != fmt.Sprint(n) {
+				t.Errorf("TestFrameHeader: test %d: message %d: expected payload %d, got %s", i+1, n, n, resp.Payload)
+			}
+		}
+
+		c.Quit()
+	}
+
+}
+
+func TestStats(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_stats.sock"
+
+	srv, err := New(unixSockPath, func(cmd string, args unixsock.Args) *unixsock.Response {
+		if cmd == "fail" {
+			return &unixsock.Response{Status: unixsock.STATUS_FAIL, Error: "failed"}
+		}
+		time.Sleep(time.Millisecond)
+		return &unixsock.Response{Status: unixsock.STATUS_OK}
+	})
+	if err != nil {
+		t.Fatalf("TestStats: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestStats: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	for _, cmd := range []string{"ok", "ok", "ok", "fail", "fail"} {
+		if _, err := c.Send(cmd, unixsock.Args{}, true, false); err != nil {
+			t.Fatalf("TestStats: could not send: %s", err.Error())
+		}
+	}
+
+	stats := srv.Stats()
+	if s := stats["ok"]; s.Calls != 3 || s.Errors != 0 || s.P50 < time.Millisecond || s.Max < s.P99 {
+		t.Errorf("TestStats: unexpected stats of 'ok': %+v", s)
+	}
+	if s := stats["fail"]; s.Calls != 2 || s.Errors != 2 || s.ErrorRate != 1 {
+		t.Errorf("TestStats: unexpected stats of 'fail': %+v", s)
+	}
+
+	// Introspection
+	resp, err := c.Send("_sys.stats", unixsock.Args{}, true, false)
+	if err != nil || resp.Status != unixsock.STATUS_OK {
+		t.Fatalf("TestStats: could not fetch stats: %v (%+v)", err, resp)
+	}
+	reported := map[string]CommandStats{}
+	if err := json.Unmarshal([]byte(resp.Payload), &reported); err != nil {
+		t.Fatalf("TestStats: could not decode stats: %s", err.Error())
+	}
+	if reported["ok"].Calls != 3 || reported["fail"].Errors != 2 {
+		t.Errorf("TestStats: unexpected reported stats: %+v", reported)
+	}
+
+}
+
+func TestRecorder(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_recorder.sock"
+
+	f, err := ioutil.TempFile("", "unixsock-recording")
+	if err != nil {
+		t.Fatalf("TestRecorder: could not create recording: %s", err.Error())
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Record
+	handler := func(failing string) func(cmd string, args unixsock.Args) *unixsock.Response {
+		return func(cmd string, args unixsock.Args) *unixsock.Response {
+			if cmd == failing {
+				return &unixsock.Response{Status: unixsock.STATUS_FAIL, Error: "regression"}
+			}
+			return &unixsock.Response{Status: unixsock.STATUS_OK, Payload: fmt.Sprint(args["n"])}
+		}
+	}
+
+	srv, err := New(unixSockPath, handler(""), WithRecorder(record.NewRecorder(f)))
+	if err != nil {
+		t.Fatalf("TestRecorder: could not start server: %s", err.Error())
+	}
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestRecorder: could not create client: %s", err.Error())
+	}
+	for i, cmd := range []string{"config.get", "config.set", "stats"} {
+		if _, err := c.Send(cmd, unixsock.Args{"n": i}, true, false); err != nil {
+			t.Fatalf("TestRecorder: could not send: %s", err.Error())
+		}
+	}
+	c.Quit()
+	srv.Stop()
+
+	// Replay against a server with a regression
+	srv, err = New(unixSockPath, handler("config.set"))
+	if err != nil {
+		t.Fatalf("TestRecorder: could not restart server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err = client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestRecorder: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	recording, err := os.Open(f.Name())
+	if err != nil {
+		t.Fatalf("TestRecorder: could not open recording: %s", err.Error())
+	}
+	defer recording.Close()
+
+	var replayed, diverged []string
+	err = record.Replay(c, recording, false, func(r *record.Result) {
+		replayed = append(replayed, r.Record.Cmd)
+		if r.Diverged() {
+			diverged = append(diverged, r.Record.Cmd)
+		}
+		if r.Record.Peer == nil || r.Record.Time.IsZero() {
+			t.Errorf("TestRecorder: incomplete record: %+v", r.Record)
+		}
+	})
+	if err != nil {
+		t.Fatalf("TestRecorder: could not replay: %s", err.Error())
+	}
+
+	if got := strings.Join(replayed, ","); got != "config.get,config.set,stats" {
+		t.Errorf("TestRecorder: unexpected replayed commands: %s", got)
+	}
+	if got := strings.Join(diverged, ","); got != "config.set" {
+		t.Errorf("TestRecorder: unexpected diverged commands: %s", got)
+	}
+
+}
+
+func TestIdleTimeout(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_idle.sock"
+
+	srv, err := New(unixSockPath, func(cmd string, args unixsock.Args) *unixsock.Response {
+		if cmd == "slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return &unixsock.Response{Status: unixsock.STATUS_OK}
+	}, WithReceiveTimeout(0), WithIdleTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("TestIdleTimeout: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	// Commands in flight keep the connection open
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestIdleTimeout: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+	if resp, err := c.Send("slow", unixsock.Args{}, true, false); err != nil || resp.Status != unixsock.STATUS_OK {
+		t.Errorf("TestIdleTimeout: slow command failed: %v (%+v)", err, resp)
+	}
+
+	// Idle connections are closed
+	conn, err := net.Dial("unix", unixSockPath)
+	if err != nil {
+		t.Fatalf("TestIdleTimeout: could not connect: %s", err.Error())
+	}
+	defer conn.Close()
+
+	// The close frame is followed by the end of the connection
+	started := time.Now()
+	conn.SetReadDeadline(started.Add(5 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, conn); err != nil || time.Since(started) > 2*time.Second {
+		t.Errorf("TestIdleTimeout: expected the idle connection to be closed, got: %v after %s", err, time.Since(started))
+	}
+
+}
+
+// exhaustedListener fails the accept of the first connection after being
+// armed with EMFILE, returning the connection on the next call
+type exhaustedListener struct {
+	net.Listener
+	armed   int32
+	pending net.Conn
+}
+
+func (l *exhaustedListener) Accept() (net.Conn, error) {
+	if c := l.pending; c != nil {
+		l.pending = nil
+		return c, nil
+	}
+	c, err := l.Listener.Accept()
+	if err == nil && atomic.CompareAndSwapInt32(&l.armed, 1, 0) {
+		l.pending = c
+		return nil, &net.OpError{Op: "accept", Net: "unix", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+	return c, err
+}
+
+func TestExhaustion(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_exhaustion.sock"
+
+	inner, err := net.Listen("unix", unixSockPath)
+	if err != nil {
+		t.Fatalf("TestExhaustion: could not listen: %s", err.Error())
+	}
+	l := &exhaustedListener{Listener: inner}
+
+	acceptErrors := make(chan error, 1)
+	srv, err := Serve(l, fakeHandler, WithReclaimIdle(50*time.Millisecond), OnAcceptError(func(err error) {
+		acceptErrors <- err
+	}))
+	if err != nil {
+		t.Fatalf("TestExhaustion: could not serve: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	// Idle connection
+	idle, err := net.Dial("unix", unixSockPath)
+	if err != nil {
+		t.Fatalf("TestExhaustion: could not connect: %s", err.Error())
+	}
+	defer idle.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// The next connection is served once the idle one has been closed
+	atomic.StoreInt32(&l.armed, 1)
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestExhaustion: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+	if resp, err := c.Send("hello.world", unixsock.Args{}, true, false); err != nil || resp.Status != unixsock.STATUS_OK {
+		t.Errorf("TestExhaustion: command failed: %v (%+v)", err, resp)
+	}
+
+	select {
+	case err := <-acceptErrors:
+		if exhausted, ok := err.(*ExhaustedError); !ok || exhausted.Reclaimed != 1 || exhausted.Count != 1 {
+			t.Errorf("TestExhaustion: expected an ExhaustedError reclaiming 1 connection, got %v", err)
+		}
+	default:
+		t.Errorf("TestExhaustion: exhaustion not reported")
+	}
+
+	// The close frame is followed by the end of the connection
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.Copy(ioutil.Discard, idle); err != nil {
+		t.Errorf("TestExhaustion: expected the idle connection to be closed, got %v", err)
+	}
+
+}
+
+func TestTierNoneProtocols(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_tiernone.sock"
+
+	var reached int32
+	httpHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&reached, 1)
+	})
+	rawHandler := func(ctx context.Context, peer *unixsock.PeerCred, frame []byte) ([]byte, error) {
+		atomic.AddInt32(&reached, 1)
+		return nil, nil
+	}
+
+	srv, err := New(unixSockPath, fakeHandler, WithPolicy(NewPolicy(TierNone), nil), WithHTTPHandler(httpHandler), WithRawHandler(rawHandler))
+	if err != nil {
+		t.Fatalf("TestTierNoneProtocols: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	// Raw frames: the connection is closed rather than the frame answered
+	c, err := client.New(unixSockPath, client.WithEagerConnect())
+	if err == nil {
+		frame := append([]byte{0, 0, 0, 0, ':'}, `{"cmd":"echo","args":{},"respond":true}`...)
+		binary.BigEndian.PutUint32(frame, uint32(len(frame)-5))
+		if reply, err := c.SendRaw(context.Background(), frame); err == nil {
+			t.Errorf("TestTierNoneProtocols: raw frame of a peer without access answered: %q", reply)
+		}
+		c.Quit()
+	}
+
+	// HTTP
+	hc := &http.Client{Transport: client.NewHTTPTransport(unixSockPath), Timeout: time.Second}
+	if resp, err := hc.Get("http://unix/"); err == nil {
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("TestTierNoneProtocols: HTTP request of a peer without access succeeded")
+		}
+		resp.Body.Close()
+	}
+
+	// Lines of JSON
+	conn, err := net.Dial("unix", unixSockPath)
+	if err == nil {
+		conn.Write([]byte(`{"cmd":"echo","args":{}}` + "\n"))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		ioutil.ReadAll(conn)
+		conn.Close()
+	}
+
+	if n := atomic.LoadInt32(&reached); n != 0 {
+		t.Errorf("TestTierNoneProtocols: handlers reached %d times by a peer without access", n)
+	}
+
+}
+
+func TestHTTP(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_http.sock"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/peer", func(w http.ResponseWriter, r *http.Request) {
+		peer := PeerFromRequest(r)
+		fmt.Fprintf(w, "%t", peer != nil && int(peer.PID) == os.Getpid())
+	})
+
+	srv, err := New(unixSockPath, fakeHandler, WithHTTPHandler(mux), WithPolicy(NewPolicy(TierReadOnly), nil))
+	if err != nil {
+		t.Fatalf("TestHTTP: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	hc := &http.Client{Transport: client.NewHTTPTransport(unixSockPath), Timeout: time.Second}
+
+	tests := []struct {
+		method string
+		status int
+		body   string
+	}{
+		{http.MethodGet, http.StatusOK, "true"},
+		{http.MethodPost, http.StatusForbidden, ""},
+	}
+
+	for i, test := range tests {
+		req, _ := http.NewRequest(test.method, "http://unix/peer", nil)
+		resp, err := hc.Do(req)
+		if err != nil {
+			t.Fatalf("TestHTTP: test %d failed: %s", i+1, err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status || (test.body != "" && string(body) != test.body) {
+			t.Errorf("TestHTTP: test %d failed: unexpected response %d: %s", i+1, resp.StatusCode, body)
+		}
+	}
+
+	// Commands are served on the same socket
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestHTTP: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+	if resp, err := c.Send("_sys.health", unixsock.Args{}, true, false); err != nil || resp.Status != unixsock.StatusOK {
+		t.Errorf("TestHTTP: command failed: %v (%+v)", err, resp)
+	}
+
+}
+
+func TestMaxConnsPerPeer(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_peerquota.sock"
+
+	srv, err := New(unixSockPath, fakeHandler, WithMaxConnsPerPeer(2))
+	if err != nil {
+		t.Fatalf("TestMaxConnsPerPeer: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	// Use up the quota of this process
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("unix", unixSockPath)
+		if err != nil {
+			t.Fatalf("TestMaxConnsPerPeer: could not connect: %s", err.Error())
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+
+		// Make sure that the connection has been admitted
+		msg := unixsock.NewSender(conn, "_sys.health", unixsock.Args{}, true, false)
+		if err := msg.Send(); err != nil || msg.Receive() != nil {
+			t.Fatalf("TestMaxConnsPerPeer: connection %d not served", i+1)
+		}
+	}
+
+	send := func() unixsock.Status {
+		c, err := client.New(unixSockPath)
+		if err != nil {
+			t.Fatalf("TestMaxConnsPerPeer: could not create client: %s", err.Error())
+		}
+		defer c.Quit()
+		resp, err := c.Send("echo", unixsock.Args{}, true, false)
+		if err != nil {
+			t.Fatalf("TestMaxConnsPerPeer: could not send: %s", err.Error())
+		}
+		return resp.Status
+	}
+
+	if status := send(); status != unixsock.STATUS_REJECTED {
+		t.Errorf("TestMaxConnsPerPeer: expected %s over the quota, got %s", unixsock.STATUS_REJECTED, status)
+	}
+
+	// Closing a connection frees up the quota
+	conns[0].Close()
+	var status unixsock.Status
+	for i := 0; i < 50 && status != unixsock.STATUS_OK; i++ {
+		time.Sleep(10 * time.Millisecond)
+		status = send()
+	}
+	if status != unixsock.STATUS_OK {
+		t.Errorf("TestMaxConnsPerPeer: expected %s within the quota, got %s", unixsock.STATUS_OK, status)
+	}
+
+}
+
+func TestResponseCompression(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_respcompression.sock"
+
+	blob := strings.Repeat("compressible ", 1000)
+	srv, err := New(unixSockPath, func(cmd string, args unixsock.Args) *unixsock.Response {
+		if cmd == "small" {
+			return &unixsock.Response{Status: unixsock.STATUS_OK, Payload: "small"}
+		}
+		return &unixsock.Response{Status: unixsock.STATUS_OK, Payload: blob}
+	})
+	if err != nil {
+		t.Fatalf("TestResponseCompression: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	// On the wire
+	conn, err := net.Dial("unix", unixSockPath)
+	if err != nil {
+		t.Fatalf("TestResponseCompression: could not connect: %s", err.Error())
+	}
+	defer conn.Close()
+	c := unixsock.NewConn(conn)
+
+	tests := []struct {
+		cmd      string
+		args     unixsock.Args
+		encoding string
+	}{
+		{"big", unixsock.Args{}, ""},
+		{"_sys.hello", unixsock.Args{"accept_encoding": []interface{}{"gzip", unixsock.CompressionFlate}}, ""},
+		{"big", unixsock.Args{}, unixsock.CompressionFlate},
+		{"small", unixsock.Args{}, ""},
+	}
+
+	for i, test := range tests {
+		msg := unixsock.NewSender(c, test.cmd, test.args, true, false)
+		if err := msg.Send(); err != nil {
+			t.Fatalf("TestResponseCompression: test %d: could not send: %s", i+1, err.Error())
+		}
+		if err := msg.Receive(); err != nil {
+			t.Fatalf("TestResponseCompression: test %d: could not receive: %s", i+1, err.Error())
+		}
+
+		resp := msg.GetResponse()
+		if resp.Encoding != test.encoding {
+			t.Errorf("TestResponseCompression: test %d: expected encoding '%s', got '%s'", i+1, test.encoding, resp.Encoding)
+		}
+		if err := resp.DecodePayload(); err != nil {
+			t.Errorf("TestResponseCompression: test %d: could not decode: %s", i+1, err.Error())
+		}
+		if test.cmd == "big" && resp.Payload != blob {
+			t.Errorf("TestResponseCompression: test %d: payload mismatch", i+1)
+		}
+	}
+
+	// Transparently via the client
+	cl, err := client.New(unixSockPath, client.WithResponseCompression())
+	if err != nil {
+		t.Fatalf("TestResponseCompression: could not create client: %s", err.Error())
+	}
+	defer cl.Quit()
+
+	resp, err := cl.Send("big", unixsock.Args{}, true, false)
+	if err != nil {
+		t.Fatalf("TestResponseCompression: could not send: %s", err.Error())
+	}
+	if resp.Payload != blob || resp.Encoding != "" {
+		t.Errorf("TestResponseCompression: expected the decoded payload, got %d bytes (encoding '%s')", len(resp.Payload), resp.Encoding)
+	}
+
+}
+
+func TestTenants(t *testing.T) {
+
+	aliceSockPath := os.Getenv("HOME") + "/_test_tenant_alice.sock"
+	bobSockPath := os.Getenv("HOME") + "/_test_tenant_bob.sock"
+
+	release := make(chan struct{})
+	tenantHandler := func(ctx context.Context, req *Request) *unixsock.Response {
+		if req.Cmd == "block" {
+			<-release
+		}
+		return unixsock.NewResponse().OK().WithPayload(TenantFromContext(ctx).Name)
+	}
+
+	alice := &Tenant{Name: "alice", Handler: HandlerFunc(tenantHandler), MaxInFlight: 1}
+	bob := &Tenant{Name: "bob", Handler: HandlerFunc(tenantHandler)}
+	tenants := NewTenants().BySocket("alice.sock", alice).ByUID(uint32(os.Getuid()), bob)
+
+	for _, path := range []string{aliceSockPath, bobSockPath} {
+		srv, err := NewWithHandler(path, tenants)
+		if err != nil {
+			t.Fatalf("TestTenants: could not start server: %s", err.Error())
+		}
+		defer srv.Stop()
+	}
+
+	send := func(path, cmd string) *unixsock.Response {
+		c, err := client.New(path)
+		if err != nil {
+			t.Fatalf("TestTenants: could not create client: %s", err.Error())
+		}
+		defer c.Quit()
+		resp, err := c.Send(cmd, unixsock.Args{}, true, false)
+		if err != nil {
+			t.Fatalf("TestTenants: could not send: %s", err.Error())
+		}
+		return resp
+	}
+
+	// Tenants are chosen by socket, then by UID
+	if resp := send(aliceSockPath, "echo"); resp.Payload != "alice" {
+		t.Errorf("TestTenants: expected tenant alice, got %v", resp)
+	}
+	if resp := send(bobSockPath, "echo"); resp.Payload != "bob" {
+		t.Errorf("TestTenants: expected tenant bob, got %v", resp)
+	}
+
+	// Per-tenant quota
+	blocked := make(chan *unixsock.Response, 1)
+	go func() {
+		blocked <- send(aliceSockPath, "block")
+	}()
+
+	var resp *unixsock.Response
+	for i := 0; i < 50; i++ {
+		if resp = send(aliceSockPath, "echo"); resp.Status == unixsock.STATUS_REJECTED {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if resp.Status != unixsock.STATUS_REJECTED {
+		t.Errorf("TestTenants: expected %s over the quota, got %v", unixsock.STATUS_REJECTED, resp)
+	}
+	if resp := send(bobSockPath, "echo"); resp.Status != unixsock.STATUS_OK {
+		t.Errorf("TestTenants: expected other tenants not to be affected by the quota, got %v", resp)
+	}
+
+	close(release)
+	if resp := <-blocked; resp.Status != unixsock.STATUS_OK {
+		t.Errorf("TestTenants: expected the blocked command to succeed, got %v", resp)
+	}
+	if resp := send(aliceSockPath, "echo"); resp.Status != unixsock.STATUS_OK {
+		t.Errorf("TestTenants: expected %s within the quota, got %v", unixsock.STATUS_OK, resp)
+	}
+
+	// Commands matching no tenant
+	if resp := tenants.ServeUnix(context.Background(), &Request{Cmd: "echo"}); resp.Status != unixsock.STATUS_FAIL {
+		t.Errorf("TestTenants: expected commands without a tenant to fail, got %v", resp)
+	}
+
+}
+
+// rowStream streams rows and summarizes them in its trailer
+type rowStream struct {
+	io.Reader
+	rows int
+}
+
+func (s *rowStream) Trailer() map[string]string {
+	return map[string]string{"rows": strconv.Itoa(s.rows)}
+}
+
+func TestStreamTrailer(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_trailer.sock"
+	fakeSockPath := os.Getenv("HOME") + "/_test_trailer_fake.sock"
+
+	rows := strings.Repeat("row\n", 50000)
+
+	srv, err := New(unixSockPath, func(cmd string, args unixsock.Args) *unixsock.Response {
+		return unixsock.NewResponse().OK().WithTrailer("source", "db").WithStream(&rowStream{strings.NewReader(rows), 50000})
+	})
+	if err != nil {
+		t.Fatalf("TestStreamTrailer: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestStreamTrailer: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	buf := &bytes.Buffer{}
+	resp, err := c.SendTo(context.Background(), "dump", unixsock.Args{}, buf)
+	if err != nil {
+		t.Fatalf("TestStreamTrailer: could not send: %s", err.Error())
+	}
+	expected := map[string]string{
+		"rows":                 "50000",
+		"source":               "db",
+		unixsock.TrailerLength: strconv.Itoa(len(rows)),
+		unixsock.TrailerCRC32:  fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(rows))),
+	}
+	if !reflect.DeepEqual(resp.Trailer, expected) {
+		t.Errorf("TestStreamTrailer: expected trailer %v, got %v", expected, resp.Trailer)
+	}
+	if buf.String() != rows {
+		t.Errorf("TestStreamTrailer: streamed payload mismatch: got %d bytes, expected %d", buf.Len(), len(rows))
+	}
+
+	// Server losing a chunk
+	l, err := net.Listen("unix", fakeSockPath)
+	if err != nil {
+		t.Fatalf("TestStreamTrailer: could not listen: %s", err.Error())
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		receiver := unixsock.NewReceiver(conn)
+		if receiver.Receive() != nil {
+			return
+		}
+		chunk := unixsock.NewSender(conn, receiver.GetCmd(), nil, false, false)
+		chunk.SetID(receiver.GetID())
+		chunk.SetChunk([]byte("row\n"), true)
+		chunk.Send()
+
+		receiver.SetResponse(unixsock.NewResponse().OK().WithTrailer(unixsock.TrailerLength, "8"))
+		receiver.Send()
+	}()
+
+	fake, err := client.New(fakeSockPath)
+	if err != nil {
+		t.Fatalf("TestStreamTrailer: could not create client: %s", err.Error())
+	}
+	defer fake.Quit()
+	if _, err := fake.SendTo(context.Background(), "dump", unixsock.Args{}, ioutil.Discard); err == nil || !strings.Contains(err.Error(), "incomplete stream") {
+		t.Errorf("TestStreamTrailer: expected an incomplete stream to be detected, got %v", err)
+	}
+
+}
+
+func TestCancellation(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_cancel.sock"
+
+	cancelled := make(chan string, 10)
+	srv, err := NewWithHandler(unixSockPath, HandlerFunc(func(ctx context.Context, req *Request) *unixsock.Response {
+		if req.Cmd != "slow" {
+			return unixsock.NewResponse().OK().WithPayload(req.Cmd)
+		}
+		select {
+		case <-ctx.Done():
+			cancelled <- req.Cmd
+			return unixsock.NewResponse().Fail(ctx.Err())
+		case <-time.After(5 * time.Second):
+			return unixsock.NewResponse().OK()
+		}
+	}))
+	if err != nil {
+		t.Fatalf("TestCancellation: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	tests := []struct {
+		opts      []client.Option
+		cancelled bool
+	}{
+		{[]client.Option{client.WithCancellation()}, true},
+		{[]client.Option{client.WithCancellation(), client.WithFrameHeader(true)}, true},
+		{nil, false},
+	}
+
+	for i, test := range tests {
+		c, err := client.New(unixSockPath, test.opts...)
+		if err != nil {
+			t.Fatalf("TestCancellation: test %d: could not create client: %s", i+1, err.Error())
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		if _, err := c.Call(ctx, "slow", unixsock.Args{}); err == nil {
+			t.Errorf("TestCancellation: test %d: expected the call to time out", i+1)
+		}
+		cancel()
+
+		select {
+		case <-cancelled:
+			if !test.cancelled {
+				t.Errorf("TestCancellation: test %d: expected the handler not to be cancelled", i+1)
+			}
+		case <-time.After(time.Second):
+			if test.cancelled {
+				t.Errorf("TestCancellation: test %d: expected the handler to be cancelled", i+1)
+			}
+		}
+
+		// The connection keeps serving commands
+		if test.cancelled {
+			resp, err := c.Send("echo", unixsock.Args{}, true, false)
+			if err != nil || resp.Payload != "echo" {
+				t.Errorf("TestCancellation: test %d: expected a response after the cancellation, got %v (%v)", i+1, resp, err)
+			}
+		}
+
+		c.Quit()
+	}
+
+}
+
+func TestAck(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_ack.sock"
+
+	release := make(chan struct{})
+	var executed int32
+	srv, err := New(unixSockPath, func(cmd string, args unixsock.Args) *unixsock.Response {
+		<-release
+		atomic.AddInt32(&executed, 1)
+		return unixsock.NewResponse().OK()
+	}, WithConcurrentPerConn(200))
+	if err != nil {
+		t.Fatalf("TestAck: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestAck: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	// Acknowledged before the handlers return
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := c.Call(context.Background(), "metric", unixsock.Args{"i": i}, client.WithAck(), client.WithCallTimeout(time.Second))
+			if err != nil || resp != nil {
+				t.Errorf("TestAck: message %d: expected an acknowledgement, got %v (%v)", i, resp, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&executed); n != 0 {
+		t.Errorf("TestAck: expected no command to have been executed yet, got %d", n)
+	}
+
+	close(release)
+	for i := 0; i < 100 && atomic.LoadInt32(&executed) < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&executed); n != 100 {
+		t.Errorf("TestAck: expected all commands to be executed, got %d", n)
+	}
+
+	// Regular calls still receive responses
+	resp, err := c.Send("metric", unixsock.Args{}, true, false)
+	if err != nil || resp.Status != unixsock.STATUS_OK {
+		t.Errorf("TestAck: expected a response, got %v (%v)", resp, err)
+	}
+
+}
+
+func TestPeerProcess(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_peer_process.sock"
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("TestPeerProcess: could not resolve the test binary: %s", err.Error())
+	}
+
+	records := &bytes.Buffer{}
+	srv, err := NewWithHandler(unixSockPath, HandlerFunc(func(ctx context.Context, req *Request) *unixsock.Response {
+		if req.Process == nil {
+			return unixsock.NewResponse().Failf("process not resolved")
+		}
+		return unixsock.NewResponse().OK().WithPayload(req.Process.Exe)
+	}), WithPeerProcess(), WithRecorder(record.NewRecorder(records)))
+	if err != nil {
+		t.Fatalf("TestPeerProcess: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestPeerProcess: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	// Handlers
+	resp, err := c.Call(context.Background(), "whoami", unixsock.Args{})
+	if err != nil || !resp.Succeeded() || resp.Payload != exe {
+		t.Fatalf("TestPeerProcess: expected the executable %s, got %v (%+v)", exe, err, resp)
+	}
+
+	// Connection statistics
+	if clients := srv.Clients(); len(clients) != 1 || clients[0].Process == nil || clients[0].Process.Exe != exe {
+		t.Errorf("TestPeerProcess: expected the process in the connection statistics, got %+v", clients)
+	}
+
+	// Recordings
+	rec := &record.Record{}
+	if err := json.Unmarshal(records.Bytes(), rec); err != nil || rec.Process == nil || rec.Process.Exe != exe {
+		t.Errorf("TestPeerProcess: expected the process in the recording, got %v (%s)", err, records.String())
+	}
+
+	// Processes that exited cannot be resolved
+	if _, err := (&unixsock.PeerCred{PID: 1 << 30}).Process(); err == nil {
+		t.Errorf("TestPeerProcess: expected an error for an unknown process")
+	}
+
+}
+
+func TestClients(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_clients.sock"
+
+	srv, err := NewWithHandler(unixSockPath, HandlerFunc(func(ctx context.Context, req *Request) *unixsock.Response {
+		stats, ok := ConnStatsFromContext(ctx)
+		if !ok {
+			return unixsock.NewResponse().Failf("no connection statistics")
+		}
+		if req.Cmd == "fail" {
+			return unixsock.NewResponse().Failf("failed")
+		}
+		return unixsock.NewResponse().OK().WithPayloadJSON(stats)
+	}))
+	if err != nil {
+		t.Fatalf("TestClients: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestClients: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	for _, cmd := range []string{"echo", "fail", "echo"} {
+		if _, err := c.Send(cmd, unixsock.Args{}, true, false); err != nil {
+			t.Fatalf("TestClients: could not send: %s", err.Error())
+		}
+	}
+
+	// Statistics seen by handlers
+	resp, err := c.Send("echo", unixsock.Args{}, true, false)
+	if err != nil {
+		t.Fatalf("TestClients: could not send: %s", err.Error())
+	}
+	own := ConnStats{}
+	if err := resp.PayloadJSON(&own); err != nil {
+		t.Fatalf("TestClients: malformed statistics: %s", err.Error())
+	}
+	if own.Received != 4 || own.Sent != 3 || own.Errors != 1 || own.InFlight != 1 || own.BytesReceived == 0 || own.BytesSent == 0 {
+		t.Errorf("TestClients: unexpected statistics of the own connection: %+v", own)
+	}
+	if own.Peer == nil || own.Peer.PID != int32(os.Getpid()) || own.Socket != unixSockPath {
+		t.Errorf("TestClients: expected the peer and socket of the connection, got %v at '%s'", own.Peer, own.Socket)
+	}
+
+	// Introspection
+	resp, err = c.Send("_sys.clients", unixsock.Args{}, true, false)
+	if err != nil {
+		t.Fatalf("TestClients: could not send: %s", err.Error())
+	}
+	var clients []ConnStats
+	if err := resp.PayloadJSON(&clients); err != nil {
+		t.Fatalf("TestClients: malformed client list: %s", err.Error())
+	}
+	if len(clients) != 1 || clients[0].ID != own.ID || clients[0].Received != 5 || clients[0].Sent != 4 {
+		t.Errorf("TestClients: unexpected client list: %+v", clients)
+	}
+
+	if listed := srv.Clients(); len(listed) != 1 || listed[0].Sent != 5 {
+		t.Errorf("TestClients: unexpected client list: %+v", listed)
+	}
+
+}
+
+func TestShutdownCleanup(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_cleanup.sock"
+	defer os.Remove(unixSockPath + ".lock")
+
+	srv, err := New(unixSockPath, fakeHandler, WithSocketMode(0600))
+	if err != nil {
+		t.Fatalf("TestShutdownCleanup: could not start server: %s", err.Error())
+	}
+
+	info, err := os.Lstat(unixSockPath)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("TestShutdownCleanup: expected a socket with permissions 0600, got %v (%v)", info, err)
+	}
+
+	// Stopping concurrently and repeatedly
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.Stop()
+		}()
+	}
+	wg.Wait()
+	srv.Shutdown(true, "again")
+
+	if _, err := os.Lstat(unixSockPath); !os.IsNotExist(err) {
+		t.Errorf("TestShutdownCleanup: socket left behind by Stop: %v", err)
+	}
+	if srv.Err() != nil {
+		t.Errorf("TestShutdownCleanup: unexpected error after Stop: %s", srv.Err())
+	}
+
+	// Sockets replaced by another process are left alone
+	srv, err = New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestShutdownCleanup: could not restart: %s", err.Error())
+	}
+	os.Remove(unixSockPath)
+	other, err := net.Listen("unix", unixSockPath)
+	if err != nil {
+		t.Fatalf("TestShutdownCleanup: could not listen: %s", err.Error())
+	}
+	defer other.Close()
+
+	srv.Stop()
+	if _, err := os.Lstat(unixSockPath); err != nil {
+		t.Errorf("TestShutdownCleanup: socket of another process removed by Stop: %s", err.Error())
+	}
+
+}
+
+func TestSealedArgs(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_sealed.sock"
+
+	sealer, err := unixsock.NewSealer(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatalf("TestSealedArgs: could not create sealer: %s", err.Error())
+	}
+
+	router := NewRouter()
+	router.Use(OpenSealed(sealer))
+	router.Register("login", TierReadOnly, func(cmd string, args unixsock.Args) *unixsock.Response {
+		if args["password"] != "hunter2" {
+			return unixsock.NewResponse().Failf("wrong password")
+		}
+		return unixsock.NewResponse().OK()
+	})
+
+	recording := &bytes.Buffer{}
+	srv, err := NewWithHandler(unixSockPath, router, WithRecorder(record.NewRecorder(recording)))
+	if err != nil {
+		t.Fatalf("TestSealedArgs: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestSealedArgs: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+	c.Use(client.SealArgs(sealer, "password"))
+
+	resp, err := c.Send("login", unixsock.Args{"user": "root", "password": "hunter2"}, true, false)
+	if err != nil || resp.Status != unixsock.STATUS_OK {
+		t.Fatalf("TestSealedArgs: expected the handler to see the plaintext, got %v (%v)", resp, err)
+	}
+	if strings.Contains(recording.String(), "hunter2") || !strings.Contains(recording.String(), "root") {
+		t.Errorf("TestSealedArgs: expected only the sealed argument to be hidden in the recording: %s", recording.String())
+	}
+
+	// Sealed with another key
+	other, _ := unixsock.NewSealer(bytes.Repeat([]byte{2}, 32))
+	foreign, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestSealedArgs: could not create client: %s", err.Error())
+	}
+	defer foreign.Quit()
+	foreign.Use(client.SealArgs(other, "password"))
+
+	resp, err = foreign.Send("login", unixsock.Args{"password": "hunter2"}, true, false)
+	if err != nil || resp.Meta[ErrorCodeMeta] != CodeUnsealable {
+		t.Errorf("TestSealedArgs: expected a foreign key to be rejected, got %v (%v)", resp, err)
+	}
+
+}
+
+func TestFilePassing(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_file_passing.sock"
+
+	stored, err := ioutil.TempFile("", "unixsock-test-")
+	if err != nil {
+		t.Fatalf("TestFilePassing: could not create file: %s", err.Error())
+	}
+	defer os.Remove(stored.Name())
+	stored.WriteString(strings.Repeat("f", 8<<10))
+	stored.Close()
+
+	router := NewRouter()
+	router.Register("big", TierReadOnly, func(cmd string, args unixsock.Args) *unixsock.Response {
+		fill, _ := args["fill"].(string)
+		return unixsock.NewResponse().OK().WithPayload(strings.Repeat(fill, 64<<10))
+	})
+	router.Register("small", TierReadOnly, func(cmd string, args unixsock.Args) *unixsock.Response {
+		return unixsock.NewResponse().OK().WithPayload("small")
+	})
+	router.Register("stored", TierReadOnly, func(cmd string, args unixsock.Args) *unixsock.Response {
+		f, err := os.Open(stored.Name())
+		if err != nil {
+			return unixsock.NewResponse().Fail(err)
+		}
+		return unixsock.NewResponse().OK().WithStream(f)
+	})
+	router.Register("stored.rw", TierReadOnly, func(cmd string, args unixsock.Args) *unixsock.Response {
+		f, err := os.OpenFile(stored.Name(), os.O_RDWR, 0)
+		if err != nil {
+			return unixsock.NewResponse().Fail(err)
+		}
+		f.Seek(2<<10, io.SeekStart)
+		return unixsock.NewResponse().OK().WithStream(f)
+	})
+
+	srv, err := NewWithHandler(unixSockPath, router, WithFilePassing(1024))
+	if err != nil {
+		t.Fatalf("TestFilePassing: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath, client.WithFilePassing())
+	if err != nil {
+		t.Fatalf("TestFilePassing: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	// readFile reads and closes the file passed along with a response
+	readFile := func(resp *unixsock.Response) string {
+		if resp == nil || resp.File == nil {
+			return ""
+		}
+		defer resp.File.Close()
+		content, _ := ioutil.ReadAll(resp.File)
+		return string(content)
+	}
+
+	// Concurrent calls receive their own files
+	var wg sync.WaitGroup
+	for _, fill := range []string{"a", "b", "c", "d"} {
+		wg.Add(1)
+		go func(fill string) {
+			defer wg.Done()
+			resp, err := c.Send("big", unixsock.Args{"fill": fill}, true, false)
+			if err != nil || resp.Payload != "" {
+				t.Errorf("TestFilePassing: expected the payload to be passed as a file, got %v", err)
+				return
+			}
+			if content := readFile(resp); content != strings.Repeat(fill, 64<<10) {
+				t.Errorf("TestFilePassing: wrong content of the file passed for '%s' (%d bytes)", fill, len(content))
+			}
+		}(fill)
+	}
+	wg.Wait()
+
+	// Files of regular files streamed by the handler are passed as they are
+	resp, err := c.Send("stored", unixsock.Args{}, true, false)
+	if err != nil || readFile(resp) != strings.Repeat("f", 8<<10) {
+		t.Errorf("TestFilePassing: expected the stored file to be passed, got %v", err)
+	}
+
+	// ... but read-only, from the offset of the handler's descriptor
+	resp, err = c.Send("stored.rw", unixsock.Args{}, true, false)
+	if err != nil || resp.File == nil {
+		t.Fatalf("TestFilePassing: expected the stored file to be passed, got %v", err)
+	}
+	if _, err := resp.File.Write([]byte("x")); err == nil {
+		t.Errorf("TestFilePassing: expected the passed file to be read-only")
+	}
+	if content := readFile(resp); content != strings.Repeat("f", 6<<10) {
+		t.Errorf("TestFilePassing: expected the file from the handler's offset, got %d bytes", len(content))
+	}
+
+	// Writers receive the content of the file
+	sink := &bytes.Buffer{}
+	if _, err := c.SendTo(context.Background(), "big", unixsock.Args{"fill": "s"}, sink); err != nil || sink.String() != strings.Repeat("s", 64<<10) {
+		t.Errorf("TestFilePassing: expected the passed payload in the writer, got %d bytes (%v)", sink.Len(), err)
+	}
+
+	// Small payloads are sent through the socket
+	if resp, err = c.Send("small", unixsock.Args{}, true, false); err != nil || resp.Payload != "small" || resp.File != nil {
+		t.Errorf("TestFilePassing: expected a small payload to be sent through the socket, got %v (%v)", resp, err)
+	}
+
+	// Clients not accepting files
+	plain, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestFilePassing: could not create client: %s", err.Error())
+	}
+	defer plain.Quit()
+
+	if resp, err = plain.Send("big", unixsock.Args{"fill": "p"}, true, false); err != nil || resp.File != nil || resp.Payload != strings.Repeat("p", 64<<10) {
+		t.Errorf("TestFilePassing: expected the payload to be sent through the socket, got %v", err)
+	}
+
+}
+
+func TestConnectionHandoff(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_handoff.sock"
+
+	srv, err := New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestConnectionHandoff: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	a, err := client.New(unixSockPath, client.WithTags(map[string]string{"owner": "a"}), client.WithFrameHeader(true))
+	if err != nil {
+		t.Fatalf("TestConnectionHandoff: could not create client: %s", err.Error())
+	}
+	defer a.Quit()
+
+	if _, err := a.Send("ping", unixsock.Args{}, true, false); err != nil {
+		t.Fatalf("TestConnectionHandoff: could not send: %s", err.Error())
+	}
+
+	conn, state := a.Detach()
+	if conn == nil || !state.FrameHeader || state.Path != unixSockPath {
+		t.Fatalf("TestConnectionHandoff: expected a detached connection, got %v (%+v)", conn, state)
+	}
+
+	// Events sent while nobody reads wait on the connection
+	if n := srv.BroadcastTo(Selector{"owner": "a"}, "queued", unixsock.Args{}); n != 1 {
+		t.Fatalf("TestConnectionHandoff: expected the detached connection to stay open, delivered to %d", n)
+	}
+
+	// Hand the descriptor over as if across an exec boundary
+	f, err := conn.(*unixsock.Conn).Conn.(*net.UnixConn).File()
+	if err != nil {
+		t.Fatalf("TestConnectionHandoff: could not get the descriptor: %s", err.Error())
+	}
+	conn.Close()
+	inherited, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("TestConnectionHandoff: could not rebuild the connection: %s", err.Error())
+	}
+
+	b, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestConnectionHandoff: could not create client: %s", err.Error())
+	}
+	defer b.Quit()
+
+	events := make(chan string, 10)
+	b.OnEvent(func(cmd string, args unixsock.Args) {
+		events <- cmd
+	})
+
+	if err := b.Attach(inherited, state); err != nil {
+		t.Fatalf("TestConnectionHandoff: could not attach: %s", err.Error())
+	}
+
+	select {
+	case cmd := <-events:
+		if cmd != "queued" {
+			t.Errorf("TestConnectionHandoff: expected the queued event, got '%s'", cmd)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("TestConnectionHandoff: queued event never received")
+	}
+
+	// The server sees the same connection, with its tags
+	if _, err := b.Send("ping", unixsock.Args{}, true, false); err != nil {
+		t.Errorf("TestConnectionHandoff: could not send over the attached connection: %s", err.Error())
+	}
+	if n := srv.BroadcastTo(Selector{"owner": "a"}, "live", unixsock.Args{}); n != 1 {
+		t.Errorf("TestConnectionHandoff: expected the tags to stay with the connection, delivered to %d", n)
+	}
+	select {
+	case cmd := <-events:
+		if cmd != "live" {
+			t.Errorf("TestConnectionHandoff: expected the live event, got '%s'", cmd)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("TestConnectionHandoff: live event never received")
+	}
+
+	// The detaching client dials a new connection
+	if _, err := a.Send("ping", unixsock.Args{}, true, false); err != nil {
+		t.Errorf("TestConnectionHandoff: expected the detaching client to remain usable: %s", err.Error())
+	}
+
+	other, err := client.New(unixSockPath + ".other")
+	if err != nil {
+		t.Fatalf("TestConnectionHandoff: could not create client: %s", err.Error())
+	}
+	defer other.Quit()
+	if conn, _ := other.Detach(); conn != nil {
+		t.Errorf("TestConnectionHandoff: expected nothing to detach from an unconnected client")
+	}
+	if err := other.Attach(inherited, state); err == nil {
+		t.Errorf("TestConnectionHandoff: expected a connection to another socket to be refused")
+	}
+
+}
+
+func TestResponseSigning(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_signing.sock"
+
+	signer, err := unixsock.NewSigner(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatalf("TestResponseSigning: could not create signer: %s", err.Error())
+	}
+
+	router := NewRouter()
+	router.Register("greet", TierReadOnly, func(cmd string, args unixsock.Args) *unixsock.Response {
+		return unixsock.NewResponse().OK().WithPayload("hello").WithMeta("lang", "en")
+	})
+	router.Register("dump", TierReadOnly, func(cmd string, args unixsock.Args) *unixsock.Response {
+		return unixsock.NewResponse().OK().WithStream(strings.NewReader(strings.Repeat("x", 100<<10)))
+	})
+
+	srv, err := NewWithHandler(unixSockPath, router, WithResponseSigning(signer))
+	if err != nil {
+		t.Fatalf("TestResponseSigning: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestResponseSigning: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+	c.Use(client.VerifyResponses(signer))
+
+	resp, err := c.Send("greet", unixsock.Args{}, true, false)
+	if err != nil || resp.Payload != "hello" || resp.Meta[unixsock.SignatureMeta] == "" {
+		t.Fatalf("TestResponseSigning: expected a verified response, got %v (%v)", resp, err)
+	}
+
+	// Streamed payloads, collected and written to a sink
+	if resp, err = c.Send("dump", unixsock.Args{}, true, false); err != nil || len(resp.Payload) != 100<<10 {
+		t.Errorf("TestResponseSigning: expected a verified streamed response, got %v", err)
+	}
+	sink := &bytes.Buffer{}
+	if _, err = c.SendTo(context.Background(), "dump", unixsock.Args{}, sink); err != nil || sink.Len() != 100<<10 {
+		t.Errorf("TestResponseSigning: expected a verified response streamed into the sink, got %v", err)
+	}
+
+	// Failures and reserved commands are signed as well
+	if resp, err = c.Send("unknown", unixsock.Args{}, true, false); err != nil || resp.Status != unixsock.STATUS_FAIL {
+		t.Errorf("TestResponseSigning: expected a verified failure, got %v (%v)", resp, err)
+	}
+	if _, err = c.Send("_sys.health", unixsock.Args{}, true, false); err != nil {
+		t.Errorf("TestResponseSigning: expected a verified reserved command, got %v", err)
+	}
+
+	// Verified with another key
+	other, _ := unixsock.NewSigner(bytes.Repeat([]byte{2}, 32))
+	foreign, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestResponseSigning: could not create client: %s", err.Error())
+	}
+	defer foreign.Quit()
+	foreign.Use(client.VerifyResponses(other))
+
+	if resp, err = foreign.Send("greet", unixsock.Args{}, true, false); err == nil || resp != nil {
+		t.Errorf("TestResponseSigning: expected a signature of another key to be rejected, got %v", resp)
+	}
+
+	// Unsigned responses
+	unsignedPath := os.Getenv("HOME") + "/_test_unsigned.sock"
+	unsigned, err := NewWithHandler(unsignedPath, router)
+	if err != nil {
+		t.Fatalf("TestResponseSigning: could not start server: %s", err.Error())
+	}
+	defer unsigned.Stop()
+
+	verifying, err := client.New(unsignedPath)
+	if err != nil {
+		t.Fatalf("TestResponseSigning: could not create client: %s", err.Error())
+	}
+	defer verifying.Quit()
+	verifying.Use(client.VerifyResponses(signer))
+
+	if _, err = verifying.Send("greet", unixsock.Args{}, true, false); err == nil || !strings.Contains(err.Error(), "not signed") {
+		t.Errorf("TestResponseSigning: expected an unsigned response to be rejected, got %v", err)
+	}
+
+	if _, err := unixsock.NewSigner([]byte("short")); err == nil {
+		t.Errorf("TestResponseSigning: expected a short key to be rejected")
+	}
+
+}
+
+func TestRecorderRedactor(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_redactor.sock"
+
+	recording := &bytes.Buffer{}
+	recorder := record.NewRecorder(recording, record.WithRedactor(unixsock.RedactKeys("password")))
+
+	srv, err := New(unixSockPath, func(cmd string, args unixsock.Args) *unixsock.Response {
+		return unixsock.NewResponse().Failf("wrong password '%s'", args["password"])
+	}, WithRecorder(recorder))
+	if err != nil {
+		t.Fatalf("TestRecorderRedactor: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestRecorderRedactor: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	resp, err := c.Send("login", unixsock.Args{"user": "root", "password": "hunter2"}, true, false)
+	if err != nil || !strings.Contains(resp.Error, "hunter2") {
+		t.Fatalf("TestRecorderRedactor: expected the response to be sent unredacted, got %v (%v)", resp, err)
+	}
+
+	recorded := recording.String()
+	rec, err := record.NewReader(recording).Next()
+	if err != nil {
+		t.Fatalf("TestRecorderRedactor: could not read the recording: %s", err.Error())
+	}
+	if strings.Contains(recorded, "hunter2") || rec.Args["password"] != unixsock.Redacted || rec.Args["user"] != "root" {
+		t.Errorf("TestRecorderRedactor: secret not redacted in the recording: %+v", rec)
+	}
+
+}
+
+func TestCircuitBreakerCancellation(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_breaker_cancel.sock"
+
+	srv, err := New(unixSockPath, func(cmd string, args unixsock.Args) *unixsock.Response {
+		if cmd == "slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return &unixsock.Response{Status: unixsock.STATUS_OK}
+	})
+	if err != nil {
+		t.Fatalf("TestCircuitBreakerCancellation: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	breaker := client.NewCircuitBreaker(1, time.Hour, nil)
+	c, err := client.New(unixSockPath, client.WithCircuitBreaker(breaker))
+	if err != nil {
+		t.Fatalf("TestCircuitBreakerCancellation: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	// Calls given up by the caller are not failures of the server
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.Call(ctx, "slow", unixsock.Args{}); err == nil {
+		t.Fatalf("TestCircuitBreakerCancellation: expected the call to time out")
+	}
+	if state := breaker.State(); state != client.BreakerClosed {
+		t.Errorf("TestCircuitBreakerCancellation: cancelled call changed the breaker to %s", state)
+	}
+	if resp, err := c.Call(context.Background(), "echo", unixsock.Args{}); err != nil || !resp.Succeeded() {
+		t.Errorf("TestCircuitBreakerCancellation: expected the call to succeed, got %v (%v)", resp, err)
+	}
+
+}
+
+func TestAdaptiveTimeout(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_adaptive.sock"
+
+	var delay int64
+	srv, err := New(unixSockPath, func(cmd string, args unixsock.Args) *unixsock.Response {
+		time.Sleep(time.Duration(atomic.LoadInt64(&delay)))
+		return unixsock.NewResponse().OK()
+	}, WithConcurrentPerConn(4))
+	if err != nil {
+		t.Fatalf("TestAdaptiveTimeout: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	adaptive := client.NewAdaptiveTimeout(3, 20*time.Millisecond, 2*time.Second)
+	c, err := client.New(unixSockPath, client.WithAdaptiveTimeout(adaptive))
+	if err != nil {
+		t.Fatalf("TestAdaptiveTimeout: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	for i := 0; i < 10; i++ {
+		if _, err := c.Send("ping", unixsock.Args{}, true, false); err != nil {
+			t.Fatalf("TestAdaptiveTimeout: could not send: %s", err.Error())
+		}
+	}
+	if timeout, ok := adaptive.Timeout("ping"); !ok || timeout != 20*time.Millisecond {
+		t.Errorf("TestAdaptiveTimeout: expected the minimum timeout for a fast command, got %s (%t)", timeout, ok)
+	}
+	if _, ok := adaptive.Timeout("dump"); ok {
+		t.Errorf("TestAdaptiveTimeout: expected no timeout for an unobserved command")
+	}
+
+	// A slow command times out early, after which its timeout grows back
+	atomic.StoreInt64(&delay, int64(100*time.Millisecond))
+	started := time.Now()
+	if _, err := c.Send("ping", unixsock.Args{}, true, false); err == nil || time.Since(started) > time.Second {
+		t.Errorf("TestAdaptiveTimeout: expected an early timeout, got %v after %s", err, time.Since(started))
+	}
+
+	recovered := false
+	for i := 0; i < 5 && !recovered; i++ {
+		_, err := c.Send("ping", unixsock.Args{}, true, false)
+		recovered = err == nil
+	}
+	if !recovered {
+		t.Errorf("TestAdaptiveTimeout: timeout did not adapt to the slower command")
+	}
+	if ewma, p99 := adaptive.Latency("ping"); ewma <= 0 || p99 < 60*time.Millisecond {
+		t.Errorf("TestAdaptiveTimeout: unexpected latencies: average %s, p99 %s", ewma, p99)
+	}
+
+}
+
+func TestInlineConnections(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_inline.sock"
+
+	srv, err := New(unixSockPath, fakeHandler, WithInlineConnections(), WithDispatchQueue(2, 8))
+	if err != nil {
+		t.Fatalf("TestInlineConnections: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	// Per-request clients
+	for i := 0; i < 3; i++ {
+		c, err := client.New(unixSockPath)
+		if err != nil {
+			t.Fatalf("TestInlineConnections: could not create client: %s", err.Error())
+		}
+		if _, err := c.Send("ping", unixsock.Args{}, true, true); err != nil {
+			t.Errorf("TestInlineConnections: could not send: %s", err.Error())
+		}
+		c.Quit()
+	}
+
+	// Connections are served one at a time
+	first, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestInlineConnections: could not create client: %s", err.Error())
+	}
+	if _, err := first.Send("ping", unixsock.Args{}, true, false); err != nil {
+		t.Fatalf("TestInlineConnections: could not send: %s", err.Error())
+	}
+
+	second, err := client.New(unixSockPath, client.WithTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("TestInlineConnections: could not create client: %s", err.Error())
+	}
+	defer second.Quit()
+	if _, err := second.Send("ping", unixsock.Args{}, true, false); err == nil {
+		t.Errorf("TestInlineConnections: expected the second connection to wait for the first one")
+	}
+
+	first.Quit()
+	if _, err := second.Send("ping", unixsock.Args{}, true, false); err != nil {
+		t.Errorf("TestInlineConnections: second connection not served after the first one: %s", err.Error())
+	}
+
+	if stats := srv.QueueStats(); stats != (QueueStats{}) {
+		t.Errorf("TestInlineConnections: expected the dispatch queue to be bypassed, got %+v", stats)
+	}
+
+}
+
+// benchmarkConnections measures a per-request client: connecting, sending a
+// single command and disconnecting
+func benchmarkConnections(b *testing.B, opts ...Option) {
+
+	unixSockPath := os.Getenv("HOME") + "/_bench_conns.sock"
+
+	srv, err := New(unixSockPath, fakeHandler, opts...)
+	if err != nil {
+		b.Fatalf("could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c, err := client.New(unixSockPath)
+		if err != nil {
+			b.Fatalf("could not create client: %s", err.Error())
+		}
+		if _, err := c.Send("ping", unixsock.Args{}, true, true); err != nil {
+			b.Fatalf("could not send: %s", err.Error())
+		}
+		c.Quit()
+	}
+}
+
+func BenchmarkConnections(b *testing.B) {
+	benchmarkConnections(b)
+}
+
+func BenchmarkInlineConnections(b *testing.B) {
+	benchmarkConnections(b, WithInlineConnections())
+}
+
+// BenchmarkConnectionBurst measures bursts of per-request clients, with
+// connections served right from the accept loop and, for comparison, handed
+// to a single dispatcher goroutine (the former accept loop)
+func BenchmarkConnectionBurst(b *testing.B) {
+	b.Run("accept", func(b *testing.B) {
+		benchmarkConnectionBurst(b)
+	})
+	b.Run("dispatcher", func(b *testing.B) {
+		benchmarkConnectionBurst(b, withAcceptDispatcher())
+	})
+}
+
+func benchmarkConnectionBurst(b *testing.B, opts ...Option) {
+
+	unixSockPath := os.Getenv("HOME") + "/_bench_burst.sock"
+
+	srv, err := New(unixSockPath, fakeHandler, opts...)
+	if err != nil {
+		b.Fatalf("could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c, err := client.New(unixSockPath)
+			if err != nil {
+				b.Errorf("could not create client: %s", err.Error())
+				return
+			}
+			_, err = c.Send("ping", unixsock.Args{}, true, true)
+			c.Quit()
+			if err != nil {
+				b.Errorf("could not send: %s", err.Error())
+				return
+			}
+		}
+	})
+}
+
+// lockedBuffer is a buffer safe for concurrent use
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// Write appends p to the buffer
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// String returns the contents of the buffer
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDebugDump(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_dump.sock"
+
+	serverDump, clientDump := &lockedBuffer{}, &lockedBuffer{}
+	dumped := int32(0)
+	srv, err := New(unixSockPath, fakeHandler, WithDebugDump(serverDump), WithDebugDumpFilter(func(peer *unixsock.PeerCred) bool {
+		// Only the first connection is dumped
+		return atomic.AddInt32(&dumped, 1) == 1
+	}))
+	if err != nil {
+		t.Fatalf("TestDebugDump: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath, client.WithDebugDump(clientDump))
+	if err != nil {
+		t.Fatalf("TestDebugDump: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	if _, err := c.Send("dumped.cmd", unixsock.Args{}, true, false); err != nil {
+		t.Fatalf("TestDebugDump: could not send: %s", err.Error())
+	}
+
+	other, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestDebugDump: could not create client: %s", err.Error())
+	}
+	defer other.Quit()
+	if _, err := other.Send("hidden.cmd", unixsock.Args{}, true, false); err != nil {
+		t.Fatalf("TestDebugDump: could not send: %s", err.Error())
+	}
+
+	// Request and response on both sides
+	for side, dump := range map[string]string{"server": serverDump.String(), "client": clientDump.String()} {
+		if !strings.Contains(dump, "<<< ") || !strings.Contains(dump, ">>> ") || !strings.Contains(dump, "dumped.c") {
+			t.Errorf("TestDebugDump: expected both directions in the %s dump:\n%s", side, dump)
+		}
+	}
+	if !strings.Contains(serverDump.String(), "conn 1 (") {
+		t.Errorf("TestDebugDump: expected the connection label in the dump:\n%s", serverDump.String())
+	}
+	if strings.Contains(serverDump.String(), "hidden.c") {
+		t.Errorf("TestDebugDump: filtered connection dumped:\n%s", serverDump.String())
+	}
+
+}
+
+func TestProfiling(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_profiling.sock"
+
+	srv, err := New(unixSockPath, fakeHandler)
+	if err != nil {
+		t.Fatalf("TestProfiling: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath, client.WithTimeout(10*time.Second))
+	if err != nil {
+		t.Fatalf("TestProfiling: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	profile := func(args unixsock.Args) ([]byte, *unixsock.Response) {
+		buf := &bytes.Buffer{}
+		resp, err := c.SendTo(context.Background(), "_sys.pprof", args, buf)
+		if err != nil {
+			t.Fatalf("TestProfiling: could not send: %s", err.Error())
+		}
+		return buf.Bytes(), resp
+	}
+
+	// Text format
+	goroutines, resp := profile(unixsock.Args{"debug": 1})
+	if !resp.Succeeded() || resp.Meta["profile"] != "goroutine" || !bytes.Contains(goroutines, []byte("goroutine profile:")) {
+		t.Errorf("TestProfiling: expected the goroutine profile, got %v: %q", resp, goroutines)
+	}
+
+	// Binary (gzipped protobuf) profiles
+	for _, args := range []unixsock.Args{{"profile": "heap"}, {"profile": "cpu", "seconds": 1}} {
+		data, resp := profile(args)
+		if !resp.Succeeded() || len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+			t.Errorf("TestProfiling: expected a gzipped %s profile, got %v (%d bytes)", args["profile"], resp, len(data))
+		}
+	}
+
+	if _, resp := profile(unixsock.Args{"profile": "nonexistent"}); resp.Succeeded() {
+		t.Errorf("TestProfiling: expected unknown profiles to fail")
+	}
+	if _, resp := profile(unixsock.Args{"profile": "cpu", "seconds": 3600}); resp.Succeeded() {
+		t.Errorf("TestProfiling: expected overly long CPU profiles to fail")
+	}
+
+	// Cancelled CPU profiles are stopped right away, so that the next one
+	// can start
+	cancelling, err := client.New(unixSockPath, client.WithCancellation())
+	if err != nil {
+		t.Fatalf("TestProfiling: could not create client: %s", err.Error())
+	}
+	defer cancelling.Quit()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	cancelling.SendTo(ctx, "_sys.pprof", unixsock.Args{"profile": "cpu", "seconds": 60}, ioutil.Discard)
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	if data, resp := profile(unixsock.Args{"profile": "cpu", "seconds": 1}); !resp.Succeeded() || len(data) == 0 {
+		t.Errorf("TestProfiling: CPU profile still running after cancellation: %v", resp)
+	}
+
+	// Published variables
+	resp, err = c.Send("_sys.expvar", unixsock.Args{}, true, false)
+	if err != nil {
+		t.Fatalf("TestProfiling: could not send: %s", err.Error())
+	}
+	vars := map[string]json.RawMessage{}
+	if err := resp.PayloadJSON(&vars); err != nil {
+		t.Fatalf("TestProfiling: malformed variables: %s", err.Error())
+	}
+	for _, name := range []string{"memstats", "cmdline"} {
+		if _, ok := vars[name]; !ok {
+			t.Errorf("TestProfiling: expected %s among the variables, got %d variables", name, len(vars))
+		}
+	}
+
+	// The server does not publish expvar's handler by importing it
+	req, _ := http.NewRequest(http.MethodGet, expvarPath, nil)
+	if _, pattern := http.DefaultServeMux.Handler(req); pattern == expvarPath {
+		t.Errorf("TestProfiling: %s registered on http.DefaultServeMux", expvarPath)
+	}
+
+}
+
+func TestCommandHelp(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_command_help.sock"
+
+	units := NewRouter()
+	units.Register("restart", TierMutating, fakeHandler)
+	units.Declare("restart", Schema{Required: []string{"unit"}, Types: map[string]string{"unit": "string"}})
+	if err := units.Describe("restart", Help{
+		Usage:    "Restarts a unit",
+		Args:     map[string]string{"unit": "name of the unit"},
+		Examples: []string{"unit.restart unit=nginx.service"},
+	}); err != nil {
+		t.Fatalf("TestCommandHelp: could not describe command: %s", err.Error())
+	}
+	units.Alias("reload", "restart")
+	units.Deprecate("reload", "")
+
+	router := NewRouter()
+	router.Register("ping", TierReadOnly, fakeHandler)
+	router.Mount("unit.", units)
+
+	if err := router.Describe("unknown", Help{}); err == nil {
+		t.Errorf("TestCommandHelp: expected an error for an unknown command")
+	}
+
+	// Help survives later schema declarations
+	router.Describe("ping", Help{Usage: "Checks the liveness"})
+	router.Declare("ping", Schema{Strict: true})
+
+	srv, err := NewWithHandler(unixSockPath, router)
+	if err != nil {
+		t.Fatalf("TestCommandHelp: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestCommandHelp: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	commands := func(args unixsock.Args) ([]CommandInfo, *unixsock.Response) {
+		resp, err := c.Send("_sys.commands", args, true, false)
+		if err != nil {
+			t.Fatalf("TestCommandHelp: could not send: %s", err.Error())
+		}
+		var commands []CommandInfo
+		if resp.Succeeded() {
+			if err := resp.PayloadJSON(&commands); err != nil {
+				t.Fatalf("TestCommandHelp: malformed command list: %s", err.Error())
+			}
+		}
+		return commands, resp
+	}
+
+	all, _ := commands(unixsock.Args{})
+	if len(all) != 2 || all[0].Name != "ping" || all[0].Help == nil || all[0].Help.Usage != "Checks the liveness" || all[0].Schema == nil || !all[0].Schema.Strict {
+		t.Fatalf("TestCommandHelp: unexpected command list: %+v", all)
+	}
+
+	restart := all[1]
+	if restart.Name != "unit.restart" || restart.Tier != "mutating" || !reflect.DeepEqual(restart.Aliases, []string{"unit.reload"}) || restart.Deprecated {
+		t.Errorf("TestCommandHelp: unexpected description of unit.restart: %+v", restart)
+	}
+	if restart.Help == nil || restart.Help.Args["unit"] != "name of the unit" || len(restart.Help.Examples) != 1 || restart.Schema.Types["unit"] != "string" {
+		t.Errorf("TestCommandHelp: unexpected help of unit.restart: %+v", restart.Help)
+	}
+
+	// Single commands, also by alias
+	if single, _ := commands(unixsock.Args{"cmd": "unit.reload"}); len(single) != 1 || single[0].Name != "unit.restart" {
+		t.Errorf("TestCommandHelp: expected unit.restart, got %+v", single)
+	}
+	if _, resp := commands(unixsock.Args{"cmd": "unit.stop"}); resp.Succeeded() {
+		t.Errorf("TestCommandHelp: expected unknown commands to fail")
+	}
+
+}
+
+func TestWarmup(t *testing.T) {
+
+	paths := []string{os.Getenv("HOME") + "/_test_warmup_1.sock", os.Getenv("HOME") + "/_test_warmup_2.sock"}
+	servers := make([]UnixSockSrv, len(paths))
+	for i, path := range paths {
+		srv, err := New(path, fakeHandler)
+		if err != nil {
+			t.Fatalf("TestWarmup: could not start server: %s", err.Error())
+		}
+		defer srv.Stop()
+		servers[i] = srv
+	}
+
+	// Servers track connections right after accepting them
+	clients := func(srv UnixSockSrv, n int) bool {
+		deadline := time.Now().Add(time.Second)
+		for len(srv.Clients()) != n {
+			if time.Now().After(deadline) {
+				return false
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return true
+	}
+
+	var connects int32
+	c, err := client.New(paths[0], client.WithStateCallback(func(state client.ConnState, err error) {
+		if state == client.StateConnected {
+			atomic.AddInt32(&connects, 1)
+		}
+	}))
+	if err != nil {
+		t.Fatalf("TestWarmup: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	if n, err := c.Warmup(context.Background(), 4); err != nil || n != 1 {
+		t.Fatalf("TestWarmup: expected a single connection, got %d (%v)", n, err)
+	}
+	if !clients(servers[0], 1) {
+		t.Errorf("TestWarmup: expected the server to see the connection before the first call")
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.Send("hello.world", unixsock.Args{}, true, false); err != nil {
+			t.Fatalf("TestWarmup: could not send: %s", err.Error())
+		}
+	}
+	if n := atomic.LoadInt32(&connects); n != 1 {
+		t.Errorf("TestWarmup: expected calls to reuse the warm connection, got %d connects", n)
+	}
+
+	// Multi-clients connect to several servers, reporting unreachable ones
+	multi, err := client.NewMulti(append(paths, os.Getenv("HOME")+"/_test_warmup_missing.sock"), client.RoundRobin)
+	if err != nil {
+		t.Fatalf("TestWarmup: could not create multi-client: %s", err.Error())
+	}
+	defer multi.Quit()
+
+	if n, err := multi.Warmup(context.Background(), 2); err != nil || n != 2 {
+		t.Errorf("TestWarmup: expected two connections, got %d (%v)", n, err)
+	}
+	if n, err := multi.Warmup(context.Background(), 10); err == nil || n != 2 {
+		t.Errorf("TestWarmup: expected the missing server to fail, got %d (%v)", n, err)
+	}
+	for i, srv := range servers {
+		if !clients(srv, 2-i) {
+			t.Errorf("TestWarmup: expected server %d to have %d clients, got %d", i+1, 2-i, len(srv.Clients()))
+		}
+	}
+
+}
+
+// credTransport listens on unix sockets, attaching fake credentials to
+// every accepted connection
+type credTransport struct {
+	unixsock.NetTransport
+	cred *unixsock.PeerCred
+}
+
+func (t *credTransport) Listen(address string) (net.Listener, error) {
+	l, err := t.NetTransport.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	return &credListener{Listener: l, cred: t.cred}, nil
+}
+
+type credListener struct {
+	net.Listener
+	cred *unixsock.PeerCred
+}
+
+func (l *credListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &unixsock.CredConn{Conn: c, Cred: l.cred}, nil
+}
+
+func TestCredConn(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_cred_conn.sock"
+	transport := &credTransport{NetTransport: unixsock.NetTransport{Network: "unix"}, cred: &unixsock.PeerCred{PID: 1, UID: 4242, GID: 4242}}
+
+	// Only the fake user may execute commands
+	policy := NewPolicy(TierNone).AllowUID(4242, TierAdmin)
+	srv, err := NewWithHandler(unixSockPath, HandlerFunc(func(ctx context.Context, req *Request) *unixsock.Response {
+		return unixsock.NewResponse().OK().WithPayload(req.Peer.String())
+	}), WithTransport(transport), WithPolicy(policy, func(cmd string) Tier { return TierAdmin }))
+	if err != nil {
+		t.Fatalf("TestCredConn: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestCredConn: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	resp, err := c.Call(context.Background(), "whoami", unixsock.Args{})
+	if err != nil || !resp.Succeeded() || resp.Payload != "pid=1 uid=4242 gid=4242" {
+		t.Errorf("TestCredConn: expected the fake credentials, got %v (%+v)", err, resp)
+	}
+
+	if _, err := unixsock.PeerCreds(&unixsock.CredConn{}); err == nil {
+		t.Errorf("TestCredConn: expected an error for a connection without credentials")
+	}
+
+}
+
+func TestForward(t *testing.T) {
+
+	frontPath := os.Getenv("HOME") + "/_test_forward_front.sock"
+	backendPath := os.Getenv("HOME") + "/_test_forward_backend.sock"
+
+	cancelled := make(chan struct{}, 1)
+	backend, err := NewWithHandler(backendPath, HandlerFunc(func(ctx context.Context, req *Request) *unixsock.Response {
+		if req.Cmd == "billing.slow" {
+			select {
+			case <-ctx.Done():
+				cancelled <- struct{}{}
+			case <-time.After(5 * time.Second):
+			}
+			return unixsock.NewResponse().Failf("cancelled")
+		}
+		return unixsock.NewResponse().OK().WithPayloadJSON(map[string]interface{}{
+			"cmd":     req.Cmd,
+			"args":    req.Args,
+			"meta":    req.Meta,
+			"peer":    ForwardedPeer(req),
+			"expires": !req.Expires.IsZero(),
+		})
+	}))
+	if err != nil {
+		t.Fatalf("TestForward: could not start backend: %s", err.Error())
+	}
+	defer backend.Stop()
+
+	front, err := New(frontPath, func(cmd string, args unixsock.Args) *unixsock.Response {
+		return unixsock.NewResponse().OK().WithPayload("front")
+	})
+	if err != nil {
+		t.Fatalf("TestForward: could not start front: %s", err.Error())
+	}
+	defer front.Stop()
+
+	if err := front.Forward("[", backendPath); err == nil {
+		t.Errorf("TestForward: expected an invalid pattern to fail")
+	}
+	if err := front.Forward("billing.*", backendPath); err != nil {
+		t.Fatalf("TestForward: could not forward: %s", err.Error())
+	}
+
+	c, err := client.New(frontPath, client.WithCancellation())
+	if err != nil {
+		t.Fatalf("TestForward: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	// Commands not matching the pattern are served by the front
+	resp, err := c.Call(context.Background(), "status", unixsock.Args{})
+	if err != nil || resp.Payload != "front" {
+		t.Fatalf("TestForward: expected the front to respond, got %v (%v)", resp, err)
+	}
+
+	resp, err = c.Call(context.Background(), "billing.charge", unixsock.Args{"amount": "10"},
+		client.WithCallMeta("trace", "abc"),
+		client.WithCallTTL(time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("TestForward: could not call: %s", err.Error())
+	}
+	forwarded := struct {
+		Cmd     string
+		Args    map[string]interface{}
+		Meta    map[string]string
+		Peer    *unixsock.PeerCred
+		Expires bool
+	}{}
+	if err := resp.PayloadJSON(&forwarded); err != nil {
+		t.Fatalf("TestForward: malformed payload %q: %s", resp.Payload, err.Error())
+	}
+	if forwarded.Cmd != "billing.charge" || forwarded.Args["amount"] != "10" || !forwarded.Expires {
+		t.Errorf("TestForward: unexpected forwarded request: %+v", forwarded)
+	}
+	if id, err := strconv.ParseUint(forwarded.Meta[ForwardedIDMeta], 10, 64); err != nil || id == 0 || forwarded.Meta["trace"] != "abc" {
+		t.Errorf("TestForward: unexpected metadata: %v", forwarded.Meta)
+	}
+	if forwarded.Peer == nil || forwarded.Peer.PID != int32(os.Getpid()) {
+		t.Errorf("TestForward: expected the original peer, got %v", forwarded.Peer)
+	}
+
+	// Cancellations reach the target
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.Call(ctx, "billing.slow", unixsock.Args{}); err == nil {
+		t.Errorf("TestForward: expected the call to time out")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Errorf("TestForward: forwarded command not cancelled")
+	}
+
+}
+
+func TestCloseReasons(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_close.sock"
+
+	handler := func(cmd string, args unixsock.Args) *unixsock.Response {
+		return &unixsock.Response{Status: unixsock.STATUS_OK}
+	}
+
+	// disconnect connects a client and waits for its connection to end
+	disconnect := func(name string, call bool, opts ...Option) *client.Disconnect {
+		srv, err := New(unixSockPath, handler, opts...)
+		if err != nil {
+			t.Fatalf("TestCloseReasons: %s: could not start server: %s", name, err.Error())
+		}
+		defer srv.Stop()
+
+		c, err := client.New(unixSockPath)
+		if err != nil {
+			t.Fatalf("TestCloseReasons: %s: could not create client: %s", name, err.Error())
+		}
+		defer c.Quit()
+
+		disconnects := make(chan *client.Disconnect, 1)
+		c.OnDisconnect(func(d *client.Disconnect) {
+			select {
+			case disconnects <- d:
+			default:
+			}
+		})
+		if _, err := c.Warmup(context.Background(), 1); err != nil {
+			t.Fatalf("TestCloseReasons: %s: could not connect: %s", name, err.Error())
+		}
+		if call {
+			c.Send("blob", unixsock.Args{"blob": strings.Repeat("x", 2<<20)}, true, false)
+		}
+
+		select {
+		case d := <-disconnects:
+			return d
+		case <-time.After(2 * time.Second):
+			t.Fatalf("TestCloseReasons: %s: connection not closed", name)
+		}
+		return nil
+	}
+
+	if d := disconnect("idle", false, WithReceiveTimeout(0), WithIdleTimeout(50*time.Millisecond)); d.Reason != unixsock.CloseIdleTimeout {
+		t.Errorf("TestCloseReasons: expected reason '%s' for an idle connection, got: %v", unixsock.CloseIdleTimeout, d)
+	}
+	if d := disconnect("receive timeout", false, WithReceiveTimeout(50*time.Millisecond)); d.Reason != unixsock.CloseIdleTimeout {
+		t.Errorf("TestCloseReasons: expected reason '%s' after the receive timeout, got: %v", unixsock.CloseIdleTimeout, d)
+	}
+	if d := disconnect("unauthorized", false, WithPolicy(NewPolicy(TierNone), nil)); d.Reason != unixsock.CloseUnauthorized || d.Err == nil {
+		t.Errorf("TestCloseReasons: expected reason '%s' for a peer without access, got: %v", unixsock.CloseUnauthorized, d)
+	}
+	if d := disconnect("too long", true); d.Reason != unixsock.CloseProtocolError || !strings.Contains(d.Message, "too long") {
+		t.Errorf("TestCloseReasons: expected reason '%s' for a message too long, got: %v", unixsock.CloseProtocolError, d)
+	}
+
+	// Connections closed by the client
+	srv, err := New(unixSockPath, handler)
+	if err != nil {
+		t.Fatalf("TestCloseReasons: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestCloseReasons: could not create client: %s", err.Error())
+	}
+	disconnects := make(chan *client.Disconnect, 1)
+	c.OnDisconnect(func(d *client.Disconnect) { disconnects <- d })
+	if _, err := c.Warmup(context.Background(), 1); err != nil {
+		t.Fatalf("TestCloseReasons: could not connect: %s", err.Error())
+	}
+	c.Quit()
+
+	select {
+	case d := <-disconnects:
+		if d.Reason != unixsock.CloseNormal || d.Err != nil {
+			t.Errorf("TestCloseReasons: expected reason '%s' after quitting, got: %v", unixsock.CloseNormal, d)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("TestCloseReasons: connection not closed after quitting")
+	}
+
+}
+
+func TestConfigValidation(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_config.sock"
+
+	// Defaults are valid
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Errorf("TestConfigValidation: expected the default server config to be valid, got: %s", err.Error())
+	}
+	if err := client.DefaultConfig().Validate(); err != nil {
+		t.Errorf("TestConfigValidation: expected the default client config to be valid, got: %s", err.Error())
+	}
+	if err := unixsock.DefaultConfig().Validate(); err != nil {
+		t.Errorf("TestConfigValidation: expected the default message config to be valid, got: %s", err.Error())
+	}
+
+	// Every problem is listed
+	config := DefaultConfig()
+	config.ReceiveTimeout = -time.Second
+	config.QueueCapacity = 10
+	config.ShedWatermark = 1.5
+	config.MessageSizes = []MessageSize{{Pattern: "upload[", Bytes: 0}}
+	err := config.Validate()
+	if configErr, ok := err.(*unixsock.ConfigError); !ok || len(configErr.Problems) != 6 {
+		t.Errorf("TestConfigValidation: expected 6 problems, got: %v", err)
+	}
+
+	// Misconfigured servers and clients fail at construction
+	if srv, err := New(unixSockPath, fakeHandler, WithDispatchQueue(-1, 0)); err == nil {
+		srv.Stop()
+		t.Errorf("TestConfigValidation: expected an error for negative workers")
+	}
+	if srv, err := New(unixSockPath, fakeHandler, config.Options()...); err == nil {
+		srv.Stop()
+		t.Errorf("TestConfigValidation: expected an error for an invalid config")
+	}
+	if _, err := client.New(unixSockPath, client.WithTimeout(-time.Second)); err == nil {
+		t.Errorf("TestConfigValidation: expected an error for a negative client timeout")
+	}
+
+	// Valid configs
+	config = DefaultConfig()
+	config.Workers, config.QueueCapacity, config.ShedWatermark = 2, 16, 0.8
+	srv, err := New(unixSockPath, fakeHandler, config.Options()...)
+	if err != nil {
+		t.Fatalf("TestConfigValidation: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	clientConfig := client.DefaultConfig()
+	clientConfig.Timeout = time.Second
+	c, err := client.New(unixSockPath, clientConfig.Options()...)
+	if err != nil {
+		t.Fatalf("TestConfigValidation: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	if resp, err := c.Send("config", unixsock.Args{}, true, false); err != nil || resp.Status != unixsock.STATUS_OK {
+		t.Errorf("TestConfigValidation: expected a successful call, got: %v, %v", resp, err)
+	}
+
+	// Reconfiguring is validated as well
+	if err := srv.Reconfigure(WithLoadShedding(2)); err == nil {
+		t.Errorf("TestConfigValidation: expected an error when reconfiguring with an invalid watermark")
+	}
+
+}
+
+func TestClientStats(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_client_stats.sock"
+
+	srv, err := New(unixSockPath, func(cmd string, args unixsock.Args) *unixsock.Response {
+		if cmd == "fail" {
+			return unixsock.NewResponse().Failf("failed")
+		}
+		return unixsock.NewResponse().OK()
+	})
+	if err != nil {
+		t.Fatalf("TestClientStats: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath, client.WithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("TestClientStats: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	for i := 0; i < 3; i++ {
+		c.Call(context.Background(), "ok", unixsock.Args{})
+	}
+	c.Call(context.Background(), "fail", unixsock.Args{})
+
+	stats := c.Stats()
+	if stats.Calls != 4 || stats.Statuses[unixsock.STATUS_OK] != 3 || stats.Statuses[unixsock.STATUS_FAIL] != 1 || stats.Failures != 0 {
+		t.Errorf("TestClientStats: expected 3 successful and 1 failed call, got: %+v", stats)
+	}
+	if stats.Dials != 1 || stats.Connections != 1 || stats.InFlight != 0 {
+		t.Errorf("TestClientStats: expected a single open connection and no calls in flight, got: %+v", stats)
+	}
+	if stats.Latency.Count != 4 || stats.Latency.Quantile(0.5) <= 0 || stats.Latency.Quantile(0.99) < stats.Latency.Quantile(0.5) {
+		t.Errorf("TestClientStats: expected 4 latencies, got: %+v", stats.Latency)
+	}
+
+	// Calls failing without a response
+	unreachable, err := client.New(unixSockPath+".missing", client.WithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("TestClientStats: could not create client: %s", err.Error())
+	}
+	defer unreachable.Quit()
+	if _, err := unreachable.Call(context.Background(), "ok", unixsock.Args{}); err == nil {
+		t.Fatalf("TestClientStats: expected an error for an unreachable server")
+	}
+
+	stats = unreachable.Stats()
+	if stats.Calls != 1 || stats.Failures != 1 || stats.DialErrors == 0 || stats.Connections != 0 || stats.Latency.Count != 0 {
+		t.Errorf("TestClientStats: expected a failed call and dial errors, got: %+v", stats)
+	}
+
+}
+
+func TestChaosTransport(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_chaos.sock"
+
+	// Faults that must not break the framing
+	transport := chaos.New(nil, chaos.Faults{
+		Latency:    0.2,
+		MaxLatency: 2 * time.Millisecond,
+		ShortRead:  0.5,
+		SplitWrite: 0.5,
+	}, 42)
+
+	srv, err := New(unixSockPath, func(cmd string, args unixsock.Args) *unixsock.Response {
+		return unixsock.NewResponse().OK().WithPayload(strings.Repeat(cmd, 100))
+	}, WithTransport(transport), WithReceiveTimeout(250*time.Millisecond))
+	if err != nil {
+		t.Fatalf("TestChaosTransport: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath, client.WithTransport(transport), client.WithTimeout(250*time.Millisecond))
+	if err != nil {
+		t.Fatalf("TestChaosTransport: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	for i := 0; i < 50; i++ {
+		cmd := fmt.Sprintf("cmd%d.", i)
+		resp, err := c.Call(context.Background(), cmd, unixsock.Args{"i": i})
+		if err != nil || resp.Payload != strings.Repeat(cmd, 100) {
+			t.Fatalf("TestChaosTransport: call %d failed despite harmless faults: %v (%+v)", i, err, resp)
+		}
+	}
+
+	counts := transport.Counts()
+	if counts.Delays == 0 || counts.ShortReads == 0 || counts.SplitWrites == 0 {
+		t.Errorf("TestChaosTransport: expected faults to be injected, got %+v", counts)
+	}
+
+	// Destructive faults make calls fail without hanging
+	transport.SetFaults(chaos.Faults{DropByte: 0.05, Close: 0.05})
+	failed := 0
+	for i := 0; i < 100; i++ {
+		if _, err := c.Call(context.Background(), "soak", unixsock.Args{}); err != nil {
+			failed++
+		}
+	}
+	if counts := transport.Counts(); failed == 0 || counts.DroppedBytes == 0 || counts.Closes == 0 {
+		t.Errorf("TestChaosTransport: expected failing calls, got %d (%+v)", failed, counts)
+	}
+
+	// The client recovers once the faults stop
+	transport.SetFaults(chaos.Faults{})
+	recovered := false
+	for i := 0; i < 10 && !recovered; i++ {
+		resp, err := c.Call(context.Background(), "recovered", unixsock.Args{})
+		recovered = err == nil && resp.Succeeded()
+	}
+	if !recovered {
+		t.Errorf("TestChaosTransport: client did not recover after the faults stopped")
+	}
+
+}
+
+func TestSoak(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_soak.sock"
+
+	// Open file descriptors (-1 if unknown)
+	openFDs := func() int {
+		fds, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			return -1
+		}
+		return len(fds)
+	}
+
+	// Waits for the goroutines and file descriptors to return to the
+	// baseline
+	leaks := func(goroutines, fds int) (int, int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			g, f := runtime.NumGoroutine()-goroutines, openFDs()-fds
+			if (g <= 0 && f <= 0) || time.Now().After(deadline) {
+				return g, f
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	handler := func(cmd string, args unixsock.Args) *unixsock.Response {
+		switch cmd {
+		case "stream":
+			return unixsock.NewResponse().OK().WithStream(strings.NewReader(strings.Repeat("x", 64<<10)))
+		case "slow":
+			time.Sleep(time.Millisecond)
+		case "fail":
+			return unixsock.NewResponse().Failf("failed")
+		}
+		return unixsock.NewResponse().OK().WithPayload(cmd)
+	}
+
+	rounds := []struct {
+		name        string
+		opts        []Option
+		serverFirst bool // Stop the server while the clients are busy
+	}{
+		{"clients first", nil, false},
+		{"server first", nil, true},
+		{"dispatch queue", []Option{WithDispatchQueue(4, 64), WithConcurrentPerConn(4)}, true},
+		{"no receive timeout", []Option{WithReceiveTimeout(0), WithEventHistory(16)}, true},
+	}
+
+	time.Sleep(100 * time.Millisecond) // Let earlier tests wind down
+	goroutines, fds := runtime.NumGoroutine(), openFDs()
+
+	for _, round := range rounds {
+
+		srv, err := New(unixSockPath, handler, round.opts...)
+		if err != nil {
+			t.Fatalf("TestSoak: %s: could not start server: %s", round.name, err.Error())
+		}
+
+		// Raw connections never closed by their peer
+		raw, err := net.Dial("unix", unixSockPath)
+		if err != nil {
+			t.Fatalf("TestSoak: %s: could not dial: %s", round.name, err.Error())
+		}
+
+		stop := make(chan struct{})
+		wg := &sync.WaitGroup{}
+		for i := 0; i < *soakClients; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				c, err := client.New(unixSockPath, client.WithTimeout(time.Second))
+				if err != nil {
+					t.Errorf("TestSoak: could not create client: %s", err.Error())
+					return
+				}
+				defer func() { c.Quit() }()
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				if i%2 == 0 {
+					events, err := c.Subscribe(ctx, "soak.*")
+					if err == nil {
+						go func() {
+							for range events {
+							}
+						}()
+					}
+				}
+
+				for n := 0; ; n++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+
+					switch n % 5 {
+					case 0:
+						c.SendTo(ctx, "stream", unixsock.Args{}, ioutil.Discard)
+					case 1:
+						c.Call(ctx, "slow", unixsock.Args{})
+					case 2:
+						c.Call(ctx, "fail", unixsock.Args{})
+					case 3:
+						callCtx, callCancel := context.WithTimeout(ctx, 100*time.Microsecond)
+						c.Call(callCtx, "slow", unixsock.Args{})
+						callCancel()
+					default:
+						// Reconnecting clients
+						if n%25 == 4 {
+							c.Quit()
+							redialed, err := client.New(unixSockPath, client.WithTimeout(time.Second))
+							if err != nil {
+								return
+							}
+							c = redialed
+						}
+						c.Call(ctx, "ping", unixsock.Args{})
+					}
+				}
+			}(i)
+		}
+
+		// Events
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-time.After(time.Millisecond):
+					srv.Broadcast("soak.tick", unixsock.Args{})
+				}
+			}
+		}()
+
+		time.Sleep(*soakDuration)
+		if round.serverFirst {
+			srv.Stop()
+			close(stop)
+			wg.Wait()
+		} else {
+			close(stop)
+			wg.Wait()
+			srv.Stop()
+		}
+
+		// The server closes its end of the raw connection as well
+		rawFDs := 0
+		if fds >= 0 {
+			rawFDs = 1
+		}
+		g, f := leaks(goroutines, fds+rawFDs)
+		raw.Close()
+		if g > 0 || f > 0 {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("TestSoak: %s: leaked %d goroutines and %d file descriptors:\n%s", round.name, g, f, buf[:runtime.Stack(buf, true)])
+		}
+	}
+
+}
+
+func TestSystemCommands(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_system_commands.sock"
+
+	// Every system command is registered
+	for _, cmd := range unixsock.SystemCommands() {
+		if _, registered := systemCommands[cmd]; !registered || !unixsock.IsReserved(cmd) {
+			t.Errorf("TestSystemCommands: system command '%s' is not registered", cmd)
+		}
+	}
+	if len(systemCommands) != len(unixsock.SystemCommands()) {
+		t.Errorf("TestSystemCommands: expected %d system commands, got %d", len(unixsock.SystemCommands()), len(systemCommands))
+	}
+
+	handler := func(cmd string, args unixsock.Args) *unixsock.Response {
+		return unixsock.NewResponse().OK().WithPayload("handler")
+	}
+
+	// call starts a server with opts and calls cmd
+	call := func(cmd string, opts []Option, clientOpts ...client.Option) (*unixsock.Response, error) {
+		srv, err := New(unixSockPath, handler, opts...)
+		if err != nil {
+			t.Fatalf("TestSystemCommands: could not start server: %s", err.Error())
+		}
+		defer srv.Stop()
+
+		c, err := client.New(unixSockPath, clientOpts...)
+		if err != nil {
+			t.Fatalf("TestSystemCommands: could not create client: %s", err.Error())
+		}
+		defer c.Quit()
+
+		if cmd == "" {
+			return nil, c.Ping(context.Background())
+		}
+		return c.Call(context.Background(), cmd, unixsock.Args{})
+	}
+
+	// The reserved namespace never reaches the handler
+	if resp, err := call("_sys.custom", nil); err != nil || resp.Succeeded() || !strings.Contains(resp.Error, "unknown system command") {
+		t.Errorf("TestSystemCommands: expected unknown reserved commands to fail, got %v (%+v)", err, resp)
+	}
+	if resp, err := call(unixsock.SysHealth, nil); err != nil || resp.Payload != "healthy" {
+		t.Errorf("TestSystemCommands: expected the health check, got %v (%+v)", err, resp)
+	}
+
+	// Moved to another namespace
+	prefixed := []Option{WithSystemPrefix("_admin.")}
+	if resp, err := call("_admin.health", prefixed); err != nil || resp.Payload != "healthy" {
+		t.Errorf("TestSystemCommands: expected the health check under the new prefix, got %v (%+v)", err, resp)
+	}
+	if resp, err := call(unixsock.SysHealth, prefixed); err != nil || resp.Payload != "handler" {
+		t.Errorf("TestSystemCommands: expected the handler to serve the old namespace, got %v (%+v)", err, resp)
+	}
+	if _, err := call("", append(prefixed, WithoutSystemCommands(unixsock.SysStats)), client.WithSystemPrefix("_admin.")); err != nil {
+		t.Errorf("TestSystemCommands: could not ping a server with another prefix: %s", err.Error())
+	}
+
+	// Disabled
+	if resp, err := call(unixsock.SysPprof, []Option{WithoutSystemCommands(unixsock.SysPprof)}); err != nil || resp.Succeeded() || !strings.Contains(resp.Error, "unknown system command") {
+		t.Errorf("TestSystemCommands: expected a disabled command to fail, got %v (%+v)", err, resp)
+	}
+	if _, err := call("", []Option{WithoutSystemCommands()}); err == nil {
+		t.Errorf("TestSystemCommands: expected pinging to fail without system commands")
+	}
+
+	// Misconfigured
+	if _, err := New(unixSockPath, handler, WithoutSystemCommands("_sys.bogus")); err == nil {
+		t.Errorf("TestSystemCommands: expected an error for an unknown system command")
+	}
+	if _, err := New(unixSockPath, handler, WithSystemPrefix("admin")); err == nil {
+		t.Errorf("TestSystemCommands: expected an error for a prefix without a dot")
+	}
+
+}
+
+func TestShutdownRefusal(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_shutdown_refusal.sock"
+
+	release := make(chan struct{})
+	handler := func(cmd string, args unixsock.Args) *unixsock.Response {
+		if cmd == "slow" {
+			<-release
+		}
+		return unixsock.NewResponse().OK()
+	}
+
+	// Commands received after the shutdown are refused
+	srv, err := New(unixSockPath, handler)
+	if err != nil {
+		t.Fatalf("TestShutdownRefusal: could not start server: %s", err.Error())
+	}
+	conn, err := net.Dial("unix", unixSockPath)
+	if err != nil {
+		t.Fatalf("TestShutdownRefusal: could not connect: %s", err.Error())
+	}
+	defer conn.Close()
+	if msg := unixsock.NewSender(conn, "echo", unixsock.Args{}, true, false); msg.Send() != nil || msg.Receive() != nil {
+		t.Fatalf("TestShutdownRefusal: connection not served")
+	}
+
+	srv.Stop()
+	if goAway := unixsock.NewReceiver(conn); goAway.Receive() != nil || goAway.GetCmd() != unixsock.SysGoAway {
+		t.Fatalf("TestShutdownRefusal: expected the goaway event")
+	}
+	msg := unixsock.NewSender(conn, "echo", unixsock.Args{}, true, false)
+	if err := msg.Send(); err != nil || msg.Receive() != nil {
+		t.Fatalf("TestShutdownRefusal: expected a response after the shutdown, got %v", err)
+	}
+	if resp := msg.GetResponse(); resp.Status != unixsock.StatusRetry || resp.Meta["reason"] != ShutdownReason {
+		t.Errorf("TestShutdownRefusal: expected the command to be refused, got %+v", resp)
+	}
+
+	// Clients can not redial a server that announced its shutdown
+	srv, err = New(unixSockPath, handler)
+	if err != nil {
+		t.Fatalf("TestShutdownRefusal: could not restart server: %s", err.Error())
+	}
+	goingAway := make(chan struct{}, 1)
+	c, err := client.New(unixSockPath, client.WithStateCallback(func(state client.ConnState, err error) {
+		if state == client.StateGoingAway {
+			goingAway <- struct{}{}
+		}
+	}))
+	if err != nil {
+		t.Fatalf("TestShutdownRefusal: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+	if _, err := c.Call(context.Background(), "echo", unixsock.Args{}); err != nil {
+		t.Fatalf("TestShutdownRefusal: could not call: %s", err.Error())
+	}
+
+	srv.Stop()
+	select {
+	case <-goingAway:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("TestShutdownRefusal: expected the client to be notified")
+	}
+	if _, err := c.Call(context.Background(), "echo", unixsock.Args{}); err != client.ErrServerShuttingDown {
+		t.Errorf("TestShutdownRefusal: expected %v after the shutdown, got %v", client.ErrServerShuttingDown, err)
+	}
+
+	// Queued commands are refused once the server stops
+	srv, err = New(unixSockPath, handler, WithDispatchQueue(1, 4))
+	if err != nil {
+		t.Fatalf("TestShutdownRefusal: could not restart server: %s", err.Error())
+	}
+	c, err = client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestShutdownRefusal: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	slow := make(chan error, 1)
+	go func() {
+		_, err := c.Call(context.Background(), "slow", unixsock.Args{})
+		slow <- err
+	}()
+	other, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestShutdownRefusal: could not create client: %s", err.Error())
+	}
+	defer other.Quit()
+	queued := make(chan error, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond) // Queued behind the slow command
+		resp, err := other.Call(context.Background(), "echo", unixsock.Args{})
+		if err == client.ErrServerShuttingDown && resp.Status != unixsock.StatusRetry {
+			err = fmt.Errorf("unexpected response %+v", resp)
+		}
+		queued <- err
+	}()
+	time.Sleep(150 * time.Millisecond)
+
+	srv.Stop()
+	if err := <-queued; err != client.ErrServerShuttingDown {
+		t.Errorf("TestShutdownRefusal: expected %v for the queued command, got %v", client.ErrServerShuttingDown, err)
+	}
+	close(release)
+	if err := <-slow; err != nil {
+		t.Errorf("TestShutdownRefusal: expected the running command to complete, got %v", err)
+	}
+
+}
+
+func TestNotify(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_notify.sock"
+
+	var mu sync.Mutex
+	value := 0
+	handler := func(cmd string, args unixsock.Args) *unixsock.Response {
+		switch cmd {
+		case "set":
+			time.Sleep(5 * time.Millisecond) // Slower than reading the next message
+			n, _ := args["value"].(float64)
+			mu.Lock()
+			value = int(n)
+			mu.Unlock()
+			return nil
+		case "get":
+			mu.Lock()
+			defer mu.Unlock()
+			return unixsock.NewResponse().OK().WithPayload(strconv.Itoa(value))
+		}
+		return unixsock.NewResponse().Failf("unknown command")
+	}
+
+	// Notifications take effect before the calls made after them, even if
+	// the server handles messages concurrently
+	srv, err := New(unixSockPath, handler, WithConcurrentPerConn(4))
+	if err != nil {
+		t.Fatalf("TestNotify: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestNotify: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	for i := 1; i <= 20; i++ {
+		if err := c.Notify(context.Background(), "set", unixsock.Args{"value": i}); err != nil {
+			t.Fatalf("TestNotify: could not notify: %s", err.Error())
+		}
+		resp, err := c.Call(context.Background(), "get", unixsock.Args{})
+		if err != nil || resp.Payload != strconv.Itoa(i) {
+			t.Fatalf("TestNotify: expected the notification %d to take effect first, got %v (%+v)", i, err, resp)
+		}
+	}
+
+	// Failures to write are reported
+	unreachable, err := client.New(os.Getenv("HOME") + "/_test_notify_missing.sock")
+	if err != nil {
+		t.Fatalf("TestNotify: could not create client: %s", err.Error())
+	}
+	defer unreachable.Quit()
+	if err := unreachable.Notify(context.Background(), "set", unixsock.Args{"value": 0}); err == nil {
+		t.Errorf("TestNotify: expected an error notifying a missing server")
+	}
+
+}
+
+func TestSessionResumption(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_session_resumption.sock"
+
+	handler := func(cmd string, args unixsock.Args) *unixsock.Response {
+		return unixsock.NewResponse().OK()
+	}
+
+	srv, err := New(unixSockPath, handler, WithSessionResumption(time.Minute), WithEventHistory(16))
+	if err != nil {
+		t.Fatalf("TestSessionResumption: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	// The long timeout keeps the client from redialing on its own
+	c, err := client.New(unixSockPath, client.WithSessionResumption(), client.WithEventFilter("kind=job"), client.WithTags(map[string]string{"role": "worker"}), client.WithTimeout(time.Minute))
+	if err != nil {
+		t.Fatalf("TestSessionResumption: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	events := make(chan string, 16)
+	c.OnEvent(func(cmd string, args unixsock.Args) {
+		events <- fmt.Sprint(args["n"])
+	})
+
+	// expect waits for the events ns (and no others)
+	expect := func(ns ...string) {
+		for _, n := range ns {
+			select {
+			case got := <-events:
+				if got != n {
+					t.Errorf("TestSessionResumption: expected event %s, got %s", n, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("TestSessionResumption: expected event %s", n)
+			}
+		}
+		select {
+		case got := <-events:
+			t.Errorf("TestSessionResumption: unexpected event %s", got)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// connected waits until the server has n connections
+	connected := func(n int) []ConnStats {
+		for i := 0; i < 500; i++ {
+			if clients := srv.Clients(); len(clients) == n {
+				return clients
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("TestSessionResumption: expected %d connections, got %d", n, len(srv.Clients()))
+		return nil
+	}
+
+	if _, err := c.Call(context.Background(), "echo", unixsock.Args{}); err != nil {
+		t.Fatalf("TestSessionResumption: could not call: %s", err.Error())
+	}
+	if clients := connected(1); clients[0].Resumed {
+		t.Errorf("TestSessionResumption: expected the first connection not to be resumed")
+	}
+	srv.Broadcast("job", unixsock.Args{"kind": "job", "n": 1})
+	expect("1")
+
+	// Drop the connection and miss some events
+	conn, _ := c.Detach()
+	if conn == nil {
+		t.Fatalf("TestSessionResumption: expected a connection to drop")
+	}
+	conn.Close()
+	connected(0)
+	srv.Broadcast("job", unixsock.Args{"kind": "job", "n": 2})
+	srv.Broadcast("job", unixsock.Args{"kind": "other", "n": 3})
+
+	// The redialed connection resumes the session: the missed events are
+	// replayed and the event filter applies without subscribing again
+	if _, err := c.Call(context.Background(), "echo", unixsock.Args{}); err != nil {
+		t.Fatalf("TestSessionResumption: could not call after the drop: %s", err.Error())
+	}
+	clients := connected(1)
+	if !clients[0].Resumed || clients[0].Tags["role"] != "worker" {
+		t.Errorf("TestSessionResumption: expected the session to be resumed, got %+v", clients[0])
+	}
+	expect("2")
+	srv.Broadcast("job", unixsock.Args{"kind": "other", "n": 4})
+	srv.Broadcast("job", unixsock.Args{"kind": "job", "n": 5})
+	expect("5")
+
+	// Unknown (or used) tokens start a new session
+	raw, err := net.Dial("unix", unixSockPath)
+	if err != nil {
+		t.Fatalf("TestSessionResumption: could not connect: %s", err.Error())
+	}
+	defer raw.Close()
+	hello := unixsock.NewSender(raw, unixsock.SysHello, unixsock.Args{"resume": "0123456789abcdef"}, true, false)
+	if err := hello.Send(); err != nil || hello.Receive() != nil {
+		t.Fatalf("TestSessionResumption: handshake failed: %v", err)
+	}
+	if resp := hello.GetResponse(); resp.Meta["resumed"] != "" || resp.Meta["resume_token"] == "" {
+		t.Errorf("TestSessionResumption: expected a new session, got %+v", resp)
+	}
+
+}
+
+func TestPolicyWithoutClassifier(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_policy_without_classifier.sock"
+
+	// User commands are not classified, reserved commands keep their tiers
+	srv, err := New(unixSockPath, fakeHandler, WithPolicy(NewPolicy(TierReadOnly), nil))
+	if err != nil {
+		t.Fatalf("TestPolicyWithoutClassifier: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestPolicyWithoutClassifier: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	tests := []struct {
+		cmd     string
+		allowed bool
+	}{
+		{"echo", true},
+		{unixsock.SysHealth, true},
+		{unixsock.SysDrain, false},
+	}
+
+	for _, test := range tests {
+		resp, err := c.Call(context.Background(), test.cmd, unixsock.Args{})
+		if err != nil {
+			t.Fatalf("TestPolicyWithoutClassifier: could not call '%s': %s", test.cmd, err.Error())
+		}
+		if denied := strings.Contains(resp.Error, "permission denied"); denied == test.allowed {
+			t.Errorf("TestPolicyWithoutClassifier: expected '%s' to be allowed: %v, got %+v", test.cmd, test.allowed, resp)
+		}
+	}
+
+}
+
+func TestUnknownStatus(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_unknown_status.sock"
+
+	handler := func(cmd string, args unixsock.Args) *unixsock.Response {
+		return &unixsock.Response{Status: "ok", Payload: "done"}
+	}
+
+	srv, err := New(unixSockPath, handler)
+	if err != nil {
+		t.Fatalf("TestUnknownStatus: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	c, err := client.New(unixSockPath)
+	if err != nil {
+		t.Fatalf("TestUnknownStatus: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	// The client gets a failure naming the status instead of a lost
+	// connection
+	resp, err := c.Call(context.Background(), "echo", unixsock.Args{})
+	if err != nil {
+		t.Fatalf("TestUnknownStatus: expected a response, got %s", err.Error())
+	}
+	if resp.Status != unixsock.STATUS_FAIL || !strings.Contains(resp.Error, "unknown status 'ok'") {
+		t.Errorf("TestUnknownStatus: expected a failure naming the status, got %+v", resp)
+	}
+
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"github.com/vaitekunas/unixsock"
+)
+
+// digest starts the signature of the response to the message received by
+// receiver (nil if responses are not signed, see WithResponseSigning)
+func (o *options) digest(receiver unixsock.Communicator) *unixsock.Digest {
+	if o.signer == nil {
+		return nil
+	}
+	return o.signer.Digest(receiver.GetMeta()[unixsock.SignNonceMeta], receiver.GetCmd())
+}
+
+// sign returns a signed copy of resp, whose streamed data (if any) has been
+// written to digest. Unsigned responses are returned as they are.
+func sign(digest *unixsock.Digest, resp *unixsock.Response) *unixsock.Response {
+	if digest == nil || resp == nil {
+		return resp
+	}
+
+	signed := *resp
+	signed.Meta = make(map[string]string, len(resp.Meta)+1)
+	for key, value := range resp.Meta {
+		signed.Meta[key] = value
+	}
+	digest.Sign(&signed)
+
+	return &signed
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// Statistics limits
+const (
+	statsSamples  = 1024     // Latency samples kept per command
+	statsCommands = 256      // Commands tracked individually
+	statsOther    = "_other" // Commands beyond the limit are tracked together
+)
+
+// CommandStats are the execution statistics of a single command. Latencies
+// are measured from the moment the command is received (including time
+// spent in the dispatch queue) until its response is ready, and their
+// percentiles are computed over the most recent calls.
+type CommandStats struct {
+	Calls     uint64        `json:"calls"`
+	Errors    uint64        `json:"errors"`
+	ErrorRate float64       `json:"error_rate"`
+	P50       time.Duration `json:"p50"`
+	P90       time.Duration `json:"p90"`
+	P99       time.Duration `json:"p99"`
+	Max       time.Duration `json:"max"`
+}
+
+// commandStats accumulates the statistics of a single command
+type commandStats struct {
+	calls   uint64
+	errors  uint64
+	max     time.Duration
+	samples samples
+}
+
+// stats accumulates the execution statistics of all commands
+type stats struct {
+	mu       sync.Mutex
+	commands map[string]*commandStats
+}
+
+// newStats creates empty statistics
+func newStats() *stats {
+	return &stats{commands: make(map[string]*commandStats)}
+}
+
+// record records a single call of cmd. Calls not ending in success count as
+// errors.
+func (s *stats) record(cmd string, latency time.Duration, resp *unixsock.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.commands[cmd]
+	if !ok {
+		// Do not let clients sending random commands exhaust the memory
+		if len(s.commands) >= statsCommands {
+			cmd = statsOther
+		}
+		if c, ok = s.commands[cmd]; !ok {
+			c = &commandStats{}
+			s.commands[cmd] = c
+		}
+	}
+
+	c.calls++
+	if resp == nil || resp.Status != unixsock.STATUS_OK {
+		c.errors++
+	}
+	if latency > c.max {
+		c.max = latency
+	}
+	c.samples.add(latency)
+}
+
+// snapshot returns the current statistics of all commands
+func (s *stats) snapshot() map[string]CommandStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := make(map[string]CommandStats, len(s.commands))
+	for cmd, c := range s.commands {
+		p50, p90, p99 := c.samples.percentiles()
+		snapshot[cmd] = CommandStats{
+			Calls:     c.calls,
+			Errors:    c.errors,
+			ErrorRate: float64(c.errors) / float64(c.calls),
+			P50:       p50,
+			P90:       p90,
+			P99:       p99,
+			Max:       c.max,
+		}
+	}
+
+	return snapshot
+}
+
+// samples is a ring buffer of the most recent latencies
+type samples struct {
+	values []time.Duration
+	next   int
+}
+
+// add adds a single latency, replacing the oldest one once the buffer is full
+func (s *samples) add(latency time.Duration) {
+	if len(s.values) < statsSamples {
+		s.values = append(s.values, latency)
+		return
+	}
+	s.values[s.next] = latency
+	s.next = (s.next + 1) % statsSamples
+}
+
+// percentiles returns the 50th, 90th and 99th percentiles of the latencies
+func (s *samples) percentiles() (p50, p90, p99 time.Duration) {
+	sorted := make([]time.Duration, len(s.values))
+	copy(sorted, s.values)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return percentile(sorted, 0.50), percentile(sorted, 0.90), percentile(sorted, 0.99)
+}
+
+// percentile returns the p-th percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1)+0.5)]
+}
+
+// sysStatsHandler reports the execution statistics of all commands as JSON
+// (latencies in nanoseconds)
+func sysStatsHandler(ctx context.Context, srv *unixSockSrv, args unixsock.Args) *unixsock.Response {
+	return unixsock.NewResponse().OK().WithPayloadJSON(srv.Stats()).WithMeta("latency", "ns")
+}
+
+// sysQueueHandler reports the metrics of the dispatch queue as JSON (wait
+// times in nanoseconds)
+func sysQueueHandler(ctx context.Context, srv *unixSockSrv, args unixsock.Args) *unixsock.Response {
+	return unixsock.NewResponse().OK().WithPayloadJSON(srv.QueueStats()).WithMeta("latency", "ns")
+}
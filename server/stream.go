@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// streamChunkSize is the size of the chunks a response stream is split into
+const streamChunkSize = 64 << 10
+
+// streamResponse sends response.Stream to the client as a sequence of chunks
+// sharing the ID of the request. The response itself is sent by the caller
+// afterwards and terminates the stream. Its trailer carries the length and
+// checksum of the stream, along with the summary of streams implementing
+// unixsock.Trailer. A failing stream turns the response into a failure. The
+// streamed data is written to digest, unless nil.
+func streamResponse(c *unixsock.Conn, receiver unixsock.Communicator, response *unixsock.Response, o *options, digest *unixsock.Digest) error {
+
+	if closer, ok := response.Stream.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	sum := crc32.NewIEEE()
+	var length int64
+
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := response.Stream.Read(buf)
+		if n > 0 {
+			sum.Write(buf[:n])
+			length += int64(n)
+			if digest != nil {
+				digest.Write(buf[:n])
+			}
+
+			chunk := unixsock.NewSender(c, receiver.GetCmd(), nil, false, false)
+			chunk.SetID(receiver.GetID())
+			chunk.SetChunk(buf[:n], true)
+			chunk.SetWriteBuffer(o.writeBuffer)
+			if errSend := chunk.Send(); errSend != nil {
+				return errSend
+			}
+		}
+		if err == io.EOF {
+			trailer := make(map[string]string)
+			if t, ok := response.Stream.(unixsock.Trailer); ok {
+				for key, value := range t.Trailer() {
+					trailer[key] = value
+				}
+			}
+			for key, value := range response.Trailer {
+				trailer[key] = value
+			}
+			trailer[unixsock.TrailerLength] = strconv.FormatInt(length, 10)
+			trailer[unixsock.TrailerCRC32] = fmt.Sprintf("%08x", sum.Sum32())
+			response.Trailer = trailer
+			return nil
+		}
+		if err != nil {
+			response.Status = unixsock.STATUS_FAIL
+			response.Error = "stream: " + err.Error()
+			return nil
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// sysSubscribe is the reserved command a client sends in order to receive
+// only the events matching a filter expression
+const sysSubscribe = unixsock.SysSubscribe
+
+// eventFilter delivers the events whose arguments match all of its key=value
+// matchers. A nil filter matches every event.
+type eventFilter map[string]string
+
+// parseFilter parses a filter expression of comma-separated key=value
+// matchers, e.g. "unit=nginx.service, state=failed". An empty expression
+// matches every event.
+func parseFilter(expr string) (eventFilter, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+
+	filter := eventFilter{}
+	for _, matcher := range strings.Split(expr, ",") {
+		kv := strings.SplitN(matcher, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || key == "" {
+			return nil, fmt.Errorf("parseFilter: malformed matcher '%s' (expected key=value)", strings.TrimSpace(matcher))
+		}
+		filter[key] = strings.TrimSpace(kv[1])
+	}
+
+	return filter, nil
+}
+
+// matches informs whether an event carrying args passes the filter. Values
+// are compared in their textual form, so that "code=2" matches the number 2.
+func (f eventFilter) matches(args unixsock.Args) bool {
+	for key, value := range f {
+		arg, ok := args[key]
+		if !ok || fmt.Sprint(arg) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// subscribe replaces the event filter of a connection with the one requested
+// by the client (args "filter") and answers the request with the sequence
+// number of the last published event. If the client passes the sequence
+// number of the last event it has seen (args "since"), the kept events it
+// missed are sent right after the response.
+func (u *unixSockSrv) subscribe(c *unixsock.Conn, receiver unixsock.Communicator, o *options) {
+
+	expr, _ := receiver.GetArgs()["filter"].(string)
+	filter, err := parseFilter(expr)
+
+	// Live events must not overtake the replayed ones
+	u.events.mu.Lock()
+	defer u.events.mu.Unlock()
+
+	response := unixsock.NewResponse().OK().WithPayload(strconv.FormatUint(u.events.seq, 10))
+	if err != nil {
+		response = unixsock.NewResponse().Fail(err)
+	} else {
+		u.mu.Lock()
+		if _, open := u.conns[c]; open {
+			u.filters[c] = filter
+		}
+		u.mu.Unlock()
+	}
+
+	if receiver.ShouldRespond() {
+		receiver.SetWriteBuffer(o.writeBuffer)
+		receiver.SetResponse(response)
+		if receiver.Send() != nil {
+			return
+		}
+	}
+
+	since, ok := sinceArg(receiver.GetArgs())
+	if !ok || err != nil {
+		return
+	}
+	u.replay(c, since, filter)
+}
+
+// sinceArg returns the sequence number of the last event a client has seen
+// (args "since"), if given
+func sinceArg(args unixsock.Args) (uint64, bool) {
+	switch value := args["since"].(type) {
+	case uint64:
+		return value, true
+	case float64: // Clients not using the uint64 type envelope
+		return uint64(value), true
+	}
+	return 0, false
+}
+
+// replay sends the kept events following since that match filter. The
+// caller must hold the event log's lock.
+func (u *unixSockSrv) replay(c *unixsock.Conn, since uint64, filter eventFilter) {
+	for _, e := range u.events.since(since, filter) {
+		if u.sendEvent(c, e.seq, e.cmd, e.args) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// Reserved system commands
+const (
+	sysPrefix = unixsock.SysPrefix
+	sysHealth = unixsock.SysHealth
+	sysDrain  = unixsock.SysDrain
+	sysStats  = unixsock.SysStats
+	sysQueue  = unixsock.SysQueue
+	sysGoAway = unixsock.SysGoAway // Event sent to all clients on shutdown
+)
+
+// systemCommand is a reserved command handled by the server itself
+type systemCommand struct {
+	tier    Tier
+	handler func(ctx context.Context, srv *unixSockSrv, args unixsock.Args) *unixsock.Response
+}
+
+// systemCommands contains all reserved commands. They take precedence over
+// the user handler.
+var systemCommands = map[string]systemCommand{
+	sysHealth:      {TierReadOnly, sysHealthHandler},
+	sysDrain:       {TierAdmin, sysDrainHandler},
+	sysStats:       {TierReadOnly, sysStatsHandler},
+	sysQueue:       {TierReadOnly, sysQueueHandler},
+	sysClients:     {TierAdmin, sysClientsHandler},
+	sysPprof:       {TierAdmin, sysPprofHandler},
+	sysExpvar:      {TierAdmin, sysExpvarHandler},
+	sysCommands:    {TierReadOnly, sysCommandsHandler},
+	sysMaintenance: {TierAdmin, sysMaintenanceHandler},
+}
+
+// systemCommand returns the system command cmd refers to, honouring the
+// server's namespace (see WithSystemPrefix). Commands in the namespace that
+// are unknown or disabled (see WithoutSystemCommands) fail rather than
+// reaching the handler.
+func (o *options) systemCommand(cmd string) (systemCommand, bool) {
+
+	prefix := o.systemPrefix
+	if prefix == "" {
+		prefix = sysPrefix
+	}
+	if !strings.HasPrefix(cmd, prefix) {
+		return systemCommand{}, false
+	}
+
+	name := sysPrefix + strings.TrimPrefix(cmd, prefix)
+	if sys, ok := systemCommands[name]; ok && !o.systemDisabled[name] {
+		return sys, true
+	}
+
+	return systemCommand{TierReadOnly, func(ctx context.Context, srv *unixSockSrv, args unixsock.Args) *unixsock.Response {
+		return unixsock.NewResponse().Failf("dispatch: unknown system command '%s'", cmd)
+	}}, true
+}
+
+// sysHealthHandler reports the result of the server's health check
+func sysHealthHandler(ctx context.Context, srv *unixSockSrv, args unixsock.Args) *unixsock.Response {
+
+	srv.mu.RLock()
+	check := srv.health
+	srv.mu.RUnlock()
+
+	if check != nil {
+		if err := check(); err != nil {
+			return unixsock.NewResponse().Failf("degraded: %s", err.Error())
+		}
+	}
+
+	return unixsock.NewResponse().OK().WithPayload("healthy")
+}
+
+// sysDrainHandler stops the server from accepting new connections
+func sysDrainHandler(ctx context.Context, srv *unixSockSrv, args unixsock.Args) *unixsock.Response {
+
+	srv.Drain()
+
+	return unixsock.NewResponse().OK().WithPayload("draining")
+}
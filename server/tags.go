@@ -0,0 +1,75 @@
+package server
+
+import (
+	"github.com/vaitekunas/unixsock"
+)
+
+// Selector selects connections by the tags their clients set in the
+// handshake (see client.WithTags), e.g. Selector{"role": "worker"}. A
+// connection matches if it carries all tags of the selector with the same
+// values; the empty selector matches every connection.
+type Selector map[string]string
+
+// Matches informs whether tags match the selector
+func (s Selector) Matches(tags map[string]string) bool {
+	for key, value := range s {
+		if tagged, ok := tags[key]; !ok || tagged != value {
+			return false
+		}
+	}
+	return true
+}
+
+// helloTags parses the connection tags of a handshake (nil if none)
+func helloTags(args unixsock.Args) map[string]string {
+	raw, _ := args["tags"].(map[string]interface{})
+	if len(raw) == 0 {
+		return nil
+	}
+
+	tags := make(map[string]string, len(raw))
+	for key, value := range raw {
+		if s, ok := value.(string); ok {
+			tags[key] = s
+		}
+	}
+
+	return tags
+}
+
+// setTags sets the tags of the connection
+func (a *connActivity) setTags(tags map[string]string) {
+	a.tags.Store(tags)
+}
+
+// tagged returns the tags of the connection (nil if none)
+func (a *connActivity) tagged() map[string]string {
+	tags, _ := a.tags.Load().(map[string]string)
+	return tags
+}
+
+// BroadcastTo pushes an event to the connected clients whose tags match
+// selector (and whose event filter, if any, matches the arguments). Unlike
+// broadcast events, targeted events are neither numbered nor kept in the
+// event history, since replaying them to reconnecting clients could reach
+// connections they were not meant for.
+func (u *unixSockSrv) BroadcastTo(selector Selector, cmd string, args unixsock.Args) int {
+
+	u.mu.RLock()
+	conns := make([]*unixsock.Conn, 0, len(u.conns))
+	for c, activity := range u.conns {
+		if selector.Matches(activity.tagged()) && u.filters[c].matches(args) {
+			conns = append(conns, c)
+		}
+	}
+	u.mu.RUnlock()
+
+	delivered := 0
+	for _, c := range conns {
+		if err := u.sendEvent(c, 0, cmd, args); err == nil {
+			delivered++
+		}
+	}
+
+	return delivered
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+)
+
+// tenantContextKey is the context key of the tenant a command is executed for
+type tenantContextKey struct{}
+
+// TenantFromContext returns the tenant a command is executed for (nil if the
+// command has not been dispatched by Tenants)
+func TenantFromContext(ctx context.Context) *Tenant {
+	tenant, _ := ctx.Value(tenantContextKey{}).(*Tenant)
+	return tenant
+}
+
+// Tenant is a logical tenant of a server shared by several users or
+// applications (see Tenants)
+type Tenant struct {
+	// Name identifies the tenant in errors
+	Name string
+
+	// Handler executes the commands of the tenant, e.g. a Router
+	Handler Handler
+
+	// MaxInFlight limits the number of commands of the tenant executed
+	// concurrently (unlimited if zero). Commands exceeding it are answered
+	// with unixsock.STATUS_REJECTED.
+	MaxInFlight int
+}
+
+// Tenants dispatches commands to the handlers of several tenants, so that a
+// single process can serve all of them. The tenant of a command is chosen by
+// the socket the connection was accepted on (see Request.Socket), e.g. by
+// serving the same Tenants on "/run/app/alice.sock" and "/run/app/bob.sock",
+// then by the UID of the peer. Commands matching no tenant are passed to the
+// default tenant (if any). Quotas are shared by all servers serving the same
+// Tenants.
+type Tenants struct {
+	mu       sync.Mutex
+	def      *Tenant
+	bySocket map[string]*Tenant
+	byUID    map[uint32]*Tenant
+	inFlight map[*Tenant]int
+}
+
+// NewTenants creates a new set of tenants without any tenant
+func NewTenants() *Tenants {
+	return &Tenants{
+		bySocket: make(map[string]*Tenant),
+		byUID:    make(map[uint32]*Tenant),
+		inFlight: make(map[*Tenant]int),
+	}
+}
+
+// BySocket serves the connections accepted on sockets whose path ends with
+// suffix (e.g. "alice.sock") as tenant. Of several matching suffixes the
+// longest wins.
+func (t *Tenants) BySocket(suffix string, tenant *Tenant) *Tenants {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bySocket[suffix] = tenant
+	return t
+}
+
+// ByUID serves the peers running as uid as tenant
+func (t *Tenants) ByUID(uid uint32, tenant *Tenant) *Tenants {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.byUID[uid] = tenant
+	return t
+}
+
+// Default serves the commands matching no other tenant as tenant
+func (t *Tenants) Default(tenant *Tenant) *Tenants {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.def = tenant
+	return t
+}
+
+// Tenant returns the tenant of req (nil if none)
+func (t *Tenants) Tenant(req *Request) *Tenant {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tenant(req)
+}
+
+// tenant returns the tenant of req. The caller has to hold t.mu.
+func (t *Tenants) tenant(req *Request) *Tenant {
+
+	var tenant *Tenant
+	var suffix string
+	for s, candidate := range t.bySocket {
+		if strings.HasSuffix(req.Socket, s) && (tenant == nil || len(s) > len(suffix)) {
+			tenant, suffix = candidate, s
+		}
+	}
+	if tenant != nil {
+		return tenant
+	}
+
+	if req.Peer != nil {
+		if tenant, ok := t.byUID[req.Peer.UID]; ok {
+			return tenant
+		}
+	}
+
+	return t.def
+}
+
+// ServeUnix executes req with the handler of its tenant, enforcing the
+// tenant's quota
+func (t *Tenants) ServeUnix(ctx context.Context, req *Request) *unixsock.Response {
+
+	t.mu.Lock()
+	tenant := t.tenant(req)
+	if tenant == nil {
+		t.mu.Unlock()
+		return &unixsock.Response{
+			Status: unixsock.STATUS_FAIL,
+			Error:  fmt.Sprintf("Tenants: no tenant serves command '%s' (%s)", req.Cmd, req.Peer),
+		}
+	}
+	if tenant.MaxInFlight > 0 && t.inFlight[tenant] >= tenant.MaxInFlight {
+		t.mu.Unlock()
+		return &unixsock.Response{
+			Status: unixsock.STATUS_REJECTED,
+			Error:  fmt.Sprintf("Tenants: too many commands in flight (at most %d for tenant '%s')", tenant.MaxInFlight, tenant.Name),
+		}
+	}
+	t.inFlight[tenant]++
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		if t.inFlight[tenant]--; t.inFlight[tenant] <= 0 {
+			delete(t.inFlight, tenant)
+		}
+		t.mu.Unlock()
+	}()
+
+	return tenant.Handler.ServeUnix(context.WithValue(ctx, tenantContextKey{}, tenant), req)
+}
@@ -0,0 +1,119 @@
+//go:build linux || darwin || freebsd || dragonfly || netbsd || openbsd
+// +build linux darwin freebsd dragonfly netbsd openbsd
+
+package server
+
+import (
+	"fmt"
+	"github.com/vaitekunas/unixsock"
+	"github.com/vaitekunas/unixsock/client"
+	context "golang.org/x/net/context"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// pairTransport connects clients to servers via socket pairs, without any
+// socket file
+type pairTransport struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPairTransport() *pairTransport {
+	return &pairTransport{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (p *pairTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	conns := make([]net.Conn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), address)
+		conns[i], err = net.FileConn(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	select {
+	case p.conns <- conns[1]:
+		return conns[0], nil
+	case <-p.closed:
+	case <-ctx.Done():
+	}
+	conns[0].Close()
+	conns[1].Close()
+
+	return nil, fmt.Errorf("no listener at %s", address)
+}
+
+func (p *pairTransport) Listen(address string) (net.Listener, error) {
+	return p, nil
+}
+
+func (p *pairTransport) Accept() (net.Conn, error) {
+	select {
+	case c := <-p.conns:
+		return c, nil
+	case <-p.closed:
+		return nil, fmt.Errorf("listener closed")
+	}
+}
+
+func (p *pairTransport) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
+
+func (p *pairTransport) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pair", Net: "unix"}
+}
+
+func TestTransport(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_transport.sock"
+	transport := newPairTransport()
+
+	srv, err := New(unixSockPath, fakeHandler, WithTransport(transport))
+	if err != nil {
+		t.Fatalf("TestTransport: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	if _, err := os.Stat(unixSockPath); !os.IsNotExist(err) {
+		t.Errorf("TestTransport: expected no socket file, got %v", err)
+	}
+
+	c, err := client.New(unixSockPath, client.WithTransport(transport))
+	if err != nil {
+		t.Fatalf("TestTransport: could not create client: %s", err.Error())
+	}
+	defer c.Quit()
+
+	resp, err := c.Send("hello.world", unixsock.Args{}, true, false)
+	if err != nil {
+		t.Fatalf("TestTransport: could not send: %s", err.Error())
+	}
+	if !resp.Succeeded() {
+		t.Errorf("TestTransport: unexpected response: %v", resp)
+	}
+
+	// Peer credentials are available on unix transports
+	if clients := srv.Clients(); len(clients) != 1 || clients[0].Peer == nil || clients[0].Peer.PID != int32(os.Getpid()) {
+		t.Errorf("TestTransport: expected the peer of the connection, got %+v", clients)
+	}
+
+	// Clients not using the transport find no socket
+	if _, err := client.New(unixSockPath, client.WithEagerConnect()); err == nil {
+		t.Errorf("TestTransport: expected dialing the socket file to fail")
+	}
+
+}
@@ -0,0 +1,32 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// umaskMu serializes the umask changes of listenUnix
+var umaskMu sync.Mutex
+
+// listenUnix listens on a unix socket created with the permissions mode (0
+// for the default ones). The permissions are applied via the umask while the
+// socket is created, so that the socket is never reachable with broader
+// permissions, and the previous umask is restored right away.
+func listenUnix(socketPath string, mode os.FileMode) (net.Listener, error) {
+	if mode == 0 {
+		return net.Listen("unix", socketPath)
+	}
+
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+
+	previous := syscall.Umask(int(^mode.Perm() & os.ModePerm))
+	defer syscall.Umask(previous)
+
+	return net.Listen("unix", socketPath)
+}
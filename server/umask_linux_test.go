@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestSocketModeUmask(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_umask.sock"
+	defer os.Remove(unixSockPath + ".lock")
+
+	umask := syscall.Umask(0022)
+	defer syscall.Umask(umask)
+
+	srv, err := New(unixSockPath, fakeHandler, WithSocketMode(0600))
+	if err != nil {
+		t.Fatalf("TestSocketModeUmask: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	info, err := os.Lstat(unixSockPath)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("TestSocketModeUmask: expected a socket with permissions 0600, got %v (%v)", info, err)
+	}
+	if restored := syscall.Umask(0022); restored != 0022 {
+		t.Errorf("TestSocketModeUmask: umask not restored: %04o", restored)
+	}
+
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"net"
+	"os"
+)
+
+// listenUnix listens on a unix socket, changing its permissions to mode (0
+// for the default ones) once it has been created
+func listenUnix(socketPath string, mode os.FileMode) (net.Listener, error) {
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil || mode == 0 {
+		return l, err
+	}
+
+	if err := os.Chmod(socketPath, mode.Perm()); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
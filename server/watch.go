@@ -0,0 +1,120 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Backoff of the attempts to listen on a lost socket again
+const (
+	rebindBackoffMin = 100 * time.Millisecond
+	rebindBackoffMax = time.Minute
+)
+
+// rebindBackoff returns the delay before the next attempt to listen on a lost
+// socket again, doubling the previous one
+func rebindBackoff(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return rebindBackoffMin
+	}
+	if delay *= 2; delay > rebindBackoffMax {
+		return rebindBackoffMax
+	}
+	return delay
+}
+
+// watchSocket watches the socket file (see WithSocketWatch) and listens on
+// the socket again once the file has been removed or replaced, e.g. by a temp
+// directory cleaner. Without it, the server keeps running but can not be
+// reached anymore. Changes of the socket's directory are reported by inotify
+// (Linux) or kqueue (macOS and the BSDs), so that the socket is rebound right
+// away. The file is only checked every interval as a fallback, on other
+// platforms or while the directory can not be watched. Failed attempts to
+// listen again are retried with a backoff, and every loss is reported once
+// (see OnSocketLost). The watch is set up before watchSocket returns.
+func (u *unixSockSrv) watchSocket(l *lockedListener) {
+
+	var changed chan struct{}
+	watch := func() {
+		if u.options().socketWatch <= 0 {
+			return
+		}
+		if w, err := watchDir(filepath.Dir(l.path)); err == nil {
+			changed = w.events
+			go func() {
+				<-u.ctx.Done()
+				w.close()
+			}()
+		}
+	}
+	watch()
+
+	served, _ := os.Lstat(l.path)
+
+	go func() {
+		lost := false           // The socket is lost and could not be rebound yet
+		var retry time.Duration // Delay of the next attempt to rebind it
+
+		for {
+			interval := u.options().socketWatch
+
+			var timer <-chan time.Time
+			switch {
+			case lost:
+				timer = time.After(retry)
+			case changed == nil && interval > 0:
+				timer = time.After(interval)
+			case changed == nil:
+				// Disabled: waiting for the watch to be enabled
+				timer = time.After(time.Second)
+			}
+
+			select {
+			case <-timer:
+			case _, ok := <-changed:
+				if !ok {
+					// The directory is gone: checking every interval until
+					// it is back
+					changed = nil
+					continue
+				}
+			case <-u.ctx.Done():
+				return
+			}
+
+			// Drained servers remove the socket on purpose
+			if interval <= 0 || u.isDraining() {
+				continue
+			}
+
+			info, err := os.Lstat(l.path)
+			if !lost && err == nil && served != nil && os.SameFile(info, served) {
+				if changed == nil {
+					watch()
+				}
+				continue
+			}
+
+			err = l.rebind()
+			if err == nil {
+				served, _ = os.Lstat(l.path)
+				if changed == nil {
+					watch()
+				}
+			}
+
+			// Reported once per loss, with the outcome of the first attempt
+			if callback := u.options().onSocketLost; callback != nil && !lost {
+				callback(l.path, err)
+			}
+
+			lost = err != nil
+			if lost {
+				retry = rebindBackoff(retry)
+			} else {
+				retry = 0
+			}
+		}
+	}()
+}
@@ -0,0 +1,101 @@
+//go:build darwin || freebsd || dragonfly || netbsd || openbsd
+// +build darwin freebsd dragonfly netbsd openbsd
+
+package server
+
+import (
+	"sync"
+	"syscall"
+)
+
+// dirWatcher reports changes of the entries of a directory via kqueue
+type dirWatcher struct {
+	events chan struct{} // Signalled upon changes, closed once the watch ends
+
+	kq, dir int
+	wake    [2]int // Pipe waking the reader on close
+	once    sync.Once
+}
+
+// watchDir watches the entries of dir being created, removed or renamed,
+// i.e. writes to the directory
+func watchDir(dir string) (*dirWatcher, error) {
+
+	w := &dirWatcher{events: make(chan struct{}, 1), kq: -1, dir: -1, wake: [2]int{-1, -1}}
+
+	var err error
+	if w.dir, err = syscall.Open(dir, syscall.O_RDONLY|syscall.O_CLOEXEC, 0); err != nil {
+		w.release()
+		return nil, err
+	}
+	if err = syscall.Pipe(w.wake[:]); err != nil {
+		w.release()
+		return nil, err
+	}
+	if w.kq, err = syscall.Kqueue(); err != nil {
+		w.release()
+		return nil, err
+	}
+
+	changes := make([]syscall.Kevent_t, 2)
+	syscall.SetKevent(&changes[0], w.dir, syscall.EVFILT_VNODE, syscall.EV_ADD|syscall.EV_CLEAR)
+	changes[0].Fflags = syscall.NOTE_WRITE | syscall.NOTE_DELETE | syscall.NOTE_RENAME
+	syscall.SetKevent(&changes[1], w.wake[0], syscall.EVFILT_READ, syscall.EV_ADD)
+	if _, err = syscall.Kevent(w.kq, changes, nil, nil); err != nil {
+		w.release()
+		return nil, err
+	}
+
+	go w.read()
+
+	return w, nil
+}
+
+// read signals the events of the watch until it is closed or the directory
+// is gone, and closes the descriptors
+func (w *dirWatcher) read() {
+
+	defer close(w.events)
+	defer w.release()
+
+	events := make([]syscall.Kevent_t, 4)
+	for {
+		n, err := syscall.Kevent(w.kq, nil, events, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		for _, event := range events[:n] {
+			if int(event.Ident) == w.wake[0] || event.Fflags&(syscall.NOTE_DELETE|syscall.NOTE_RENAME) != 0 {
+				return
+			}
+		}
+
+		select {
+		case w.events <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// close ends the watch by waking the reader
+func (w *dirWatcher) close() {
+	w.once.Do(func() {
+		if w.wake[1] >= 0 {
+			syscall.Close(w.wake[1])
+		}
+	})
+}
+
+// release closes the descriptors of the watch
+func (w *dirWatcher) release() {
+	w.close()
+	for _, fd := range []int{w.kq, w.dir, w.wake[0]} {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+}
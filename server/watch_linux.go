@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// dirWatcher reports changes of the entries of a directory via inotify
+type dirWatcher struct {
+	events chan struct{} // Signalled upon changes, closed once the watch ends
+
+	mu   sync.Mutex
+	fd   int
+	wd   int
+	done bool
+}
+
+// watchDir watches the entries of dir being created, removed or renamed
+func watchDir(dir string) (*dirWatcher, error) {
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	mask := uint32(syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF)
+	wd, err := syscall.InotifyAddWatch(fd, dir, mask)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	w := &dirWatcher{events: make(chan struct{}, 1), fd: fd, wd: wd}
+	go w.read()
+
+	return w, nil
+}
+
+// read signals the events of the watch until it is removed, either by close
+// or because the directory is gone (IN_IGNORED), and closes the descriptor
+func (w *dirWatcher) read() {
+
+	defer close(w.events)
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		ignored := err != nil || n < syscall.SizeofInotifyEvent
+		for offset := 0; !ignored && offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			ignored = event.Mask&syscall.IN_IGNORED != 0
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+		}
+		if ignored {
+			w.mu.Lock()
+			w.done = true
+			syscall.Close(w.fd)
+			w.mu.Unlock()
+			return
+		}
+
+		select {
+		case w.events <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// close ends the watch. Removing it wakes the reader, which closes the
+// descriptor.
+func (w *dirWatcher) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.done {
+		w.done = true
+		syscall.InotifyRmWatch(w.fd, uint32(w.wd))
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!dragonfly,!netbsd,!openbsd
+
+package server
+
+import "fmt"
+
+// dirWatcher reports changes of the entries of a directory
+type dirWatcher struct {
+	events chan struct{}
+}
+
+// watchDir is not supported on this platform: the socket file is polled
+// instead (see watchSocket)
+func watchDir(dir string) (*dirWatcher, error) {
+	return nil, fmt.Errorf("watchDir: not supported on this platform")
+}
+
+// close ends the watch
+func (w *dirWatcher) close() {}
@@ -0,0 +1,64 @@
+//go:build linux || darwin || freebsd || dragonfly || netbsd || openbsd
+// +build linux darwin freebsd dragonfly netbsd openbsd
+
+package server
+
+import (
+	"github.com/vaitekunas/unixsock"
+	"github.com/vaitekunas/unixsock/client"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSocketWatchNotify(t *testing.T) {
+
+	unixSockPath := os.Getenv("HOME") + "/_test_socketwatch_notify.sock"
+
+	// The removal is reported by the directory watch long before the next check
+	lost := make(chan error, 10)
+	srv, err := New(unixSockPath, fakeHandler, WithSocketWatch(time.Hour), OnSocketLost(func(path string, err error) {
+		lost <- err
+	}))
+	if err != nil {
+		t.Fatalf("TestSocketWatchNotify: could not start server: %s", err.Error())
+	}
+	defer srv.Stop()
+
+	for i := 0; i < 2; i++ {
+		if err := os.Remove(unixSockPath); err != nil {
+			t.Fatalf("TestSocketWatchNotify: could not remove the socket: %s", err.Error())
+		}
+
+		select {
+		case err := <-lost:
+			if err != nil {
+				t.Fatalf("TestSocketWatchNotify: could not rebind: %s", err.Error())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("TestSocketWatchNotify: removal %d of the socket not detected", i+1)
+		}
+
+		c, err := client.New(unixSockPath)
+		if err != nil {
+			t.Fatalf("TestSocketWatchNotify: could not create client: %s", err.Error())
+		}
+		if _, err := c.Send("ping", unixsock.Args{}, true, false); err != nil {
+			t.Errorf("TestSocketWatchNotify: server unreachable after rebinding: %s", err.Error())
+		}
+		c.Quit()
+	}
+
+	// Unrelated files in the directory are left alone
+	other := os.Getenv("HOME") + "/_test_socketwatch_notify.tmp"
+	if f, err := os.Create(other); err == nil {
+		f.Close()
+		os.Remove(other)
+	}
+	select {
+	case err := <-lost:
+		t.Errorf("TestSocketWatchNotify: socket reported lost after an unrelated change (%v)", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+}
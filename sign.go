@@ -0,0 +1,144 @@
+package unixsock
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+)
+
+// Metadata used to sign responses (see Signer)
+const (
+	SignatureMeta = "signature"  // Response metadata carrying the signature (hex)
+	SignNonceMeta = "sign_nonce" // Request metadata binding the signature to a call
+)
+
+// minSignKey is the minimum length of signing keys
+const minSignKey = 16
+
+// Signer signs responses with a key shared by the client and the server
+// (HMAC-SHA256), so that clients can verify that a response has been sent by
+// the server holding the key rather than by a process interposing on the
+// socket path. It is safe for concurrent use.
+type Signer struct {
+	key []byte
+}
+
+// NewSigner creates a signer using key, which has to be at least 16 bytes
+// long
+func NewSigner(key []byte) (*Signer, error) {
+	if len(key) < minSignKey {
+		return nil, fmt.Errorf("NewSigner: key must be at least %d bytes long, got %d", minSignKey, len(key))
+	}
+	return &Signer{key: append([]byte(nil), key...)}, nil
+}
+
+// Nonce returns a random nonce binding the signature of a response to a
+// single call (see SignNonceMeta), so that recorded responses can not be
+// replayed in response to other calls
+func (s *Signer) Nonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("Nonce: %s", err.Error())
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// Digest accumulates the payload of a response to command cmd sent with
+// nonce, streamed data included. The payload is written in the order it is
+// sent, i.e. the streamed chunks followed by Response.Payload.
+type Digest struct {
+	key   []byte
+	nonce string
+	cmd   string
+	body  hash.Hash
+}
+
+// Digest starts the signature of a response to command cmd sent with nonce
+// (empty if the client sent none)
+func (s *Signer) Digest(nonce, cmd string) *Digest {
+	return &Digest{
+		key:   s.key,
+		nonce: nonce,
+		cmd:   cmd,
+		body:  sha256.New(),
+	}
+}
+
+// Write adds streamed data to the digest
+func (d *Digest) Write(p []byte) (int, error) {
+	return d.body.Write(p)
+}
+
+// Sum returns the signature of resp, whose streamed data (if any) has been
+// written to the digest. It covers the status, error, warning, metadata
+// (except the signature itself), trailer and payload of resp.
+func (d *Digest) Sum(resp *Response) string {
+	return hex.EncodeToString(d.sum(resp))
+}
+
+// sum computes the signature of resp
+func (d *Digest) sum(resp *Response) []byte {
+	d.body.Write([]byte(resp.Payload))
+
+	mac := hmac.New(sha256.New, d.key)
+	for _, field := range []string{d.nonce, d.cmd, string(resp.Status), resp.Error, resp.Warning} {
+		writeField(mac, field)
+	}
+	writeMap(mac, resp.Meta, SignatureMeta)
+	writeMap(mac, resp.Trailer, "")
+	mac.Write(d.body.Sum(nil))
+
+	return mac.Sum(nil)
+}
+
+// Sign signs resp (see Sum) and attaches the signature to its metadata
+func (d *Digest) Sign(resp *Response) {
+	resp.WithMeta(SignatureMeta, d.Sum(resp))
+}
+
+// Verify checks the signature attached to resp, whose streamed data (if
+// any) has been written to the digest
+func (d *Digest) Verify(resp *Response) error {
+	signature, ok := resp.Meta[SignatureMeta]
+	if !ok {
+		return fmt.Errorf("Verify: response to '%s' is not signed", d.cmd)
+	}
+
+	received, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(received, d.sum(resp)) {
+		return fmt.Errorf("Verify: response to '%s' has an invalid signature", d.cmd)
+	}
+
+	return nil
+}
+
+// writeField writes a length-prefixed field to the MAC
+func writeField(mac hash.Hash, field string) {
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(len(field)))
+	mac.Write(length[:])
+	mac.Write([]byte(field))
+}
+
+// writeMap writes the entries of m (except skip) to the MAC, sorted by key
+func writeMap(mac hash.Hash, m map[string]string, skip string) {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		if key != skip {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	writeField(mac, fmt.Sprintf("%d", len(keys)))
+	for _, key := range keys {
+		writeField(mac, key)
+		writeField(mac, m[key])
+	}
+}
@@ -0,0 +1,70 @@
+package unixsock
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Status is the outcome of a command. Statuses are sent as strings, so that
+// the wire format remains unchanged; unknown statuses are rejected when
+// encoding or decoding a response.
+type Status string
+
+// Statuses
+const (
+	StatusOK   Status = "success" // The command succeeded
+	StatusFail Status = "failure" // The command failed
+
+	// StatusPartial is reported for commands that succeeded only partly,
+	// e.g. a batch of which some items failed. The payload describes the
+	// outcome.
+	StatusPartial Status = "partial"
+
+	// StatusRetry is reported for commands that failed due to a transient
+	// condition (e.g. a busy resource) and may be retried
+	StatusRetry Status = "retry"
+
+	// StatusExpired is reported for messages that have not been executed
+	// because their expiry passed while they were waiting (see SetExpiry)
+	StatusExpired Status = "expired"
+
+	// StatusRejected is reported for messages sent over connections the
+	// server refuses to serve (e.g. exceeding a connection quota)
+	StatusRejected Status = "rejected"
+)
+
+// Valid informs whether s is a known status. The empty status (of messages
+// that have not been responded to) is valid.
+func (s Status) Valid() bool {
+	switch s {
+	case "", StatusOK, StatusFail, StatusPartial, StatusRetry, StatusExpired, StatusRejected:
+		return true
+	}
+	return false
+}
+
+// String returns the wire representation of the status
+func (s Status) String() string {
+	return string(s)
+}
+
+// MarshalJSON encodes a known status as a string
+func (s Status) MarshalJSON() ([]byte, error) {
+	if !s.Valid() {
+		return nil, fmt.Errorf("MarshalJSON: unknown status '%s'", string(s))
+	}
+	return json.Marshal(string(s))
+}
+
+// UnmarshalJSON decodes a known status from a string
+func (s *Status) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("UnmarshalJSON: %s", err.Error())
+	}
+	if !Status(str).Valid() {
+		return fmt.Errorf("UnmarshalJSON: unknown status '%s'", str)
+	}
+	*s = Status(str)
+	return nil
+}
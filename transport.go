@@ -0,0 +1,38 @@
+package unixsock
+
+import (
+	"net"
+
+	context "golang.org/x/net/context"
+)
+
+// Transport establishes the connections between clients and servers, which
+// then frame their messages over them (see NewConn). Implementations can
+// carry the protocol over other means than a local unix socket, e.g. a
+// socket forwarded over SSH, a WebSocket bridge or an in-memory transport
+// for tests, without changes to the client or the server.
+type Transport interface {
+	// Dial connects to the server listening at address. Dialing must be
+	// aborted once ctx is done.
+	Dial(ctx context.Context, address string) (net.Conn, error)
+
+	// Listen listens for connections at address
+	Listen(address string) (net.Listener, error)
+}
+
+// NetTransport is the Transport of a network supported by package net, e.g.
+// "unix" (the default of clients and servers) or "tcp"
+type NetTransport struct {
+	Network string
+}
+
+// Dial connects to address on the transport's network
+func (t NetTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	return dialer.DialContext(ctx, t.Network, address)
+}
+
+// Listen listens on address on the transport's network
+func (t NetTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen(t.Network, address)
+}
@@ -0,0 +1,307 @@
+package unixsock
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TypeEncoder converts a value of a registered type into a string
+type TypeEncoder func(v interface{}) (string, error)
+
+// TypeDecoder converts a string produced by a TypeEncoder back into a value
+type TypeDecoder func(s string) (interface{}, error)
+
+// Keys of the JSON object wrapping values of registered types
+const (
+	typeKey  = "$type"
+	valueKey = "$value"
+)
+
+// typeConverter contains the converters of a single registered type
+type typeConverter struct {
+	name   string
+	encode TypeEncoder
+	decode TypeDecoder
+}
+
+// typeRegistry contains all registered types
+var typeRegistry = struct {
+	sync.RWMutex
+	byType map[reflect.Type]*typeConverter
+	byName map[string]*typeConverter
+}{
+	byType: make(map[reflect.Type]*typeConverter),
+	byName: make(map[string]*typeConverter),
+}
+
+// RegisterType registers converters for the type of sample under name.
+// Args values of a registered type are sent as {"$type": name, "$value": ...}
+// and are restored to their original type on the receiving side, instead of
+// degrading to strings or float64. Both sides must register the same types.
+// Registering an already registered type or name replaces the converters.
+// Integers (int, int64, uint and uint64) are sent as plain JSON numbers and
+// only wrapped as "int64" or "uint64" beyond ±2^53, where float64 would lose
+// precision.
+func RegisterType(name string, sample interface{}, encode TypeEncoder, decode TypeDecoder) {
+	if name == "" || sample == nil || encode == nil || decode == nil {
+		panic("RegisterType: name, sample, encode and decode are required")
+	}
+
+	conv := &typeConverter{
+		name:   name,
+		encode: encode,
+		decode: decode,
+	}
+
+	typeRegistry.Lock()
+	defer typeRegistry.Unlock()
+	typeRegistry.byType[reflect.TypeOf(sample)] = conv
+	typeRegistry.byName[name] = conv
+}
+
+// RegisteredTypes returns the names of all registered types
+func RegisteredTypes() []string {
+	typeRegistry.RLock()
+	defer typeRegistry.RUnlock()
+
+	names := make([]string, 0, len(typeRegistry.byName))
+	for name := range typeRegistry.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Built-in types
+func init() {
+	RegisterType("time", time.Time{},
+		func(v interface{}) (string, error) {
+			return v.(time.Time).Format(time.RFC3339Nano), nil
+		},
+		func(s string) (interface{}, error) {
+			return time.Parse(time.RFC3339Nano, s)
+		})
+
+	RegisterType("duration", time.Duration(0),
+		func(v interface{}) (string, error) {
+			return strconv.FormatInt(int64(v.(time.Duration)), 10), nil
+		},
+		func(s string) (interface{}, error) {
+			d, err := strconv.ParseInt(s, 10, 64)
+			return time.Duration(d), err
+		})
+
+	RegisterType("bytes", []byte{},
+		func(v interface{}) (string, error) {
+			return base64.StdEncoding.EncodeToString(v.([]byte)), nil
+		},
+		func(s string) (interface{}, error) {
+			return base64.StdEncoding.DecodeString(s)
+		})
+
+	RegisterType("sealed", Sealed{},
+		func(v interface{}) (string, error) {
+			return base64.StdEncoding.EncodeToString(v.(Sealed)), nil
+		},
+		func(s string) (interface{}, error) {
+			sealed, err := base64.StdEncoding.DecodeString(s)
+			return Sealed(sealed), err
+		})
+
+	RegisterType("int64", int64(0),
+		func(v interface{}) (string, error) {
+			return strconv.FormatInt(v.(int64), 10), nil
+		},
+		func(s string) (interface{}, error) {
+			return strconv.ParseInt(s, 10, 64)
+		})
+
+	RegisterType("uint64", uint64(0),
+		func(v interface{}) (string, error) {
+			return strconv.FormatUint(v.(uint64), 10), nil
+		},
+		func(s string) (interface{}, error) {
+			return strconv.ParseUint(s, 10, 64)
+		})
+}
+
+// MarshalJSON marshals Args, wrapping values of registered types
+func (a Args) MarshalJSON() ([]byte, error) {
+	if a == nil {
+		return []byte("null"), nil
+	}
+
+	encoded, err := encodeValue(map[string]interface{}(a))
+	if err != nil {
+		return nil, fmt.Errorf("MarshalJSON: %s", err.Error())
+	}
+
+	return json.Marshal(encoded)
+}
+
+// UnmarshalJSON unmarshals Args, restoring values of registered types
+func (a *Args) UnmarshalJSON(data []byte) error {
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if raw == nil {
+		*a = nil
+		return nil
+	}
+
+	decoded, err := decodeValue(raw)
+	if err != nil {
+		return fmt.Errorf("UnmarshalJSON: %s", err.Error())
+	}
+
+	*a = Args(decoded.(map[string]interface{}))
+
+	return nil
+}
+
+// maxExactInteger is the largest integer a float64 represents exactly, which
+// is all JSON decoders guarantee
+const maxExactInteger = 1 << 53
+
+// encodeInteger wraps integers exceeding the precision of float64 (see
+// maxExactInteger) as int64 or uint64 values. Smaller integers are left as
+// plain JSON numbers, so that peers unaware of the type envelope read them.
+func encodeInteger(v interface{}) (interface{}, bool) {
+	var signed int64
+	var unsigned uint64
+	switch val := v.(type) {
+	case int:
+		signed = int64(val)
+	case int64:
+		signed = val
+	case uint:
+		unsigned = uint64(val)
+	case uint64:
+		unsigned = val
+	default:
+		return nil, false
+	}
+
+	switch {
+	case signed > maxExactInteger || signed < -maxExactInteger:
+		return map[string]interface{}{typeKey: "int64", valueKey: strconv.FormatInt(signed, 10)}, true
+	case unsigned > maxExactInteger:
+		return map[string]interface{}{typeKey: "uint64", valueKey: strconv.FormatUint(unsigned, 10)}, true
+	}
+
+	return v, true
+}
+
+// encodeValue recursively wraps values of registered types
+func encodeValue(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if enc, ok := encodeInteger(v); ok {
+		return enc, nil
+	}
+
+	typeRegistry.RLock()
+	conv, ok := typeRegistry.byType[reflect.TypeOf(v)]
+	typeRegistry.RUnlock()
+
+	if ok {
+		s, err := conv.encode(v)
+		if err != nil {
+			return nil, fmt.Errorf("encodeValue: could not encode %s: %s", conv.name, err.Error())
+		}
+		return map[string]interface{}{typeKey: conv.name, valueKey: s}, nil
+	}
+
+	switch val := v.(type) {
+	case Args:
+		return encodeValue(map[string]interface{}(val))
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			enc, err := encodeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = enc
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			enc, err := encodeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = enc
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
+// decodeValue recursively restores values of registered types
+func decodeValue(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if conv, s, ok := wrappedValue(val); ok {
+			dec, err := conv.decode(s)
+			if err != nil {
+				return nil, fmt.Errorf("decodeValue: could not decode %s: %s", conv.name, err.Error())
+			}
+			return dec, nil
+		}
+		for k, item := range val {
+			dec, err := decodeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			val[k] = dec
+		}
+		return val, nil
+	case []interface{}:
+		for i, item := range val {
+			dec, err := decodeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			val[i] = dec
+		}
+		return val, nil
+	default:
+		return v, nil
+	}
+}
+
+// wrappedValue checks whether m is a wrapped value of a registered type.
+// Maps that merely look like envelopes (e.g. with an unregistered $type) are
+// user data.
+func wrappedValue(m map[string]interface{}) (*typeConverter, string, bool) {
+	if len(m) != 2 {
+		return nil, "", false
+	}
+
+	name, ok := m[typeKey].(string)
+	if !ok {
+		return nil, "", false
+	}
+	s, ok := m[valueKey].(string)
+	if !ok {
+		return nil, "", false
+	}
+
+	typeRegistry.RLock()
+	conv, ok := typeRegistry.byName[name]
+	typeRegistry.RUnlock()
+
+	return conv, s, ok
+}
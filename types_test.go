@@ -0,0 +1,190 @@
+package unixsock
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestArgsTypes(t *testing.T) {
+
+	now := time.Now()
+
+	args := Args{
+		"time":     now,
+		"duration": 1500 * time.Millisecond,
+		"bytes":    []byte{0, 1, 2, 255},
+		"int64":    int64(math.MaxInt64),
+		"uint64":   uint64(math.MaxUint64),
+		"nested":   map[string]interface{}{"when": now},
+		"list":     []interface{}{int64(1<<53 + 1)},
+		"plain":    "string",
+	}
+
+	data, err := json.Marshal(args)
+	if err != nil {
+		t.Fatalf("TestArgsTypes: could not marshal args: %s", err.Error())
+	}
+
+	decoded := Args{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("TestArgsTypes: could not unmarshal args: %s", err.Error())
+	}
+
+	if tm, ok := decoded["time"].(time.Time); !ok || !tm.Equal(now) {
+		t.Errorf("TestArgsTypes: time did not survive: %v", decoded["time"])
+	}
+	if d, ok := decoded["duration"].(time.Duration); !ok || d != 1500*time.Millisecond {
+		t.Errorf("TestArgsTypes: duration did not survive: %v", decoded["duration"])
+	}
+	if b, ok := decoded["bytes"].([]byte); !ok || !bytes.Equal(b, []byte{0, 1, 2, 255}) {
+		t.Errorf("TestArgsTypes: bytes did not survive: %v", decoded["bytes"])
+	}
+	if i, ok := decoded["int64"].(int64); !ok || i != math.MaxInt64 {
+		t.Errorf("TestArgsTypes: int64 did not survive: %v", decoded["int64"])
+	}
+	if u, ok := decoded["uint64"].(uint64); !ok || u != math.MaxUint64 {
+		t.Errorf("TestArgsTypes: uint64 did not survive: %v", decoded["uint64"])
+	}
+	if nested, ok := decoded["nested"].(map[string]interface{}); !ok {
+		t.Errorf("TestArgsTypes: nested map did not survive: %v", decoded["nested"])
+	} else if tm, ok := nested["when"].(time.Time); !ok || !tm.Equal(now) {
+		t.Errorf("TestArgsTypes: nested time did not survive: %v", nested["when"])
+	}
+	if list, ok := decoded["list"].([]interface{}); !ok || len(list) != 1 || list[0] != int64(1<<53+1) {
+		t.Errorf("TestArgsTypes: list did not survive: %v", decoded["list"])
+	}
+	if decoded["plain"] != "string" {
+		t.Errorf("TestArgsTypes: plain value did not survive: %v", decoded["plain"])
+	}
+
+}
+
+func TestArgsIntegers(t *testing.T) {
+
+	args := Args{
+		"small":    int64(5),
+		"int":      1 << 60,
+		"negative": -1 << 60,
+		"uint":     uint(1<<53 + 1),
+		"lookalike": map[string]interface{}{
+			"$type":  "unregistered",
+			"$value": "5",
+		},
+	}
+
+	data, err := json.Marshal(args)
+	if err != nil {
+		t.Fatalf("TestArgsIntegers: could not marshal args: %s", err.Error())
+	}
+
+	// Integers within the precision of float64 are plain numbers
+	if !bytes.Contains(data, []byte(`"small":5`)) {
+		t.Errorf("TestArgsIntegers: expected a plain number, got %s", data)
+	}
+
+	decoded := Args{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("TestArgsIntegers: could not unmarshal args: %s", err.Error())
+	}
+
+	expected := map[string]interface{}{
+		"small":    float64(5),
+		"int":      int64(1 << 60),
+		"negative": int64(-1 << 60),
+		"uint":     uint64(1<<53 + 1),
+	}
+	for key, value := range expected {
+		if decoded[key] != value {
+			t.Errorf("TestArgsIntegers: expected %s to decode as %T %v, got %T %v", key, value, value, decoded[key], decoded[key])
+		}
+	}
+
+	// Maps looking like envelopes of unregistered types are user data
+	if lookalike, ok := decoded["lookalike"].(map[string]interface{}); !ok || lookalike["$type"] != "unregistered" || lookalike["$value"] != "5" {
+		t.Errorf("TestArgsIntegers: expected the map to survive, got %v", decoded["lookalike"])
+	}
+
+}
+
+func TestSealer(t *testing.T) {
+
+	sealer, err := NewSealer(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatalf("TestSealer: could not create sealer: %s", err.Error())
+	}
+	if _, err := NewSealer([]byte("short")); err == nil {
+		t.Errorf("TestSealer: expected an invalid key to be rejected")
+	}
+
+	args := Args{"user": "root", "password": "hunter2", "ttl": time.Minute}
+	sealed, err := sealer.Seal(args, "password", "ttl", "missing")
+	if err != nil {
+		t.Fatalf("TestSealer: could not seal: %s", err.Error())
+	}
+	if _, ok := sealed["password"].(Sealed); !ok || sealed["user"] != "root" || args["password"] != "hunter2" {
+		t.Fatalf("TestSealer: unexpected sealed args: %v (original %v)", sealed, args)
+	}
+
+	// On the wire
+	data, err := json.Marshal(sealed)
+	if err != nil {
+		t.Fatalf("TestSealer: could not marshal args: %s", err.Error())
+	}
+	if bytes.Contains(data, []byte("hunter2")) {
+		t.Errorf("TestSealer: plaintext in the encoded args: %s", data)
+	}
+	decoded := Args{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("TestSealer: could not unmarshal args: %s", err.Error())
+	}
+
+	opened, err := sealer.Open(decoded)
+	if err != nil {
+		t.Fatalf("TestSealer: could not open: %s", err.Error())
+	}
+	if opened["password"] != "hunter2" || opened["ttl"] != time.Minute || opened["user"] != "root" {
+		t.Errorf("TestSealer: unexpected opened args: %v", opened)
+	}
+
+	// Swapped values and foreign keys
+	swapped := Args{"token": decoded["password"]}
+	if _, err := sealer.Open(swapped); err == nil {
+		t.Errorf("TestSealer: expected a value sealed under another key to be rejected")
+	}
+	other, _ := NewSealer(bytes.Repeat([]byte{8}, 32))
+	if _, err := other.Open(decoded); err == nil {
+		t.Errorf("TestSealer: expected a value sealed with another key to be rejected")
+	}
+
+}
+
+func TestRedactKeys(t *testing.T) {
+
+	args := Args{
+		"user":     "root",
+		"password": "hunter2",
+		"nested":   map[string]interface{}{"token": "abc123", "ttl": 5},
+	}
+	resp := &Response{Status: STATUS_FAIL, Error: "wrong password 'hunter2'", Payload: "token abc123"}
+
+	redactedArgs, redactedResp := RedactKeys("password", "token").Redact("login", args, resp)
+
+	if redactedArgs["password"] != Redacted || redactedArgs["user"] != "root" {
+		t.Errorf("TestRedactKeys: unexpected redacted args: %v", redactedArgs)
+	}
+	if nested, _ := redactedArgs["nested"].(map[string]interface{}); nested["token"] != Redacted || nested["ttl"] != 5 {
+		t.Errorf("TestRedactKeys: nested argument not redacted: %v", redactedArgs["nested"])
+	}
+	if redactedResp.Error != "wrong password '[redacted]'" || redactedResp.Payload != "token [redacted]" {
+		t.Errorf("TestRedactKeys: secrets not scrubbed from the response: %+v", redactedResp)
+	}
+
+	// The originals belong to the caller
+	if args["password"] != "hunter2" || resp.Error != "wrong password 'hunter2'" {
+		t.Errorf("TestRedactKeys: originals modified: %v, %+v", args, resp)
+	}
+
+}
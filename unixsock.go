@@ -1,18 +1,32 @@
 package unixsock
 
 import (
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"sync"
 	"time"
 )
 
-// Status constants
+// Status constants (see Status)
 const (
-	STATUS_OK   = "success"
-	STATUS_FAIL = "failure"
+	STATUS_OK       = StatusOK
+	STATUS_FAIL     = StatusFail
+	STATUS_EXPIRED  = StatusExpired
+	STATUS_REJECTED = StatusRejected
+)
+
+// Priority is the scheduling priority of a message. Servers running a
+// dispatch queue execute higher priority messages first.
+type Priority int
+
+// Priority levels
+const (
+	PriorityLow    Priority = -1 // Bulk commands
+	PriorityNormal Priority = 0  // Default
+	PriorityHigh   Priority = 1  // Operator/admin commands
 )
 
 // Args is a shorthand for a map of strings to interfaces
@@ -20,17 +34,65 @@ type Args map[string]interface{}
 
 // Response contains a response from the UnixManager
 type Response struct {
-	Status  string `json:"status"`
+	Status  Status `json:"status"`
 	Error   string `json:"error"`
 	Payload string `json:"payload"`
+
+	// Warning (if any) informs the client about issues that did not prevent
+	// the command from executing, e.g. the use of a deprecated command
+	Warning string `json:"warning,omitempty"`
+
+	// Meta (if any) carries metadata about the payload, e.g. units, versions
+	// or pagination cursors
+	Meta map[string]string `json:"meta,omitempty"`
+
+	// Encoding (if any) of the payload, negotiated with clients accepting
+	// compressed responses (see EncodePayload)
+	Encoding string `json:"encoding,omitempty"`
+
+	// Trailer (if any) summarizes a streamed response once all of its
+	// chunks have been sent, e.g. row counts. The server adds the length
+	// and checksum of the stream (see TrailerLength and TrailerCRC32),
+	// which clients verify.
+	Trailer map[string]string `json:"trailer,omitempty"`
+
+	// Stream (if set by a handler) is streamed to the client in chunks
+	// before the response itself is sent. It is closed afterwards if it
+	// implements io.Closer.
+	Stream io.Reader `json:"-"`
+
+	// File (if set by the client) holds the payload of a response passed as
+	// an open file instead of through the socket (see
+	// client.WithFilePassing). The caller has to close it.
+	File *os.File `json:"-"`
+}
+
+// Trailer keys describing the data of a streamed response
+const (
+	TrailerLength = "stream_length" // Number of bytes streamed (decimal)
+	TrailerCRC32  = "stream_crc32"  // CRC-32 (IEEE) of the bytes streamed (hex)
+)
+
+// Trailer is implemented by response streams summarizing the data they have
+// produced (e.g. a row count) once exhausted. The summary is sent in the
+// trailer of the response.
+type Trailer interface {
+	Trailer() map[string]string
 }
 
 // Communicator represents a command sent over the unix socket
 type Communicator interface {
 
 	// Options set some options on the sending/receiving
+	//
+	// Deprecated: pass WithMaxLength and WithTimeout to NewSender or
+	// NewReceiver instead. respond and close are set by NewSender.
 	Options(maxLength int, timeout time.Duration, respond, close bool)
 
+	// SetWriteBuffer makes Send write through a buffered writer of the given
+	// size, flushed explicitly at the end of each message (0 disables it)
+	SetWriteBuffer(size int)
+
 	// Receive reads all the data (a SocketMEssage) from a unix socket and stores
 	// all the content inside the receiving SocketMessage
 	Receive() error
@@ -38,12 +100,78 @@ type Communicator interface {
 	// Send sends this SocketMessage over the unix socket
 	Send() error
 
+	// Size returns the size of the received message in bytes (0 if the
+	// message has not been received)
+	Size() int
+
 	// GetCmd returns message command
 	GetCmd() string
 
 	// GetArgs returns command arguments
 	GetArgs() Args
 
+	// GetMeta returns the metadata attached to the message (e.g. trace IDs,
+	// auth tokens or the locale), kept apart from the command's arguments
+	GetMeta() map[string]string
+
+	// SetMeta attaches metadata to the message
+	SetMeta(map[string]string)
+
+	// GetID returns message ID
+	GetID() uint64
+
+	// SetID sets message ID. Responses carry the ID of their request, so
+	// that they can be matched even if they arrive out of order.
+	SetID(uint64)
+
+	// GetChunk returns the chunk of streamed data carried by the message
+	GetChunk() []byte
+
+	// SetChunk sets a chunk of streamed data. more informs the receiver that
+	// further messages with the same ID follow.
+	SetChunk(chunk []byte, more bool)
+
+	// HasMore informs whether further messages with the same ID follow
+	HasMore() bool
+
+	// IsEvent informs whether the message is an unsolicited event pushed by
+	// the server rather than a response to a request
+	IsEvent() bool
+
+	// SetEvent marks the message as an event
+	SetEvent(bool)
+
+	// IsAck informs whether the sender asks for an acknowledgement of
+	// receipt instead of a response or, in a message from the server,
+	// whether it is such an acknowledgement
+	IsAck() bool
+
+	// SetAck asks for (or marks the message as) an acknowledgement of
+	// receipt
+	SetAck(bool)
+
+	// GetPriority returns message priority
+	GetPriority() Priority
+
+	// SetPriority sets message priority
+	SetPriority(Priority)
+
+	// GetExpiry returns the time after which the message must not be
+	// executed anymore (zero if it never expires)
+	GetExpiry() time.Time
+
+	// SetExpiry sets the time after which the message must not be executed
+	// anymore. Stale messages are answered with STATUS_EXPIRED instead.
+	SetExpiry(time.Time)
+
+	// GetFile returns the file passed along with the message (nil if none).
+	// The receiver has to close it.
+	GetFile() *os.File
+
+	// SetFile passes an open file along with the message over a connection
+	// passing files (see Conn.PassFiles). The caller keeps ownership of f.
+	SetFile(f *os.File)
+
 	// GetResponse returns message's response
 	GetResponse() *Response
 
@@ -59,18 +187,18 @@ type Communicator interface {
 }
 
 // NewSender creates a blank message for the sender
-func NewSender(conn net.Conn, cmd string, args Args, respond, close bool) Communicator {
-	return newCommunicator(conn, cmd, args, &Response{}, respond, close)
+func NewSender(conn net.Conn, cmd string, args Args, respond, close bool, opts ...MessageOption) Communicator {
+	return newCommunicator(conn, cmd, args, &Response{}, respond, close, opts)
 }
 
 // NewReceiver creates a blank message for the receiver
-func NewReceiver(conn net.Conn) Communicator {
-	return newCommunicator(conn, "", Args{}, &Response{}, true, true)
+func NewReceiver(conn net.Conn, opts ...MessageOption) Communicator {
+	return newCommunicator(conn, "", Args{}, &Response{}, true, true, opts)
 }
 
 // newCommunicator creates a new socket message with default options
-func newCommunicator(conn net.Conn, cmd string, args Args, resp *Response, respond, close bool) *communicator {
-	return &communicator{
+func newCommunicator(conn net.Conn, cmd string, args Args, resp *Response, respond, close bool, opts []MessageOption) *communicator {
+	s := &communicator{
 		Cmd:       cmd,
 		Args:      args,
 		Response:  resp,
@@ -80,130 +208,308 @@ func newCommunicator(conn net.Conn, cmd string, args Args, resp *Response, respo
 		maxLength: 1 << 20,
 		timeout:   5 * time.Second,
 	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
 }
 
-// communicator represents a command sent over the unix socket
+// communicator represents a command sent over the unix socket. Its methods
+// are safe for concurrent use; the wire format is handled by an encoder
+// (Send) and a decoder (Receive), so that several communicators can share a
+// single connection.
 type communicator struct {
-	Cmd      string    `json:"cmd"`      // Command
-	Args     Args      `json:"args"`     // Command arguments
-	Response *Response `json:"response"` // Response to a message
-	Respond  bool      `json:"respond"`  // Respond after receiving
-	Close    bool      `json:"close"`    // Close connection after receiving
-
+	ID       uint64    `json:"id,omitempty"`       // Message ID
+	Event    bool      `json:"event,omitempty"`    // Unsolicited event pushed by the server
+	Cmd      string    `json:"cmd"`                // Command
+	Args     Args      `json:"args"`               // Command arguments
+	Response *Response `json:"response"`           // Response to a message
+	Respond  bool      `json:"respond"`            // Respond after receiving
+	Close    bool      `json:"close"`              // Close connection after receiving
+	Priority Priority  `json:"priority,omitempty"` // Scheduling priority
+	Expires  int64     `json:"expires,omitempty"`  // Expiry (unix time in nanoseconds)
+	Chunk    []byte    `json:"chunk,omitempty"`    // Chunk of streamed data
+	More     bool      `json:"more,omitempty"`     // More chunks follow
+	Ack      bool      `json:"ack,omitempty"`      // Acknowledge receipt instead of responding
+	File     bool      `json:"file,omitempty"`     // A file is passed along with the message
+
+	Meta map[string]string `json:"meta,omitempty"` // Metadata (e.g. trace IDs) apart from the arguments
+
+	mu        sync.Mutex    // Guards all the fields
 	conn      net.Conn      // Unix socket connection
 	maxLength int           // Maximum size of the reading buffer (1Mb)
 	timeout   time.Duration // Transaction time limit (for write/read)
+
+	writeBuffer int      // Size of the buffered writer used by Send (0 = unbuffered)
+	size        int      // Size of the received message
+	file        *os.File // File passed along with the message
 }
 
 // Options set some options on the sending/receiving
 func (s *communicator) Options(maxLength int, timeout time.Duration, respond, close bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.Respond = respond
 	s.Close = close
-	s.maxLength = maxLength
-	s.timeout = timeout
+	WithMaxLength(maxLength)(s)
+	WithTimeout(timeout)(s)
+}
+
+// deadline returns the deadline of a transaction starting now. A timeout of
+// zero (or less) means that the transaction never times out. Must be called
+// with s.mu held.
+func (s *communicator) deadline() time.Time {
+	if s.timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(s.timeout)
+}
+
+// SetWriteBuffer sets the size of the buffered writer used by Send
+func (s *communicator) SetWriteBuffer(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeBuffer = size
 }
 
 // Send sends a socketMessage over the unix socket
 func (s *communicator) Send() error {
 
-	// Set timeout
-	s.conn.SetDeadline(time.Now().Add(s.timeout))
-
-	// Marshal message to JSON
+	// Marshal message to JSON (a snapshot, so that the message can be
+	// modified while it is being written)
+	s.mu.Lock()
+	deadline := s.deadline()
+	enc := encoder{conn: s.conn, writeBuffer: s.writeBuffer, file: s.file}
+	stream, chunk := s.More, s.Chunk != nil
 	message, err := json.Marshal(s)
+	s.mu.Unlock()
 	if err != nil {
 		return fmt.Errorf("Send: could not marshal socketMessage: %s", err.Error())
 	}
 
-	// Prepare byte message
-	length := make([]byte, 4)
-	binary.BigEndian.PutUint32(length, uint32(len(message)))
-
-	byteMsg := []byte{}
-	byteMsg = append(byteMsg, length...)
-	byteMsg = append(byteMsg, []byte(":")...)
-	byteMsg = append(byteMsg, []byte(message)...)
-
-	// Send message
-	if n, err := s.conn.Write(byteMsg); n != len(byteMsg) || err != nil {
-		if err != nil {
-			return fmt.Errorf("Send: failedwriting to the socket: %s", err.Error())
-		}
-		return fmt.Errorf("Send: sent only %d bytes (message was %d)", n, len(byteMsg))
-	}
-
-	return nil
+	return enc.encode(message, stream, chunk, deadline)
 }
 
 // Receive reads all the data from a unix socket up to maxLength bytes.
 // It expects the message to have the pattern length:message, where length
 // is the length of the incoming message. It also expects the length to be
-// 4 bytes long (i.e. uint32 on 64bit systems).
-// Reading from the connection times out after timeout duration.
+// 4 bytes long (i.e. uint32 on 64bit systems). If the connection is a *Conn
+// whose peer speaks the line protocol, a single line of JSON is read instead.
+// Reading from the connection times out after timeout duration (never, if
+// the timeout is zero). Failures are reported as a *ReceiveError.
 func (s *communicator) Receive() error {
 
-	// Set timeout
-	s.conn.SetDeadline(time.Now().Add(s.timeout))
-
-	// Retrieve incoming message length
-	length := make([]byte, 4)
-	if n, err := s.conn.Read(length); n != 4 || err != nil {
-		return fmt.Errorf("Receive: reading the length of the message failed")
-	}
+	s.mu.Lock()
+	deadline := s.deadline()
+	dec := decoder{conn: s.conn, maxLength: s.maxLength}
+	s.mu.Unlock()
 
 	// Retrieve the message
-	msgLen := binary.BigEndian.Uint32(length) + 1 // Message will start with ":"
-	content := make([]byte, msgLen)
-	if n, err := s.conn.Read(content); uint32(n) != msgLen || (err != nil && err != io.EOF) {
-		if err == nil {
-			return fmt.Errorf("Receive: incorrect message length: %d (was expecting %d)", n, msgLen)
-		}
-		return fmt.Errorf("Receive: failed reading from unix socket: %s", err.Error())
-	}
-
-	// Unmarshal message
 	newMsg := &communicator{}
-	if err := json.Unmarshal(content[1:], newMsg); err != nil {
-		return fmt.Errorf("Receive: cannot unmarshal response")
+	size, err := dec.decode(newMsg, deadline)
+	if err != nil {
+		return err
 	}
 
 	// Overwrite original values
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.size = size
+	s.ID = newMsg.ID
+	s.Event = newMsg.Event
 	s.Cmd = newMsg.Cmd
 	s.Args = newMsg.Args
 	s.Response = newMsg.Response
 	s.Respond = newMsg.Respond
 	s.Close = newMsg.Close
+	s.Priority = newMsg.Priority
+	s.Expires = newMsg.Expires
+	s.Chunk = newMsg.Chunk
+	s.More = newMsg.More
+	s.Ack = newMsg.Ack
+	s.Meta = newMsg.Meta
+	s.File = newMsg.File
+	s.file = newMsg.file
 
 	return nil
 }
 
+// GetFile returns the file passed along with the message
+func (s *communicator) GetFile() *os.File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file
+}
+
+// SetFile passes a file along with the message
+func (s *communicator) SetFile(f *os.File) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.file = f
+	s.File = f != nil
+}
+
 // GetResponse returns message's response
 func (s *communicator) GetResponse() *Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.Response
 }
 
 // SetResponse sets message's response
 func (s *communicator) SetResponse(resp *Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.Response = resp
 }
 
+// Size returns the size of the received message
+func (s *communicator) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
 // GetCmd returns message's command
 func (s *communicator) GetCmd() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.Cmd
 }
 
 // GetArgs returns message's command arguments
 func (s *communicator) GetArgs() Args {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.Args
 }
 
+// GetMeta returns message's metadata
+func (s *communicator) GetMeta() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Meta
+}
+
+// SetMeta sets message's metadata
+func (s *communicator) SetMeta(meta map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Meta = meta
+}
+
+// GetID returns message's ID
+func (s *communicator) GetID() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ID
+}
+
+// SetID sets message's ID
+func (s *communicator) SetID(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ID = id
+}
+
+// GetChunk returns message's chunk of streamed data
+func (s *communicator) GetChunk() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Chunk
+}
+
+// SetChunk sets message's chunk of streamed data
+func (s *communicator) SetChunk(chunk []byte, more bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Chunk = chunk
+	s.More = more
+}
+
+// HasMore informs whether further messages with the same ID follow
+func (s *communicator) HasMore() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.More
+}
+
+// IsEvent informs whether the message is an event
+func (s *communicator) IsEvent() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Event
+}
+
+// SetEvent marks the message as an event
+func (s *communicator) SetEvent(event bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Event = event
+}
+
+// IsAck informs whether the message asks for (or is) an acknowledgement
+func (s *communicator) IsAck() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Ack
+}
+
+// SetAck asks for (or marks the message as) an acknowledgement
+func (s *communicator) SetAck(ack bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Ack = ack
+}
+
+// GetPriority returns message's priority
+func (s *communicator) GetPriority() Priority {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Priority
+}
+
+// SetPriority sets message's priority
+func (s *communicator) SetPriority(p Priority) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Priority = p
+}
+
+// GetExpiry returns message's expiry
+func (s *communicator) GetExpiry() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Expires == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, s.Expires)
+}
+
+// SetExpiry sets message's expiry
+func (s *communicator) SetExpiry(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.IsZero() {
+		s.Expires = 0
+		return
+	}
+	s.Expires = t.UnixNano()
+}
+
 // ShouldRespond informs the message handler that a response is expected
 func (s *communicator) ShouldRespond() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.Respond
 }
 
 // ShouldClose informs the message handler that there's not going to be any
 // further communication and the connection can be closed
 func (s *communicator) ShouldClose() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.Close
 }
@@ -0,0 +1,589 @@
+package unixsock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// slowConn is a fake connection accepting at most chunk bytes per write and
+// failing every other write with EAGAIN
+type slowConn struct {
+	net.Conn
+	mu       sync.Mutex
+	chunk    int
+	delay    time.Duration
+	calls    int
+	deadline time.Time
+	buf      bytes.Buffer
+}
+
+func (c *slowConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	time.Sleep(c.delay)
+
+	if !c.deadline.IsZero() && time.Now().After(c.deadline) {
+		return 0, &net.OpError{Op: "write", Net: "unix", Err: syscall.ETIMEDOUT}
+	}
+
+	c.calls++
+	if c.calls%2 == 0 {
+		return 0, &net.OpError{Op: "write", Net: "unix", Err: syscall.EAGAIN}
+	}
+
+	if len(p) > c.chunk {
+		p = p[:c.chunk]
+	}
+	return c.buf.Write(p)
+}
+
+func (c *slowConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func TestSendSlowSocket(t *testing.T) {
+
+	tests := []struct {
+		writeBuffer int
+		timeout     time.Duration
+		isErr       bool
+	}{
+		{0, 5 * time.Second, false},
+		{16, 5 * time.Second, false},
+		{0, 5 * time.Millisecond, true},
+	}
+
+	for i, test := range tests {
+		conn := &slowConn{chunk: 7, delay: 100 * time.Microsecond}
+
+		msg := NewSender(conn, "slow", Args{"payload": "a somewhat longer message that needs many writes"}, true, true)
+		msg.Options(1<<20, test.timeout, true, true)
+		msg.SetWriteBuffer(test.writeBuffer)
+
+		err := msg.Send()
+		if (err != nil) != test.isErr {
+			t.Errorf("TestSendSlowSocket: test %d failed: unexpected error state: %v", i+1, err)
+			continue
+		}
+		if test.isErr {
+			continue
+		}
+
+		// Verify the frame
+		frame := conn.buf.Bytes()
+		length := binary.BigEndian.Uint32(frame[:4])
+		if int(length) != len(frame)-5 || frame[4] != ':' {
+			t.Errorf("TestSendSlowSocket: test %d failed: malformed frame (length %d, frame %d bytes)", i+1, length, len(frame))
+			continue
+		}
+
+		decoded := &communicator{}
+		if err := json.Unmarshal(frame[5:], decoded); err != nil {
+			t.Errorf("TestSendSlowSocket: test %d failed: could not decode frame: %s", i+1, err.Error())
+			continue
+		}
+		if decoded.Cmd != "slow" {
+			t.Errorf("TestSendSlowSocket: test %d failed: expected cmd 'slow', got '%s'", i+1, decoded.Cmd)
+		}
+	}
+
+}
+
+func TestReceiveErrors(t *testing.T) {
+
+	frame := func(body string) []byte {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(body)))
+		return append(append(length, ':'), body...)
+	}
+
+	tests := []struct {
+		data      []byte
+		maxLength int
+		kind      error
+	}{
+		{nil, 1 << 20, ErrClosed},
+		{[]byte{0, 0}, 1 << 20, ErrTruncated},
+		{frame(`{"cmd":"hello"}`)[:10], 1 << 20, ErrTruncated},
+		{frame(`{"cmd":`), 1 << 20, ErrMalformed},
+		{frame(`{"cmd":"hello"} {}`), 1 << 20, ErrMalformed},
+		{frame(`{"cmd":"hello"}`), 4, ErrTooLong},
+		{[]byte(`{"cmd":"hel`), 1 << 20, ErrTruncated},
+		{[]byte(`{"cmd":"hello"}` + "\n"), 4, ErrTooLong},
+		{[]byte(`{"cmd":` + "\n"), 1 << 20, ErrMalformed},
+	}
+
+	for i, test := range tests {
+		server, client := net.Pipe()
+		go func() {
+			client.Write(test.data)
+			client.Close()
+		}()
+
+		receiver := NewReceiver(NewConn(server))
+		receiver.Options(test.maxLength, time.Second, false, false)
+		err := receiver.Receive()
+		server.Close()
+
+		re, ok := err.(*ReceiveError)
+		if !ok {
+			t.Errorf("TestReceiveErrors: test %d failed: expected a *ReceiveError, got: %v", i+1, err)
+			continue
+		}
+		if re.Kind != test.kind {
+			t.Errorf("TestReceiveErrors: test %d failed: expected %s, got: %s", i+1, test.kind, err.Error())
+		}
+	}
+
+	// Timeout
+	server, client := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	receiver := NewReceiver(NewConn(server))
+	receiver.Options(1<<20, 10*time.Millisecond, false, false)
+	if err, ok := receiver.Receive().(*ReceiveError); !ok || !err.Timeout() {
+		t.Errorf("TestReceiveErrors: expected a timeout, got: %v", err)
+	}
+
+}
+
+func TestDuplex(t *testing.T) {
+
+	const senders, receivers, messages = 4, 4, 50
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	conns := []*Conn{NewConn(a), NewConn(b)}
+
+	// Both ends send and receive concurrently on the same connection
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, 2*(senders+receivers))
+	received := make([]map[uint64]int, len(conns))
+	mu := &sync.Mutex{}
+
+	for side, conn := range conns {
+		received[side] = map[uint64]int{}
+
+		for s := 0; s < senders; s++ {
+			wg.Add(1)
+			go func(conn *Conn, s int) {
+				defer wg.Done()
+				for m := 0; m < messages; m++ {
+					id := uint64(s*messages + m + 1)
+					msg := NewSender(conn, fmt.Sprintf("msg.%d", id), Args{"blob": strings.Repeat("x", int(id))}, false, false)
+					msg.SetID(id)
+					if err := msg.Send(); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}(conn, s)
+		}
+
+		for r := 0; r < receivers; r++ {
+			wg.Add(1)
+			go func(conn *Conn, side int) {
+				defer wg.Done()
+				for m := 0; m < senders*messages/receivers; m++ {
+					msg := NewReceiver(conn)
+					if err := msg.Receive(); err != nil {
+						errs <- err
+						return
+					}
+					id := msg.GetID()
+					if msg.GetCmd() != fmt.Sprintf("msg.%d", id) || msg.GetArgs()["blob"] != strings.Repeat("x", int(id)) {
+						errs <- fmt.Errorf("message %d corrupted", id)
+						return
+					}
+					mu.Lock()
+					received[side][id]++
+					mu.Unlock()
+				}
+			}(conn, side)
+		}
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("TestDuplex: %s", err.Error())
+	}
+
+	for side := range conns {
+		if len(received[side]) != senders*messages {
+			t.Errorf("TestDuplex: side %d received %d distinct messages, expected %d", side+1, len(received[side]), senders*messages)
+		}
+		for id, n := range received[side] {
+			if n != 1 {
+				t.Errorf("TestDuplex: side %d received message %d %d times", side+1, id, n)
+			}
+		}
+	}
+
+}
+
+func TestCommunicatorConcurrentUse(t *testing.T) {
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// Drain the other end
+	go func() {
+		receiver := NewReceiver(NewConn(b))
+		for receiver.Receive() == nil {
+		}
+	}()
+
+	// A single message is sent repeatedly while being modified
+	msg := NewSender(NewConn(a), "shared", Args{}, false, false)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			msg.SetID(uint64(i))
+			msg.SetChunk([]byte{byte(i)}, i%2 == 0)
+			msg.SetPriority(PriorityHigh)
+			msg.SetExpiry(time.Now().Add(time.Minute))
+			msg.SetResponse(&Response{Status: STATUS_OK})
+			msg.Options(1<<20, time.Second, true, false)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		if err := msg.Send(); err != nil {
+			t.Fatalf("TestCommunicatorConcurrentUse: could not send: %s", err.Error())
+		}
+		msg.GetID()
+		msg.HasMore()
+	}
+	<-done
+
+}
+
+func TestFrameHeader(t *testing.T) {
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	sender, receiver := NewConn(a), NewConn(b)
+
+	// Frames with a header that cannot be understood
+	corrupt := func(version byte, flags byte, body string) []byte {
+		frame := append(frameHeader([]byte(body), flags), body...)
+		frame[2] = version
+		if flags&frameFlagCRC != 0 {
+			frame[8] ^= 0xFF
+		}
+		return frame
+	}
+
+	tests := []struct {
+		header bool
+		crc    bool
+		raw    []byte
+		cmd    string
+		kind   error
+	}{
+		{false, false, nil, "legacy", nil},
+		{true, false, nil, "plain", nil},
+		{true, true, nil, "crc", nil},
+		{false, false, corrupt(FrameVersion, frameFlagCRC, `{"cmd":"x"}`), "", ErrMalformed},
+		{false, false, corrupt(FrameVersion+1, 0, `{"cmd":"x"}`), "", ErrMalformed},
+		{false, false, corrupt(FrameVersion, 1<<4, `{"cmd":"x"}`), "", ErrMalformed},
+		{true, true, nil, "after", nil},
+	}
+
+	for i, test := range tests {
+		if test.header {
+			sender.EnableFrameHeader(test.crc)
+		}
+
+		errs := make(chan error, 1)
+		go func(raw []byte, cmd string) {
+			if raw != nil {
+				_, err := a.Write(raw)
+				errs <- err
+				return
+			}
+			errs <- NewSender(sender, cmd, Args{}, false, false).Send()
+		}(test.raw, test.cmd)
+
+		msg := NewReceiver(receiver)
+		err := msg.Receive()
+		if sendErr := <-errs; sendErr != nil {
+			t.Fatalf("TestFrameHeader: test %d: could not send: %s", i+1, sendErr.Error())
+		}
+
+		if test.kind != nil {
+			if re, ok := err.(*ReceiveError); !ok || re.Kind != test.kind {
+				t.Errorf("TestFrameHeader: test %d: expected %s, got: %v", i+1, test.kind, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("TestFrameHeader: test %d: could not receive: %s", i+1, err.Error())
+			continue
+		}
+		if msg.GetCmd() != test.cmd {
+			t.Errorf("TestFrameHeader: test %d: expected cmd '%s', got '%s'", i+1, test.cmd, msg.GetCmd())
+		}
+	}
+
+	// The receiving end answers in kind
+	if !receiver.FrameHeader() {
+		t.Errorf("TestFrameHeader: expected the receiver to switch to frame headers")
+	}
+
+}
+
+func TestReadFrame(t *testing.T) {
+
+	message := `{"cmd":"unit.restart","respond":true}`
+	legacy := append([]byte{0, 0, 0, byte(len(message)), ':'}, message...)
+	plain := append(frameHeader([]byte(message), 0), message...)
+	crc := append(frameHeader([]byte(message), frameFlagCRC), message...)
+	corrupted := append([]byte{}, crc...)
+	corrupted[len(corrupted)-2] = 'X'
+
+	tests := []struct {
+		frame   []byte
+		max     int
+		readErr error
+		msgErr  error
+	}{
+		{legacy, 0, nil, nil},
+		{plain, 0, nil, nil},
+		{crc, len(message), nil, nil},
+		{corrupted, 0, nil, ErrMalformed},
+		{plain, len(message) - 1, ErrTooLong, nil},
+		{plain[:len(plain)-1], 0, ErrTruncated, nil},
+		{plain[:2], 0, ErrTruncated, nil},
+		{[]byte{}, 0, ErrClosed, nil},
+	}
+
+	for i, test := range tests {
+		stream := append(append([]byte{}, test.frame...), "trailing"...)
+		if test.readErr == ErrTruncated || test.readErr == ErrClosed {
+			stream = test.frame
+		}
+
+		frame, err := ReadFrame(bytes.NewReader(stream), test.max)
+		if test.readErr != nil {
+			if re, ok := err.(*ReceiveError); !ok || re.Kind != test.readErr {
+				t.Errorf("TestReadFrame: test %d failed: expected %v, got %v", i+1, test.readErr, err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(frame, test.frame) {
+			t.Errorf("TestReadFrame: test %d failed: got %q (%v)", i+1, frame, err)
+			continue
+		}
+
+		got, err := FrameMessage(frame)
+		if test.msgErr != nil {
+			if re, ok := err.(*ReceiveError); !ok || re.Kind != test.msgErr {
+				t.Errorf("TestReadFrame: test %d failed: expected %v, got %v", i+1, test.msgErr, err)
+			}
+			continue
+		}
+		if err != nil || string(got) != message {
+			t.Errorf("TestReadFrame: test %d failed: got message %q (%v)", i+1, got, err)
+		}
+	}
+
+}
+
+// repeatConn is a fake connection reading the same frame over and over
+type repeatConn struct {
+	net.Conn
+	frame []byte
+	off   int
+}
+
+func (c *repeatConn) Read(p []byte) (int, error) {
+	n := copy(p, c.frame[c.off:])
+	c.off = (c.off + n) % len(c.frame)
+	return n, nil
+}
+
+func (c *repeatConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func benchmarkReceive(b *testing.B, values int) {
+
+	body := fmt.Sprintf(`{"cmd":"metrics.push","args":{"host":"web-1","values":[%s1]},"respond":true}`, strings.Repeat("0.25,", values))
+	frame := make([]byte, 5, 5+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	frame[4] = ':'
+	frame = append(frame, body...)
+
+	receiver := NewReceiver(NewConn(&repeatConn{frame: frame}))
+	receiver.Options(1<<20, time.Second, false, false)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frame)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := receiver.Receive(); err != nil {
+			b.Fatalf("BenchmarkReceive: %s", err.Error())
+		}
+	}
+}
+
+// BenchmarkReceive reads small messages into the reused buffer of the
+// connection
+func BenchmarkReceive(b *testing.B) {
+	benchmarkReceive(b, 200)
+}
+
+// BenchmarkReceiveLarge streams messages larger than the reused buffer
+// through a json.Decoder
+func BenchmarkReceiveLarge(b *testing.B) {
+	benchmarkReceive(b, 20000)
+}
+
+func TestReadBuffer(t *testing.T) {
+
+	message := func(size int) string {
+		return fmt.Sprintf(`{"cmd":"blob.put","args":{"data":"%s"}}`, strings.Repeat("x", size))
+	}
+	frame := func(body string) []byte {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(body)))
+		return append(append(length, ':'), body...)
+	}
+
+	sizes := []int{100, 2 * maxReadBuffer, 1000, 3 * maxReadBuffer, 10}
+
+	// Framed messages and lines
+	for _, lines := range []bool{false, true} {
+		server, client := net.Pipe()
+		go func() {
+			for _, size := range sizes {
+				if lines {
+					client.Write([]byte(message(size) + "\n"))
+				} else {
+					client.Write(frame(message(size)))
+				}
+			}
+			client.Close()
+		}()
+
+		conn := NewConn(server)
+		receiver := NewReceiver(conn)
+		receiver.Options(1<<20, time.Second, false, false)
+
+		for i, size := range sizes {
+			if err := receiver.Receive(); err != nil {
+				t.Fatalf("TestReadBuffer: message %d (lines: %t): could not receive: %s", i+1, lines, err.Error())
+			}
+			if data, _ := receiver.GetArgs()["data"].(string); len(data) != size {
+				t.Errorf("TestReadBuffer: message %d (lines: %t): expected %d bytes of data, got %d", i+1, lines, size, len(data))
+			}
+			if cap(conn.readBuf) > maxReadBuffer {
+				t.Errorf("TestReadBuffer: message %d (lines: %t): kept a read buffer of %d bytes", i+1, lines, cap(conn.readBuf))
+			}
+		}
+		server.Close()
+	}
+
+}
+
+type gateConn struct {
+	net.Conn
+	gate chan struct{}
+	once sync.Once
+	mu   sync.Mutex
+	cmds []string
+
+	writing int // Messages being written
+	moved   int // Deadlines changed while a message was being written
+}
+
+func (c *gateConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.writing++
+	c.mu.Unlock()
+
+	c.once.Do(func() { <-c.gate })
+
+	msg := struct{ Cmd string }{}
+	json.Unmarshal(p[bytes.IndexByte(p, '{'):], &msg)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writing--
+	c.cmds = append(c.cmds, msg.Cmd)
+
+	return len(p), nil
+}
+
+func (c *gateConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writing > 0 {
+		c.moved++
+	}
+	return nil
+}
+
+func TestLanes(t *testing.T) {
+
+	fake := &gateConn{gate: make(chan struct{})}
+	conn := NewConn(fake)
+
+	send := func(cmd string, args Args, chunk []byte) chan error {
+		done := make(chan error, 1)
+		go func() {
+			msg := NewSender(conn, cmd, args, false, false)
+			if chunk != nil {
+				msg.SetChunk(chunk, true)
+			}
+			done <- msg.Send()
+		}()
+		time.Sleep(50 * time.Millisecond)
+		return done
+	}
+
+	// The first chunk is being written while another chunk, a large message
+	// and a ping are waiting
+	chunk := bytes.Repeat([]byte("x"), 1024)
+	sent := []chan error{
+		send("chunk.1", nil, chunk),
+		send("chunk.2", nil, chunk),
+		send("large", Args{"data": strings.Repeat("x", laneBulkSize)}, nil),
+		send("ping", nil, nil),
+	}
+	close(fake.gate)
+
+	for i, done := range sent {
+		if err := <-done; err != nil {
+			t.Fatalf("TestLanes: message %d failed: %s", i+1, err.Error())
+		}
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.cmds) != 4 || fake.cmds[0] != "chunk.1" || fake.cmds[1] != "ping" {
+		t.Errorf("TestLanes: expected the ping to overtake the bulk lane, got %q", fake.cmds)
+	}
+	if fake.moved > 0 {
+		t.Errorf("TestLanes: waiting messages changed the write deadline %d times", fake.moved)
+	}
+
+}
@@ -0,0 +1,72 @@
+package unixsock
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// writeRetryDelay is the pause between retries of a write that made no progress
+const writeRetryDelay = time.Millisecond
+
+// writeFull writes all of buf to conn. Short writes are continued and
+// temporary errors (e.g. EAGAIN on a non-blocking socket) are retried until
+// deadline, so that a slow reader does not make Send fail prematurely.
+func writeFull(conn io.Writer, buf []byte, deadline time.Time) (int, error) {
+
+	written := 0
+	for written < len(buf) {
+		n, err := conn.Write(buf[written:])
+		written += n
+
+		if err != nil && !isTemporary(err) {
+			return written, err
+		}
+
+		// No progress: wait a little and retry (unless out of time)
+		if n == 0 {
+			if !deadline.IsZero() && !time.Now().Before(deadline) {
+				if err == nil {
+					err = io.ErrShortWrite
+				}
+				return written, fmt.Errorf("writeFull: deadline exceeded after %d of %d bytes: %s", written, len(buf), err.Error())
+			}
+			time.Sleep(writeRetryDelay)
+		}
+	}
+
+	return written, nil
+}
+
+// isTemporary checks whether a write error is worth retrying
+func isTemporary(err error) bool {
+
+	// Unwrap
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+
+	if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK || err == syscall.EINTR {
+		return true
+	}
+
+	return false
+}
+
+// fullWriter is an io.Writer performing complete writes until a deadline. It
+// is used underneath buffered writers.
+type fullWriter struct {
+	conn     io.Writer
+	deadline time.Time
+}
+
+// Write writes all of p
+func (w *fullWriter) Write(p []byte) (int, error) {
+	return writeFull(w.conn, p, w.deadline)
+}